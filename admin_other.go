@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// isWindowsAdministrator is only meaningful on Windows.
+func isWindowsAdministrator() (bool, error) {
+	return false, nil
+}
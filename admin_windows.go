@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// isWindowsAdministrator reports whether the current process token is a
+// member of the built-in Administrators group.
+func isWindowsAdministrator() (bool, error) {
+	sid, err := windows.CreateWellKnownSid(windows.WinBuiltinAdministratorsSid)
+	if err != nil {
+		return false, err
+	}
+	return windows.Token(0).IsMember(sid)
+}
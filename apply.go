@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// authorizedKeysField is the field of cloud-init user-data, and of
+// Terraform outputs, that lists key lines
+const authorizedKeysField = "ssh_authorized_keys"
+
+// documentKey is a key line found in a document apply reads, with where it
+// was found: its path in the document, e.g. users[0].ssh_authorized_keys[2],
+// and its line.
+type documentKey struct {
+	text string
+	path string
+	line int
+}
+
+// applyDocument makes the keys labeled with --label match those listed in
+// the document at path, as sync does with a provider's keys: keys it lists
+// that aren't installed are added, and installed ones it doesn't list are
+// removed.
+func (a *app) applyDocument(ctx context.Context, store doorman.KeyStore, path string) error {
+	label := a.opts.caLabel
+	if label == "" {
+		return withExitCode(exitUsage, fmt.Errorf("apply needs --label, the user the document's keys are installed for"))
+	}
+	if !caLabelPattern.MatchString(label) || strings.HasPrefix(label, caLabelPrefix) {
+		return withExitCode(exitUsage, fmt.Errorf("invalid label '%s': use letters, digits, '.', '_' and '-'", label))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return withExitCode(exitFile, fmt.Errorf("error reading %s: %w", path, err))
+	}
+	found, err := documentKeys(data, a.opts.format)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("error reading %s: %w", path, err))
+	}
+	keys, err := validDocumentKeys(found)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("%s: %w", path, err))
+	}
+	a.verbosef("Read %s from %s\n", countKeys(len(keys)), path)
+
+	rules, err := a.withRules(documentSource(keys))
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	source, err := a.withForcedOptions(rules)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	closeAudit, err := a.openAudit()
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	// BEHAVIOR: The keys came from a document, not a provider, so the user
+	// isn't recorded as managed; sync --all would otherwise replace them
+	// with whatever GitHub has for the label
+	a.unsynced = true
+	change, err := a.newManager(doorman.WithSource(source), doorman.WithStore(store)).Sync(ctx, label)
+	if err != nil {
+		return actionError("sync", err, a.now())
+	}
+	return a.recordChange(ctx, store, change)
+}
+
+// documentKeys finds the key lines of a document in format: cloud-init
+// user-data, whose ssh_authorized_keys lists may be at the top level or
+// under users, or json, such as terraform output -json prints, where each
+// list may also be the value of a Terraform output of that name.
+func documentKeys(data []byte, format string) ([]documentKey, error) {
+	switch format {
+	case "", "cloud-init":
+	case "json":
+		if !json.Valid(data) {
+			var v any
+			return nil, fmt.Errorf("invalid JSON: %w", json.Unmarshal(data, &v))
+		}
+	default:
+		return nil, fmt.Errorf("invalid format '%s' for apply: use cloud-init or json", format)
+	}
+	// JSON is YAML, so one parser reads both, and says where each key is
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	var keys []documentKey
+	if err := findDocumentKeys(&root, "", &keys); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no %s list found", authorizedKeysField)
+	}
+	return keys, nil
+}
+
+// findDocumentKeys appends the key lines of every ssh_authorized_keys list
+// under node, at path, to keys.
+func findDocumentKeys(node *yaml.Node, path string, keys *[]documentKey) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if err := findDocumentKeys(child, path, keys); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			if err := findDocumentKeys(child, path+"["+strconv.Itoa(i)+"]", keys); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name, value := node.Content[i].Value, node.Content[i+1]
+			field := name
+			if path != "" {
+				field = path + "." + name
+			}
+			if name != authorizedKeysField {
+				if err := findDocumentKeys(value, field, keys); err != nil {
+					return err
+				}
+				continue
+			}
+			// A Terraform output holds the list as its value
+			if value.Kind == yaml.MappingNode {
+				for j := 0; j+1 < len(value.Content); j += 2 {
+					if value.Content[j].Value == "value" {
+						value, field = value.Content[j+1], field+".value"
+						break
+					}
+				}
+			}
+			if value.Kind != yaml.SequenceNode {
+				return fmt.Errorf("%s (line %d) is not a list", field, value.Line)
+			}
+			for j, item := range value.Content {
+				itemPath := field + "[" + strconv.Itoa(j) + "]"
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("%s (line %d) is not a key line", itemPath, item.Line)
+				}
+				*keys = append(*keys, documentKey{text: item.Value, path: itemPath, line: item.Line})
+			}
+		}
+	}
+	return nil
+}
+
+// validDocumentKeys parses keys, with any options they have as the options
+// they must be installed with, reporting every line that isn't a valid
+// public key by its path and line.
+func validDocumentKeys(keys []documentKey) ([]doorman.PublicKey, error) {
+	var valid []doorman.PublicKey
+	var invalid []string
+	for _, found := range keys {
+		key, ok := doorman.ParseKey(found.text)
+		if ok {
+			_, err := key.OptionList()
+			ok = err == nil && key.Fingerprint() != ""
+		}
+		if !ok {
+			invalid = append(invalid, fmt.Sprintf("%s (line %d)", found.path, found.line))
+			continue
+		}
+		public := key.PublicKey
+		public.ForcedOptions = key.Options()
+		// BEHAVIOR: Lines doorman exported end with its label and stamps,
+		// which it adds again when installing them
+		if _, ok := key.Added(); ok {
+			public.Comment = key.Note()
+		}
+		valid = append(valid, public)
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("%d invalid public %s: %s", len(invalid), plural(len(invalid), "key", "keys"), strings.Join(invalid, ", "))
+	}
+	return valid, nil
+}
+
+// documentSource gives the keys of a document apply read, whoever asks.
+type documentSource []doorman.PublicKey
+
+func (s documentSource) Keys(ctx context.Context, user string) ([]doorman.PublicKey, error) {
+	return s, nil
+}
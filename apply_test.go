@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunApplyCloudInit(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	revoked, restricted := newTestKey(t), newTestKey(t)
+	writeFile(t, path, "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQC7 bob\n"+revoked+" alice\n")
+	userData := filepath.Join(e.home, "user-data.yaml")
+	writeFile(t, userData, `#cloud-config
+users:
+  - default
+  - name: deploy
+    ssh_authorized_keys:
+      - `+testKey+` alice@laptop
+      - 'from="10.0.0.0/8" `+restricted+`'
+`)
+
+	if err := run(e.deps, []string{"doorman", "apply", "--label", "alice", "--yes", userData}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQC7 bob\n" +
+		testKey + " alice@laptop alice" + today + "\n" +
+		`from="10.0.0.0/8" ` + restricted + " alice" + today + "\n"
+	if content := readFile(t, path); content != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, content)
+	}
+	if _, err := os.Stat(filepath.Join(e.home, ".local", "state", "doorman", "state.json")); !os.IsNotExist(err) {
+		t.Error("expected the label not to be recorded as a user sync --all gets keys for")
+	}
+}
+
+func TestRunApplyJSON(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	output := filepath.Join(e.home, "output.json")
+	writeFile(t, output, `{"ssh_authorized_keys": {"sensitive": false, "type": ["list", "string"], "value": ["`+testKey+`"]}}`)
+
+	if err := run(e.deps, []string{"doorman", "apply", "--label", "alice", "--format", "json", "--yes", output}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	writeFile(t, output, "ssh_authorized_keys: []\n")
+	err := run(e.deps, []string{"doorman", "apply", "--label", "alice", "--format", "json", "--yes", output})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "invalid JSON") {
+		t.Errorf("expected YAML to be refused as JSON, got %v", err)
+	}
+}
+
+func TestRunApplyInvalidKeys(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	userData := filepath.Join(e.home, "user-data.yaml")
+	writeFile(t, userData, `ssh_authorized_keys:
+  - `+testKey+`
+  - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBMpUdog alice
+users:
+  - name: deploy
+    ssh_authorized_keys:
+      - not a key
+`)
+
+	err := run(e.deps, []string{"doorman", "apply", "--label", "alice", "--yes", userData})
+	expected := userData + ": 2 invalid public keys: ssh_authorized_keys[1] (line 3), users[0].ssh_authorized_keys[0] (line 7)"
+	if exitCodeFor(err) != exitUsage || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("expected nothing to be written")
+	}
+
+	err = run(e.deps, []string{"doorman", "apply", "--yes", userData})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "--label") {
+		t.Errorf("expected --label to be required, got %v", err)
+	}
+}
+
+// TestRunApplyExported applies what export printed to another file, which
+// ends up with the same keys, labeled once.
+func TestRunApplyExported(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	other := newTestKey(t)
+	writeFile(t, path, testKey+" work laptop alice doorman-added=2025-03-18\n"+other+" alice doorman-added=2025-03-18\n")
+	if err := run(e.deps, []string{"doorman", "export", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	userData := filepath.Join(e.home, "user-data.yaml")
+	writeFile(t, userData, e.out.String())
+
+	copied := filepath.Join(e.home, "authorized_keys.new")
+	if err := run(e.deps, []string{"doorman", "apply", "--file", copied, "--label", "alice", "--yes", userData}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content := readFile(t, copied)
+	for _, expected := range []string{testKey + " work laptop alice" + today + "\n", other + " alice" + today + "\n"} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("expected %q in\n%s", expected, content)
+		}
+	}
+}
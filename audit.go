@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// auditRecord is one line of the audit log. Prev chains the records: it is
+// the SHA256 of the previous line, so editing or deleting a record breaks
+// the chain at the next one.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// User is the local account doorman ran as, and SudoUser who invoked
+	// sudo to run it, if anyone
+	User     string `json:"user"`
+	SudoUser string `json:"sudo_user,omitempty"`
+	Action   string `json:"action"`
+	Username string `json:"username"`
+	Path     string `json:"path"`
+	// Source is which URL of the sources setting the keys were fetched
+	// from
+	Source  string   `json:"source,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Expired are the removed keys that were dropped as expired
+	Expired []string `json:"expired,omitempty"`
+	// RemovedAdded holds the day each removed key had been added, by
+	// fingerprint, for those that recorded it
+	RemovedAdded map[string]string `json:"removed_added,omitempty"`
+	Before       string            `json:"before_sha256"`
+	After        string            `json:"after_sha256"`
+	Prev         string            `json:"prev_sha256"`
+}
+
+// auditError reports that authorized_keys was changed but the change could
+// not be recorded, which fails the run when strict_audit is set.
+type auditError struct {
+	err error
+}
+
+func (e *auditError) Error() string {
+	return "authorized_keys was changed, but the audit log could not be written: " + e.err.Error()
+}
+
+func (e *auditError) Unwrap() error { return e.err }
+
+// auditLog appends records to ~/.ssh/.doorman_audit.jsonl. The file is
+// opened on the first record, or up front by open.
+type auditLog struct {
+	deps *deps
+	file *os.File
+	// prev is the SHA256 of the last line in the file
+	prev string
+}
+
+func (d *deps) auditLogPath() (string, error) {
+	sshDir, err := d.getSSHDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(sshDir, ".doorman_audit.jsonl"), nil
+}
+
+// open opens the log for appending, creating ~/.ssh if need be, and reads
+// the hash of its last record.
+func (l *auditLog) open() error {
+	if l.file != nil {
+		return nil
+	}
+	path, err := l.deps.auditLogPath()
+	if err != nil {
+		return err
+	}
+	if err := l.deps.ensureSSHDir(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			l.prev = sha256Line(scanner.Bytes())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	return nil
+}
+
+// record appends a record of change to path, with the source the keys
+// came from if known, unless nothing changed.
+func (l *auditLog) record(change *doorman.Change, path, source string) error {
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return nil
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	currentUser, err := l.deps.currentUser()
+	if err != nil {
+		return err
+	}
+
+	record := auditRecord{
+		Time:     l.deps.now().UTC(),
+		User:     currentUser.Username,
+		SudoUser: l.deps.getenv("SUDO_USER"),
+		Action:   string(change.Action),
+		Username: change.Username,
+		Path:     path,
+		Source:   source,
+		Added:    fingerprints(change.Added),
+		Removed:  fingerprints(change.Removed),
+		Expired:  fingerprints(change.Expired),
+		Before:   change.BeforeSHA256,
+		After:    change.AfterSHA256,
+		Prev:     l.prev,
+	}
+	for _, key := range change.Removed {
+		if added, ok := key.Added(); ok {
+			if record.RemovedAdded == nil {
+				record.RemovedAdded = make(map[string]string)
+			}
+			record.RemovedAdded[key.Fingerprint()] = added.Format(time.DateOnly)
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.prev = sha256Line(line)
+	return l.file.Sync()
+}
+
+func (l *auditLog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+func fingerprints(keys []doorman.Key) []string {
+	var result []string
+	for _, key := range keys {
+		result = append(result, key.Fingerprint())
+	}
+	return result
+}
+
+func sha256Line(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// printAuditLog prints the audit log's records and verifies their hash
+// chain, failing at the first record that doesn't follow from the one
+// before it.
+func (a *app) printAuditLog() error {
+	path, err := a.auditLogPath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(a.stdout, "No audit records in %s\n", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading audit log: %w", err)
+	}
+
+	prev, count := "", 0
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record auditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return withExitCode(exitGeneric, fmt.Errorf("%s:%d: invalid audit record: %w", path, i+1, err))
+		}
+		// BEHAVIOR: Print the records that check out before reporting the
+		// break, so what can still be trusted is visible
+		if record.Prev != prev {
+			return withExitCode(exitGeneric, fmt.Errorf("%s:%d: hash chain broken: the record before it was changed or removed", path, i+1))
+		}
+		a.printAuditRecord(record)
+		prev = sha256Line(line)
+		count++
+	}
+
+	fmt.Fprintf(a.stdout, "%d %s, hash chain intact\n", count, plural(count, "record", "records"))
+	return nil
+}
+
+func (a *app) printAuditRecord(record auditRecord) {
+	user := record.User
+	if record.SudoUser != "" {
+		user += " (sudo by " + record.SudoUser + ")"
+	}
+	fmt.Fprintf(a.stdout, "%s  %s  %s %s  %s\n", record.Time.Format(time.RFC3339), user, record.Action, record.Username, record.Path)
+	if record.Source != "" {
+		fmt.Fprintln(a.stdout, "  from "+record.Source)
+	}
+	for _, fingerprint := range record.Added {
+		fmt.Fprintln(a.stdout, "  + "+fingerprint)
+	}
+	for _, fingerprint := range record.Removed {
+		// BEHAVIOR: How long a key was installed is told from the day of
+		// its removal, so the log reads the same whenever it is printed
+		age := "age unknown"
+		if added, err := time.Parse(time.DateOnly, record.RemovedAdded[fingerprint]); err == nil {
+			age = "added " + added.Format(time.DateOnly) + ", " + daysAgo(added, record.Time)
+		}
+		fmt.Fprintf(a.stdout, "  - %s (%s)\n", fingerprint, age)
+	}
+	fmt.Fprintf(a.stdout, "  before %s\n  after  %s\n", record.Before, record.After)
+}
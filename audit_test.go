@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditAddRemove adds alice's key and removes it again, leaving two audit
+// records.
+func auditAddRemove(t *testing.T, e *testEnv) {
+	t.Helper()
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), "")
+	e.mockKeys(testKey)
+	for _, action := range []string{"add", "remove"} {
+		if err := run(e.deps, []string{"doorman", "--yes", action, "alice"}); err != nil {
+			t.Fatalf("unexpected error from %s: %v", action, err)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	e := newTestEnv(t)
+	e.env["SUDO_USER"] = "admin"
+	auditAddRemove(t, e)
+
+	path := filepath.Join(e.home, ".ssh", ".doorman_audit.jsonl")
+	lines := strings.Split(strings.TrimSuffix(readFile(t, path), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", lines)
+	}
+	var records [2]auditRecord
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &records[i]); err != nil {
+			t.Fatalf("invalid record %q: %v", line, err)
+		}
+	}
+
+	const fingerprint = "SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I"
+	keysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	added := sha256Hex(testKey + " alice" + today + "\n")
+	add, remove := records[0], records[1]
+	if add.User != "tester" || add.SudoUser != "admin" || add.Action != "add" || add.Username != "alice" || add.Path != keysPath {
+		t.Errorf("unexpected add record %+v", add)
+	}
+	if len(add.Added) != 1 || add.Added[0] != fingerprint || add.Before != sha256Hex("") || add.After != added || add.Prev != "" {
+		t.Errorf("unexpected add record %+v", add)
+	}
+	date := time.Now().Format(time.DateOnly)
+	if len(remove.Removed) != 1 || remove.Removed[0] != fingerprint || remove.RemovedAdded[fingerprint] != date || remove.Before != added || remove.After != sha256Hex("") {
+		t.Errorf("unexpected remove record %+v", remove)
+	}
+	if remove.Prev != sha256Hex(lines[0]) {
+		t.Errorf("expected the remove record to chain to the add record, got %q", remove.Prev)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "audit-log"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{"  tester (sudo by admin)  add alice  " + keysPath + "\n", "  + " + fingerprint + "\n", "  - " + fingerprint + " (added " + date + ", today)\n", "2 records, hash chain intact\n"} {
+		if !strings.Contains(e.out.String(), expected) {
+			t.Errorf("expected %q in output, got %q", expected, e.out.String())
+		}
+	}
+}
+
+func TestAuditLogTampered(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+	}{
+		{"edited", func(lines []string) []string {
+			lines[0] = strings.Replace(lines[0], "alice", "bob", 1)
+			return lines
+		}},
+		{"deleted", func(lines []string) []string {
+			return lines[1:]
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			auditAddRemove(t, e)
+			path := filepath.Join(e.home, ".ssh", ".doorman_audit.jsonl")
+			lines := strings.Split(strings.TrimSuffix(readFile(t, path), "\n"), "\n")
+			writeFile(t, path, strings.Join(tt.tamper(lines), "\n")+"\n")
+
+			err := run(e.deps, []string{"doorman", "audit-log"})
+			if err == nil || !strings.Contains(err.Error(), "hash chain broken") {
+				t.Errorf("expected the broken chain to be reported, got %v", err)
+			}
+			if code := exitCodeFor(err); code != exitGeneric {
+				t.Errorf("expected exit code %d, got %d", exitGeneric, code)
+			}
+		})
+	}
+}
+
+func TestAuditLogEmpty(t *testing.T) {
+	e := newTestEnv(t)
+	if err := run(e.deps, []string{"doorman", "audit-log"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(e.out.String(), "No audit records in ") {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+}
+
+func TestAuditLogUnwritable(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+	}{
+		{"strict", true},
+		{"not strict", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			keysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+			writeFile(t, keysPath, "")
+			// A directory where the log should be can't be opened as a file
+			if err := os.Mkdir(filepath.Join(e.home, ".ssh", ".doorman_audit.jsonl"), 0700); err != nil {
+				t.Fatal(err)
+			}
+			configPath := filepath.Join(e.home, "config.toml")
+			writeFile(t, configPath, fmt.Sprintf("strict_audit = %v\n", tt.strict))
+			e.mockKeys(testKey)
+
+			err := run(e.deps, []string{"doorman", "--yes", "--config", configPath, "add", "alice"})
+			if tt.strict {
+				if code := exitCodeFor(err); code != exitFile {
+					t.Errorf("expected exit code %d, got %d (%v)", exitFile, code, err)
+				}
+				if content := readFile(t, keysPath); content != "" {
+					t.Errorf("expected nothing to be added, got %q", content)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !strings.Contains(e.errOut.String(), "Warning: could not write the audit log") {
+				t.Errorf("expected a warning, got %q", e.errOut.String())
+			}
+			if content := readFile(t, keysPath); content == "" {
+				t.Error("expected the key to be added")
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// caLabelPrefix starts the label of the cert-authority lines add-ca writes,
+// e.g. "doorman-ca:corp", keeping them apart from users' keys.
+const caLabelPrefix = "doorman-ca:"
+
+var caLabelPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// certAuthority reports whether key is a cert-authority line, returning the
+// label add-ca wrote it under, or "" if it was written some other way, and
+// the principals it is limited to.
+func certAuthority(key doorman.Key) (label string, principals []string, ok bool) {
+	// Options sshd would reject make no CA
+	options, _ := key.OptionList()
+	for _, option := range options {
+		switch strings.ToLower(option.Name) {
+		case "cert-authority":
+			ok = true
+		case "principals":
+			principals = strings.Split(option.Value, ",")
+		}
+	}
+	label, _ = strings.CutPrefix(key.Label(), caLabelPrefix)
+	if label == key.Label() {
+		label = ""
+	}
+	return label, principals, ok
+}
+
+// addCA installs the CA key at location, a URL or a file, as a
+// cert-authority line limited to --principals and labeled with --label, or
+// else location's name. A CA already installed under the label is replaced.
+func (a *app) addCA(ctx context.Context, store doorman.KeyStore, location string) error {
+	label := a.opts.caLabel
+	if label == "" {
+		label, _, _ = strings.Cut(path.Base(strings.TrimSuffix(location, "/")), ".")
+	}
+	if !caLabelPattern.MatchString(label) {
+		return withExitCode(exitUsage, fmt.Errorf("invalid CA label '%s': use letters, digits, '.', '_' and '-', with --label", label))
+	}
+	principals := strings.Split(a.opts.principals, ",")
+	for _, principal := range principals {
+		if principal == "" || strings.ContainsAny(principal, " \t\"\\") {
+			return withExitCode(exitUsage, fmt.Errorf("invalid principal '%s' in --principals", principal))
+		}
+	}
+
+	key, err := a.fetchCA(ctx, location)
+	if err != nil {
+		return err
+	}
+	key.ForcedOptions = `cert-authority,principals="` + strings.Join(principals, ",") + `"`
+	source, err := a.withRules(caSource{key})
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	closeAudit, err := a.openAudit()
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	// BEHAVIOR: CAs keep their own labels whatever comment_format says
+	change, err := a.newManager(doorman.WithSource(source), doorman.WithStore(store), doorman.WithLabels(doorman.Labels{})).Sync(ctx, caLabelPrefix+label)
+	if err != nil {
+		return actionError("add", err, a.now())
+	}
+	return a.recordChange(ctx, store, change)
+}
+
+// fetchCA reads the one public key at location, an https:// URL or a file.
+func (a *app) fetchCA(ctx context.Context, location string) (doorman.PublicKey, error) {
+	var data []byte
+	var err error
+	if strings.Contains(location, "://") {
+		if !strings.HasPrefix(location, "https://") {
+			return doorman.PublicKey{}, withExitCode(exitUsage, fmt.Errorf("invalid CA URL '%s': only https:// URLs are supported", location))
+		}
+		data, err = doorman.FetchKeys(ctx, httpClient{a}, location)
+	} else {
+		data, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return doorman.PublicKey{}, withExitCode(exitFetch, fmt.Errorf("error reading the CA key: %w", err))
+	}
+	keys := doorman.ParsePublicKeys(data)
+	if len(keys) != 1 {
+		return doorman.PublicKey{}, withExitCode(exitUsage, fmt.Errorf("expected one public key in %s, found %d", location, len(keys)))
+	}
+	if keys[0].Fingerprint() == "" {
+		return doorman.PublicKey{}, withExitCode(exitUsage, fmt.Errorf("invalid %s key in %s", keys[0].Type, location))
+	}
+	return doorman.PublicKey{Type: keys[0].Type, Blob: keys[0].Blob}, nil
+}
+
+// caSource gives every label the same CA key, to add or remove it through a
+// Manager like a user's keys.
+type caSource struct {
+	key doorman.PublicKey
+}
+
+func (s caSource) Keys(ctx context.Context, label string) ([]doorman.PublicKey, error) {
+	return []doorman.PublicKey{s.key}, nil
+}
+
+// removeCA removes the cert-authority line add-ca wrote under label.
+func (a *app) removeCA(ctx context.Context, store doorman.KeyStore, label string) error {
+	if !caLabelPattern.MatchString(label) {
+		return withExitCode(exitUsage, fmt.Errorf("invalid CA label '%s'", label))
+	}
+	keys, err := a.newManager(doorman.WithStore(store)).List(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading authorized_keys: %w", err)
+	}
+	i := slices.IndexFunc(keys, func(key doorman.Key) bool { return key.Label() == caLabelPrefix+label })
+	if i < 0 {
+		return withExitCode(exitUsage, fmt.Errorf("no CA labeled '%s' in %s", label, store.Path()))
+	}
+
+	closeAudit, err := a.openAudit()
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	change, err := a.newManager(doorman.WithSource(caSource{keys[i].PublicKey}), doorman.WithStore(store), doorman.WithLabels(doorman.Labels{})).Remove(ctx, caLabelPrefix+label)
+	if err != nil {
+		return actionError("remove", err, a.now())
+	}
+	return a.recordChange(ctx, store, change)
+}
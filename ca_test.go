@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunAddCA(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, testKey+" alice\n")
+	ca := filepath.Join(e.home, "user_ca.pub")
+	writeFile(t, ca, testKey+" ca@example.com\n")
+
+	if err := run(e.deps, []string{"doorman", "--yes", "add-ca", ca, "--principals", "alice,bob"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	line := `cert-authority,principals="alice,bob" ` + testKey + " doorman-ca:user_ca" + today
+	if content := readFile(t, path); content != testKey+" alice\n"+line+"\n" {
+		t.Errorf("expected the CA to be added, got %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(e.home, ".local", "state", "doorman", "state.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the CA not to be recorded as a managed user, got %v", err)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "add-ca", ca, "--principals", "alice", "--label", "corp"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := run(e.deps, []string{"doorman", "--yes", "add-ca", ca, "--principals", "carol", "--label", "corp"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	corp := `cert-authority,principals="carol" ` + testKey + " doorman-ca:corp" + today
+	if content := readFile(t, path); content != testKey+" alice\n"+line+"\n"+corp+"\n" {
+		t.Errorf("expected the corp CA to be replaced, got %q", content)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), "\nca:user_ca  ed25519") || !strings.Contains(e.out.String(), "cert-authority for alice,bob\n") {
+		t.Errorf("expected the CA to be listed as such, got %q", e.out.String())
+	}
+}
+
+func TestRunRemoveCA(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, testKey+" alice\ncert-authority,principals=\"alice\" "+testKey+" doorman-ca:corp\n")
+
+	if err := run(e.deps, []string{"doorman", "--yes", "remove-ca", "corp"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice\n" {
+		t.Errorf("expected only the CA to be removed, got %q", content)
+	}
+
+	err := run(e.deps, []string{"doorman", "--yes", "remove-ca", "corp"})
+	if exitCodeFor(err) != exitUsage || err.Error() != "no CA labeled 'corp' in "+path {
+		t.Errorf("expected the missing CA to be reported, got %v", err)
+	}
+}
+
+func TestRunAddCAErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		ca       string
+		args     []string
+		expected string
+	}{
+		{"no principals", testKey, nil, "add-ca needs --principals"},
+		{"empty principal", testKey, []string{"--principals", "alice,"}, "invalid principal ''"},
+		{"two keys", testKey + "\n" + testKey, []string{"--principals", "alice"}, "expected one public key in"},
+		{"no key", "not a key", []string{"--principals", "alice"}, "found 0"},
+		{"bad label", testKey, []string{"--principals", "alice", "--label", "a b"}, "invalid CA label 'a b'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			ca := filepath.Join(e.home, "ca.pub")
+			writeFile(t, ca, tt.ca+"\n")
+			err := run(e.deps, append([]string{"doorman", "--yes", "add-ca", ca}, tt.args...))
+			if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected a usage error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+
+	e := newTestEnv(t)
+	err := run(e.deps, []string{"doorman", "--yes", "add-ca", "http://ca.example.com/ca.pub", "--principals", "alice"})
+	if err == nil || !strings.Contains(err.Error(), "only https:// URLs are supported") {
+		t.Errorf("expected a plain HTTP URL to be refused, got %v", err)
+	}
+}
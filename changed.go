@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// changesKeys reports whether action changes users' keys, so can report
+// whether it changed anything with --output json and --changed-exit-code.
+func changesKeys(action string) bool {
+	switch action {
+	case "add", "remove", "sync", "reconcile":
+		return true
+	}
+	return false
+}
+
+// changeRecord is a change as --output json prints it, a line each.
+type changeRecord struct {
+	Action   string `json:"action"`
+	Username string `json:"username"`
+	Path     string `json:"path"`
+	// Changed reports whether the file was modified; Summary says the same
+	// as the line printed for people
+	Changed bool     `json:"changed"`
+	Summary string   `json:"summary"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Expired are the removed keys sync dropped as expired
+	Expired []string `json:"expired,omitempty"`
+}
+
+// printChangeJSON writes change, made to the file at path, to w as a line
+// of JSON.
+func printChangeJSON(w io.Writer, change *doorman.Change, path string) error {
+	record := changeRecord{
+		Action:   string(change.Action),
+		Username: change.Username,
+		Path:     path,
+		Changed:  changed(change),
+		Summary:  change.String(),
+		Added:    []string{},
+		Removed:  []string{},
+	}
+	for _, key := range change.Added {
+		record.Added = append(record.Added, key.Fingerprint())
+	}
+	for _, key := range change.Removed {
+		record.Removed = append(record.Removed, key.Fingerprint())
+	}
+	for _, key := range change.Expired {
+		record.Expired = append(record.Expired, key.Fingerprint())
+	}
+	return json.NewEncoder(w).Encode(record)
+}
+
+// changed reports whether change modified the file.
+func changed(change *doorman.Change) bool {
+	return change.BeforeSHA256 != change.AfterSHA256
+}
+
+// changedExit returns err, or, when it is nil but authorized_keys was
+// modified, the --changed-exit-code, so configuration management can tell
+// changed from unchanged. Nothing more is printed for it.
+func (a *app) changedExit(err error) error {
+	if err != nil || !a.changed || a.opts.changedExitCode == 0 {
+		return err
+	}
+	return withExitCode(a.opts.changedExitCode, &silentError{errors.New("authorized_keys was changed")})
+}
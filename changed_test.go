@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunChangedExitCode(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	e.mockKeys("ssh-ed25519 KEY...")
+
+	err := run(e.deps, []string{"doorman", "--yes", "--changed-exit-code", "10", "add", "alice"})
+	if exitCodeFor(err) != 10 {
+		t.Errorf("expected exit code 10 for a change, got %v", err)
+	}
+	if code := runMain(e.deps, []string{"doorman", "--yes", "--changed-exit-code", "10", "add", "alice"}); code != exitOK {
+		t.Errorf("expected exit code 0 when every key is installed already, got %d", code)
+	}
+	if !strings.HasSuffix(e.out.String(), "Keys for alice are already installed (1 key)\n") {
+		t.Errorf("expected the no-op to be reported, got %q", e.out.String())
+	}
+	if content := readFile(t, path); content != "ssh-ed25519 KEY... alice"+today+"\n" {
+		t.Errorf("expected a single copy of the key, got %q", content)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "--changed-exit-code", "10", "remove", "bob"}); err != nil {
+		t.Errorf("expected no error for a no-op remove, got %v", err)
+	}
+	if e.out.String() != "No keys for bob to remove\n" {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+
+	e.errOut.Reset()
+	if code := runMain(e.deps, []string{"doorman", "--yes", "--changed-exit-code", "10", "remove", "alice"}); code != 10 {
+		t.Errorf("expected exit code 10 for a removal, got %d", code)
+	}
+	if e.errOut.Len() != 0 {
+		t.Errorf("expected nothing printed for the exit code, got %q", e.errOut.String())
+	}
+
+	for _, args := range [][]string{
+		{"doorman", "--changed-exit-code", "10", "list"},
+		{"doorman", "--yes", "--changed-exit-code", "300", "add", "alice"},
+	} {
+		if err := run(e.deps, args); exitCodeFor(err) != exitUsage {
+			t.Errorf("%q: expected exit code %d, got %v", args, exitUsage, err)
+		}
+	}
+}
+
+func TestRunChangesJSON(t *testing.T) {
+	e := newTestEnv(t)
+	e.mockKeys("ssh-ed25519 KEY...")
+
+	for _, changed := range []bool{true, false} {
+		e.out.Reset()
+		if err := run(e.deps, []string{"doorman", "--yes", "--output", "json", "add", "alice"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var record changeRecord
+		if err := json.Unmarshal(e.out.Bytes(), &record); err != nil {
+			t.Fatalf("expected a line of JSON on stdout, got %q: %v", e.out.String(), err)
+		}
+		if record.Action != "add" || record.Username != "alice" || record.Changed != changed || len(record.Added) != boolInt(changed) {
+			t.Errorf("unexpected record %+v", record)
+		}
+		if !strings.Contains(e.errOut.String(), record.Summary) {
+			t.Errorf("expected stderr to say the same as %q, got %q", record.Summary, e.errOut.String())
+		}
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// problem is something check found wrong with an installed key.
+type problem struct {
+	user    string
+	key     doorman.Key
+	message string
+}
+
+// checkKeys reports the installed keys that break the rules doorman
+// enforces when adding them, such as keys no longer in the pin file, too
+// weak for the key policy, without the options [options] sets or installed
+// for several users, which got in before the rule did or by another route,
+// and those whose options sshd can't parse. It fails with exitProblems if
+// it finds any. Keys on more than one line, and an sshd that would ignore
+// the option --set-env-option adds, are warned about, and are only
+// problems with --strict. With --output json the problems are printed as
+// a checkReport.
+func (a *app) checkKeys(ctx context.Context, store doorman.KeyStore) error {
+	path := store.Path()
+	keys, err := a.newManager(doorman.WithStore(store)).List(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading authorized_keys: %w", err)
+	}
+	entries, err := store.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error reading authorized_keys: %w", err)
+	}
+	duplicates := a.duplicateKeys(entries)
+	rules, err := a.keyRules()
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+
+	// BEHAVIOR: Keys --policy-warn-only lets in are still problems
+	var problems []problem
+	for _, key := range keys {
+		user := a.keyUser(key)
+		for _, rule := range rules {
+			if reason := rule.violation(user, key.PublicKey); reason != "" {
+				problems = append(problems, problem{user, key, reason})
+			}
+		}
+		if _, err := key.OptionList(); err != nil {
+			problems = append(problems, problem{user, key, fmt.Sprintf("sshd will ignore this line: %v", err)})
+		}
+		options, pattern, err := a.forcedOptions(user)
+		if err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		if _, _, ca := certAuthority(key); !ca && user != "" && options != "" && key.Options() != options {
+			setBy := "[options] sets for " + pattern
+			switch {
+			case pattern == "":
+				setBy = "set_env_option sets"
+			case a.setsEnvOption():
+				setBy = "[options] and set_env_option set for " + pattern
+			}
+			problems = append(problems, problem{user, key, fmt.Sprintf("missing the options %s: %s", setBy, options)})
+		}
+	}
+	problems = append(problems, a.sharedKeyProblems(keys)...)
+	var warnings []string
+	if warning := a.envOptionWarning(); warning != "" {
+		warnings = append(warnings, warning)
+	}
+
+	if a.opts.output == "json" {
+		if err := writeCheckReport(a.stdout, problems, duplicates, warnings, path, a.opts.strict); err != nil {
+			return err
+		}
+	} else {
+		printProblems(a.stdout, problems, path)
+		printDuplicates(a.stdout, duplicates, path)
+		for _, warning := range warnings {
+			fmt.Fprintf(a.stdout, "Warning: %s\n", warning)
+		}
+	}
+	var found []string
+	if len(problems) > 0 {
+		found = append(found, fmt.Sprintf("%d %s", len(problems), plural(len(problems), "problem", "problems")))
+	}
+	if a.opts.strict && len(duplicates) > 0 {
+		found = append(found, fmt.Sprintf("%d duplicate %s", len(duplicates), plural(len(duplicates), "key", "keys")))
+	}
+	if a.opts.strict && len(warnings) > 0 {
+		found = append(found, fmt.Sprintf("%d %s", len(warnings), plural(len(warnings), "warning", "warnings")))
+	}
+	if len(found) > 0 {
+		return withExitCode(exitProblems, fmt.Errorf("found %s in %s", joinNames(found), path))
+	}
+	return nil
+}
+
+// printProblems prints problems, found in the file at path, a line each,
+// or that there are none.
+func printProblems(w io.Writer, problems []problem, path string) {
+	for _, problem := range problems {
+		name := problem.user
+		if name == "" {
+			name = "(unlabeled)"
+		}
+		fmt.Fprintf(w, "%s: %s: %s\n", name, problem.key.Describe(), problem.message)
+	}
+	if len(problems) == 0 {
+		fmt.Fprintf(w, "No problems found in %s\n", path)
+	}
+}
+
+// checkReportVersion is the version of the report check --output json
+// prints. It changes when a field is removed or changes meaning, not when
+// one is added.
+const checkReportVersion = 1
+
+// checkReport is what check --output json prints, for dashboards.
+type checkReport struct {
+	SchemaVersion int    `json:"schema_version"`
+	Path          string `json:"path"`
+	// OK reports that no problems were found, nor, with --strict,
+	// duplicate keys or warnings
+	OK bool `json:"ok"`
+	// Users are those with problems, in order; unlabeled keys come under
+	// the empty username
+	Users []checkUser `json:"users"`
+	// Duplicates are the keys on more than one line, in order of their
+	// first
+	Duplicates []checkDuplicate `json:"duplicates"`
+	// Warnings are about the host rather than a key, such as an sshd
+	// that ignores the option set_env_option adds
+	Warnings []string `json:"warnings"`
+}
+
+type checkUser struct {
+	User     string         `json:"user"`
+	Problems []checkProblem `json:"problems"`
+}
+
+type checkProblem struct {
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	Problem     string `json:"problem"`
+}
+
+type checkDuplicate struct {
+	Type        string               `json:"type"`
+	Fingerprint string               `json:"fingerprint"`
+	Lines       []checkDuplicateLine `json:"lines"`
+}
+
+type checkDuplicateLine struct {
+	Line    int    `json:"line"`
+	User    string `json:"user"`
+	Options string `json:"options"`
+	Comment string `json:"comment"`
+}
+
+// writeCheckReport writes problems, duplicates and warnings, found in the
+// file at path, to w as a checkReport.
+func writeCheckReport(w io.Writer, problems []problem, duplicates []duplicateKey, warnings []string, path string, strict bool) error {
+	ok := len(problems) == 0 && (!strict || len(duplicates) == 0 && len(warnings) == 0)
+	report := checkReport{SchemaVersion: checkReportVersion, Path: path, OK: ok, Users: []checkUser{}, Duplicates: []checkDuplicate{}, Warnings: append([]string{}, warnings...)}
+	byUser := make(map[string][]checkProblem)
+	for _, problem := range problems {
+		byUser[problem.user] = append(byUser[problem.user], checkProblem{
+			Type:        problem.key.Type,
+			Fingerprint: problem.key.Fingerprint(),
+			Problem:     problem.message,
+		})
+	}
+	users := make([]string, 0, len(byUser))
+	for user := range byUser {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		report.Users = append(report.Users, checkUser{User: user, Problems: byUser[user]})
+	}
+	for _, duplicate := range duplicates {
+		listed := checkDuplicate{Type: duplicate.key.Type, Fingerprint: duplicate.key.Fingerprint()}
+		for _, line := range duplicate.lines {
+			listed.Lines = append(listed.Lines, checkDuplicateLine{Line: line.line, User: line.user, Options: line.key.Options(), Comment: line.key.Comment})
+		}
+		report.Duplicates = append(report.Duplicates, listed)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRunCheckJSON compares check --output json with testdata/check.json,
+// so the report's schema can't change by accident. A deliberate change
+// updates the file, and checkReportVersion if a field is removed or
+// changes meaning.
+func TestRunCheckJSON(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, testKey+" alice\n"+testKey+" bob\n")
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "deny_types = [\"ssh-ed25519\"]\n")
+
+	err := run(e.deps, []string{"doorman", "--config", config, "--output", "json", "check"})
+	if exitCodeFor(err) != exitProblems {
+		t.Errorf("expected exit code %d, got %v", exitProblems, err)
+	}
+	golden, err := os.ReadFile(filepath.Join("testdata", "check.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.ReplaceAll(e.out.String(), path, "/home/alice/.ssh/authorized_keys"); got != string(golden) {
+		t.Errorf("expected\n%s\ngot\n%s", golden, got)
+	}
+
+	e.out.Reset()
+	writeFile(t, path, testKey+" alice\n")
+	if err := run(e.deps, []string{"doorman", "--output", "json", "check"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), `"ok": true`) || !strings.Contains(e.out.String(), `"users": []`) {
+		t.Errorf("expected an empty report, got %q", e.out.String())
+	}
+}
+
+func TestRunCheckMalformedOptions(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, `command="rsync --server" `+testKey+" alice\n"+`from=10.0.0.1 `+newTestKey(t)+" bob\n")
+
+	err := run(e.deps, []string{"doorman", "check"})
+	if exitCodeFor(err) != exitProblems || err.Error() != "found 1 problem in "+path {
+		t.Fatalf("expected one problem, got %v", err)
+	}
+	if !strings.HasPrefix(e.out.String(), "bob: ") || !strings.Contains(e.out.String(), "sshd will ignore this line: invalid options 'from=10.0.0.1': from needs its argument in quotes") {
+		t.Errorf("expected bob's unquoted option flagged, got %q", e.out.String())
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+// config holds the settings read from doorman's configuration file.
+type config struct {
+	// AuthorizedKeysFile overrides the file keys are written to. It accepts
+	// the same %h and %u tokens as sshd's AuthorizedKeysFile.
+	AuthorizedKeysFile string `toml:"authorized_keys_file"`
+	// Provider names where keys come from, as listed by "doorman help
+	// providers". Same as --provider.
+	Provider string `toml:"provider"`
+	// KeysURL fetches keys from a GitHub-style server instead of GitHub;
+	// {user} is replaced by the username. Same as --url.
+	KeysURL string `toml:"keys_url"`
+	// Sources fetches keys from the first of these URLs, in the same form as
+	// KeysURL, that can be reached and doesn't fail with a server error, e.g.
+	// an internal mirror and then GitHub.
+	Sources []string `toml:"sources"`
+	// KeysFile reads keys from a local file instead; {user} is replaced by
+	// the username. Same as --keys-file.
+	KeysFile string `toml:"keys_file"`
+	// MaxKeyAge is how long ago a key may have been added before stats
+	// flags it, e.g. "180d". Same as --max-age.
+	MaxKeyAge string `toml:"max_key_age"`
+	// StrictAudit fails any change that can't be recorded in the audit log,
+	// refusing to start when the log can't be opened.
+	StrictAudit bool `toml:"strict_audit"`
+	// CacheDir is where keys caches each user's keys, by default
+	// ~/.cache/doorman.
+	CacheDir string `toml:"cache_dir"`
+	// MaxCacheAge is how stale cached keys may be before keys refuses them,
+	// e.g. "12h". Same as --max-cache-age.
+	MaxCacheAge string `toml:"max_cache_age"`
+	// MetricsAddress is where serve exposes Prometheus metrics, e.g.
+	// "127.0.0.1:9100". Same as --metrics-address.
+	MetricsAddress string `toml:"metrics_address"`
+	// PostChangeHook is a shell command run after authorized_keys changes.
+	// Same as --post-hook.
+	PostChangeHook string `toml:"post_change_hook"`
+	// PinFile lists the fingerprints of the keys users may have installed;
+	// keys of users it lists that aren't in it are refused. Without it, or
+	// when it doesn't exist, no keys are pinned.
+	PinFile string `toml:"pin_file"`
+	// AllowedSigners names a file in ssh-keygen's allowed signers format;
+	// when set, key lists are only trusted with a valid signature from one
+	// of its keys.
+	AllowedSigners string `toml:"allowed_signers"`
+	// SignatureURL is where each user's signature is, a URL or path in
+	// which {user} is replaced by the username; by default the keys URL or
+	// file with .sig appended.
+	SignatureURL string `toml:"signature_url"`
+	// DenyFile lists the fingerprints of keys that may never be installed,
+	// for anyone. serve rereads it before every sync.
+	DenyFile string `toml:"deny_file"`
+	// DenyTypes lists key types that may not be installed, e.g.
+	// ["ssh-dss"].
+	DenyTypes []string `toml:"deny_types"`
+	// MinRSABits is the smallest RSA key that may be installed, e.g. 3072.
+	MinRSABits int `toml:"min_rsa_bits"`
+	// MaxOfflineAge is how stale cached keys may be before --offline
+	// refuses them, e.g. "3d"; by default there is no limit.
+	MaxOfflineAge string `toml:"max_offline_age"`
+	// HTTPTimeout bounds each HTTP request, e.g. "10s"; 30 seconds by
+	// default.
+	HTTPTimeout string `toml:"http_timeout"`
+	// CAFile names a PEM file of certificate authorities to trust besides
+	// the system's, for key servers behind a private CA or a TLS-inspecting
+	// proxy.
+	CAFile string `toml:"ca_file"`
+	// ClientCert and ClientKey name a PEM certificate and its key, presented
+	// to key servers that require client certificates. Same as
+	// --client-cert and --client-key.
+	ClientCert string `toml:"client_cert"`
+	ClientKey  string `toml:"client_key"`
+	// CommentFormat is how keys are labeled with their user, e.g.
+	// "doorman:{user}:{date}"; {user}, {provider}, {date} and {host} are
+	// filled in. By default keys are labeled with the bare username.
+	CommentFormat string `toml:"comment_format"`
+	// Options maps username patterns, as matched by path.Match, to the
+	// options keys of matching users must be installed with, e.g.
+	// {"bot-*" = "restrict,command=\"/usr/local/bin/bot-shell\""}; {user}
+	// is replaced by the username.
+	Options map[string]string `toml:"options"`
+	// SetEnvOption installs every user's keys with
+	// environment="DOORMAN_USER=<username>", so sessions can tell who
+	// logged in. Same as --set-env-option.
+	SetEnvOption bool `toml:"set_env_option"`
+	// SortEntries orders the keys doorman manages by username, key type
+	// and fingerprint whenever it writes authorized_keys, after any other
+	// lines. Same as --sort.
+	SortEntries bool `toml:"sort_entries"`
+	// IncludeLegacyFile has remove, list and check act on authorized_keys2
+	// next to authorized_keys as well, for hosts whose sshd still reads it.
+	// Same as --include-legacy-file.
+	IncludeLegacyFile bool `toml:"include_legacy_file"`
+	// ExpiryGrace is how long after a key's doorman-expires= stamp sync and
+	// serve still keep it, e.g. "24h"; none by default.
+	ExpiryGrace string `toml:"expiry_grace"`
+	// MaxLineLength is the longest line authorized_keys may have, in bytes;
+	// 1 MiB by default.
+	MaxLineLength int `toml:"max_line_length"`
+	// Headers are sent with every request for keys, except to GitHub, e.g.
+	// {"X-Org-Token" = "..."}. --header adds to and replaces them.
+	Headers map[string]string `toml:"headers"`
+}
+
+func (d *deps) defaultConfigPath() (string, error) {
+	if dir := d.getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "doorman", "config.toml"), nil
+	}
+	currentUser, err := d.currentUser()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(currentUser.HomeDir, ".config", "doorman", "config.toml"), nil
+}
+
+// loadConfig reads the configuration file at path, or the default location
+// when path is empty. A missing default file yields an empty configuration;
+// a missing explicitly requested file is an error.
+func (a *app) loadConfig(path string) (config, error) {
+	var cfg config
+
+	explicit := path != ""
+	if !explicit {
+		var err error
+		if path, err = a.defaultConfigPath(); err != nil {
+			return cfg, err
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return cfg, nil
+		}
+		return cfg, fmt.Errorf("error reading config: %w", err)
+	}
+
+	meta, err := toml.Decode(string(data), &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("error parsing config %s: %w", path, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return cfg, fmt.Errorf("error parsing config %s: unknown setting '%s'", path, undecoded[0])
+	}
+
+	a.verbosef("Loaded config from %s\n", path)
+	return cfg, nil
+}
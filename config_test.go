@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	e := newTestEnv(t)
+
+	writeFile(t, filepath.Join(e.home, ".config", "doorman", "config.toml"), `authorized_keys_file = "/etc/ssh/keys/%u"`+"\n")
+
+	loaded, err := e.loadConfig("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loaded.AuthorizedKeysFile != "/etc/ssh/keys/%u" {
+		t.Errorf("unexpected authorized_keys_file: %q", loaded.AuthorizedKeysFile)
+	}
+}
+
+func TestLoadConfigXDG(t *testing.T) {
+	e := newTestEnv(t)
+	e.env["XDG_CONFIG_HOME"] = filepath.Join(e.home, "xdg")
+
+	writeFile(t, filepath.Join(e.home, "xdg", "doorman", "config.toml"), `authorized_keys_file = "keys"`+"\n")
+
+	loaded, err := e.loadConfig("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loaded.AuthorizedKeysFile != "keys" {
+		t.Errorf("unexpected authorized_keys_file: %q", loaded.AuthorizedKeysFile)
+	}
+}
+
+func TestLoadConfigMissingDefault(t *testing.T) {
+	e := newTestEnv(t)
+
+	loaded, err := e.loadConfig("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, config{}) {
+		t.Errorf("expected empty config, got %+v", loaded)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	e := newTestEnv(t)
+
+	tests := []struct {
+		name        string
+		content     string
+		errContains string
+	}{
+		{"invalid toml", "authorized_keys_file = ", "error parsing config"},
+		{"unknown setting", "authorised_keys_file = \"x\"\n", "unknown setting 'authorised_keys_file'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(e.home, tt.name+".toml")
+			writeFile(t, path, tt.content)
+
+			_, err := e.loadConfig(path)
+			if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("expected error containing %q, got %v", tt.errContains, err)
+			}
+		})
+	}
+
+	if _, err := e.loadConfig(filepath.Join(e.home, "missing.toml")); err == nil {
+		t.Error("expected error for missing explicit config")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// cronLockWait is how long --cron waits for another doorman to finish with
+// authorized_keys
+const cronLockWait = 10 * time.Second
+
+// cronFailureThreshold is how many times in a row fetching a user's keys
+// must fail under --cron before it is reported, so short outages don't
+// fill mailboxes
+const cronFailureThreshold = 3
+
+// silentError is an error runMain doesn't print, though it still sets the
+// exit code: under --cron, a fetch failure not yet worth reporting.
+type silentError struct {
+	err error
+}
+
+func (e *silentError) Error() string { return e.err.Error() }
+func (e *silentError) Unwrap() error { return e.err }
+
+// silence returns err as a silentError if silent is set.
+func silence(err error, silent bool) error {
+	if silent && err != nil {
+		return &silentError{err}
+	}
+	return err
+}
+
+// cronState is what --cron remembers between runs.
+type cronState struct {
+	// FetchFailures counts each user's fetches that failed in a row
+	FetchFailures map[string]int `json:"fetch_failures"`
+}
+
+// stateDir returns doorman's directory under the user's state directory.
+func (d *deps) stateDir() (string, error) {
+	if dir := d.getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "doorman"), nil
+	}
+	currentUser, err := d.currentUser()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(currentUser.HomeDir, ".local", "state", "doorman"), nil
+}
+
+func (d *deps) cronStatePath() (string, error) {
+	dir, err := d.stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cron.json"), nil
+}
+
+// recordFetch counts username's failed fetches in the state file, resetting
+// the count when the fetch didn't fail, and reports whether err is a fetch
+// failure too recent to report. A failure that can't be counted is always
+// reported.
+func (a *app) recordFetch(username string, err error) (silent bool) {
+	failed := errors.As(err, new(*doorman.FetchError)) || errors.As(err, new(*doorman.RateLimitError))
+
+	path, pathErr := a.cronStatePath()
+	if pathErr != nil {
+		return false
+	}
+	var state cronState
+	if data, err := os.ReadFile(path); err == nil {
+		// A damaged state file only costs the counts
+		_ = json.Unmarshal(data, &state)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	if state.FetchFailures == nil {
+		state.FetchFailures = make(map[string]int)
+	}
+
+	if !failed {
+		if _, ok := state.FetchFailures[username]; !ok {
+			return false
+		}
+		delete(state.FetchFailures, username)
+	} else {
+		state.FetchFailures[username]++
+	}
+	if err := saveCronState(path, state); err != nil {
+		fmt.Fprintf(a.stderr, "Warning: could not save %s: %v\n", path, err)
+		return false
+	}
+	return failed && state.FetchFailures[username] < cronFailureThreshold
+}
+
+func saveCronState(path string, state cronState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// printChange reports change, or under --cron, only a change that modified
+// the file, with the keys added and removed.
+func (a *app) printChange(change *doorman.Change) {
+	if !a.opts.cron {
+		fmt.Fprintln(a.stdout, change)
+		return
+	}
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return
+	}
+	fmt.Fprintln(a.stdout, change)
+	for _, key := range change.Added {
+		fmt.Fprintln(a.stdout, "  + "+key.Describe())
+	}
+	for _, key := range change.Removed {
+		fmt.Fprintln(a.stdout, "  - "+key.Describe())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+func TestRunCron(t *testing.T) {
+	e := newTestEnv(t)
+	// cron has no terminal
+	e.stdinIsTerminal = func() bool { return false }
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	e.mockKeys(testKey)
+
+	if err := run(e.deps, []string{"doorman", "--cron", "sync", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "Synced keys for alice: added 1 (1 ed25519), removed 0\n" +
+		"  + 256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice" + today + " (ED25519)\n"
+	if e.out.String() != expected {
+		t.Errorf("expected only the change, got %q", e.out.String())
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	// Nothing to do, nothing to say
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--cron", "sync", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.Len() != 0 || e.errOut.Len() != 0 {
+		t.Errorf("expected no output, got %q and %q", e.out.String(), e.errOut.String())
+	}
+}
+
+func TestRunCronFetchFailures(t *testing.T) {
+	e := newTestEnv(t)
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), "")
+
+	runCron := func() int {
+		e.out.Reset()
+		e.errOut.Reset()
+		return runMain(e.deps, []string{"doorman", "--cron", "sync", "alice"})
+	}
+
+	e.mockKeysError(&doorman.FetchError{Err: errors.New("connection refused")})
+	for i := 1; i < cronFailureThreshold; i++ {
+		if code := runCron(); code != exitFetch {
+			t.Errorf("failure %d: expected exit code %d, got %d", i, exitFetch, code)
+		}
+		if e.out.Len() != 0 || e.errOut.Len() != 0 {
+			t.Errorf("failure %d: expected no output, got %q and %q", i, e.out.String(), e.errOut.String())
+		}
+	}
+	if code := runCron(); code != exitFetch || !strings.Contains(e.errOut.String(), "connection refused") {
+		t.Errorf("expected failure %d to be reported, got exit code %d and %q", cronFailureThreshold, code, e.errOut.String())
+	}
+
+	// A success starts the count again
+	e.mockKeys(testKey)
+	if code := runCron(); code != exitOK {
+		t.Fatalf("expected success, got exit code %d: %s", code, e.errOut.String())
+	}
+	e.mockKeysError(&doorman.FetchError{Err: errors.New("connection refused")})
+	if code := runCron(); code != exitFetch || e.errOut.Len() != 0 {
+		t.Errorf("expected the first failure after a success to be silent, got exit code %d and %q", code, e.errOut.String())
+	}
+}
+
+func TestRunCronReportsOtherErrors(t *testing.T) {
+	e := newTestEnv(t)
+	e.mockKeysError(doorman.ErrUserNotFound)
+
+	if code := runMain(e.deps, []string{"doorman", "--cron", "sync", "nobody"}); code != exitUsage {
+		t.Errorf("expected exit code %d, got %d", exitUsage, code)
+	}
+	if e.errOut.Len() == 0 {
+		t.Error("expected an unknown user to be reported straight away")
+	}
+}
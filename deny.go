@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// denyList is the SHA256 fingerprints of keys that must never be installed,
+// for anyone, such as keys known to be compromised.
+type denyList struct {
+	path         string
+	fingerprints map[string]bool
+}
+
+// loadDenyList reads deny_file, returning nil when it isn't set. Unlike a
+// missing pin file, a missing deny file is an error: keys known to be bad
+// shouldn't get in because the list was moved.
+func (a *app) loadDenyList() (*denyList, error) {
+	if a.cfg.DenyFile == "" {
+		return nil, nil
+	}
+	return readDenyList(a.cfg.DenyFile)
+}
+
+// readDenyList reads a deny file: one fingerprint per line, as ssh-keygen
+// -lf prints it. Blank lines and # comments are skipped.
+func readDenyList(path string) (*denyList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading deny file: %w", err)
+	}
+	d := &denyList{path: path, fingerprints: make(map[string]bool)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 1 || !strings.HasPrefix(fields[0], "SHA256:") {
+			return nil, fmt.Errorf("%s:%d: expected a single SHA256 fingerprint, as ssh-keygen -lf prints", path, i+1)
+		}
+		d.fingerprints[fields[0]] = true
+	}
+	return d, nil
+}
+
+// violation explains why key may not be installed, or is "" if it may.
+func (d *denyList) violation(username string, key doorman.PublicKey) string {
+	if !d.fingerprints[key.Fingerprint()] {
+		return ""
+	}
+	return "on the deny list " + d.path
+}
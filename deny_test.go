@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadDenyList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny")
+	writeFile(t, path, "# Debian weak keys\n\nSHA256:one\nSHA256:two  # incident 42\n")
+	d, err := readDenyList(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(d.fingerprints) != 2 || !d.fingerprints["SHA256:two"] {
+		t.Errorf("unexpected deny list %v", d.fingerprints)
+	}
+
+	for _, content := range []string{"SHA256:one SHA256:two\n", "# comment\nMD5:aa:bb\n"} {
+		writeFile(t, path, content)
+		if _, err := readDenyList(path); err == nil || !strings.Contains(err.Error(), "expected a single SHA256 fingerprint") {
+			t.Errorf("expected %q to be rejected, got %v", content, err)
+		}
+	}
+}
+
+func TestRunDenyList(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	deny := filepath.Join(e.home, "deny")
+	writeFile(t, deny, testKeyFingerprint+"  # leaked\n")
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "deny_file = '"+deny+"'\n")
+	other := newTestKey(t)
+	e.source = userSource{"alice": testKey + "\n" + other, "bob": testKey}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--config", config, "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != other+" alice"+today+"\n" {
+		t.Errorf("expected the denied key to be skipped, got %q", content)
+	}
+	if !strings.Contains(e.errOut.String(), "Refusing 1 of alice's 2 keys:") || !strings.Contains(e.errOut.String(), "(ED25519): on the deny list "+deny) {
+		t.Errorf("expected the denied key to be reported, got %q", e.errOut.String())
+	}
+
+	err := run(e.deps, []string{"doorman", "--yes", "--config", config, "add", "bob"})
+	if exitCodeFor(err) != exitNoKeys {
+		t.Errorf("expected bob's only key to be refused, got %v", err)
+	}
+
+	writeFile(t, path, testKey+" bob\n"+other+" alice\n")
+	e.out.Reset()
+	err = run(e.deps, []string{"doorman", "--config", config, "check"})
+	if exitCodeFor(err) != exitProblems || !strings.HasPrefix(e.out.String(), "bob: 256 SHA256:") {
+		t.Errorf("expected bob's denied key to be flagged, got %v and %q", err, e.out.String())
+	}
+
+	writeFile(t, config, "deny_file = '"+filepath.Join(e.home, "missing")+"'\n")
+	err = run(e.deps, []string{"doorman", "--yes", "--config", config, "add", "alice"})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "error reading deny file") {
+		t.Errorf("expected a missing deny file to be an error, got %v", err)
+	}
+}
+
+func TestRuleSourceReload(t *testing.T) {
+	e := newTestEnv(t)
+	deny := filepath.Join(e.home, "deny")
+	writeFile(t, deny, "")
+	e.cfg.DenyFile = deny
+	rules, err := e.withRules(userSource{"alice": testKey})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys, err := rules.Keys(context.Background(), "alice"); err != nil || len(keys) != 1 {
+		t.Fatalf("expected alice's key, got %v, %v", keys, err)
+	}
+
+	writeFile(t, deny, testKeyFingerprint+"\n")
+	rules.reload()
+	if _, err := rules.Keys(context.Background(), "alice"); exitCodeFor(err) != exitNoKeys {
+		t.Errorf("expected the reloaded deny list to refuse alice's key, got %v", err)
+	}
+
+	if err := os.Remove(deny); err != nil {
+		t.Fatal(err)
+	}
+	rules.reload()
+	if _, err := rules.Keys(context.Background(), "alice"); exitCodeFor(err) != exitNoKeys {
+		t.Errorf("expected the last deny list read to stay in force, got %v", err)
+	}
+	if !strings.Contains(e.errOut.String(), "rules_reload_failed") {
+		t.Errorf("expected the failed reload to be logged, got %q", e.errOut.String())
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// Exit codes of diff, which follow diff(1) rather than the other actions so
+// it can be used in shell conditionals; the keys matching exits with 0
+const (
+	diffDiffers = 1
+	diffTrouble = 2
+)
+
+// diffHelp is what help diff prints.
+const diffHelp = `doorman diff <username>... compares the keys installed for each user with
+those they publish, as sync would install them, and changes nothing.
+
+For each user it prints "alice: up to date (2 keys)", or "alice: differs
+(2 missing locally, 1 extra)" followed by a line for each key: "+" for a
+published key that isn't installed, "-" for an installed key that is no
+longer published. --brief prints only the first line, and --quiet nothing.
+
+Like diff(1), it exits with:
+  0  every user's keys match
+  1  some user's keys differ
+  2  trouble: keys couldn't be fetched or authorized_keys couldn't be read
+
+Trouble with one user is reported on stderr and the others are still
+compared; the exit code is then 2.
+`
+
+// diffUsers compares the installed keys of each of usernames with those they
+// publish, exiting as diffHelp says.
+func (a *app) diffUsers(ctx context.Context, manager *doorman.Manager, usernames []string) error {
+	var differ, failed int
+	var firstErr error
+	for _, username := range usernames {
+		diff, err := manager.Diff(ctx, username)
+		if errors.Is(err, context.Canceled) {
+			return withExitCode(diffTrouble, actionError("diff", err, a.now()))
+		}
+		if err != nil {
+			err = actionError("diff", err, a.now())
+			fmt.Fprintf(a.stderr, "%s: %v\n", username, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+		if diff.Differs() {
+			differ++
+		}
+		a.printDiff(diff)
+	}
+
+	switch {
+	case failed > 0:
+		return withExitCode(diffTrouble, &silentError{fmt.Errorf("could not compare the keys of %d %s: %w", failed, plural(failed, "user", "users"), firstErr)})
+	case differ > 0:
+		return withExitCode(diffDiffers, &silentError{fmt.Errorf("the keys of %d %s differ", differ, plural(differ, "user", "users"))})
+	}
+	return nil
+}
+
+// printDiff prints diff as --quiet and --brief say.
+func (a *app) printDiff(diff *doorman.KeyDiff) {
+	if a.opts.quiet {
+		return
+	}
+	if !diff.Differs() {
+		fmt.Fprintf(a.stdout, "%s: up to date (%s)\n", diff.Username, countKeys(diff.Installed))
+		return
+	}
+	fmt.Fprintf(a.stdout, "%s: differs (%d missing locally, %d extra)\n", diff.Username, len(diff.Missing), len(diff.Extra))
+	if a.opts.brief {
+		return
+	}
+	for _, key := range diff.Missing {
+		fmt.Fprintln(a.stdout, "+ "+key.FingerprintLine())
+	}
+	for _, key := range diff.Extra {
+		fmt.Fprintln(a.stdout, "- "+key.Describe())
+	}
+}
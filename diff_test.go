@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+func TestRunDiff(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	kept, revoked, published := newTestKey(t), newTestKey(t), newTestKey(t)
+	content := kept + " alice\n" + revoked + " alice\n" + testKey + " bob\n"
+	writeFile(t, path, content)
+	revokedKey, _ := doorman.ParseKey(revoked + " alice")
+	publishedKey := parseKeys(published + " laptop")[0]
+
+	e.mockKeys(testKey)
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "diff", "bob"}); err != nil {
+		t.Fatalf("expected exit code 0, got %v", err)
+	}
+	if e.out.String() != "bob: up to date (1 key)\n" {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+
+	e.mockKeys(kept + "\n" + published + " laptop")
+	e.out.Reset()
+	err := run(e.deps, []string{"doorman", "diff", "alice"})
+	if exitCodeFor(err) != diffDiffers {
+		t.Errorf("expected exit code %d, got %v", diffDiffers, err)
+	}
+	expected := "alice: differs (1 missing locally, 1 extra)\n" +
+		"+ " + publishedKey.FingerprintLine() + "\n" +
+		"- " + revokedKey.Describe() + "\n"
+	if e.out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, e.out.String())
+	}
+	if got := readFile(t, path); got != content {
+		t.Errorf("expected nothing changed, got %q", got)
+	}
+
+	e.out.Reset()
+	err = run(e.deps, []string{"doorman", "diff", "--brief", "alice"})
+	if exitCodeFor(err) != diffDiffers {
+		t.Errorf("expected exit code %d, got %v", diffDiffers, err)
+	}
+	if e.out.String() != "alice: differs (1 missing locally, 1 extra)\n" {
+		t.Errorf("expected only the summary, got %q", e.out.String())
+	}
+
+	e.out.Reset()
+	err = run(e.deps, []string{"doorman", "diff", "--quiet", "alice"})
+	if exitCodeFor(err) != diffDiffers {
+		t.Errorf("expected exit code %d, got %v", diffDiffers, err)
+	}
+	if e.out.String() != "" {
+		t.Errorf("expected no output, got %q", e.out.String())
+	}
+}
+
+func TestRunDiffTrouble(t *testing.T) {
+	e := newTestEnv(t)
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), testKey+" alice\n")
+
+	e.mockKeysError(errors.New("connection refused"))
+	if code := runMain(e.deps, []string{"doorman", "diff", "--quiet", "alice"}); code != diffTrouble {
+		t.Errorf("expected exit code %d, got %d", diffTrouble, code)
+	}
+	if !strings.Contains(e.errOut.String(), "alice: ") || !strings.Contains(e.errOut.String(), "connection refused") {
+		t.Errorf("expected the failure on stderr even with --quiet, got %q", e.errOut.String())
+	}
+
+	if err := run(e.deps, []string{"doorman", "sync", "--quiet", "alice"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected --quiet to be refused outside diff, got %v", err)
+	}
+}
+
+func TestRunHelpDiff(t *testing.T) {
+	e := newTestEnv(t)
+	if err := run(e.deps, []string{"doorman", "help", "diff"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), "1  some user's keys differ") {
+		t.Errorf("expected the exit codes to be documented, got %q", e.out.String())
+	}
+}
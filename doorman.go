@@ -2,252 +2,1444 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
-)
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/term"
 
-// Dependencies for testing
-var (
-	osExit      = os.Exit
-	httpGet     = http.Get
-	userCurrent = user.Current
-	stdin       io.Reader = os.Stdin
-	stdout      io.Writer = os.Stdout
-	stdinReader *bufio.Reader
+	"github.com/sultano/doorman/pkg/doorman"
 )
 
-func getStdinReader() *bufio.Reader {
-	if stdinReader == nil {
-		stdinReader = bufio.NewReader(stdin)
+// deps connects doorman to everything outside the process. main uses
+// newDeps; tests construct them with fakes.
+type deps struct {
+	stdin  *bufio.Reader
+	stdout io.Writer
+	stderr io.Writer
+	// answers is where prompts are answered from when it isn't stdin: the
+	// terminal, when stdin isn't one
+	answers *bufio.Reader
+
+	// transport carries every HTTP request; when nil, newHTTPClient builds
+	// one tuned for fetching keys
+	transport        http.RoundTripper
+	currentUser      func() (*user.User, error)
+	lookupUser       func(username string) (*user.User, error)
+	hostname         func() (string, error)
+	getenv           func(key string) string
+	stdinIsTerminal  func() bool
+	stdoutIsTerminal func() bool
+	// openTerminal opens the controlling terminal for reading answers
+	openTerminal func() (io.ReadCloser, error)
+	// terminalWidth is the width of the terminal on stdout, or 0
+	terminalWidth   func() int
+	listAgentKeys   func() ([]doorman.PublicKey, error)
+	isAdministrator func() (bool, error)
+	now             func() time.Time
+	sleep           func(ctx context.Context, d time.Duration) error
+
+	// goos is the platform to behave as, normally runtime.GOOS
+	goos           string
+	sshdConfigPath string
+	// source, when set, replaces the key source chosen by flags and config
+	source doorman.KeySource
+
+	executable       func() (string, error)
+	runCommand       func(ctx context.Context, name string, args ...string) error
+	systemdSystemDir string
+	// openRemote connects to --host, returning an SFTP client and a
+	// function closing the connection
+	openRemote func(ctx context.Context, host string) (*sftp.Client, func() error, error)
+	// runHook runs a shell command with env added to its environment,
+	// returning its combined output
+	runHook func(ctx context.Context, command string, env []string) ([]byte, error)
+
+	// keysOwner, when set, is the user who ran doorman with sudo, whose
+	// authorized_keys is managed instead of root's
+	keysOwner *user.User
+}
+
+// newDeps returns the dependencies of the running process.
+func newDeps() *deps {
+	return &deps{
+		stdin:            bufio.NewReader(os.Stdin),
+		stdout:           os.Stdout,
+		stderr:           os.Stderr,
+		currentUser:      user.Current,
+		lookupUser:       user.Lookup,
+		hostname:         os.Hostname,
+		getenv:           os.Getenv,
+		stdinIsTerminal:  func() bool { return term.IsTerminal(int(os.Stdin.Fd())) },
+		stdoutIsTerminal: func() bool { return term.IsTerminal(int(os.Stdout.Fd())) },
+		openTerminal:     openTerminal,
+		terminalWidth: func() int {
+			width, _, err := term.GetSize(int(os.Stdout.Fd()))
+			if err != nil {
+				return 0
+			}
+			return width
+		},
+		listAgentKeys:   listSSHAgentKeys,
+		isAdministrator: isWindowsAdministrator,
+		now:             time.Now,
+		sleep:           sleepContext,
+		goos:            runtime.GOOS,
+		sshdConfigPath:  defaultSSHDConfigPath(),
+
+		executable:       os.Executable,
+		runCommand:       runSystemCommand,
+		systemdSystemDir: "/etc/systemd/system",
+		runHook:          runShellCommand,
+		openRemote:       dialRemote,
 	}
-	return stdinReader
 }
 
-func resetStdinReader() {
-	stdinReader = nil
+// options holds the command-line flags shared by all actions.
+type options struct {
+	configPath string
+	file       string
+	verbose    bool
+	yes        bool
+	// interactive asks for confirmations despite DOORMAN_ASSUME_YES
+	interactive bool
+	force       bool
+	provider    string
+	keysURL     string
+	keysFile    string
+
+	waitForRateLimit bool
+
+	noHeader     bool
+	output       string
+	maxAge       string
+	showFullKeys bool
+
+	logFormat string
+	logLevel  string
+	logFile   string
+
+	events string
+
+	promptTimeout time.Duration
+	cron          bool
+
+	maxCacheAge string
+
+	webhook        string
+	secretFile     string
+	metricsAddress string
+	healthMaxAge   string
+
+	interval string
+	users    string
+	system   bool
+	enable   bool
+
+	all bool
+
+	postHook string
+
+	check bool
+
+	format string
+
+	homeDir string
+
+	host string
+
+	inventory       string
+	continueOnError bool
+
+	fromList string
+
+	noCache bool
+
+	concurrency int
+
+	offline bool
+
+	policyWarnOnly bool
+
+	principals string
+	caLabel    string
+
+	reallyRoot bool
+	allowRoot  bool
+
+	dryRun bool
+	patch  string
+
+	commentFormat string
+
+	prune bool
+
+	stale       string
+	removeStale bool
+
+	// strict makes check fail on keys on more than one line
+	strict bool
+
+	setEnvOption bool
+
+	// sort orders the keys doorman manages whenever the file is written
+	sort bool
+
+	unmanaged          bool
+	exceptFingerprints stringsFlag
+	// headers are sent with requests for keys, as "Name: value"
+	headers             stringsFlag
+	sendHeadersAnywhere bool
+	clientCert          string
+	clientKey           string
+	socks5              string
+
+	allowEmpty bool
+
+	ifMissing bool
+
+	includeLegacyFile bool
+
+	noExpire bool
+
+	changedExitCode int
+
+	quiet bool
+	brief bool
+}
+
+// stringsFlag is a flag that may be given more than once, collecting each
+// value.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// app is a single invocation of doorman: its deps, and the settings read
+// from its arguments and configuration file by run().
+type app struct {
+	*deps
+	opts   options
+	cfg    config
+	logger *slog.Logger
+	// client makes every HTTP request, set up by run() from the config
+	client *http.Client
+	// headers are sent with requests for keys, from --header and the
+	// headers setting
+	headers http.Header
+	// progress reports on actions given several usernames; nil otherwise
+	progress *progress
+	audit    *auditLog
+	// events receives the Manager's events with --events; nil otherwise
+	events func(doorman.Event)
+	// metrics counts what serve does with --metrics-address; nil otherwise
+	metrics *metrics
+	// health tracks serve's syncs for /healthz; nil otherwise
+	health *health
+	// localFiles serializes writes to the audit log and state file while
+	// hosts are worked on in parallel; nil otherwise
+	localFiles *sync.Mutex
+	// offlineFetched holds when the cached keys --offline used were
+	// fetched, by username; nil without --offline
+	offlineFetched *sync.Map
+	// fetchedFrom holds which of the sources setting each user's keys were
+	// fetched from, by username
+	fetchedFrom *sync.Map
+	// pendingRead is a read from stdin that a prompt stopped waiting for
+	pendingRead chan lineResult
+	// labels is how keys in the store being worked on are labeled, set by
+	// runAction
+	labels doorman.Labels
+	// changes receives each change as JSON with --output json on actions
+	// that change keys; nil otherwise
+	changes io.Writer
+	// changed is set once authorized_keys has been modified
+	changed bool
+	// unsynced is set when keys come from a document apply read, so their
+	// user isn't recorded as one sync --all gets keys for
+	unsynced bool
+	// dryRuns are the stores --dry-run kept changes from, for --patch
+	dryRuns []*dryRunStore
+}
+
+func (a *app) verbosef(format string, args ...any) {
+	if a.opts.verbose {
+		fmt.Fprintf(a.stderr, format, args...)
+	}
+}
+
+// parseArgs parses flags, which may appear before, between or after the
+// positional arguments, and returns the positional arguments.
+func (d *deps) parseArgs(args []string) (options, []string, error) {
+	var o options
+	fs := d.flagSet(&o)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return o, nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return o, positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// flagSet returns the flags, parsed into o. Each must be documented in
+// flagGroups.
+func (d *deps) flagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("doorman", flag.ContinueOnError)
+	fs.SetOutput(d.stderr)
+	fs.Usage = func() { printUsage(d.stderr) }
+	fs.StringVar(&o.configPath, "config", "", "")
+	fs.StringVar(&o.file, "file", "", "")
+	fs.BoolVar(&o.verbose, "verbose", false, "")
+	fs.BoolVar(&o.verbose, "v", false, "")
+	fs.BoolVar(&o.yes, "yes", false, "")
+	fs.BoolVar(&o.yes, "y", false, "")
+	fs.BoolVar(&o.interactive, "interactive", false, "")
+	fs.BoolVar(&o.force, "force", false, "")
+	fs.StringVar(&o.provider, "provider", "", "")
+	fs.StringVar(&o.keysURL, "url", "", "")
+	fs.StringVar(&o.keysFile, "keys-file", "", "")
+	fs.BoolVar(&o.waitForRateLimit, "wait-for-ratelimit", false, "")
+	fs.BoolVar(&o.noHeader, "no-header", false, "")
+	fs.BoolVar(&o.showFullKeys, "show-full-keys", false, "")
+	fs.StringVar(&o.maxAge, "max-age", "", "")
+	fs.StringVar(&o.output, "output", "table", "")
+	fs.StringVar(&o.logFormat, "log-format", "text", "")
+	fs.StringVar(&o.logLevel, "log-level", "", "")
+	fs.StringVar(&o.logFile, "log-file", "", "")
+	fs.StringVar(&o.events, "events", "", "")
+	fs.DurationVar(&o.promptTimeout, "prompt-timeout", 0, "")
+	fs.BoolVar(&o.cron, "cron", false, "")
+	fs.StringVar(&o.maxCacheAge, "max-cache-age", "", "")
+	fs.StringVar(&o.webhook, "webhook", "", "")
+	fs.StringVar(&o.secretFile, "secret-file", "", "")
+	fs.StringVar(&o.metricsAddress, "metrics-address", "", "")
+	fs.StringVar(&o.healthMaxAge, "health-max-age", "", "")
+	fs.StringVar(&o.interval, "interval", "1h", "")
+	fs.StringVar(&o.users, "users", "", "")
+	fs.BoolVar(&o.system, "system", false, "")
+	fs.BoolVar(&o.enable, "enable", false, "")
+	fs.BoolVar(&o.all, "all", false, "")
+	fs.BoolVar(&o.prune, "prune", false, "")
+	fs.StringVar(&o.postHook, "post-hook", "", "")
+	fs.BoolVar(&o.check, "check", false, "")
+	fs.StringVar(&o.format, "format", "", "")
+	fs.StringVar(&o.homeDir, "home-dir", "", "")
+	fs.BoolVar(&o.reallyRoot, "really-root", false, "")
+	fs.BoolVar(&o.allowRoot, "allow-root", false, "")
+	fs.BoolVar(&o.dryRun, "dry-run", false, "")
+	fs.StringVar(&o.patch, "patch", "", "")
+	fs.StringVar(&o.commentFormat, "comment-format", "", "")
+	fs.StringVar(&o.stale, "stale", "", "")
+	fs.BoolVar(&o.removeStale, "remove-stale", false, "")
+	fs.BoolVar(&o.strict, "strict", false, "")
+	fs.BoolVar(&o.setEnvOption, "set-env-option", false, "")
+	fs.BoolVar(&o.sort, "sort", false, "")
+	fs.BoolVar(&o.unmanaged, "unmanaged", false, "")
+	fs.Var(&o.exceptFingerprints, "except-fingerprint", "")
+	fs.Var(&o.headers, "header", "")
+	fs.BoolVar(&o.sendHeadersAnywhere, "send-headers-anywhere", false, "")
+	fs.StringVar(&o.clientCert, "client-cert", "", "")
+	fs.StringVar(&o.clientKey, "client-key", "", "")
+	fs.StringVar(&o.socks5, "socks5", "", "")
+	fs.BoolVar(&o.allowEmpty, "allow-empty", false, "")
+	fs.BoolVar(&o.ifMissing, "if-missing", false, "")
+	fs.BoolVar(&o.includeLegacyFile, "include-legacy-file", false, "")
+	fs.BoolVar(&o.noExpire, "no-expire", false, "")
+	fs.IntVar(&o.changedExitCode, "changed-exit-code", 0, "")
+	fs.BoolVar(&o.quiet, "quiet", false, "")
+	fs.BoolVar(&o.brief, "brief", false, "")
+	fs.StringVar(&o.host, "host", "", "")
+	fs.StringVar(&o.inventory, "inventory", "", "")
+	fs.BoolVar(&o.continueOnError, "continue-on-error", false, "")
+	fs.StringVar(&o.fromList, "from-list", "", "")
+	fs.BoolVar(&o.noCache, "no-cache", false, "")
+	fs.IntVar(&o.concurrency, "concurrency", defaultConcurrency, "")
+	fs.BoolVar(&o.offline, "offline", false, "")
+	fs.BoolVar(&o.policyWarnOnly, "policy-warn-only", false, "")
+	fs.StringVar(&o.principals, "principals", "", "")
+	fs.StringVar(&o.caLabel, "label", "", "")
+	return fs
+}
+
+// checkProvider rejects an unknown --provider before anything else happens.
+func checkProvider(o options) error {
+	if o.provider == "" {
+		return nil
+	}
+	_, err := doorman.LookupProvider(o.provider)
+	return err
 }
 
 func main() {
-	if err := run(os.Args); err != nil {
-		fmt.Fprintln(stdout, err)
-		osExit(1)
+	os.Exit(runMain(newDeps(), os.Args))
+}
+
+// runMain runs doorman, reporting any error on stderr, and returns the exit
+// code.
+func runMain(d *deps, args []string) int {
+	if err := run(d, args); err != nil {
+		if !errors.As(err, new(*silentError)) {
+			fmt.Fprintln(d.stderr, err)
+		}
+		return exitCodeFor(err)
 	}
+	return exitOK
 }
 
-func run(args []string) error {
-	if len(args) != 3 {
-		fmt.Fprintln(stdout, "Usage: doorman add <username>")
-		fmt.Fprintln(stdout, "       doorman remove <username>")
-		return fmt.Errorf("invalid arguments")
+func run(d *deps, args []string) error {
+	parsed, positional, err := d.parseArgs(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("invalid arguments"))
+	}
+	if err := checkProvider(parsed); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if parsed.output != "table" && parsed.output != "json" {
+		return withExitCode(exitUsage, fmt.Errorf("invalid output '%s': use table or json", parsed.output))
+	}
+	// BEHAVIOR: Nobody answers prompts under cron, or for webhooks
+	if parsed.cron || len(positional) > 0 && positional[0] == "serve" {
+		parsed.yes = true
+	}
+	if parsed.events != "" && parsed.events != "ndjson" {
+		return withExitCode(exitUsage, fmt.Errorf("invalid events format '%s': use ndjson", parsed.events))
+	}
+	if len(positional) > 0 && positional[0] == "help" {
+		return d.runHelp(positional[1:])
+	}
+	if len(positional) == 1 && positional[0] == "man" {
+		return d.printManual(parsed.format)
+	}
+	if parsed.homeDir != "" {
+		if d, err = d.withHomeDir(parsed.homeDir); err != nil {
+			return err
+		}
+	}
+	if len(positional) > 0 && !slices.Contains(actionNames(), positional[0]) {
+		return withExitCode(exitUsage, invalidActionError(positional[0]))
+	}
+	validArgs := len(positional) >= 2
+	if len(positional) > 0 && takesNoUsername(positional[0]) {
+		validArgs = len(positional) == 1
+	}
+	if len(positional) > 0 && (positional[0] == "keys" || positional[0] == "add-ca" || positional[0] == "remove-ca") {
+		validArgs = len(positional) == 2
+	}
+	if len(positional) > 0 && positional[0] == "fix-perms" {
+		validArgs = len(positional) == 1
+	}
+	if len(positional) > 0 && positional[0] == "export" {
+		validArgs = true
+	}
+	if len(positional) > 0 && positional[0] == "apply" {
+		validArgs = len(positional) == 2
+	}
+	if len(positional) > 0 && positional[0] == "man" {
+		// man on its own was handled above
+		validArgs = false
+	}
+	if len(positional) > 0 && positional[0] == "state" {
+		validArgs = len(positional) >= 2 && positional[1] == "import"
+	}
+	if parsed.all {
+		validArgs = len(positional) == 1 && positional[0] == "sync"
+	}
+	if parsed.fromList != "" {
+		validArgs = len(positional) >= 1
+	}
+	if parsed.prune && !parsed.all {
+		validArgs = false
+	}
+	if parsed.unmanaged {
+		validArgs = len(positional) == 1 && positional[0] == "remove"
+	}
+	if len(parsed.exceptFingerprints) > 0 && !parsed.unmanaged {
+		validArgs = false
+	}
+	if !validArgs {
+		printUsage(d.stderr)
+		return withExitCode(exitUsage, fmt.Errorf("invalid arguments"))
+	}
+	var events func(doorman.Event)
+	if parsed.events == "ndjson" {
+		// BEHAVIOR: stdout carries nothing but events, so everything meant
+		// for people moves to stderr
+		events = ndjsonEvents(d.stdout)
+		redirected := *d
+		redirected.stdout = d.stderr
+		d = &redirected
+	}
+	var changes io.Writer
+	if parsed.output == "json" && changesKeys(positional[0]) && parsed.inventory == "" {
+		if parsed.events != "" {
+			return withExitCode(exitUsage, fmt.Errorf("--output json can't be used with --events"))
+		}
+		// BEHAVIOR: Likewise, stdout carries nothing but the changes
+		changes = d.stdout
+		redirected := *d
+		redirected.stdout = d.stderr
+		d = &redirected
+	}
+	a := &app{deps: d, opts: parsed, events: events, changes: changes}
+	closeLog, err := a.openLog()
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	action := positional[0]
+	if a.opts.host != "" && !worksRemotely(action) {
+		return withExitCode(exitUsage, fmt.Errorf("--host only works with add, remove, sync, reconcile, diff, add-ca, remove-ca, list, stats and check"))
+	}
+	if action == "add-ca" && a.opts.principals == "" {
+		return withExitCode(exitUsage, fmt.Errorf("add-ca needs --principals, the comma-separated principals the CA may sign certificates for"))
+	}
+	if a.opts.host != "" && a.opts.homeDir != "" {
+		return withExitCode(exitUsage, fmt.Errorf("--host and --home-dir can't be used together"))
+	}
+	if a.opts.inventory != "" && (a.opts.host != "" || a.opts.homeDir != "") {
+		return withExitCode(exitUsage, fmt.Errorf("--inventory can't be used with --host or --home-dir"))
+	}
+	owner, err := a.sudoUser(action)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		fmt.Fprintf(d.stderr, "Run with sudo by %s: managing %s's authorized_keys in %s rather than root's (pass --really-root for root's)\n", owner.Username, owner.Username, owner.HomeDir)
+		d = d.withKeysOwner(owner)
+		a.deps = d
+	}
+	if a.opts.format != "" && action != "export" && action != "apply" {
+		return withExitCode(exitUsage, fmt.Errorf("--format only works with man, export and apply"))
+	}
+	if a.opts.dryRun && !changesKeys(action) && action != "fix-perms" {
+		return withExitCode(exitUsage, fmt.Errorf("--dry-run only works with add, remove, sync, reconcile and fix-perms"))
+	}
+	if a.opts.patch != "" && (!a.opts.dryRun || !changesKeys(action)) {
+		return withExitCode(exitUsage, fmt.Errorf("--patch only works with add, remove, sync and reconcile --dry-run"))
+	}
+	if a.opts.patch != "" && a.opts.inventory != "" {
+		return withExitCode(exitUsage, fmt.Errorf("--patch describes one host's authorized_keys; it can't be used with --inventory"))
+	}
+	if a.opts.stale != "" && action != "list" {
+		return withExitCode(exitUsage, fmt.Errorf("--stale only works with list"))
+	}
+	if a.opts.removeStale && a.opts.stale == "" {
+		return withExitCode(exitUsage, fmt.Errorf("--remove-stale needs --stale, the age past which keys are removed"))
+	}
+	if a.opts.strict && action != "check" {
+		return withExitCode(exitUsage, fmt.Errorf("--strict only works with check"))
+	}
+	if a.opts.fromList != "" && action != "add" && action != "remove" {
+		return withExitCode(exitUsage, fmt.Errorf("--from-list only works with add and remove"))
+	}
+	if a.opts.offline && action != "add" && action != "remove" && action != "sync" && action != "reconcile" {
+		return withExitCode(exitUsage, fmt.Errorf("--offline only works with add, remove, sync and reconcile"))
+	}
+	if a.opts.offline {
+		a.offlineFetched = &sync.Map{}
+	}
+	if a.opts.concurrency < 1 {
+		return withExitCode(exitUsage, fmt.Errorf("--concurrency must be at least 1, got %d", a.opts.concurrency))
+	}
+	if a.opts.inventory != "" && action != "add" && action != "remove" && action != "sync" && action != "reconcile" {
+		return withExitCode(exitUsage, fmt.Errorf("--inventory only works with add, remove, sync and reconcile"))
+	}
+	if a.opts.allowEmpty && action != "reconcile" {
+		return withExitCode(exitUsage, fmt.Errorf("--allow-empty only works with reconcile"))
+	}
+	if (a.opts.quiet || a.opts.brief) && action != "diff" {
+		return withExitCode(exitUsage, fmt.Errorf("--quiet and --brief only work with diff"))
+	}
+	if a.opts.ifMissing && action != "add" {
+		return withExitCode(exitUsage, fmt.Errorf("--if-missing only works with add"))
+	}
+	if a.opts.includeLegacyFile && (!readsLegacyFile(action) || a.opts.host != "" || a.opts.inventory != "") {
+		return withExitCode(exitUsage, fmt.Errorf("--include-legacy-file only works with remove, list and check, and not with --host or --inventory"))
+	}
+	if a.opts.setEnvOption && !slices.Contains([]string{"add", "sync", "diff", "serve", "keys", "apply", "check"}, action) {
+		return withExitCode(exitUsage, fmt.Errorf("--set-env-option only works with add, sync, diff, serve, keys, apply and check"))
+	}
+	writesKeys := changesKeys(action) || slices.Contains([]string{"serve", "apply", "add-ca", "remove-ca"}, action) || action == "list" && a.opts.removeStale
+	if a.opts.sort && !writesKeys {
+		return withExitCode(exitUsage, fmt.Errorf("--sort only works with add, remove, sync, reconcile, serve, apply, add-ca, remove-ca and list --remove-stale"))
+	}
+	if a.opts.noExpire && action != "sync" && action != "serve" {
+		return withExitCode(exitUsage, fmt.Errorf("--no-expire only works with sync and serve"))
+	}
+	if a.opts.changedExitCode != 0 && (!changesKeys(action) || a.opts.inventory != "") {
+		return withExitCode(exitUsage, fmt.Errorf("--changed-exit-code only works with add, remove, sync and reconcile, and not with --inventory"))
+	}
+	if a.opts.changedExitCode < 0 || a.opts.changedExitCode > 255 {
+		return withExitCode(exitUsage, fmt.Errorf("--changed-exit-code must be between 0 and 255, got %d", a.opts.changedExitCode))
+	}
+	if a.opts.inventory != "" && a.opts.unmanaged {
+		return withExitCode(exitUsage, fmt.Errorf("--unmanaged can't be used with --inventory; remove unmanaged keys a host at a time"))
+	}
+
+	if err := a.assumeYes(action); err != nil {
+		return err
+	}
+
+	// BEHAVIOR: When stdin isn't a terminal, e.g. it is a pipe, prompts are
+	// answered on the controlling terminal instead. Without one there is
+	// nobody to answer them, and reading whatever is on stdin (usually EOF)
+	// would silently abort
+	if (!asksNothing(action) || a.opts.removeStale) && !a.opts.yes && !d.stdinIsTerminal() {
+		terminal, err := d.openTerminal()
+		if err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("refusing to prompt: stdin is not a terminal and there is no terminal to ask on; pass --yes"))
+		}
+		defer terminal.Close()
+		d.answers = bufio.NewReader(terminal)
+	}
+
+	if a.cfg, err = a.loadConfig(a.opts.configPath); err != nil {
+		// A bad config file isn't an authorized_keys problem
+		return withExitCode(exitGeneric, err)
+	}
+	if a.headers, err = a.extraHeaders(); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if a.client, err = a.newHTTPClient(); err != nil {
+		return withExitCode(exitGeneric, err)
+	}
+	a.fetchedFrom = &sync.Map{}
+	switch action {
+	case "audit-log":
+		return a.printAuditLog()
+	case "keys":
+		return a.printKeys(context.Background(), positional[1])
+	case "systemd-install":
+		return a.installSystemd(context.Background())
+	case "systemd-uninstall":
+		return a.uninstallSystemd(context.Background())
+	case "fix-perms":
+		return a.fixPermissions(context.Background())
+	case "self-update":
+		return a.selfUpdate(context.Background())
 	}
 
-	action := args[1]
-	username := args[2]
-	keysURL := fmt.Sprintf("https://github.com/%s.keys", username)
+	// BEHAVIOR: Ctrl-C abandons a fetch or prompt in progress, and nothing
+	// is written once it has been pressed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	keys, err := fetchKeys(keysURL)
+	if a.opts.inventory != "" {
+		return a.runInventory(ctx, action, positional)
+	}
+	store, closeStore, err := a.openStore(ctx)
 	if err != nil {
-		return fmt.Errorf("error fetching keys: %w", err)
+		return err
 	}
+	defer closeStore()
+	err = a.runWithLegacyFile(ctx, store, action, positional)
+	if err == nil && a.opts.patch != "" {
+		err = a.writePatch()
+	}
+	return a.changedExit(err)
+}
 
-	if len(strings.TrimSpace(string(keys))) == 0 {
-		return fmt.Errorf("no public keys found for user '%s'", username)
+// openStore returns the authorized_keys to act on, on --host or here, and a
+// function closing it.
+func (a *app) openStore(ctx context.Context) (doorman.KeyStore, func() error, error) {
+	if a.opts.host != "" {
+		remote, closeRemote, err := a.remoteStore(ctx)
+		if err != nil {
+			return nil, nil, withExitCode(exitRemote, err)
+		}
+		return a.sortedStore(a.dryRunStore(remote)), closeRemote, nil
+	}
+	store, err := a.keyStore()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error locating authorized_keys: %w", err)
 	}
+	return a.sortedStore(a.dryRunStore(store)), func() error { return nil }, nil
+}
 
+// runAction carries out action, named with its arguments by positional, on
+// store.
+func (a *app) runAction(ctx context.Context, store doorman.KeyStore, action string, positional []string) error {
+	d := a.deps
+	if err := a.checkRootTarget(action, storePath(store)); err != nil {
+		return err
+	}
+	var err error
+	if a.labels, err = a.keyLabels(store); err != nil {
+		return err
+	}
 	switch action {
-	case "add":
-		if err := confirmAndAddKeys(keys, username); err != nil {
-			return fmt.Errorf("error adding keys to authorized_keys: %w", err)
+	case "list":
+		if a.opts.stale != "" {
+			return a.listStale(ctx, store)
 		}
-		fmt.Fprintln(stdout, "Keys added successfully!")
-	case "remove":
-		if err := confirmAndRemoveKeys(keys, username); err != nil {
-			return fmt.Errorf("error removing keys from authorized_keys: %w", err)
+		return a.listKeys(ctx, store)
+	case "stats":
+		return a.printStats(ctx, a.newManager(doorman.WithStore(store)))
+	case "export":
+		return a.exportKeys(ctx, store, positional[1:])
+	case "apply":
+		return a.applyDocument(ctx, store, positional[1])
+	case "check":
+		return a.checkKeys(ctx, store)
+	case "state":
+		return a.importState(store, positional[2:])
+	case "add-ca":
+		return a.addCA(ctx, store, positional[1])
+	case "remove-ca":
+		return a.removeCA(ctx, store, positional[1])
+	}
+	if a.opts.unmanaged {
+		return a.removeUnmanaged(ctx, store)
+	}
+
+	var source doorman.KeySource
+	usernames := positional[1:]
+	if a.opts.all {
+		usernames, source, err = a.managedUsers(store)
+	} else {
+		source, err = a.keySource()
+	}
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	var listed map[string]int
+	if a.opts.fromList != "" {
+		if usernames, listed, err = readUserList(a.opts.fromList, usernames); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+	}
+	if a.labels.FoldCase && a.source == nil && !a.opts.all && !a.opts.offline {
+		canonical := a.canonicalUsers(ctx, usernames)
+		for i, username := range canonical {
+			if line, ok := listed[usernames[i]]; ok {
+				listed[username] = line
+			}
+		}
+		usernames = canonical
+	}
+	if a.opts.ifMissing {
+		if usernames, err = a.usersWithoutKeys(store, usernames); err != nil {
+			return fmt.Errorf("error reading authorized_keys: %w", err)
+		}
+		if len(usernames) == 0 {
+			return nil
+		}
+	}
+	var prefetcher *prefetchSource
+	if len(usernames) > 1 {
+		prefetcher = &prefetchSource{KeySource: source, app: a}
+		source = prefetcher
+	}
+	if len(usernames) > 1 && action != "serve" && action != "diff" && a.opts.fromList == "" && !a.opts.all {
+		var w io.Writer = d.stdout
+		if a.opts.cron {
+			w = io.Discard
+		}
+		a.progress = newProgress(w, d.stdoutIsTerminal(), action, len(usernames))
+		source = progressSource{source, a.progress}
+	}
+	if a.opts.offline {
+		source = offlineNotice{source, a}
+	}
+	// BEHAVIOR: The rules restrict which keys are installed, not which can be
+	// removed, and a key they refuse hasn't been revoked by its user
+	var rules *ruleSource
+	if action != "remove" && action != "reconcile" {
+		if rules, err = a.withRules(source); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		source = rules
+		if source, err = a.withForcedOptions(source); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+	}
+	if action == "serve" && a.metricsAddress() != "" {
+		a.metrics = newMetrics()
+	}
+	expiry, err := a.expiryOptions()
+	if err != nil {
+		return err
+	}
+	manager := a.newManager(append([]doorman.Option{doorman.WithSource(source), doorman.WithStore(store)}, expiry...)...)
+
+	// BEHAVIOR: Keys are fetched in parallel, but changes are still made,
+	// previewed and reported one user at a time, in the order given
+	prefetch := func(ctx context.Context) {
+		if prefetcher != nil {
+			prefetcher.prefetch(ctx, usernames, a.opts.concurrency)
 		}
-		fmt.Fprintln(stdout, "Keys removed successfully!")
-	default:
-		return fmt.Errorf("invalid action '%s'. Please use 'add' or 'remove'", action)
+	}
+	if action == "diff" {
+		prefetch(ctx)
+		return a.diffUsers(ctx, manager, usernames)
 	}
 
+	closeAudit, err := a.openAudit()
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	if action == "serve" {
+		return a.serve(ctx, func(ctx context.Context) {
+			rules.reload()
+			prefetch(ctx)
+			a.syncAll(ctx, manager, store, usernames)
+		})
+	}
+	prefetch(ctx)
+	if a.opts.fromList != "" {
+		return a.applyUsers(ctx, manager, store, action, usernames, listed)
+	}
+	if a.opts.all {
+		return a.syncManaged(ctx, manager, store, usernames)
+	}
+	for _, username := range usernames {
+		if a.progress != nil {
+			a.progress.start(username)
+		}
+		err := a.apply(ctx, manager, store, action, username)
+		unlock := a.lockLocalFiles()
+		silent := a.opts.cron && a.recordFetch(username, err)
+		unlock()
+		switch {
+		case errors.Is(err, doorman.ErrFileMissing) && (action == "remove" || action == "reconcile"):
+			a.progress.interrupt()
+			fmt.Fprintln(d.stderr, "The authorized_keys file does not exist.")
+			return nil
+		// BEHAVIOR: One user's failure doesn't stop the others, but Ctrl-C
+		// or a bad signature stops them all
+		case err != nil && (a.progress == nil || errors.Is(err, context.Canceled) || errors.As(err, new(*signatureError))):
+			a.progress.interrupt()
+			return silence(actionError(action, err, d.now()), silent)
+		case errors.Is(err, doorman.ErrAborted):
+			a.progress.skip()
+		case err != nil:
+			a.progress.fail(silence(actionError(action, err, d.now()), silent))
+		}
+	}
+	if a.progress != nil {
+		return a.progress.err()
+	}
 	return nil
 }
 
-func fetchKeys(url string) ([]byte, error) {
-	response, err := httpGet(url)
-	if err != nil {
-		return nil, err
+// openAudit sets up the audit log, unless an inventory already has as its
+// hosts share one, returning a function that closes it.
+func (a *app) openAudit() (func(), error) {
+	if a.audit != nil {
+		return func() {}, nil
+	}
+	a.audit = &auditLog{deps: a.deps}
+	closeAudit := func() { a.audit.close() }
+	if a.cfg.StrictAudit {
+		if err := a.audit.open(); err != nil {
+			closeAudit()
+			return nil, withExitCode(exitFile, fmt.Errorf("error opening audit log; nothing was changed because strict_audit is set: %w", err))
+		}
 	}
-	defer response.Body.Close()
+	return closeAudit, nil
+}
 
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch keys: HTTP %d", response.StatusCode)
+// apply carries out action for username and prints what changed.
+func (a *app) apply(ctx context.Context, manager *doorman.Manager, store doorman.KeyStore, action, username string) error {
+	var change *doorman.Change
+	var err error
+	switch action {
+	case "add":
+		change, err = manager.Add(ctx, username)
+	case "remove":
+		change, err = manager.Remove(ctx, username)
+	case "sync":
+		change, err = manager.Sync(ctx, username)
+	case "reconcile":
+		change, err = manager.Reconcile(ctx, username, a.opts.allowEmpty)
+		if errors.Is(err, doorman.ErrNoKeys) {
+			return fmt.Errorf("%w; pass --allow-empty to remove all of their keys", err)
+		}
+	}
+	if err != nil {
+		return err
 	}
+	return a.recordChange(ctx, store, change)
+}
 
-	keys, err := io.ReadAll(response.Body)
+// usersWithoutKeys returns those of usernames with no keys installed in
+// store, saying which are skipped, for add --if-missing. Nothing is fetched
+// for the others, so a bootstrap that has already run needs no network.
+func (a *app) usersWithoutKeys(store doorman.KeyStore, usernames []string) ([]string, error) {
+	entries, err := store.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		return usernames, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	content := doorman.FormatEntries(entries)
+	var missing []string
+	for _, username := range usernames {
+		installed := len(a.labels.UserKeys(content, username))
+		if installed == 0 {
+			missing = append(missing, username)
+			continue
+		}
+		if !a.opts.cron {
+			fmt.Fprintf(a.stdout, "%s already has %s installed, skipping\n", username, countKeys(installed))
+		}
+	}
+	return missing, nil
+}
+
+// recordChange prints change, made to store, and records it in the audit
+// log and the state file before running the post-change hook. With
+// --dry-run, it only prints it.
+func (a *app) recordChange(ctx context.Context, store doorman.KeyStore, change *doorman.Change) error {
+	a.progress.interrupt()
+	// BEHAVIOR: Nothing was written, so there is nothing to record
+	if a.opts.dryRun {
+		fmt.Fprintf(a.stdout, "%s (--dry-run, nothing written)\n", change)
+		a.changed = a.changed || changed(change)
+		return nil
+	}
+	if change.Created {
+		a.warnUnenforcedPermissions(store.Path())
+	}
+	a.printChange(change)
+	a.changed = a.changed || changed(change)
+	if a.changes != nil {
+		if err := printChangeJSON(a.changes, change, store.Path()); err != nil {
+			return err
+		}
+	}
 
-	return keys, nil
+	unlock := a.lockLocalFiles()
+	auditErr := a.audit.record(change, store.Path(), a.sourceOf(change.Username))
+	stateErr := a.recordState(store, change)
+	unlock()
+	if auditErr != nil {
+		if a.cfg.StrictAudit {
+			return &auditError{auditErr}
+		}
+		fmt.Fprintf(a.stderr, "Warning: could not write the audit log: %v\n", auditErr)
+	}
+	if stateErr != nil {
+		fmt.Fprintf(a.stderr, "Warning: could not update the state file: %v\n", stateErr)
+	}
+	// BEHAVIOR: The change stands whatever the hook does
+	if err := a.runPostChangeHook(ctx, change, store.Path()); err != nil {
+		fmt.Fprintf(a.stderr, "Warning: post-change hook failed: %v\n", err)
+	}
+	return nil
 }
 
-func getAuthorizedKeysPath() (string, error) {
-	currentUser, err := userCurrent()
-	if err != nil {
-		return "", err
+// syncAll syncs each of usernames for serve, logging failures rather than
+// stopping.
+func (a *app) syncAll(ctx context.Context, manager *doorman.Manager, store doorman.KeyStore, usernames []string) {
+	for _, username := range usernames {
+		err := a.apply(ctx, manager, store, "sync", username)
+		a.metrics.recordSync(username, err, a.now())
+		a.health.recordSync(username, err, a.now())
+		switch {
+		// BEHAVIOR: The next cycle syncs onto the hand edit that conflicted,
+		// so a skipped cycle is only worth a warning
+		case errors.Is(err, doorman.ErrConflict):
+			a.logger.Warn("sync_skipped", "user", username, "error", err)
+		case err != nil:
+			a.logger.Error("sync_failed", "user", username, "error", actionError("sync", err, a.now()))
+		}
+	}
+	if a.metrics != nil {
+		if keys, err := manager.List(ctx); err == nil {
+			a.metrics.managedKeys.Set(float64(len(keys)))
+		}
 	}
-	return filepath.Join(currentUser.HomeDir, ".ssh", "authorized_keys"), nil
 }
 
-func ensureSSHDir() error {
-	currentUser, err := userCurrent()
-	if err != nil {
+// takesNoUsername reports whether action works without a username. None of
+// these actions ask anything.
+func takesNoUsername(action string) bool {
+	switch action {
+	case "list", "stats", "check", "audit-log", "systemd-install", "systemd-uninstall", "self-update":
+		return true
+	}
+	return false
+}
+
+// worksRemotely reports whether action can manage a file on --host.
+func worksRemotely(action string) bool {
+	switch action {
+	case "add", "remove", "sync", "reconcile", "diff", "add-ca", "remove-ca", "list", "stats", "check":
+		return true
+	}
+	return false
+}
+
+// asksNothing reports whether action never prompts, so can run without a
+// terminal. keys is run by sshd, which gives it none.
+func asksNothing(action string) bool {
+	return takesNoUsername(action) || action == "keys" || action == "state" || action == "diff" || action == "export"
+}
+
+// actionError says which step of action failed, keeping err matchable so
+// exitCodeFor can classify it.
+func actionError(action string, err error, now time.Time) error {
+	var limitErr *doorman.RateLimitError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("interrupted; authorized_keys was not changed: %w", err)
+	case errors.As(err, new(*auditError)):
+		return err
+	case errors.Is(err, doorman.ErrAborted), errors.Is(err, doorman.ErrInvalidUser),
+		errors.Is(err, doorman.ErrUserNotFound), errors.Is(err, doorman.ErrNoKeys),
+		errors.As(err, new(*doorman.RenamedUserError)):
 		return err
+	case errors.As(err, &limitErr):
+		return fmt.Errorf("error fetching keys: %w", newRateLimitError(limitErr, now))
+	case errors.As(err, new(*doorman.FetchError)):
+		return fmt.Errorf("error %w", err)
 	}
-	sshDir := filepath.Join(currentUser.HomeDir, ".ssh")
-	if _, err := os.Stat(sshDir); os.IsNotExist(err) {
-		return os.Mkdir(sshDir, 0700)
+
+	switch action {
+	case "add":
+		return fmt.Errorf("error adding keys to authorized_keys: %w", err)
+	case "remove", "reconcile":
+		return fmt.Errorf("error removing keys from authorized_keys: %w", err)
+	default:
+		return fmt.Errorf("error updating keys in authorized_keys: %w", err)
+	}
+}
+
+func (d *deps) runHelp(topics []string) error {
+	switch {
+	case len(topics) == 0:
+		printUsage(d.stdout)
+	case len(topics) == 1 && topics[0] == "exit-codes":
+		printExitCodes(d.stdout)
+	case len(topics) == 1 && topics[0] == "diff":
+		fmt.Fprint(d.stdout, diffHelp)
+	case len(topics) == 1 && topics[0] == "providers":
+		for _, name := range doorman.ListProviders() {
+			fmt.Fprintln(d.stdout, name)
+		}
+	default:
+		printUsage(d.stderr)
+		return withExitCode(exitUsage, fmt.Errorf("unknown help topic '%s'", strings.Join(topics, " ")))
 	}
 	return nil
 }
 
-func promptConfirmation(prompt string) (bool, error) {
-	fmt.Fprint(stdout, prompt)
-	reader := getStdinReader()
-	line, err := reader.ReadString('\n')
-	if err != nil && err != io.EOF {
-		return false, err
+// keySource builds the source of the provider named by --provider or the
+// provider setting, defaulting to GitHub. --url and --keys-file choose the
+// url and file providers and give their location, as do the matching
+// settings; any of the three flags replaces all three settings.
+func (a *app) keySource() (doorman.KeySource, error) {
+	if a.source != nil {
+		return a.source, nil
+	}
+	provider, location, err := a.providerChoice()
+	if err != nil {
+		return nil, err
 	}
-	response := strings.ToLower(strings.TrimSpace(line))
-	return response == "yes", nil
+	switch templates := strings.Fields(location); {
+	case provider == "url" && len(templates) > 1:
+		a.verbosef("Fetching keys from the first of %s to answer\n", strings.Join(templates, ", "))
+	case provider == "url" && location != "":
+		a.verbosef("Fetching keys from %s\n", location)
+	case provider == "file" && location != "":
+		a.verbosef("Reading keys from %s\n", location)
+	}
+	return a.newSource(provider, location)
+}
+
+// newSource returns a source of the named provider, getting keys from
+// location.
+func (a *app) newSource(provider, location string) (doorman.KeySource, error) {
+	var source doorman.KeySource
+	var err error
+	if templates := strings.Fields(location); provider == "url" && len(templates) > 1 {
+		source, err = a.fallbackSource(templates)
+	} else {
+		source, err = a.providerSource(provider, location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dir, err := a.offlineDir(provider, location)
+	if err != nil {
+		return nil, err
+	}
+	return cachingSource{KeySource: source, app: a, dir: dir}, nil
 }
 
-func confirmAndAddKeys(keys []byte, username string) error {
-	keysWithUsername := appendUsernameToKeys(keys, username)
+// gitHubTokenVariable names the environment variable holding a GitHub token,
+// with which keys are fetched from GitHub's API along with their IDs
+const gitHubTokenVariable = "GITHUB_TOKEN"
 
-	authorizedKeysPath, err := getAuthorizedKeysPath()
+// providerSource returns a source of the named provider, getting keys from
+// location, whose key lists must be signed if allowed_signers says so.
+func (a *app) providerSource(provider, location string) (doorman.KeySource, error) {
+	factory, err := doorman.LookupProvider(provider)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	source, err := factory(doorman.ProviderOptions{Location: location, Client: httpClient{a}, GitHubToken: a.getenv(gitHubTokenVariable)})
+	if err != nil {
+		return nil, err
+	}
+	return a.withSignatures(source, provider, location)
+}
 
-	fileExists := true
-	if _, err := os.Stat(authorizedKeysPath); os.IsNotExist(err) {
-		fileExists = false
-		confirmed, err := promptConfirmation("The authorized_keys file does not exist. Do you want to create it? (yes/no): ")
-		if err != nil {
-			return err
+// providerChoice returns the provider chosen by the flags, or else the
+// configuration file, and where it should get keys from. The sources
+// setting chooses the url provider, with the URLs separated by spaces as
+// its location.
+func (a *app) providerChoice() (provider, location string, err error) {
+	provider, keysURL, keysFile := a.cfg.Provider, a.cfg.KeysURL, a.cfg.KeysFile
+	sources := a.cfg.Sources
+	if a.opts.provider != "" || a.opts.keysURL != "" || a.opts.keysFile != "" {
+		provider, keysURL, keysFile = a.opts.provider, a.opts.keysURL, a.opts.keysFile
+		sources = nil
+	}
+	if len(sources) > 0 {
+		if (provider != "" && provider != "url") || keysURL != "" || keysFile != "" {
+			return "", "", fmt.Errorf("sources can't be combined with the provider, keys_url or keys_file settings")
 		}
-		if !confirmed {
-			fmt.Fprintln(stdout, "Operation aborted.")
-			return nil
+		if len(sources) == 1 {
+			keysURL = sources[0]
+		} else {
+			return "url", strings.Join(sources, " "), nil
 		}
 	}
 
-	fmt.Fprintf(stdout, "Keys to be added:\n%s\n", string(keysWithUsername))
-	confirmed, err := promptConfirmation("Do you want to add these keys? (yes/no): ")
-	if err != nil {
-		return err
+	var implied string
+	switch {
+	case keysURL != "" && keysFile != "":
+		return "", "", fmt.Errorf("keys can be fetched from a URL or read from a file, not both")
+	case keysURL != "":
+		implied, location = "url", keysURL
+	case keysFile != "":
+		implied, location = "file", keysFile
 	}
-	if !confirmed {
-		fmt.Fprintln(stdout, "Operation aborted.")
-		return nil
+	if provider == "" {
+		provider = implied
 	}
+	if provider == "" {
+		provider = "github"
+	}
+	if implied != "" && provider != implied {
+		return "", "", fmt.Errorf("the %s provider can't get keys from '%s'", provider, location)
+	}
+	return provider, location, nil
+}
 
-	if err := ensureSSHDir(); err != nil {
-		return err
+// httpClient lets the library fetch through app.client, revalidating
+// cached key lists and logging rate limit headers in verbose mode.
+type httpClient struct {
+	*app
+}
+
+func (c httpClient) Do(request *http.Request) (*http.Response, error) {
+	response, err := c.cachedDo(c.withExtraHeaders(request))
+	if err == nil {
+		c.logRateLimitHeaders(response)
+		err = recordPayload(request.Context(), response)
 	}
+	return response, err
+}
 
-	// BEHAVIOR: Append keys to existing file instead of overwriting
-	// Using O_APPEND to preserve existing authorized keys
-	if fileExists {
-		file, err := os.OpenFile(authorizedKeysPath, os.O_APPEND|os.O_WRONLY, 0600)
-		if err != nil {
-			return err
+// newManager returns a Manager that confirms changes at the terminal and
+// honors --verbose and --wait-for-ratelimit, configured further by extra.
+func (a *app) newManager(extra ...doorman.Option) *doorman.Manager {
+	rateLimitWait := doorman.DefaultRateLimitWait
+	if a.opts.waitForRateLimit {
+		rateLimitWait = maxRateLimitWait
+	}
+
+	opts := append([]doorman.Option{
+		doorman.WithPrompter(terminalPrompter{a}),
+		doorman.WithLogger(a.logger),
+		doorman.WithClock(clock{a.deps}),
+		doorman.WithRateLimitWait(rateLimitWait),
+		doorman.WithRemovalCheck(a.confirmSessionKeyRemoval),
+		doorman.WithAdditionCheck(a.confirmSharedKeys),
+		doorman.WithLabels(a.labels),
+	}, extra...)
+	if a.events != nil || a.metrics != nil {
+		opts = append(opts, doorman.WithEventHandler(a.handleEvent))
+	}
+	return doorman.NewManager(opts...)
+}
+
+// openLog sets a.logger up as chosen by the --log-* flags, returning a
+// function that closes the log file, if any.
+func (a *app) openLog() (func() error, error) {
+	level := slog.LevelWarn
+	switch {
+	case a.opts.verbose:
+		level = slog.LevelDebug
+	case a.opts.cron:
+		// Warnings, such as waiting out a rate limit, aren't worth a mail
+		level = slog.LevelError
+	}
+	if a.opts.logLevel != "" {
+		if err := level.UnmarshalText([]byte(a.opts.logLevel)); err != nil {
+			return nil, withExitCode(exitUsage, fmt.Errorf("invalid log level '%s': use debug, info, warn or error", a.opts.logLevel))
 		}
-		defer file.Close()
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
 
-		// Ensure we start on a new line
-		stat, err := file.Stat()
+	var w io.Writer = a.stderr
+	closeLog := func() error { return nil }
+	if a.opts.logFile != "" {
+		f, err := os.OpenFile(a.opts.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 		if err != nil {
-			return err
-		}
-		if stat.Size() > 0 {
-			if _, err := file.WriteString("\n"); err != nil {
-				return err
-			}
+			return nil, fmt.Errorf("error opening log file: %w", err)
 		}
-		_, err = file.Write(keysWithUsername)
-		return err
+		w, closeLog = f, f.Close
+	} else {
+		// On a terminal, events are read as they happen
+		handlerOpts.ReplaceAttr = withoutTime
 	}
 
-	return os.WriteFile(authorizedKeysPath, keysWithUsername, 0600)
+	switch a.opts.logFormat {
+	case "text":
+		a.logger = slog.New(slog.NewTextHandler(w, handlerOpts))
+	case "json":
+		a.logger = slog.New(slog.NewJSONHandler(w, handlerOpts))
+	default:
+		closeLog()
+		return nil, withExitCode(exitUsage, fmt.Errorf("invalid log format '%s': use text or json", a.opts.logFormat))
+	}
+	return closeLog, nil
 }
 
-func confirmAndRemoveKeys(keys []byte, username string) error {
-	keysWithUsername := appendUsernameToKeys(keys, username)
+// withoutTime drops the timestamp from log lines written to stderr.
+func withoutTime(groups []string, attr slog.Attr) slog.Attr {
+	if len(groups) == 0 && attr.Key == slog.TimeKey {
+		return slog.Attr{}
+	}
+	return attr
+}
 
-	authorizedKeysPath, err := getAuthorizedKeysPath()
+// keyStore returns the store for the authorized_keys file chosen by
+// getAuthorizedKeysPath.
+func (a *app) keyStore() (doorman.KeyStore, error) {
+	path, err := a.getAuthorizedKeysPath()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if _, err := os.Stat(authorizedKeysPath); os.IsNotExist(err) {
-		fmt.Fprintln(stdout, "The authorized_keys file does not exist.")
-		return nil
+	// Only create ~/.ssh; directories for paths configured elsewhere are
+	// expected to exist already
+	sshDir, err := a.getSSHDir()
+	if err != nil {
+		return nil, err
+	}
+	keysUser, err := a.keysUser()
+	if err != nil {
+		return nil, err
+	}
+	fileStore := doorman.NewFileStore(path)
+	fileStore.DirOwner = keysUser.Uid
+	fileStore.MaxLineLength = a.cfg.MaxLineLength
+	// Owners in an image or chroot mean nothing to the host
+	fileStore.SkipChown = a.opts.homeDir != ""
+	if a.opts.cron {
+		// Another doorman holding the lock will be run again soon enough
+		fileStore.LockWait = cronLockWait
 	}
+	if filepath.Dir(path) == sshDir {
+		return sshDirStore{fileStore, a.deps}, nil
+	}
+	return fileStore, nil
+}
 
-	fmt.Fprintf(stdout, "Keys to be removed:\n%s\n", string(keysWithUsername))
+// sshDirStore creates ~/.ssh, as ensureSSHDir does, before the first write
+// to a file in it, and under sudo gives what it writes to the user who ran
+// doorman.
+type sshDirStore struct {
+	*doorman.FileStore
+	deps *deps
+}
 
-	confirmed, err := promptConfirmation("Do you want to remove these keys? (yes/no): ")
+func (s sshDirStore) Lock() (func() error, error) {
+	if err := s.deps.ensureSSHDir(); err != nil {
+		return nil, err
+	}
+	unlock, err := s.FileStore.Lock()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if !confirmed {
-		fmt.Fprintln(stdout, "Operation aborted.")
-		return nil
+	if err := s.deps.chownToKeysOwner(s.Path() + ".lock"); err != nil {
+		unlock()
+		return nil, err
 	}
+	return unlock, nil
+}
 
-	existingKeys, err := os.ReadFile(authorizedKeysPath)
-	if err != nil {
+func (s sshDirStore) Save(entries []doorman.Entry) error {
+	if err := s.deps.ensureSSHDir(); err != nil {
 		return err
 	}
+	if err := s.FileStore.Save(entries); err != nil {
+		return err
+	}
+	return s.deps.chownToKeysOwner(s.Path())
+}
+
+// getAuthorizedKeysPath resolves the file to manage, in order of precedence:
+// the --file flag, the authorized_keys_file setting, the first
+// AuthorizedKeysFile in sshd_config, and finally ~/.ssh/authorized_keys.
+func (a *app) getAuthorizedKeysPath() (string, error) {
+	if a.opts.file != "" {
+		a.verbosef("Using %s (from --file)\n", a.opts.file)
+		return a.opts.file, nil
+	}
 
-	newKeys := removeKeysByUsername(existingKeys, username)
+	currentUser, err := a.keysUser()
+	if err != nil {
+		return "", err
+	}
 
-	return os.WriteFile(authorizedKeysPath, newKeys, 0600)
-}
+	if a.cfg.AuthorizedKeysFile != "" {
+		path, err := a.expandAuthorizedKeysFile(a.cfg.AuthorizedKeysFile, a.sshUsername(currentUser.Username), currentUser.HomeDir)
+		if err != nil {
+			return "", fmt.Errorf("invalid authorized_keys_file setting: %w", err)
+		}
+		a.verbosef("Using %s (from authorized_keys_file in config)\n", path)
+		return path, nil
+	}
 
-func appendUsernameToKeys(keys []byte, username string) []byte {
-	lines := strings.Split(strings.TrimSpace(string(keys)), "\n")
+	// BEHAVIOR: The host's sshd_config says nothing about the image or
+	// chroot --home-dir points into
+	if a.opts.homeDir != "" {
+		path := filepath.Join(currentUser.HomeDir, ".ssh", "authorized_keys")
+		a.verbosef("Using %s (from --home-dir)\n", path)
+		return path, nil
+	}
 
-	var result []string
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if len(line) > 0 {
-			result = append(result, line+" "+username)
+	if a.onWindows() {
+		admin, err := a.isAdministrator()
+		if err != nil {
+			a.verbosef("Could not determine whether the current user is an administrator: %v\n", err)
+		}
+		if admin {
+			path := administratorsAuthorizedKeysPath()
+			a.verbosef("Using %s (administrators use this file with OpenSSH for Windows)\n", path)
+			return path, nil
 		}
 	}
 
-	return []byte(strings.Join(result, "\n"))
+	defaultPath := filepath.Join(currentUser.HomeDir, ".ssh", "authorized_keys")
+
+	value, err := authorizedKeysFileFromSSHDConfig(a.sshdConfigPath)
+	switch {
+	case err != nil:
+		a.verbosef("Using %s (could not read %s: %v)\n", defaultPath, a.sshdConfigPath, err)
+		return defaultPath, nil
+	case value == "" || strings.EqualFold(value, "none"):
+		a.verbosef("Using %s (no AuthorizedKeysFile set in %s)\n", defaultPath, a.sshdConfigPath)
+		return defaultPath, nil
+	}
+
+	path, err := a.expandAuthorizedKeysFile(value, a.sshUsername(currentUser.Username), currentUser.HomeDir)
+	if err != nil {
+		a.verbosef("Using %s (could not expand AuthorizedKeysFile %q: %v)\n", defaultPath, value, err)
+		return defaultPath, nil
+	}
+	a.verbosef("Using %s (from AuthorizedKeysFile in %s)\n", path, a.sshdConfigPath)
+	return path, nil
 }
 
-func removeKeysByUsername(keys []byte, username string) []byte {
-	lines := strings.Split(string(keys), "\n")
+// withHomeDir returns deps for which home is the current user's home
+// directory, named after its last element, without looking the user up.
+func (d *deps) withHomeDir(home string) (*deps, error) {
+	home, err := filepath.Abs(home)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(home)
+	if err != nil {
+		return nil, withExitCode(exitFile, fmt.Errorf("invalid --home-dir: %w", err))
+	}
+	if !info.IsDir() {
+		return nil, withExitCode(exitFile, fmt.Errorf("invalid --home-dir: %s is not a directory", home))
+	}
+	homed := *d
+	homed.currentUser = func() (*user.User, error) {
+		return &user.User{Username: filepath.Base(home), HomeDir: home}, nil
+	}
+	return &homed, nil
+}
 
-	// BEHAVIOR: Match exact username suffix to avoid partial matches
-	// e.g., removing "bob" should not remove keys for "bobby"
-	suffix := " " + username
-	var newLines []string
-	for _, line := range lines {
-		if !strings.HasSuffix(line, suffix) {
-			newLines = append(newLines, line)
-		}
+func (d *deps) getSSHDir() (string, error) {
+	currentUser, err := d.keysUser()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(currentUser.HomeDir, ".ssh"), nil
+}
+
+func (d *deps) ensureSSHDir() error {
+	currentUser, err := d.keysUser()
+	if err != nil {
+		return err
 	}
 
-	return []byte(strings.Join(newLines, "\n"))
+	// BEHAVIOR: Never create the home directory itself; doing so as the wrong
+	// user (e.g. root) would hand the account a home it doesn't own
+	info, err := os.Stat(currentUser.HomeDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return withExitCode(exitFile, fmt.Errorf("home directory %s does not exist — create the account's home first", currentUser.HomeDir))
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return withExitCode(exitFile, fmt.Errorf("home directory %s is not a directory", currentUser.HomeDir))
+	}
+
+	sshDir := filepath.Join(currentUser.HomeDir, ".ssh")
+	if _, err := os.Stat(sshDir); !os.IsNotExist(err) {
+		return nil
+	}
+
+	d.warnUnenforcedPermissions(sshDir)
+	if err := os.MkdirAll(sshDir, 0700); err != nil {
+		return err
+	}
+	// The umask may have stripped bits from the requested mode
+	if err := os.Chmod(sshDir, 0700); err != nil {
+		return err
+	}
+	return d.chownToKeysOwner(sshDir)
 }
@@ -1,88 +1,163 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
 )
 
-// Test helpers for mocking
-func setupTestEnv(t *testing.T) (tempDir string, cleanup func()) {
-	t.Helper()
+// testKey is a valid public key for tests that need one but don't care which.
+const testKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBMpUdogPMMHu+nQNMCIXHV5Emg2Caeeb8/Qmy8gs/Kc"
+
+// testEnv is an app run by a user whose home is a fresh temporary directory,
+// typing at a terminal outside any SSH session. Output is collected in out
+// and errOut, and getenv reads env.
+type testEnv struct {
+	*app
+	home   string
+	out    *bytes.Buffer
+	errOut *bytes.Buffer
+	env    map[string]string
+}
 
-	tempDir, err := os.MkdirTemp("", "doorman-test-*")
-	if err != nil {
-		t.Fatalf("failed to create temp dir: %v", err)
-	}
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
 
-	sshDir := filepath.Join(tempDir, ".ssh")
-	if err := os.Mkdir(sshDir, 0700); err != nil {
+	home := t.TempDir()
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
 		t.Fatalf("failed to create .ssh dir: %v", err)
 	}
 
-	// Save original globals
-	origUserCurrent := userCurrent
-	origStdin := stdin
-	origStdout := stdout
-	origHttpGet := httpGet
-	origOsExit := osExit
+	e := &testEnv{home: home, out: &bytes.Buffer{}, errOut: &bytes.Buffer{}, env: map[string]string{}}
+	e.app = &app{deps: &deps{
+		stdin:  bufio.NewReader(strings.NewReader("")),
+		stdout: e.out,
+		stderr: e.errOut,
+		transport: roundTripFunc(func(request *http.Request) (*http.Response, error) {
+			return nil, errors.New("no network in tests")
+		}),
+		currentUser: func() (*user.User, error) {
+			return &user.User{Username: "tester", HomeDir: home}, nil
+		},
+		// Tests must not see the host's users either
+		lookupUser: func(username string) (*user.User, error) {
+			return nil, user.UnknownUserError(username)
+		},
+		hostname: func() (string, error) { return "testhost", nil },
+		getenv:   func(key string) string { return e.env[key] },
+		// Tests answer prompts through mockStdin, as if typed at a terminal
+		stdinIsTerminal:  func() bool { return true },
+		stdoutIsTerminal: func() bool { return false },
+		// Tests have no controlling terminal to fall back on
+		openTerminal:  func() (io.ReadCloser, error) { return nil, errors.New("no terminal") },
+		terminalWidth: func() int { return 0 },
+		// Tests must not notice the SSH agent they may be running with
+		listAgentKeys:   func() ([]doorman.PublicKey, error) { return nil, errors.New("no agent") },
+		isAdministrator: func() (bool, error) { return false, nil },
+		now:             time.Now,
+		sleep:           sleepContext,
+		goos:            runtime.GOOS,
+		// Keep the host's sshd_config out of the tests
+		sshdConfigPath: filepath.Join(home, "sshd_config"),
+	}}
+	e.logger = slog.New(slog.NewTextHandler(e.errOut, &slog.HandlerOptions{Level: slog.LevelWarn, ReplaceAttr: withoutTime}))
+	return e
+}
 
-	// Mock userCurrent to use temp directory
-	userCurrent = func() (*user.User, error) {
-		return &user.User{HomeDir: tempDir}, nil
-	}
+// today is the token stamped on keys added today.
+var today = " doorman-added=" + time.Now().Format(time.DateOnly)
 
-	cleanup = func() {
-		os.RemoveAll(tempDir)
-		userCurrent = origUserCurrent
-		stdin = origStdin
-		stdout = origStdout
-		httpGet = origHttpGet
-		osExit = origOsExit
-		resetStdinReader()
-	}
+// roundTripFunc lets a function stand in for the network.
+type roundTripFunc func(request *http.Request) (*http.Response, error)
 
-	return tempDir, cleanup
+func (f roundTripFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
 }
 
-func mockStdin(input string) {
-	stdin = strings.NewReader(input)
-	resetStdinReader() // Reset the buffered reader when stdin changes
+func (e *testEnv) mockStdin(input string) {
+	e.stdin = bufio.NewReader(strings.NewReader(input))
 }
 
-func mockStdout() *bytes.Buffer {
-	buf := &bytes.Buffer{}
-	stdout = buf
-	return buf
+func (e *testEnv) mockHTTPError(err error) {
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		return nil, err
+	})
 }
 
-func mockHttpGet(statusCode int, body string) {
-	httpGet = func(url string) (*http.Response, error) {
-		return &http.Response{
-			StatusCode: statusCode,
-			Body:       io.NopCloser(strings.NewReader(body)),
-		}, nil
-	}
+// fakeSource serves the same keys, or error, for every user.
+type fakeSource struct {
+	keys []doorman.PublicKey
+	err  error
 }
 
-func mockHttpGetError(err error) {
-	httpGet = func(url string) (*http.Response, error) {
-		return nil, err
+func (s fakeSource) Keys(ctx context.Context, user string) ([]doorman.PublicKey, error) {
+	return s.keys, s.err
+}
+
+func (e *testEnv) mockKeys(keys string) {
+	e.source = fakeSource{keys: parseKeys(keys)}
+}
+
+func (e *testEnv) mockKeysError(err error) {
+	e.source = fakeSource{err: err}
+}
+
+func parseKeys(keys string) []doorman.PublicKey {
+	return doorman.ParsePublicKeys([]byte(keys))
+}
+
+// testManager returns the Manager run() would use in the test environment,
+// fetching keys from the source set up by mockKeys.
+func (e *testEnv) testManager(t *testing.T) *doorman.Manager {
+	t.Helper()
+	source, err := e.keySource()
+	if err != nil {
+		t.Fatalf("failed to create key source: %v", err)
+	}
+	store, err := e.keyStore()
+	if err != nil {
+		t.Fatalf("failed to locate authorized_keys: %v", err)
 	}
+	return e.newManager(doorman.WithSource(source), doorman.WithStore(store))
+}
+
+// addKeys adds the keys of username as the add action does, with keys as
+// the published keys.
+func (e *testEnv) addKeys(t *testing.T, keys, username string) (*doorman.Change, error) {
+	t.Helper()
+	e.mockKeys(keys)
+	return e.testManager(t).Add(context.Background(), username)
+}
+
+// removeKeys is addKeys for the remove action.
+func (e *testEnv) removeKeys(t *testing.T, keys, username string) (*doorman.Change, error) {
+	t.Helper()
+	e.mockKeys(keys)
+	return e.testManager(t).Remove(context.Background(), username)
 }
 
 // Tests for run()
 func TestRunInvalidArgs(t *testing.T) {
-	_, cleanup := setupTestEnv(t)
-	defer cleanup()
+	e := newTestEnv(t)
 
 	tests := []struct {
 		name string
@@ -90,85 +165,141 @@ func TestRunInvalidArgs(t *testing.T) {
 	}{
 		{"no args", []string{"doorman"}},
 		{"one arg", []string{"doorman", "add"}},
-		{"too many args", []string{"doorman", "add", "user", "extra"}},
+		{"too many args", []string{"doorman", "list", "extra"}},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockStdout()
-			err := run(tt.args)
-			if err == nil {
-				t.Error("expected error for invalid args")
+			e.out.Reset()
+			e.errOut.Reset()
+			err := run(e.deps, tt.args)
+			if exitCodeFor(err) != exitUsage {
+				t.Errorf("expected exit code %d, got %v", exitUsage, err)
+			}
+			for _, expected := range []string{manName, "Usage:", "Actions:\n  add <username>...\n      fetch the users' keys", "Examples:\n  doorman add alice\n"} {
+				if !strings.Contains(e.errOut.String(), expected) {
+					t.Errorf("expected %q in the usage on stderr", expected)
+				}
+			}
+			if e.out.Len() != 0 {
+				t.Errorf("expected nothing on stdout, got %q", e.out.String())
 			}
 		})
 	}
 }
 
 func TestRunInvalidAction(t *testing.T) {
-	_, cleanup := setupTestEnv(t)
-	defer cleanup()
+	e := newTestEnv(t)
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"doorman", "ad", "alice"}, "invalid action 'ad'; did you mean 'add'?"},
+		{[]string{"doorman", "lsit"}, "invalid action 'lsit'; did you mean 'list'?"},
+		{[]string{"doorman", "remvoe-ca", "ops"}, "invalid action 'remvoe-ca'; did you mean 'remove-ca'?"},
+		{[]string{"doorman", "frobnicate", "user"}, "invalid action 'frobnicate'; available actions: add, remove, sync, reconcile, diff, add-ca, remove-ca, list,"},
+		{[]string{"doorman", "ls"}, "invalid action 'ls'; available actions: "},
+	}
+	for _, tt := range tests {
+		err := run(e.deps, tt.args)
+		if exitCodeFor(err) != exitUsage {
+			t.Errorf("%q: expected exit code %d, got %v", tt.args, exitUsage, err)
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+			t.Errorf("%q: expected %q, got %v", tt.args, tt.expected, err)
+		}
+	}
+}
+
+func TestRunFetchError(t *testing.T) {
+	e := newTestEnv(t)
 
-	mockStdout()
-	mockHttpGet(http.StatusOK, "ssh-rsa AAAAB3...")
+	e.mockKeysError(errors.New("network error"))
 
-	err := run([]string{"doorman", "invalid", "user"})
-	if err == nil {
-		t.Error("expected error for invalid action")
+	err := run(e.deps, []string{"doorman", "add", "user"})
+	var fetchErr *doorman.FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.User != "user" {
+		t.Errorf("expected a FetchError for user, got: %v", err)
 	}
-	if !strings.Contains(err.Error(), "invalid action") {
-		t.Errorf("expected 'invalid action' error, got: %v", err)
+	if !strings.HasPrefix(err.Error(), "error fetching keys for user: network error") {
+		t.Errorf("unexpected message: %v", err)
 	}
 }
 
-func TestRunFetchError(t *testing.T) {
-	_, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestRunFetchNetworkErrorHint(t *testing.T) {
+	e := newTestEnv(t)
 
-	mockStdout()
-	mockHttpGetError(errors.New("network error"))
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	e.mockHTTPError(&url.Error{Op: "Get", URL: "https://github.com/alice.keys", Err: refused})
 
-	err := run([]string{"doorman", "add", "user"})
-	if err == nil {
-		t.Error("expected error for fetch failure")
+	err := run(e.deps, []string{"doorman", "add", "alice"})
+	if exitCodeFor(err) != exitFetch {
+		t.Errorf("expected exit code %d, got %d (%v)", exitFetch, exitCodeFor(err), err)
 	}
-	if !strings.Contains(err.Error(), "error fetching keys") {
-		t.Errorf("expected 'error fetching keys' error, got: %v", err)
+	if !strings.Contains(err.Error(), "connection refused") || !strings.Contains(err.Error(), "hint: the connection was refused") {
+		t.Errorf("unexpected message: %v", err)
 	}
 }
 
-func TestRunEmptyKeys(t *testing.T) {
-	_, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestRunUserNotFound(t *testing.T) {
+	e := newTestEnv(t)
 
-	mockStdout()
-	mockHttpGet(http.StatusOK, "   \n\n  ")
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("Not Found"))}, nil
+	})
 
-	err := run([]string{"doorman", "add", "user"})
-	if err == nil {
-		t.Error("expected error for empty keys")
+	err := run(e.deps, []string{"doorman", "add", "alcie"})
+	if !errors.Is(err, doorman.ErrUserNotFound) || err.Error() != "GitHub user 'alcie' not found — check the spelling" {
+		t.Errorf("expected user not found error, got: %v", err)
+	}
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected usage exit code, got %d", exitCodeFor(err))
 	}
-	if !strings.Contains(err.Error(), "no public keys found") {
-		t.Errorf("expected 'no public keys found' error, got: %v", err)
+
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})
+	err = run(e.deps, []string{"doorman", "add", "alice"})
+	var fetchErr *doorman.FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.Status != http.StatusServiceUnavailable || fetchErr.URL != "https://github.com/alice.keys" {
+		t.Errorf("expected a FetchError for HTTP 503, got %v", err)
+	}
+	if exitCodeFor(err) != exitFetch {
+		t.Errorf("expected fetch exit code for 503, got %d", exitCodeFor(err))
+	}
+}
+
+func TestRunEmptyKeys(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.mockKeys("   \n\n  ")
+
+	err := run(e.deps, []string{"doorman", "add", "user"})
+	if !errors.Is(err, doorman.ErrNoKeys) {
+		t.Errorf("expected ErrNoKeys, got: %v", err)
 	}
 }
 
 func TestRunAddSuccess(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 
-	out := mockStdout()
-	mockHttpGet(http.StatusOK, "ssh-rsa AAAAB3...")
-	mockStdin("yes\nyes\n") // First for create file, second for add keys
+	out := e.out
+	errOut := e.errOut
+	e.mockKeys("ssh-rsa AAAAB3...")
+	e.mockStdin("yes\n")
 
-	err := run([]string{"doorman", "add", "testuser"})
+	err := run(e.deps, []string{"doorman", "add", "testuser"})
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	if !strings.Contains(out.String(), "Keys added successfully") {
-		t.Error("expected success message")
+	if !strings.Contains(out.String(), "Added 1 key for testuser (1 rsa)") {
+		t.Errorf("expected summary, got %q", out.String())
+	}
+	if errOut.Len() != 0 {
+		t.Errorf("expected nothing on stderr, got %q", errOut.String())
 	}
 
 	content, _ := os.ReadFile(authorizedKeysPath)
@@ -178,23 +309,25 @@ func TestRunAddSuccess(t *testing.T) {
 }
 
 func TestRunRemoveSuccess(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	os.WriteFile(authorizedKeysPath, []byte("ssh-rsa KEY1... testuser\nssh-rsa KEY2... other"), 0600)
 
-	out := mockStdout()
-	mockHttpGet(http.StatusOK, "ssh-rsa KEY1...")
-	mockStdin("yes\n")
+	out := e.out
+	e.mockKeys("ssh-rsa KEY1...")
+	e.mockStdin("yes\n")
 
-	err := run([]string{"doorman", "remove", "testuser"})
+	err := run(e.deps, []string{"doorman", "remove", "testuser"})
 	if err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	if !strings.Contains(out.String(), "Keys removed successfully") {
-		t.Error("expected success message")
+	if !strings.Contains(out.String(), "\n- 1  ssh-rsa KEY1... testuser\n") {
+		t.Errorf("expected the stored line to be previewed, got %q", out.String())
+	}
+	if !strings.Contains(out.String(), "Removed 1 of 1 key for testuser (1 rsa)") {
+		t.Errorf("expected summary, got %q", out.String())
 	}
 
 	content, _ := os.ReadFile(authorizedKeysPath)
@@ -206,163 +339,544 @@ func TestRunRemoveSuccess(t *testing.T) {
 	}
 }
 
-// Tests for main()
-func TestMain(t *testing.T) {
-	_, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestRunSync(t *testing.T) {
+	e := newTestEnv(t)
+
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	os.WriteFile(authorizedKeysPath, []byte("ssh-rsa OLD... testuser\nssh-rsa KEY... other\nssh-ed25519 KEEP... testuser\n"), 0600)
+
+	out := e.out
+	e.mockKeys("ssh-ed25519 KEEP...\nssh-ed25519 NEW...")
+	e.mockStdin("yes\n")
+
+	if err := run(e.deps, []string{"doorman", "sync", "testuser"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Synced keys for testuser: added 1 (1 ed25519), removed 1 (1 rsa)") {
+		t.Errorf("expected summary, got %q", out.String())
+	}
+
+	expected := "ssh-rsa KEY... other\nssh-ed25519 KEEP... testuser\nssh-ed25519 NEW... testuser" + today + "\n"
+	if content := readFile(t, authorizedKeysPath); content != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+}
+
+func TestRunAddIfMissing(t *testing.T) {
+	e := newTestEnv(t)
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, authorizedKeysPath, "ssh-rsa KEY1... alice\nssh-rsa KEY2... alice\n")
+	fetched := false
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		fetched = true
+		return nil, errors.New("should not be called")
+	})
+
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "--if-missing", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.String() != "alice already has 2 keys installed, skipping\n" {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+	if fetched {
+		t.Error("keys should not be fetched for a user who has some")
+	}
+
+	e.out.Reset()
+	e.source = userSource{"bob": "ssh-ed25519 NEW..."}
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "--if-missing", "alice", "bob"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "ssh-rsa KEY1... alice\nssh-rsa KEY2... alice\nssh-ed25519 NEW... bob" + today + "\n"
+	if content := readFile(t, authorizedKeysPath); content != expected {
+		t.Errorf("expected only bob's keys added, got %q", content)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "sync", "--if-missing", "alice"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected --if-missing to only work with add, got %v", err)
+	}
+}
+
+func TestRunReconcile(t *testing.T) {
+	e := newTestEnv(t)
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, authorizedKeysPath, "ssh-rsa OLD... testuser\nssh-rsa KEY... other\nssh-ed25519 KEEP... testuser\n")
+	e.mockKeys("ssh-ed25519 KEEP...\nssh-ed25519 NEW...")
+	e.mockStdin("yes\n")
+
+	if err := run(e.deps, []string{"doorman", "reconcile", "testuser"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), "Removed 1 of 2 keys for testuser no longer published (1 rsa)") {
+		t.Errorf("expected summary, got %q", e.out.String())
+	}
+	expected := "ssh-rsa KEY... other\nssh-ed25519 KEEP... testuser\n"
+	if content := readFile(t, authorizedKeysPath); content != expected {
+		t.Errorf("expected only the revoked key removed and nothing added, got %q", content)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "reconcile", "testuser"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.String() != "Keys for testuser are all still published (1 key)\n" {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+
+	e.mockKeys("")
+	err := run(e.deps, []string{"doorman", "--yes", "reconcile", "testuser"})
+	if !errors.Is(err, doorman.ErrNoKeys) || !strings.Contains(err.Error(), "pass --allow-empty") {
+		t.Errorf("expected an empty key list to be refused, got %v", err)
+	}
+	if content := readFile(t, authorizedKeysPath); content != expected {
+		t.Errorf("expected nothing removed, got %q", content)
+	}
+	if err := run(e.deps, []string{"doorman", "--yes", "reconcile", "--allow-empty", "testuser"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, authorizedKeysPath); content != "ssh-rsa KEY... other\n" {
+		t.Errorf("expected every key of testuser removed, got %q", content)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "sync", "--allow-empty", "testuser"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected --allow-empty to only work with reconcile, got %v", err)
+	}
+}
+
+func TestRunInvalidUsername(t *testing.T) {
+	e := newTestEnv(t)
 
-	mockStdout()
+	fetched := false
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		fetched = true
+		return nil, errors.New("should not be called")
+	})
 
-	exitCode := -1
-	osExit = func(code int) {
-		exitCode = code
+	err := run(e.deps, []string{"doorman", "add", "alice/../evil"})
+	if err == nil {
+		t.Fatal("expected error for invalid username")
+	}
+	if !strings.Contains(err.Error(), "invalid GitHub username") {
+		t.Errorf("expected 'invalid GitHub username' error, got: %v", err)
+	}
+	if fetched {
+		t.Error("keys should not be fetched for an invalid username")
 	}
+}
+
+func TestRunFileFlag(t *testing.T) {
+	e := newTestEnv(t)
+
+	customPath := filepath.Join(e.home, "custom_keys")
+	os.WriteFile(customPath, []byte("ssh-rsa EXISTING... other"), 0600)
 
-	// Test with invalid args (will trigger osExit)
-	os.Args = []string{"doorman"}
-	main()
+	e.mockKeys("ssh-rsa KEY...")
+	e.mockStdin("yes\n")
 
-	if exitCode != 1 {
-		t.Errorf("expected exit code 1, got %d", exitCode)
+	// Flags may follow the positional arguments
+	err := run(e.deps, []string{"doorman", "add", "testuser", "--file", customPath})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, _ := os.ReadFile(customPath)
+	if !strings.Contains(string(content), "testuser") {
+		t.Error("keys should be added to the --file path")
+	}
+	if _, err := os.Stat(filepath.Join(e.home, ".ssh", "authorized_keys")); !os.IsNotExist(err) {
+		t.Error("default authorized_keys should not be created")
 	}
 }
 
-// Tests for fetchKeys()
-func TestFetchKeys(t *testing.T) {
+func TestRunUnknownFlag(t *testing.T) {
+	e := newTestEnv(t)
+
+	errOut := e.errOut
+	err := run(e.deps, []string{"doorman", "--bogus", "add", "user"})
+	if err == nil {
+		t.Error("expected error for unknown flag")
+	}
+	if !strings.Contains(errOut.String(), "flag provided but not defined: -bogus") {
+		t.Errorf("expected flag error on stderr, got %q", errOut.String())
+	}
+}
+
+func TestRunConfigError(t *testing.T) {
+	e := newTestEnv(t)
+
+	err := run(e.deps, []string{"doorman", "--config", filepath.Join(e.home, "missing.toml"), "add", "user"})
+	if err == nil || !strings.Contains(err.Error(), "error reading config") {
+		t.Errorf("expected config read error, got: %v", err)
+	}
+}
+
+func TestRunNonInteractive(t *testing.T) {
+	e := newTestEnv(t)
+
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	e.stdinIsTerminal = func() bool { return false }
+	e.mockKeys("ssh-rsa KEY...")
+	e.mockStdin("")
+
+	err := run(e.deps, []string{"doorman", "add", "testuser"})
+	if err == nil || !strings.Contains(err.Error(), "there is no terminal to ask on; pass --yes") {
+		t.Fatalf("expected non-terminal error, got: %v", err)
+	}
+	if _, err := os.Stat(authorizedKeysPath); !os.IsNotExist(err) {
+		t.Error("file should not be created")
+	}
+
+	out := e.out
+	err = run(e.deps, []string{"doorman", "add", "testuser", "--yes"})
+	if err != nil {
+		t.Fatalf("unexpected error with --yes: %v", err)
+	}
+	if !strings.Contains(out.String(), "yes (--yes)") {
+		t.Error("expected prompts to be answered by --yes")
+	}
+	content, _ := os.ReadFile(authorizedKeysPath)
+	if !strings.Contains(string(content), "testuser") {
+		t.Error("keys should be added with --yes")
+	}
+}
+
+// Tests for runMain()
+func TestRunPromptsOnTerminal(t *testing.T) {
+	e := newTestEnv(t)
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	e.stdinIsTerminal = func() bool { return false }
+	e.openTerminal = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("yes\n")), nil
+	}
+	e.mockKeys(testKey)
+	e.mockStdin("no\n")
+
+	if err := run(e.deps, []string{"doorman", "add", "testuser"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, authorizedKeysPath); !strings.HasPrefix(content, testKey+" testuser") {
+		t.Errorf("expected the answer read from the terminal rather than stdin, got %q", content)
+	}
+}
+
+func TestRunLogging(t *testing.T) {
 	tests := []struct {
-		name        string
-		statusCode  int
-		body        string
-		expectError bool
-		errContains string
+		name     string
+		flags    []string
+		toFile   bool
+		expected string
 	}{
-		{"success", http.StatusOK, "ssh-rsa AAAAB3...", false, ""},
-		{"not found", http.StatusNotFound, "Not Found", true, "HTTP 404"},
-		{"server error", http.StatusInternalServerError, "Error", true, "HTTP 500"},
+		{"quiet by default", nil, false, ""},
+		{"verbose", []string{"-v"}, false, "level=DEBUG msg=fetch_keys user=alice attempt=1\n"},
+		{"text", []string{"--log-level", "info"}, false, "level=INFO msg=key_added user=alice fingerprint=SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I path="},
+		{"json to file", []string{"--log-level", "info", "--log-format", "json"}, true, `"msg":"key_added","user":"alice","fingerprint":"SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I","path":`},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(tt.statusCode)
-				w.Write([]byte(tt.body))
-			}))
-			defer server.Close()
-
-			// Reset httpGet to use real HTTP
-			origHttpGet := httpGet
-			httpGet = http.Get
-			defer func() { httpGet = origHttpGet }()
-
-			keys, err := fetchKeys(server.URL)
-
-			if tt.expectError {
-				if err == nil {
-					t.Error("expected error")
-				} else if !strings.Contains(err.Error(), tt.errContains) {
-					t.Errorf("expected error containing %q, got %v", tt.errContains, err)
+			e := newTestEnv(t)
+			e.mockKeys(testKey)
+			args := append([]string{"doorman", "add", "alice", "--yes"}, tt.flags...)
+			logFile := filepath.Join(e.home, "doorman.log")
+			if tt.toFile {
+				args = append(args, "--log-file", logFile)
+			}
+
+			if err := run(e.deps, args); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			logged := e.errOut.String()
+			if tt.toFile {
+				if logged != "" {
+					t.Errorf("expected nothing on stderr, got %q", logged)
 				}
-			} else {
+				data, err := os.ReadFile(logFile)
 				if err != nil {
-					t.Errorf("unexpected error: %v", err)
-				}
-				if string(keys) != tt.body {
-					t.Errorf("expected %q, got %q", tt.body, string(keys))
+					t.Fatalf("failed to read log file: %v", err)
 				}
+				logged = string(data)
+			}
+			if tt.expected == "" && logged != "" || !strings.Contains(logged, tt.expected) {
+				t.Errorf("expected log containing %q, got %q", tt.expected, logged)
+			}
+			if !strings.HasSuffix(e.out.String(), "Added 1 key for alice (1 ed25519)\n") {
+				t.Errorf("expected the summary on stdout, got %q", e.out.String())
 			}
 		})
 	}
 }
 
-func TestFetchKeysNetworkError(t *testing.T) {
-	origHttpGet := httpGet
-	httpGet = http.Get
-	defer func() { httpGet = origHttpGet }()
+func TestRunMain(t *testing.T) {
+	e := newTestEnv(t)
 
-	_, err := fetchKeys("http://localhost:99999/invalid")
-	if err == nil {
-		t.Error("expected network error")
+	if code := runMain(e.deps, []string{"doorman"}); code != exitUsage {
+		t.Errorf("expected exit code %d, got %d", exitUsage, code)
+	}
+	if !strings.Contains(e.errOut.String(), "invalid arguments") {
+		t.Errorf("expected error on stderr, got %q", e.errOut.String())
+	}
+	if e.out.Len() != 0 {
+		t.Errorf("expected nothing on stdout, got %q", e.out.String())
 	}
 }
 
-// Tests for appendUsernameToKeys()
-func TestAppendUsernameToKeys(t *testing.T) {
+func TestRunMainExitCodes(t *testing.T) {
 	tests := []struct {
 		name     string
-		keys     string
-		username string
-		expected string
+		args     []string
+		setup    func(e *testEnv)
+		expected int
 	}{
-		{"single key", "ssh-rsa AAAAB3...", "user", "ssh-rsa AAAAB3... user"},
-		{"multiple keys", "ssh-rsa KEY1...\nssh-ed25519 KEY2...", "user", "ssh-rsa KEY1... user\nssh-ed25519 KEY2... user"},
-		{"trailing newline", "ssh-rsa KEY...\n", "user", "ssh-rsa KEY... user"},
-		{"empty lines", "ssh-rsa KEY1...\n\nssh-rsa KEY2...", "user", "ssh-rsa KEY1... user\nssh-rsa KEY2... user"},
-		{"whitespace", "  ssh-rsa KEY...  ", "user", "ssh-rsa KEY... user"},
-		{"empty input", "", "user", ""},
-		{"only whitespace", "   \n   ", "user", ""},
+		{"success", []string{"doorman", "add", "user", "--yes"}, func(e *testEnv) {
+			e.mockKeys("ssh-rsa KEY...")
+		}, exitOK},
+		{"usage", []string{"doorman", "add"}, func(*testEnv) {}, exitUsage},
+		{"unknown flag", []string{"doorman", "--bogus", "add", "user"}, func(*testEnv) {}, exitUsage},
+		{"invalid username", []string{"doorman", "add", "-bad-"}, func(*testEnv) {}, exitUsage},
+		{"invalid action", []string{"doorman", "frobnicate", "user"}, func(e *testEnv) {
+			e.mockKeys("ssh-rsa KEY...")
+		}, exitUsage},
+		{"aborted", []string{"doorman", "add", "user"}, func(e *testEnv) {
+			e.mockKeys("ssh-rsa KEY...")
+			e.mockStdin("no\n")
+		}, exitAborted},
+		{"fetch failure", []string{"doorman", "add", "user"}, func(e *testEnv) {
+			e.mockKeysError(errors.New("network down"))
+		}, exitFetch},
+		{"user not found", []string{"doorman", "add", "user"}, func(e *testEnv) {
+			e.mockKeysError(fmt.Errorf("no keys file for user: %w", doorman.ErrUserNotFound))
+		}, exitUsage},
+		{"no keys", []string{"doorman", "add", "user"}, func(e *testEnv) {
+			e.mockKeys("\n")
+		}, exitNoKeys},
+		{"file error", []string{"doorman", "add", "user", "--yes"}, func(e *testEnv) {
+			e.mockKeys("ssh-rsa KEY...")
+			os.Mkdir(filepath.Join(e.home, ".ssh", "authorized_keys"), 0700)
+		}, exitFile},
+		{"config error", []string{"doorman", "add", "user", "--config", "/nonexistent/config.toml"}, func(*testEnv) {}, exitGeneric},
+		{"unknown provider", []string{"doorman", "add", "user", "--provider", "gitlub"}, func(*testEnv) {}, exitUsage},
+		{"invalid log format", []string{"doorman", "add", "user", "--log-format", "xml"}, func(*testEnv) {}, exitUsage},
+		{"invalid log level", []string{"doorman", "add", "user", "--log-level", "loud"}, func(*testEnv) {}, exitUsage},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := appendUsernameToKeys([]byte(tt.keys), tt.username)
-			if string(result) != tt.expected {
-				t.Errorf("expected %q, got %q", tt.expected, string(result))
+			e := newTestEnv(t)
+			tt.setup(e)
+
+			if code := runMain(e.deps, tt.args); code != tt.expected {
+				t.Errorf("expected exit code %d, got %d", tt.expected, code)
 			}
 		})
 	}
 }
 
-// Tests for removeKeysByUsername()
-func TestRemoveKeysByUsername(t *testing.T) {
+func TestExitCodeFor(t *testing.T) {
 	tests := []struct {
 		name     string
-		keys     string
-		username string
-		expected string
+		err      error
+		expected int
 	}{
-		{"remove single", "ssh-rsa KEY... user", "user", ""},
-		{"remove multiple", "ssh-rsa KEY1... user\nssh-rsa KEY2... other", "user", "ssh-rsa KEY2... other"},
-		{"no match", "ssh-rsa KEY... other", "user", "ssh-rsa KEY... other"},
-		{"partial no match", "ssh-rsa KEY... user123", "user", "ssh-rsa KEY... user123"},
-		{"prefix no match", "ssh-rsa KEY... myuser", "user", "ssh-rsa KEY... myuser"},
-		{"empty", "", "user", ""},
-		{"remove all", "ssh-rsa KEY1... user\nssh-rsa KEY2... user", "user", ""},
+		{"nil", nil, exitOK},
+		{"aborted", fmt.Errorf("wrapped: %w", doorman.ErrAborted), exitAborted},
+		{"interrupted", fmt.Errorf("wrapped: %w", context.Canceled), exitAborted},
+		{"invalid user", doorman.ErrInvalidUser, exitUsage},
+		{"user not found", fmt.Errorf("wrapped: %w", doorman.ErrUserNotFound), exitUsage},
+		{"no keys", fmt.Errorf("wrapped: %w", doorman.ErrNoKeys), exitNoKeys},
+		{"fetch error", &doorman.FetchError{User: "alice", Status: 500}, exitFetch},
+		{"rate limited", &doorman.FetchError{User: "alice", Err: &doorman.RateLimitError{RetryAfter: -1}}, exitFetch},
+		{"file missing", fmt.Errorf("wrapped: %w", doorman.ErrFileMissing), exitFile},
+		{"path error", &fs.PathError{Op: "open", Path: "x", Err: fs.ErrPermission}, exitFile},
+		{"explicit code wins", withExitCode(exitGeneric, &fs.PathError{Op: "open", Path: "x", Err: fs.ErrNotExist}), exitGeneric},
+		{"other", errors.New("boom"), exitGeneric},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := removeKeysByUsername([]byte(tt.keys), tt.username)
-			if string(result) != tt.expected {
-				t.Errorf("expected %q, got %q", tt.expected, string(result))
+			if got := exitCodeFor(tt.err); got != tt.expected {
+				t.Errorf("exitCodeFor(%v) = %d, want %d", tt.err, got, tt.expected)
 			}
 		})
 	}
 }
 
+func TestRunHelp(t *testing.T) {
+	e := newTestEnv(t)
+
+	out := e.out
+	if err := run(e.deps, []string{"doorman", "help", "exit-codes"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range exitCodeDescriptions {
+		if !strings.Contains(out.String(), fmt.Sprintf("%d  %s", c.code, c.description)) {
+			t.Errorf("exit code %d missing from help output", c.code)
+		}
+	}
+
+	out.Reset()
+	if err := run(e.deps, []string{"doorman", "help"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Usage:") {
+		t.Error("expected usage on stdout for explicit help")
+	}
+
+	out.Reset()
+	if err := run(e.deps, []string{"doorman", "help", "providers"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.String() != "file\ngithub\nurl\n" {
+		t.Errorf("unexpected providers %q", out.String())
+	}
+
+	err := run(e.deps, []string{"doorman", "help", "bogus"})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected usage error for unknown topic, got %v", err)
+	}
+}
+
+// Tests for keySource()
+func TestKeySource(t *testing.T) {
+	e := newTestEnv(t)
+	client := httpClient{e.app}
+
+	tests := []struct {
+		name     string
+		opts     options
+		cfg      config
+		expected doorman.KeySource
+		errMsg   string
+	}{
+		{"default", options{}, config{}, doorman.GitHubSource{Client: client}, ""},
+		{"url flag", options{keysURL: "https://keys.example.com/{user}.keys"}, config{}, doorman.URLSource{Template: "https://keys.example.com/{user}.keys", Client: client}, ""},
+		{"keys file setting", options{}, config{KeysFile: "/srv/keys/{user}"}, doorman.FileSource{Path: "/srv/keys/{user}"}, ""},
+		{"flag replaces setting", options{keysFile: "/tmp/keys"}, config{KeysURL: "https://keys.example.com/{user}"}, doorman.FileSource{Path: "/tmp/keys"}, ""},
+		{"both flags", options{keysURL: "https://keys.example.com/{user}", keysFile: "/tmp/keys"}, config{}, nil, "not both"},
+		{"plain http", options{keysURL: "http://keys.example.com/{user}"}, config{}, nil, "only https:// URLs"},
+		{"no placeholder", options{keysURL: "https://keys.example.com/keys"}, config{}, nil, "must contain {user}"},
+		{"provider flag", options{provider: "file", keysFile: "/tmp/keys"}, config{}, doorman.FileSource{Path: "/tmp/keys"}, ""},
+		{"provider setting", options{}, config{Provider: "github"}, doorman.GitHubSource{Client: client}, ""},
+		{"provider flag replaces settings", options{provider: "github"}, config{KeysURL: "https://keys.example.com/{user}"}, doorman.GitHubSource{Client: client}, ""},
+		{"provider conflicts with url", options{provider: "github", keysURL: "https://keys.example.com/{user}"}, config{}, nil, "the github provider can't get keys from"},
+		{"provider without location", options{provider: "file"}, config{}, nil, "needs the path"},
+		{"unknown provider setting", options{}, config{Provider: "gitlub"}, nil, "unknown provider 'gitlub': use one of file, github, url"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e.opts, e.cfg = tt.opts, tt.cfg
+
+			source, err := e.keySource()
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("expected error containing %q, got %v", tt.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			caching, ok := source.(cachingSource)
+			if !ok {
+				t.Fatalf("expected the source to be cached for --offline, got %#v", source)
+			}
+			if caching.KeySource != tt.expected {
+				t.Errorf("expected %#v, got %#v", tt.expected, caching.KeySource)
+			}
+		})
+	}
+}
+
+func TestRunKeysFile(t *testing.T) {
+	e := newTestEnv(t)
+
+	os.WriteFile(filepath.Join(e.home, "alice.pub"), []byte("ssh-ed25519 LOCAL alice@laptop\n"), 0600)
+
+	err := run(e.deps, []string{"doorman", "add", "alice", "--yes", "--keys-file", filepath.Join(e.home, "{user}.pub")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, _ := os.ReadFile(filepath.Join(e.home, ".ssh", "authorized_keys"))
+	if string(content) != "ssh-ed25519 LOCAL alice@laptop alice"+today+"\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	err = run(e.deps, []string{"doorman", "add", "bob", "--yes", "--keys-file", filepath.Join(e.home, "{user}.pub")})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected usage error for a user without a keys file, got %v", err)
+	}
+
+	err = run(e.deps, []string{"doorman", "add", "alice", "--url", "http://insecure.example.com/{user}"})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected usage error for a plain http URL, got %v", err)
+	}
+}
+
 // Tests for getAuthorizedKeysPath()
 func TestGetAuthorizedKeysPath(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+	e := newTestEnv(t)
 
-	path, err := getAuthorizedKeysPath()
+	path, err := e.getAuthorizedKeysPath()
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	expected := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	expected := filepath.Join(e.home, ".ssh", "authorized_keys")
 	if path != expected {
 		t.Errorf("expected %q, got %q", expected, path)
 	}
 }
 
+func TestGetAuthorizedKeysPathPrecedence(t *testing.T) {
+	e := newTestEnv(t)
+
+	out := e.errOut
+	e.opts.verbose = true
+	os.WriteFile(e.sshdConfigPath, []byte("AuthorizedKeysFile .ssh/authorized_keys2\n"), 0644)
+
+	path, _ := e.getAuthorizedKeysPath()
+	if expected := filepath.Join(e.home, ".ssh", "authorized_keys2"); path != expected {
+		t.Errorf("sshd_config: expected %q, got %q", expected, path)
+	}
+	if !strings.Contains(out.String(), "from AuthorizedKeysFile in") {
+		t.Errorf("verbose output should explain the choice, got %q", out.String())
+	}
+
+	e.cfg.AuthorizedKeysFile = "/srv/keys/%u"
+	path, _ = e.getAuthorizedKeysPath()
+	if path != "/srv/keys/tester" {
+		t.Errorf("config: expected %q, got %q", "/srv/keys/tester", path)
+	}
+
+	e.opts.file = "/tmp/explicit"
+	path, _ = e.getAuthorizedKeysPath()
+	if path != "/tmp/explicit" {
+		t.Errorf("--file: expected %q, got %q", "/tmp/explicit", path)
+	}
+}
+
+func TestGetAuthorizedKeysPathSSHDConfigNone(t *testing.T) {
+	e := newTestEnv(t)
+
+	os.WriteFile(e.sshdConfigPath, []byte("AuthorizedKeysFile none\n"), 0644)
+
+	path, err := e.getAuthorizedKeysPath()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := filepath.Join(e.home, ".ssh", "authorized_keys"); path != expected {
+		t.Errorf("expected fallback %q, got %q", expected, path)
+	}
+}
+
 func TestGetAuthorizedKeysPathError(t *testing.T) {
-	origUserCurrent := userCurrent
-	userCurrent = func() (*user.User, error) {
+	e := newTestEnv(t)
+	e.currentUser = func() (*user.User, error) {
 		return nil, errors.New("user error")
 	}
-	defer func() { userCurrent = origUserCurrent }()
 
-	_, err := getAuthorizedKeysPath()
+	_, err := e.getAuthorizedKeysPath()
 	if err == nil {
 		t.Error("expected error")
 	}
@@ -370,14 +884,13 @@ func TestGetAuthorizedKeysPathError(t *testing.T) {
 
 // Tests for ensureSSHDir()
 func TestEnsureSSHDir(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+	e := newTestEnv(t)
 
 	// Remove .ssh to test creation
-	sshDir := filepath.Join(tempDir, ".ssh")
+	sshDir := filepath.Join(e.home, ".ssh")
 	os.RemoveAll(sshDir)
 
-	err := ensureSSHDir()
+	err := e.ensureSSHDir()
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -395,29 +908,62 @@ func TestEnsureSSHDir(t *testing.T) {
 }
 
 func TestEnsureSSHDirExists(t *testing.T) {
-	_, cleanup := setupTestEnv(t)
-	defer cleanup()
+	e := newTestEnv(t)
 
 	// .ssh already exists from setup
-	err := ensureSSHDir()
+	err := e.ensureSSHDir()
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
 
 func TestEnsureSSHDirUserError(t *testing.T) {
-	origUserCurrent := userCurrent
-	userCurrent = func() (*user.User, error) {
+	e := newTestEnv(t)
+	e.currentUser = func() (*user.User, error) {
 		return nil, errors.New("user error")
 	}
-	defer func() { userCurrent = origUserCurrent }()
 
-	err := ensureSSHDir()
+	err := e.ensureSSHDir()
 	if err == nil {
 		t.Error("expected error")
 	}
 }
 
+func TestEnsureSSHDirMissingHome(t *testing.T) {
+	e := newTestEnv(t)
+
+	home := filepath.Join(e.home, "home", "svc")
+	e.currentUser = func() (*user.User, error) {
+		return &user.User{HomeDir: home}, nil
+	}
+
+	err := e.ensureSSHDir()
+	if err == nil || !strings.Contains(err.Error(), "home directory "+home+" does not exist") {
+		t.Fatalf("expected missing home error, got: %v", err)
+	}
+	if exitCodeFor(err) != exitFile {
+		t.Errorf("expected file error exit code, got %d", exitCodeFor(err))
+	}
+	if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Error("home directory should not be created")
+	}
+}
+
+func TestEnsureSSHDirHomeNotDirectory(t *testing.T) {
+	e := newTestEnv(t)
+
+	home := filepath.Join(e.home, "file")
+	os.WriteFile(home, nil, 0600)
+	e.currentUser = func() (*user.User, error) {
+		return &user.User{HomeDir: home}, nil
+	}
+
+	err := e.ensureSSHDir()
+	if err == nil || !strings.Contains(err.Error(), "is not a directory") {
+		t.Fatalf("expected not a directory error, got: %v", err)
+	}
+}
+
 // Tests for promptConfirmation()
 func TestPromptConfirmation(t *testing.T) {
 	tests := []struct {
@@ -428,18 +974,28 @@ func TestPromptConfirmation(t *testing.T) {
 		{"yes", "yes\n", true},
 		{"YES", "YES\n", true},
 		{"Yes", "Yes\n", true},
+		{"y", "y\n", true},
+		{"Y", "Y\n", true},
 		{"yes with space", "  yes  \n", true},
+		{"yes without newline", "yes", true},
 		{"no", "no\n", false},
-		{"empty", "\n", false},
-		{"other", "maybe\n", false},
+		{"n", "n\n", false},
+		{"N", "N\n", false},
+		{"EOF", "", false},
+		{"empty then EOF", "\n", false},
+		{"other then EOF", "maybe\n", false},
+		{"reprompt then yes", "maybe\ny\n", true},
+		{"reprompt then no", "\nno\n", false},
+		{"third attempt yes", "ok\nsure\nyes\n", true},
+		{"three strikes", "ok\nsure\nyep\nyes\n", false},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockStdin(tt.input)
-			mockStdout()
+			e := newTestEnv(t)
+			e.mockStdin(tt.input)
 
-			result, err := promptConfirmation("Test: ")
+			result, err := e.promptConfirmation(context.Background(), "Test: ")
 			if err != nil {
 				t.Errorf("unexpected error: %v", err)
 			}
@@ -450,18 +1006,16 @@ func TestPromptConfirmation(t *testing.T) {
 	}
 }
 
-// Tests for confirmAndAddKeys()
-func TestConfirmAndAddKeysNewFile(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+// Tests for the add action
+func TestAddKeysNewFile(t *testing.T) {
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	// File doesn't exist initially (not created by setup)
 
-	mockStdout()
-	mockStdin("yes\nyes\n") // First for create file, second for add keys
+	e.mockStdin("yes\n")
 
-	err := confirmAndAddKeys([]byte("ssh-rsa AAAAB3..."), "testuser")
+	_, err := e.addKeys(t, "ssh-rsa AAAAB3...", "testuser")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -476,17 +1030,15 @@ func TestConfirmAndAddKeysNewFile(t *testing.T) {
 	}
 }
 
-func TestConfirmAndAddKeysExistingFile(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestAddKeysExistingFile(t *testing.T) {
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	os.WriteFile(authorizedKeysPath, []byte("ssh-rsa EXISTING... existinguser"), 0600)
 
-	mockStdout()
-	mockStdin("yes\n")
+	e.mockStdin("yes\n")
 
-	err := confirmAndAddKeys([]byte("ssh-rsa NEW..."), "newuser")
+	_, err := e.addKeys(t, "ssh-rsa NEW...", "newuser")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -500,46 +1052,37 @@ func TestConfirmAndAddKeysExistingFile(t *testing.T) {
 	}
 }
 
-func TestConfirmAndAddKeysAbortCreate(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestAddKeysAbortCreate(t *testing.T) {
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 
-	out := mockStdout()
-	mockStdin("no\n")
-
-	err := confirmAndAddKeys([]byte("ssh-rsa AAAAB3..."), "testuser")
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
+	e.mockStdin("no\n")
 
-	if !strings.Contains(out.String(), "Operation aborted") {
-		t.Error("expected abort message")
+	_, err := e.addKeys(t, "ssh-rsa AAAAB3...", "testuser")
+	if !errors.Is(err, doorman.ErrAborted) {
+		t.Fatalf("expected doorman.ErrAborted, got: %v", err)
 	}
 
 	if _, err := os.Stat(authorizedKeysPath); !os.IsNotExist(err) {
 		t.Error("file should not be created")
 	}
+	if !strings.Contains(e.out.String(), "The authorized_keys file does not exist and will be created. Do you want to add 1 new key? (yes/no): ") {
+		t.Errorf("expected a single question saying the file will be created, got %q", e.out.String())
+	}
 }
 
-func TestConfirmAndAddKeysAbortAdd(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestAddKeysAbortAdd(t *testing.T) {
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	os.WriteFile(authorizedKeysPath, []byte("existing"), 0600)
 
-	out := mockStdout()
-	mockStdin("no\n")
-
-	err := confirmAndAddKeys([]byte("ssh-rsa AAAAB3..."), "testuser")
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
+	e.mockStdin("no\n")
 
-	if !strings.Contains(out.String(), "Operation aborted") {
-		t.Error("expected abort message")
+	_, err := e.addKeys(t, "ssh-rsa AAAAB3...", "testuser")
+	if !errors.Is(err, doorman.ErrAborted) {
+		t.Fatalf("expected doorman.ErrAborted, got: %v", err)
 	}
 
 	content, _ := os.ReadFile(authorizedKeysPath)
@@ -548,31 +1091,38 @@ func TestConfirmAndAddKeysAbortAdd(t *testing.T) {
 	}
 }
 
-func TestConfirmAndAddKeysUserError(t *testing.T) {
-	origUserCurrent := userCurrent
-	userCurrent = func() (*user.User, error) {
-		return nil, errors.New("user error")
+func TestAddKeysMemoryStore(t *testing.T) {
+	e := newTestEnv(t)
+
+	store := doorman.NewMemoryStore(doorman.Entry{Line: "ssh-rsa EXISTING... bob"})
+
+	e.mockStdin("yes\n")
+
+	manager := e.newManager(doorman.WithSource(fakeSource{keys: parseKeys("ssh-rsa NEW...")}), doorman.WithStore(store))
+	summary, err := manager.Add(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(summary.Added) != 1 {
+		t.Errorf("expected 1 added key, got %d", len(summary.Added))
 	}
-	defer func() { userCurrent = origUserCurrent }()
 
-	mockStdout()
-	err := confirmAndAddKeys([]byte("ssh-rsa AAAAB3..."), "testuser")
-	if err == nil {
-		t.Error("expected error")
+	entries, _ := store.Load()
+	expected := []doorman.Entry{{Line: "ssh-rsa EXISTING... bob"}, {Line: "ssh-rsa NEW... alice" + today}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %v, got %v", expected, entries)
 	}
 }
 
-func TestConfirmAndAddKeysEmptyExistingFile(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestAddKeysEmptyExistingFile(t *testing.T) {
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	os.WriteFile(authorizedKeysPath, []byte(""), 0600)
 
-	mockStdout()
-	mockStdin("yes\n")
+	e.mockStdin("yes\n")
 
-	err := confirmAndAddKeys([]byte("ssh-rsa AAAAB3..."), "testuser")
+	_, err := e.addKeys(t, "ssh-rsa AAAAB3...", "testuser")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -583,18 +1133,16 @@ func TestConfirmAndAddKeysEmptyExistingFile(t *testing.T) {
 	}
 }
 
-// Tests for confirmAndRemoveKeys()
-func TestConfirmAndRemoveKeysSuccess(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+// Tests for the remove action
+func TestRemoveKeysSuccess(t *testing.T) {
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	os.WriteFile(authorizedKeysPath, []byte("ssh-rsa KEY1... user1\nssh-rsa KEY2... user2"), 0600)
 
-	mockStdout()
-	mockStdin("yes\n")
+	e.mockStdin("yes\n")
 
-	err := confirmAndRemoveKeys([]byte("ssh-rsa KEY1..."), "user1")
+	_, err := e.removeKeys(t, "ssh-rsa KEY1...", "user1")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -608,44 +1156,37 @@ func TestConfirmAndRemoveKeysSuccess(t *testing.T) {
 	}
 }
 
-func TestConfirmAndRemoveKeysNoFile(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestRemoveKeysNoFile(t *testing.T) {
+	e := newTestEnv(t)
 
 	// Don't create authorized_keys
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	os.Remove(authorizedKeysPath)
 
-	out := mockStdout()
+	errOut := e.errOut
 
-	err := confirmAndRemoveKeys([]byte("ssh-rsa KEY..."), "user")
-	if err != nil {
+	e.mockKeys("ssh-rsa KEY...")
+	if err := run(e.deps, []string{"doorman", "remove", "user"}); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if !strings.Contains(out.String(), "does not exist") {
-		t.Error("expected 'does not exist' message")
+	if !strings.Contains(errOut.String(), "does not exist") {
+		t.Error("expected 'does not exist' warning on stderr")
 	}
 }
 
-func TestConfirmAndRemoveKeysAbort(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestRemoveKeysAbort(t *testing.T) {
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	original := "ssh-rsa KEY... user"
 	os.WriteFile(authorizedKeysPath, []byte(original), 0600)
 
-	out := mockStdout()
-	mockStdin("no\n")
-
-	err := confirmAndRemoveKeys([]byte("ssh-rsa KEY..."), "user")
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
+	e.mockStdin("no\n")
 
-	if !strings.Contains(out.String(), "Operation aborted") {
-		t.Error("expected abort message")
+	_, err := e.removeKeys(t, "ssh-rsa KEY...", "user")
+	if !errors.Is(err, doorman.ErrAborted) {
+		t.Fatalf("expected doorman.ErrAborted, got: %v", err)
 	}
 
 	content, _ := os.ReadFile(authorizedKeysPath)
@@ -654,43 +1195,37 @@ func TestConfirmAndRemoveKeysAbort(t *testing.T) {
 	}
 }
 
-func TestConfirmAndRemoveKeysUserError(t *testing.T) {
-	origUserCurrent := userCurrent
-	userCurrent = func() (*user.User, error) {
+func TestKeyStoreUserError(t *testing.T) {
+	e := newTestEnv(t)
+	e.currentUser = func() (*user.User, error) {
 		return nil, errors.New("user error")
 	}
-	defer func() { userCurrent = origUserCurrent }()
 
-	mockStdout()
-	err := confirmAndRemoveKeys([]byte("ssh-rsa KEY..."), "user")
-	if err == nil {
+	if _, err := e.keyStore(); err == nil {
 		t.Error("expected error")
 	}
 }
 
 // Integration tests
 func TestIntegrationFullFlow(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 
 	// Add user1
-	mockStdout()
-	mockHttpGet(http.StatusOK, "ssh-rsa KEY1...")
-	mockStdin("yes\nyes\n")
+	e.mockKeys("ssh-rsa KEY1...")
+	e.mockStdin("yes\n")
 
-	err := run([]string{"doorman", "add", "user1"})
+	err := run(e.deps, []string{"doorman", "add", "user1"})
 	if err != nil {
 		t.Fatalf("add user1 failed: %v", err)
 	}
 
 	// Add user2
-	mockStdout()
-	mockHttpGet(http.StatusOK, "ssh-rsa KEY2...")
-	mockStdin("yes\n")
+	e.mockKeys("ssh-rsa KEY2...")
+	e.mockStdin("yes\n")
 
-	err = run([]string{"doorman", "add", "user2"})
+	err = run(e.deps, []string{"doorman", "add", "user2"})
 	if err != nil {
 		t.Fatalf("add user2 failed: %v", err)
 	}
@@ -702,11 +1237,10 @@ func TestIntegrationFullFlow(t *testing.T) {
 	}
 
 	// Remove user1
-	mockStdout()
-	mockHttpGet(http.StatusOK, "ssh-rsa KEY1...")
-	mockStdin("yes\n")
+	e.mockKeys("ssh-rsa KEY1...")
+	e.mockStdin("yes\n")
 
-	err = run([]string{"doorman", "remove", "user1"})
+	err = run(e.deps, []string{"doorman", "remove", "user1"})
 	if err != nil {
 		t.Fatalf("remove user1 failed: %v", err)
 	}
@@ -722,29 +1256,16 @@ func TestIntegrationFullFlow(t *testing.T) {
 }
 
 // Edge case tests
-func TestConfirmAndAddKeysEnsureSSHDirError(t *testing.T) {
-	// Save originals
-	origUserCurrent := userCurrent
-	origStdin := stdin
-	origStdout := stdout
-
-	defer func() {
-		userCurrent = origUserCurrent
-		stdin = origStdin
-		stdout = origStdout
-		resetStdinReader()
-	}()
+func TestAddKeysEnsureSSHDirError(t *testing.T) {
+	e := newTestEnv(t)
 
 	// Use a path where we can't create directories
-	userCurrent = func() (*user.User, error) {
+	e.currentUser = func() (*user.User, error) {
 		return &user.User{HomeDir: "/nonexistent/path/that/does/not/exist"}, nil
 	}
+	e.mockStdin("yes\n")
 
-	stdout = &bytes.Buffer{}
-	stdin = strings.NewReader("yes\nyes\n")
-	resetStdinReader()
-
-	err := confirmAndAddKeys([]byte("ssh-rsa KEY..."), "user")
+	_, err := e.addKeys(t, "ssh-rsa KEY...", "user")
 	if err == nil {
 		t.Error("expected error when ensureSSHDir fails")
 	}
@@ -752,95 +1273,71 @@ func TestConfirmAndAddKeysEnsureSSHDirError(t *testing.T) {
 
 // Test error paths for run()
 func TestRunAddError(t *testing.T) {
-	// Save originals
-	origUserCurrent := userCurrent
-	origStdin := stdin
-	origStdout := stdout
-	origHttpGet := httpGet
-
-	defer func() {
-		userCurrent = origUserCurrent
-		stdin = origStdin
-		stdout = origStdout
-		httpGet = origHttpGet
-		resetStdinReader()
-	}()
-
-	// Mock to fail during confirmAndAddKeys
-	userCurrent = func() (*user.User, error) {
+	e := newTestEnv(t)
+	// Keep config loading independent of the failing user lookup
+	e.env["XDG_CONFIG_HOME"] = t.TempDir()
+
+	// Fail while locating authorized_keys
+	e.currentUser = func() (*user.User, error) {
 		return nil, errors.New("user lookup failed")
 	}
-	httpGet = func(url string) (*http.Response, error) {
-		return &http.Response{
-			StatusCode: http.StatusOK,
-			Body:       io.NopCloser(strings.NewReader("ssh-rsa KEY...")),
-		}, nil
-	}
-	stdout = &bytes.Buffer{}
-	stdin = strings.NewReader("yes\n")
-	resetStdinReader()
+	e.mockKeys("ssh-rsa KEY...")
+	e.mockStdin("yes\n")
 
-	err := run([]string{"doorman", "add", "user"})
+	err := run(e.deps, []string{"doorman", "add", "user"})
 	if err == nil {
-		t.Error("expected error when confirmAndAddKeys fails")
+		t.Error("expected error when authorized_keys cannot be located")
 	}
-	if !strings.Contains(err.Error(), "error adding keys") {
-		t.Errorf("expected 'error adding keys' error, got: %v", err)
+	if !strings.Contains(err.Error(), "error locating authorized_keys") {
+		t.Errorf("expected 'error locating authorized_keys' error, got: %v", err)
 	}
 }
 
 func TestRunRemoveError(t *testing.T) {
-	// Save originals
-	origUserCurrent := userCurrent
-	origStdin := stdin
-	origStdout := stdout
-	origHttpGet := httpGet
-
-	defer func() {
-		userCurrent = origUserCurrent
-		stdin = origStdin
-		stdout = origStdout
-		httpGet = origHttpGet
-		resetStdinReader()
-	}()
-
-	// Mock to fail during confirmAndRemoveKeys
-	userCurrent = func() (*user.User, error) {
+	e := newTestEnv(t)
+	// Keep config loading independent of the failing user lookup
+	e.env["XDG_CONFIG_HOME"] = t.TempDir()
+
+	// Fail while locating authorized_keys
+	e.currentUser = func() (*user.User, error) {
 		return nil, errors.New("user lookup failed")
 	}
-	httpGet = func(url string) (*http.Response, error) {
-		return &http.Response{
-			StatusCode: http.StatusOK,
-			Body:       io.NopCloser(strings.NewReader("ssh-rsa KEY...")),
-		}, nil
-	}
-	stdout = &bytes.Buffer{}
+	e.mockKeys("ssh-rsa KEY...")
+	e.mockStdin("yes\n")
 
-	err := run([]string{"doorman", "remove", "user"})
+	err := run(e.deps, []string{"doorman", "remove", "user"})
 	if err == nil {
-		t.Error("expected error when confirmAndRemoveKeys fails")
+		t.Error("expected error when authorized_keys cannot be located")
 	}
-	if !strings.Contains(err.Error(), "error removing keys") {
-		t.Errorf("expected 'error removing keys' error, got: %v", err)
+	if !strings.Contains(err.Error(), "error locating authorized_keys") {
+		t.Errorf("expected 'error locating authorized_keys' error, got: %v", err)
 	}
 }
 
-// Test io.ReadAll error in fetchKeys
-func TestFetchKeysReadError(t *testing.T) {
-	origHttpGet := httpGet
-	defer func() { httpGet = origHttpGet }()
+func TestPromptConfirmationReprompt(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.mockStdin("maybe\nok\nwhat\nyes\n")
+	out := e.out
 
-	// Create a reader that fails after some reads
-	httpGet = func(url string) (*http.Response, error) {
-		return &http.Response{
-			StatusCode: http.StatusOK,
-			Body:       io.NopCloser(&errorReader{}),
-		}, nil
+	result, err := e.promptConfirmation(context.Background(), "Test: ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result {
+		t.Error("expected decline after three unrecognized answers")
+	}
+	if n := strings.Count(out.String(), "Test: "); n != maxPromptAttempts {
+		t.Errorf("expected %d prompts, got %d", maxPromptAttempts, n)
+	}
+	if n := strings.Count(out.String(), "Please answer yes or no."); n != maxPromptAttempts-1 {
+		t.Errorf("expected %d re-prompt hints, got %d", maxPromptAttempts-1, n)
 	}
 
-	_, err := fetchKeys("http://example.com/test.keys")
-	if err == nil {
-		t.Error("expected read error")
+	// The unused answer is left for the next prompt
+	result, _ = e.promptConfirmation(context.Background(), "Again: ")
+	if !result {
+		t.Error("expected remaining input to be read by the next prompt")
 	}
 }
 
@@ -852,58 +1349,71 @@ func (e *errorReader) Read(p []byte) (n int, err error) {
 
 // Test promptConfirmation with read error
 func TestPromptConfirmationReadError(t *testing.T) {
-	origStdin := stdin
-	origStdout := stdout
+	e := newTestEnv(t)
+	e.stdin = bufio.NewReader(&errorReader{})
 
-	defer func() {
-		stdin = origStdin
-		stdout = origStdout
-		resetStdinReader()
-	}()
-
-	// Use a reader that returns an error
-	stdin = &errorReader{}
-	stdout = &bytes.Buffer{}
-	resetStdinReader()
-
-	_, err := promptConfirmation("Test: ")
+	_, err := e.promptConfirmation(context.Background(), "Test: ")
 	if err == nil {
 		t.Error("expected read error")
 	}
 }
 
-// Test confirmAndAddKeys with prompt error
-func TestConfirmAndAddKeysPromptError(t *testing.T) {
-	_, cleanup := setupTestEnv(t)
-	defer cleanup()
+func TestPromptConfirmationDeadline(t *testing.T) {
+	e := newTestEnv(t)
+
+	// Nothing is ever typed
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	e.stdin = bufio.NewReader(reader)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := e.promptConfirmation(ctx, "Test: ")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to abort the prompt, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %s to give up", elapsed)
+	}
+}
+
+func TestActionErrorInterrupted(t *testing.T) {
+	err := actionError("add", fmt.Errorf("reading answer: %w", context.Canceled), time.Now())
+	if !strings.HasPrefix(err.Error(), "interrupted; authorized_keys was not changed") {
+		t.Errorf("unexpected message: %v", err)
+	}
+	if exitCodeFor(err) != exitAborted {
+		t.Errorf("expected exit code %d, got %d", exitAborted, exitCodeFor(err))
+	}
+}
+
+// Test adding keys with prompt error
+func TestAddKeysPromptError(t *testing.T) {
+	e := newTestEnv(t)
 
 	// File doesn't exist, so first prompt will be called
 	// Use error reader for stdin
-	stdin = &errorReader{}
-	resetStdinReader()
-	mockStdout()
+	e.stdin = bufio.NewReader(&errorReader{})
 
-	err := confirmAndAddKeys([]byte("ssh-rsa KEY..."), "user")
+	_, err := e.addKeys(t, "ssh-rsa KEY...", "user")
 	if err == nil {
 		t.Error("expected prompt error")
 	}
 }
 
-// Test confirmAndAddKeys with second prompt error
-func TestConfirmAndAddKeysSecondPromptError(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+// Test adding keys with second prompt error
+func TestAddKeysSecondPromptError(t *testing.T) {
+	e := newTestEnv(t)
 
 	// Create file so we skip first prompt
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	_ = os.WriteFile(authorizedKeysPath, []byte("existing"), 0600)
 
 	// First read succeeds (would show keys), then error
-	stdin = &limitedErrorReader{remaining: 0}
-	resetStdinReader()
-	mockStdout()
+	e.stdin = bufio.NewReader(&limitedErrorReader{remaining: 0})
 
-	err := confirmAndAddKeys([]byte("ssh-rsa KEY..."), "user")
+	_, err := e.addKeys(t, "ssh-rsa KEY...", "user")
 	if err == nil {
 		t.Error("expected prompt error")
 	}
@@ -922,110 +1432,90 @@ func (l *limitedErrorReader) Read(p []byte) (n int, err error) {
 	return 0, errors.New("read error")
 }
 
-// Test confirmAndAddKeys with file stat error after write prompt
-func TestConfirmAndAddKeysStatError(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+// Test adding keys with file stat error after write prompt
+func TestAddKeysStatError(t *testing.T) {
+	e := newTestEnv(t)
 
 	// Create file then make it unreadable
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	os.WriteFile(authorizedKeysPath, []byte("existing"), 0600)
 
-	mockStdout()
-	mockStdin("yes\n")
+	e.mockStdin("yes\n")
 
 	// Make file unwritable after confirmation
 	os.Chmod(authorizedKeysPath, 0000)
 	defer os.Chmod(authorizedKeysPath, 0600) // Restore for cleanup
 
-	err := confirmAndAddKeys([]byte("ssh-rsa KEY..."), "user")
+	_, err := e.addKeys(t, "ssh-rsa KEY...", "user")
 	if err == nil {
 		t.Error("expected file write error")
 	}
 }
 
-// Test confirmAndRemoveKeys with prompt error
-func TestConfirmAndRemoveKeysPromptError(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+// Test removing keys with prompt error
+func TestRemoveKeysPromptError(t *testing.T) {
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	os.WriteFile(authorizedKeysPath, []byte("ssh-rsa KEY... user"), 0600)
 
-	stdin = &errorReader{}
-	resetStdinReader()
-	mockStdout()
+	e.stdin = bufio.NewReader(&errorReader{})
 
-	err := confirmAndRemoveKeys([]byte("ssh-rsa KEY..."), "user")
+	_, err := e.removeKeys(t, "ssh-rsa KEY...", "user")
 	if err == nil {
 		t.Error("expected prompt error")
 	}
 }
 
-// Test confirmAndRemoveKeys with file read error
-func TestConfirmAndRemoveKeysReadError(t *testing.T) {
-	tempDir, cleanup := setupTestEnv(t)
-	defer cleanup()
+// Test removing keys with file read error
+func TestRemoveKeysReadError(t *testing.T) {
+	e := newTestEnv(t)
 
-	authorizedKeysPath := filepath.Join(tempDir, ".ssh", "authorized_keys")
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
 	os.WriteFile(authorizedKeysPath, []byte("ssh-rsa KEY... user"), 0600)
 
-	mockStdout()
-	mockStdin("yes\n")
+	e.mockStdin("yes\n")
 
 	// Make file unreadable after confirmation check
 	os.Chmod(authorizedKeysPath, 0000)
 	defer os.Chmod(authorizedKeysPath, 0600)
 
-	err := confirmAndRemoveKeys([]byte("ssh-rsa KEY..."), "user")
+	_, err := e.removeKeys(t, "ssh-rsa KEY...", "user")
 	if err == nil {
 		t.Error("expected file read error")
 	}
 }
 
-// Benchmarks
-func BenchmarkAppendUsernameToKeys(b *testing.B) {
-	keys := []byte("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQC...\nssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI...")
-	for i := 0; i < b.N; i++ {
-		appendUsernameToKeys(keys, "testuser")
+func TestRunHomeDir(t *testing.T) {
+	e := newTestEnv(t)
+	e.currentUser = func() (*user.User, error) {
+		t.Fatal("expected --home-dir not to look up the current user")
+		return nil, nil
 	}
-}
-
-func BenchmarkRemoveKeysByUsername(b *testing.B) {
-	keys := []byte("ssh-rsa KEY1... user1\nssh-rsa KEY2... user2\nssh-rsa KEY3... user1\nssh-rsa KEY4... user3")
-	for i := 0; i < b.N; i++ {
-		removeKeysByUsername(keys, "user1")
+	writeFile(t, e.sshdConfigPath, "AuthorizedKeysFile /etc/ssh/keys/%u\n")
+	image := t.TempDir()
+	home := filepath.Join(image, "home", "admin")
+	if err := os.MkdirAll(home, 0755); err != nil {
+		t.Fatal(err)
 	}
-}
-
-// Test HTTP integration with real server
-func TestFetchKeysWithServer(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/testuser.keys" {
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprint(w, "ssh-rsa KEY...")
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-		}
-	}))
-	defer server.Close()
-
-	origHttpGet := httpGet
-	httpGet = http.Get
-	defer func() { httpGet = origHttpGet }()
+	e.mockKeys(testKey)
 
-	// Success
-	keys, err := fetchKeys(server.URL + "/testuser.keys")
-	if err != nil {
+	if err := run(e.deps, []string{"doorman", "add", "alice", "--home-dir", home, "--yes"}); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if string(keys) != "ssh-rsa KEY..." {
-		t.Errorf("unexpected keys: %q", keys)
+	path := filepath.Join(home, ".ssh", "authorized_keys")
+	if content := readFile(t, path); !strings.HasSuffix(content, " alice"+today+"\n") {
+		t.Errorf("unexpected content %q", content)
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || info.Mode().Perm() != 0700 && runtime.GOOS != "windows" {
+		t.Errorf("expected .ssh to be created with mode 0700, got %v %v", info, err)
 	}
 
-	// 404
-	_, err = fetchKeys(server.URL + "/nonexistent.keys")
-	if err == nil {
-		t.Error("expected error for 404")
+	err := run(e.deps, []string{"doorman", "add", "alice", "--home-dir", filepath.Join(image, "home", "nobody"), "--yes"})
+	if err == nil || exitCodeFor(err) != exitFile {
+		t.Errorf("expected a missing home directory to be a file error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(image, "home", "nobody")); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("expected the missing home directory not to be created")
 	}
 }
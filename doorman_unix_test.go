@@ -0,0 +1,64 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestEnsureSSHDirRestrictiveUmask(t *testing.T) {
+	e := newTestEnv(t)
+
+	sshDir := filepath.Join(e.home, ".ssh")
+	os.RemoveAll(sshDir)
+
+	oldMask := syscall.Umask(0277)
+	defer syscall.Umask(oldMask)
+
+	if err := e.ensureSSHDir(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	info, err := os.Stat(sshDir)
+	if err != nil {
+		t.Fatalf("ssh dir not created: %v", err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("expected permissions 0700, got %o", info.Mode().Perm())
+	}
+}
+
+func TestRunRefusesSymlinks(t *testing.T) {
+	e := newTestEnv(t)
+	e.source = userSource{"alice": testKey}
+	sshDir := filepath.Join(e.home, ".ssh")
+	target := filepath.Join(e.home, "elsewhere")
+	writeFile(t, target, "")
+	if err := os.Symlink(target, filepath.Join(sshDir, "authorized_keys")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := run(e.deps, []string{"doorman", "--yes", "add", "alice"})
+	if exitCodeFor(err) != exitFile || !strings.Contains(err.Error(), "authorized_keys is a symlink") {
+		t.Errorf("expected a symlinked authorized_keys to be refused, got %v", err)
+	}
+
+	os.RemoveAll(sshDir)
+	if err := os.Mkdir(target+"-dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target+"-dir", sshDir); err != nil {
+		t.Fatal(err)
+	}
+	err = run(e.deps, []string{"doorman", "--yes", "add", "alice"})
+	if exitCodeFor(err) != exitFile || !strings.Contains(err.Error(), ".ssh is a symlink") {
+		t.Errorf("expected a symlinked .ssh to be refused, got %v", err)
+	}
+	if content := readFile(t, target); content != "" {
+		t.Errorf("expected nothing written through the symlink, got %q", content)
+	}
+}
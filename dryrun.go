@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// diffContext is how many unchanged lines surround each hunk of a patch,
+// as diff -u gives
+const diffContext = 3
+
+// dryRunStore stands in for a store with --dry-run: it reads the file, but
+// keeps what would be saved to itself, so the file is never written while
+// later users of the same run still see the changes made for earlier ones.
+type dryRunStore struct {
+	doorman.KeyStore
+	// local is set when the file can be read directly, for its exact bytes
+	local bool
+
+	loaded  bool
+	before  []byte
+	exists  bool
+	pending []doorman.Entry
+	saved   bool
+}
+
+// dryRunStore returns store as --dry-run leaves it: unchanged without it,
+// or wrapped so nothing is saved, and remembered for --patch.
+func (a *app) dryRunStore(store doorman.KeyStore) doorman.KeyStore {
+	if !a.opts.dryRun {
+		return store
+	}
+	dry := &dryRunStore{KeyStore: store, local: a.opts.host == ""}
+	a.dryRuns = append(a.dryRuns, dry)
+	return dry
+}
+
+func (s *dryRunStore) Load() ([]doorman.Entry, error) {
+	if s.saved {
+		return slices.Clone(s.pending), nil
+	}
+	entries, err := s.KeyStore.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if !s.loaded {
+		s.loaded, s.exists = true, err == nil
+		s.before = doorman.FormatEntries(entries)
+		// BEHAVIOR: The patch applies to the file as it is, whose line
+		// endings doorman may rewrite, so its own bytes are compared
+		if s.local && s.exists {
+			if data, err := os.ReadFile(s.Path()); err == nil {
+				s.before = data
+			}
+		}
+	}
+	return entries, err
+}
+
+func (s *dryRunStore) Save(entries []doorman.Entry) error {
+	s.pending, s.saved = slices.Clone(entries), true
+	return nil
+}
+
+// writePatch writes the changes --dry-run kept from each file to the path
+// --patch names, as a unified diff of them all.
+func (a *app) writePatch() error {
+	var patch bytes.Buffer
+	for _, dry := range a.dryRuns {
+		if !dry.saved {
+			continue
+		}
+		path := storePath(dry.KeyStore)
+		from := path
+		if !dry.exists {
+			from = "/dev/null"
+		}
+		writeUnifiedDiff(&patch, from, path, dry.before, doorman.FormatEntries(dry.pending))
+	}
+	if err := os.WriteFile(a.opts.patch, patch.Bytes(), 0644); err != nil {
+		return withExitCode(exitFile, fmt.Errorf("error writing patch: %w", err))
+	}
+	if patch.Len() == 0 {
+		fmt.Fprintf(a.stdout, "Nothing would change; %s is empty\n", a.opts.patch)
+		return nil
+	}
+	fmt.Fprintf(a.stdout, "Wrote the change to %s; apply it with: patch -p0 -d / < %s\n", a.opts.patch, a.opts.patch)
+	return nil
+}
+
+// writeUnifiedDiff writes the difference between before and after to w as
+// diff -u does, with the file named from before and to after, or nothing
+// if they are the same.
+func writeUnifiedDiff(w io.Writer, from, to string, before, after []byte) {
+	a, b := splitLines(before), splitLines(after)
+	ops := editScript(a, b)
+	var changes []int
+	for i, op := range ops {
+		if op != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", from, to)
+
+	// Lines of a and b before each op
+	aLine, bLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if op != '+' {
+			aLine[i+1]++
+		}
+		if op != '-' {
+			bLine[i+1]++
+		}
+	}
+	for first := 0; first < len(changes); {
+		last := first
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext {
+			last++
+		}
+		start := max(changes[first]-diffContext, 0)
+		end := min(changes[last]+diffContext+1, len(ops))
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(aLine[start], aLine[end]-aLine[start]), hunkRange(bLine[start], bLine[end]-bLine[start]))
+		for i := start; i < end; i++ {
+			var line string
+			if ops[i] == '+' {
+				line = b[bLine[i]]
+			} else {
+				line = a[aLine[i]]
+			}
+			fmt.Fprintf(w, "%c%s", ops[i], line)
+			if !strings.HasSuffix(line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		first = last + 1
+	}
+}
+
+// hunkRange formats the lines of a hunk that start after line before, as
+// diff -u does: "3,2", "3" for a single line, or "2,0" for none.
+func hunkRange(before, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprint(before + 1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// splitLines splits text into lines that keep their "\n", so a last line
+// without one differs from the same line with it.
+func splitLines(text []byte) []string {
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// editScript returns the shortest way to turn a into b, an op for each line
+// of either: ' ' for a line kept, '-' for a line of a deleted and '+' for a
+// line of b added, with deletions before additions. The lines the two begin
+// and end with in common are set aside first, as changes to authorized_keys
+// are mostly small and in one place.
+func editScript(a, b []string) []byte {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// common[i][j] is the length of the longest common subsequence of
+	// ma[i:] and mb[j:]
+	common := make([][]int32, len(ma)+1)
+	for i := range common {
+		common[i] = make([]int32, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	ops := bytes.Repeat([]byte{' '}, prefix)
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			ops = append(ops, ' ')
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || common[i+1][j] >= common[i][j+1]):
+			ops = append(ops, '-')
+			i++
+		default:
+			ops = append(ops, '+')
+			j++
+		}
+	}
+	return append(ops, bytes.Repeat([]byte{' '}, suffix)...)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// applyPatch applies patch with patch -p0 -d /, as doorman says to, skipping
+// the test where patch isn't installed.
+func applyPatch(t *testing.T, patch string) {
+	t.Helper()
+	if _, err := exec.LookPath("patch"); err != nil {
+		t.Skip("patch is not installed")
+	}
+	cmd := exec.Command("patch", "-p0", "-d", "/", "--batch", "--silent")
+	cmd.Stdin = strings.NewReader(patch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("patch failed: %v\n%s\npatch:\n%s", err, out, patch)
+	}
+}
+
+func TestRunSyncDryRunPatch(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	var original strings.Builder
+	for _, user := range []string{"ann", "ben", "cat", "dan"} {
+		original.WriteString("ssh-ed25519 " + strings.ToUpper(user) + "... " + user + "\n")
+	}
+	original.WriteString("ssh-rsa OLD... alice\n")
+	for _, user := range []string{"eve", "fay", "gus", "hal", "ivy"} {
+		original.WriteString("ssh-ed25519 " + strings.ToUpper(user) + "... " + user + "\n")
+	}
+	writeFile(t, path, original.String())
+	e.mockKeys("ssh-ed25519 NEW...")
+	patchPath := filepath.Join(e.home, "alice.patch")
+
+	if err := run(e.deps, []string{"doorman", "sync", "alice", "--dry-run", "--patch", patchPath}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != original.String() {
+		t.Fatalf("expected --dry-run to leave authorized_keys alone, got %q", content)
+	}
+	for _, expected := range []string{
+		"-  5  ssh-rsa OLD... alice\n",
+		"Synced keys for alice: added 1 (1 ed25519), removed 1 (1 rsa) (--dry-run, nothing written)\n",
+		"Wrote the change to " + patchPath + "; apply it with: patch -p0 -d / < " + patchPath + "\n",
+	} {
+		if !strings.Contains(e.out.String(), expected) {
+			t.Errorf("expected %q in output, got\n%s", expected, e.out.String())
+		}
+	}
+	patch := readFile(t, patchPath)
+	expected := "--- " + path + "\n+++ " + path + "\n" +
+		"@@ -2,9 +2,9 @@\n ssh-ed25519 BEN... ben\n ssh-ed25519 CAT... cat\n ssh-ed25519 DAN... dan\n-ssh-rsa OLD... alice\n" +
+		" ssh-ed25519 EVE... eve\n ssh-ed25519 FAY... fay\n ssh-ed25519 GUS... gus\n ssh-ed25519 HAL... hal\n ssh-ed25519 IVY... ivy\n" +
+		"+ssh-ed25519 NEW... alice" + today + "\n"
+	if patch != expected {
+		t.Errorf("expected patch\n%s\ngot\n%s", expected, patch)
+	}
+
+	// The patch makes the change sync would have made
+	synced := filepath.Join(e.home, "synced")
+	writeFile(t, synced, original.String())
+	if err := run(e.deps, []string{"doorman", "sync", "alice", "--file", synced, "--yes"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	applyPatch(t, patch)
+	if content, want := readFile(t, path), readFile(t, synced); content != want {
+		t.Errorf("expected the patched file to be\n%s\ngot\n%s", want, content)
+	}
+}
+
+func TestRunDryRunPatchNewFile(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	e.mockKeys("ssh-ed25519 NEW...")
+	patchPath := filepath.Join(e.home, "alice.patch")
+
+	if err := run(e.deps, []string{"doorman", "add", "alice", "--dry-run", "--patch", patchPath}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected --dry-run not to create authorized_keys, got %v", err)
+	}
+	patch := readFile(t, patchPath)
+	expected := "--- /dev/null\n+++ " + path + "\n@@ -0,0 +1 @@\n+ssh-ed25519 NEW... alice" + today + "\n"
+	if patch != expected {
+		t.Errorf("expected patch\n%s\ngot\n%s", expected, patch)
+	}
+	applyPatch(t, patch)
+	if content := readFile(t, path); content != "ssh-ed25519 NEW... alice"+today+"\n" {
+		t.Errorf("unexpected patched file %q", content)
+	}
+}
+
+func TestRunDryRunPatchUnchanged(t *testing.T) {
+	e := newTestEnv(t)
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), "ssh-ed25519 NEW... alice\n")
+	e.mockKeys("ssh-ed25519 NEW...")
+	patchPath := filepath.Join(e.home, "alice.patch")
+
+	if err := run(e.deps, []string{"doorman", "sync", "alice", "--dry-run", "--patch", patchPath}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if patch := readFile(t, patchPath); patch != "" {
+		t.Errorf("expected an empty patch, got %q", patch)
+	}
+	if !strings.Contains(e.out.String(), "Nothing would change; "+patchPath+" is empty\n") {
+		t.Errorf("expected the empty patch to be reported, got %q", e.out.String())
+	}
+}
+
+func TestRunPatchNeedsDryRun(t *testing.T) {
+	e := newTestEnv(t)
+	for _, args := range [][]string{
+		{"sync", "alice", "--patch", "alice.patch"},
+		{"fix-perms", "--dry-run", "--patch", "alice.patch"},
+		{"list", "--dry-run"},
+	} {
+		err := run(e.deps, append([]string{"doorman"}, args...))
+		if exitCodeFor(err) != exitUsage {
+			t.Errorf("%v: expected exit code %d, got %v", args, exitUsage, err)
+		}
+	}
+}
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		before string
+		after  string
+	}{
+		{"append", "a\nb\n", "a\nb\nc\n"},
+		{"no newline at end", "a\nb", "a\nb\nc\n"},
+		{"crlf", "a\r\nb\r\n", "a\nb\n"},
+		{"two hunks", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n", "1\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n"},
+		{"rewritten in place", "a\nb\nc\n", "a\n# b\nc\n"},
+		{"emptied", "a\nb\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "authorized_keys")
+			writeFile(t, path, tt.before)
+			var patch bytes.Buffer
+			writeUnifiedDiff(&patch, path, path, []byte(tt.before), []byte(tt.after))
+			applyPatch(t, patch.String())
+			if content := readFile(t, path); content != tt.after {
+				t.Errorf("expected %q after patching, got %q\npatch:\n%s", tt.after, content, patch.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// duplicateKey is a key on more than one line of authorized_keys.
+type duplicateKey struct {
+	key   doorman.Key
+	lines []duplicateLine
+}
+
+// duplicateLine is one of the lines a duplicateKey is on, with the user
+// it is labeled with there.
+type duplicateLine struct {
+	line int
+	user string
+	key  doorman.Key
+}
+
+// duplicateKeys returns the keys in entries that are on more than one
+// line, whatever their options and comments, in order of their first
+// line. Keys are the same when their KeyIDs are, as when sync and remove
+// match them.
+func (a *app) duplicateKeys(entries []doorman.Entry) []duplicateKey {
+	byID := make(map[doorman.KeyID]int)
+	var keys []duplicateKey
+	for i, entry := range entries {
+		key, ok := entry.Key()
+		if !ok {
+			continue
+		}
+		line := duplicateLine{line: i + 1, user: a.keyUser(key), key: key}
+		if j, seen := byID[key.ID()]; seen {
+			keys[j].lines = append(keys[j].lines, line)
+			continue
+		}
+		byID[key.ID()] = len(keys)
+		keys = append(keys, duplicateKey{key: key, lines: []duplicateLine{line}})
+	}
+	var duplicates []duplicateKey
+	for _, key := range keys {
+		if len(key.lines) > 1 {
+			duplicates = append(duplicates, key)
+		}
+	}
+	return duplicates
+}
+
+// printDuplicates prints each key in duplicates with the lines it is on,
+// showing their options and comments, which may differ, followed by how
+// many were found in the file at path.
+func printDuplicates(w io.Writer, duplicates []duplicateKey, path string) {
+	if len(duplicates) == 0 {
+		return
+	}
+	for _, duplicate := range duplicates {
+		key := duplicate.key
+		name := key.ShortType() + " key"
+		if fingerprint := key.Fingerprint(); fingerprint != "" {
+			name += ", " + fingerprint + ","
+		}
+		fmt.Fprintf(w, "Warning: the same %s is on lines %s:\n", name, joinLineNumbers(duplicate.lines))
+		for _, line := range duplicate.lines {
+			fmt.Fprintf(w, "  line %d: %s\n", line.line, describeDuplicate(line.key))
+		}
+	}
+	fmt.Fprintf(w, "Found %d duplicate %s in %s\n", len(duplicates), plural(len(duplicates), "key", "keys"), path)
+}
+
+// describeDuplicate gives what sets a line apart from others with the same
+// key: its options and comment.
+func describeDuplicate(key doorman.Key) string {
+	described := strings.TrimSpace(key.Options() + " " + key.Comment)
+	if described == "" {
+		return "(no options or comment)"
+	}
+	return described
+}
+
+// joinLineNumbers renders lines' numbers as "2, 5 and 9".
+func joinLineNumbers(lines []duplicateLine) string {
+	numbers := make([]string, len(lines))
+	for i, line := range lines {
+		numbers[i] = strconv.Itoa(line.line)
+	}
+	return joinNames(numbers)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCheckDuplicates(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	other := newTestKey(t)
+	writeFile(t, path, testKey+" alice"+today+"\n"+
+		"# laptop\n"+
+		`no-pty,from="10.0.0.1" `+testKey+" laptop alice\n"+
+		other+" bob\n"+
+		testKey+"\n")
+
+	if err := run(e.deps, []string{"doorman", "check"}); err != nil {
+		t.Fatalf("expected duplicates to be a warning, got %v", err)
+	}
+	expected := "No problems found in " + path + "\n" +
+		"Warning: the same ed25519 key, SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I, is on lines 1, 3 and 5:\n" +
+		"  line 1: alice" + today + "\n" +
+		`  line 3: no-pty,from="10.0.0.1" laptop alice` + "\n" +
+		"  line 5: (no options or comment)\n" +
+		"Found 1 duplicate key in " + path + "\n"
+	if e.out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, e.out.String())
+	}
+
+	e.out.Reset()
+	err := run(e.deps, []string{"doorman", "check", "--strict"})
+	if exitCodeFor(err) != exitProblems || err.Error() != "found 1 duplicate key in "+path {
+		t.Errorf("expected --strict to fail on the duplicate, got %v", err)
+	}
+
+	e.out.Reset()
+	err = run(e.deps, []string{"doorman", "--output", "json", "check", "--strict"})
+	if exitCodeFor(err) != exitProblems {
+		t.Errorf("expected exit code %d, got %v", exitProblems, err)
+	}
+	for _, expected := range []string{`"ok": false`, `"line": 3,`, `"options": "no-pty,from=\"10.0.0.1\""`, `"comment": "laptop alice"`} {
+		if !strings.Contains(e.out.String(), expected) {
+			t.Errorf("expected %s in the report, got %s", expected, e.out.String())
+		}
+	}
+}
+
+func TestRunCheckNoDuplicates(t *testing.T) {
+	e := newTestEnv(t)
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), testKey+" alice\n"+newTestKey(t)+" alice\n")
+
+	if err := run(e.deps, []string{"doorman", "check", "--strict"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(e.out.String(), "duplicate") {
+		t.Errorf("expected no duplicates, got %q", e.out.String())
+	}
+	if err := run(e.deps, []string{"doorman", "list", "--strict"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected --strict to be refused with list, got %v", err)
+	}
+}
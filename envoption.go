@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// envOptionVariable is the variable --set-env-option has sshd set in each
+// session, to the username the key was installed for.
+const envOptionVariable = "DOORMAN_USER"
+
+// setsEnvOption reports whether keys are installed with an environment
+// option naming their user, by --set-env-option or set_env_option.
+func (a *app) setsEnvOption() bool {
+	return a.opts.setEnvOption || a.cfg.SetEnvOption
+}
+
+// withEnvOption returns the options field options with
+// environment="DOORMAN_USER=username" after the others, in place of any
+// DOORMAN_USER setting already there, so a line never has two.
+func withEnvOption(options, username string) (string, error) {
+	parsed, err := doorman.ParseKeyOptions(options)
+	if err != nil {
+		return "", err
+	}
+	var merged []doorman.KeyOption
+	for _, option := range parsed {
+		if !isEnvOption(option) {
+			merged = append(merged, option)
+		}
+	}
+	merged = append(merged, doorman.KeyOption{Name: "environment", Value: envOptionVariable + "=" + username, HasValue: true})
+	return doorman.FormatKeyOptions(merged), nil
+}
+
+// isEnvOption reports whether option is the one --set-env-option adds.
+// sshd doesn't mind the case of option names.
+func isEnvOption(option doorman.KeyOption) bool {
+	return strings.EqualFold(option.Name, "environment") && strings.HasPrefix(option.Value, envOptionVariable+"=")
+}
+
+// envOptionWarning says why sshd would ignore the option --set-env-option
+// adds, or returns "" if its configuration lets it through or the option
+// isn't added. sshd only sets variables from authorized_keys that
+// PermitUserEnvironment allows, and it allows none by default. The
+// configuration of another host isn't checked.
+func (a *app) envOptionWarning() string {
+	if !a.setsEnvOption() || a.opts.host != "" {
+		return ""
+	}
+	args, err := sshdConfigValue(a.sshdConfigPath, "PermitUserEnvironment")
+	if err != nil {
+		return fmt.Sprintf("couldn't check that sshd sets %s from the environment option: %v", envOptionVariable, err)
+	}
+	allowed := "no"
+	if len(args) > 0 {
+		allowed = args[0]
+	}
+	switch strings.ToLower(allowed) {
+	case "yes":
+		return ""
+	case "no":
+	default:
+		for _, pattern := range strings.Split(allowed, ",") {
+			if ok, _ := path.Match(pattern, envOptionVariable); ok {
+				return ""
+			}
+		}
+	}
+	return fmt.Sprintf("%s doesn't allow %s in PermitUserEnvironment, so sshd ignores the environment option set_env_option adds; set PermitUserEnvironment %s there", a.sshdConfigPath, envOptionVariable, envOptionVariable)
+}
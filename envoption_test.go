@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWithEnvOption(t *testing.T) {
+	tests := []struct {
+		options  string
+		expected string
+	}{
+		{"", `environment="DOORMAN_USER=alice"`},
+		{"restrict", `restrict,environment="DOORMAN_USER=alice"`},
+		{`environment="DOORMAN_USER=bob",no-pty`, `no-pty,environment="DOORMAN_USER=alice"`},
+		{`Environment="DOORMAN_USER=bob"`, `environment="DOORMAN_USER=alice"`},
+		{`environment="LANG=C",command="echo \"hi\""`, `environment="LANG=C",command="echo \"hi\"",environment="DOORMAN_USER=alice"`},
+	}
+	for _, tt := range tests {
+		got, err := withEnvOption(tt.options, "alice")
+		if err != nil || got != tt.expected {
+			t.Errorf("%s: expected %s, got %s (%v)", tt.options, tt.expected, got, err)
+		}
+	}
+}
+
+func TestRunSetEnvOption(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	bot := newTestKey(t)
+	e.source = userSource{"alice": testKey, "bot-deploy": bot}
+	envOption := `environment="DOORMAN_USER=alice"`
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--set-env-option", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != envOption+" "+testKey+" alice"+today+"\n" {
+		t.Fatalf("expected the key installed with the option, got %q", content)
+	}
+
+	// The option is merged with those [options] sets, and sync puts it
+	// on keys installed without it
+	writeFile(t, path, bot+" bot-deploy\n"+readFile(t, path))
+	config := e.forceBotOptions(t)
+	if err := run(e.deps, []string{"doorman", "--yes", "--config", config, "--set-env-option", "sync", "bot-deploy", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := botOptions + `,environment="DOORMAN_USER=bot-deploy" ` + bot + " bot-deploy" + today + "\n" +
+		envOption + " " + testKey + " alice" + today + "\n"
+	if content := readFile(t, path); content != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, content)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--output", "json", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), `"name": "environment",
+          "value": "DOORMAN_USER=alice"`) {
+		t.Errorf("expected list to parse the option, got %s", e.out.String())
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "remove", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); strings.Contains(content, "alice") {
+		t.Errorf("expected alice's key removed, got %q", content)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--set-env-option", "remove", "bot-deploy"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected --set-env-option to be refused with remove, got %v", err)
+	}
+}
+
+func TestRunCheckSetEnvOption(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, `environment="DOORMAN_USER=alice" `+testKey+" alice\n")
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "set_env_option = true\n")
+
+	tests := []struct {
+		name       string
+		sshdConfig string
+		warning    string
+	}{
+		{"unset", "", "Warning: " + e.sshdConfigPath + " doesn't allow DOORMAN_USER in PermitUserEnvironment"},
+		{"no", "PermitUserEnvironment no\n", "Warning: " + e.sshdConfigPath + " doesn't allow DOORMAN_USER in PermitUserEnvironment"},
+		{"other variables", "PermitUserEnvironment LANG,LC_*\n", "Warning: " + e.sshdConfigPath + " doesn't allow DOORMAN_USER in PermitUserEnvironment"},
+		{"yes", "PermitUserEnvironment yes\n", ""},
+		{"pattern", "PermitUserEnvironment LANG,DOORMAN_*\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeFile(t, e.sshdConfigPath, tt.sshdConfig)
+			e.out.Reset()
+			if err := run(e.deps, []string{"doorman", "--config", config, "check"}); err != nil {
+				t.Fatalf("expected a warning only, got %v", err)
+			}
+			if tt.warning == "" && strings.Contains(e.out.String(), "Warning") {
+				t.Errorf("expected no warning, got %q", e.out.String())
+			}
+			if !strings.Contains(e.out.String(), tt.warning) {
+				t.Errorf("expected %q, got %q", tt.warning, e.out.String())
+			}
+		})
+	}
+
+	writeFile(t, e.sshdConfigPath, "")
+	err := run(e.deps, []string{"doorman", "--config", config, "check", "--strict"})
+	if exitCodeFor(err) != exitProblems || err.Error() != "found 1 warning in "+path {
+		t.Errorf("expected --strict to fail on the warning, got %v", err)
+	}
+
+	// A key without the option is a problem
+	writeFile(t, path, testKey+" alice\n")
+	writeFile(t, e.sshdConfigPath, "PermitUserEnvironment DOORMAN_USER\n")
+	e.out.Reset()
+	err = run(e.deps, []string{"doorman", "--config", config, "check"})
+	if exitCodeFor(err) != exitProblems || !strings.Contains(e.out.String(), `missing the options set_env_option sets: environment="DOORMAN_USER=alice"`) {
+		t.Errorf("expected the missing option reported, got %v: %q", err, e.out.String())
+	}
+}
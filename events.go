@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// eventSchemaVersion is the schema_version of every --events ndjson line.
+// Adding fields or event types leaves it alone; it changes only when a field
+// is renamed, removed or changes meaning.
+const eventSchemaVersion = 1
+
+type eventLine struct {
+	SchemaVersion int `json:"schema_version"`
+	doorman.Event
+}
+
+// ndjsonEvents returns an event handler writing each event to w as a line
+// of JSON.
+func ndjsonEvents(w io.Writer) func(doorman.Event) {
+	encoder := json.NewEncoder(w)
+	return func(event doorman.Event) {
+		event.Time = event.Time.UTC()
+		// An event stream nobody reads mustn't fail the change it describes
+		_ = encoder.Encode(eventLine{eventSchemaVersion, event})
+	}
+}
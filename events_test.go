@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunEventsNDJSON(t *testing.T) {
+	e := newTestEnv(t)
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), "")
+	e.mockKeys(testKey)
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--events", "ndjson", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var types []string
+	for _, line := range strings.Split(strings.TrimSuffix(e.out.String(), "\n"), "\n") {
+		var event map[string]any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("expected only JSON lines on stdout, got %q", line)
+		}
+		if event["schema_version"] != float64(eventSchemaVersion) {
+			t.Errorf("expected schema_version %d, got %v", eventSchemaVersion, event["schema_version"])
+		}
+		types = append(types, event["type"].(string))
+	}
+	expected := []string{"operation_started", "keys_fetched", "key_added", "file_rewritten"}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected events %q, got %q", expected, types)
+	}
+	if !strings.Contains(e.errOut.String(), "Added 1 key for alice (1 ed25519)") {
+		t.Errorf("expected the summary on stderr, got %q", e.errOut.String())
+	}
+}
+
+func TestRunEventsInvalid(t *testing.T) {
+	e := newTestEnv(t)
+	err := run(e.deps, []string{"doorman", "--events", "xml", "list"})
+	if code := exitCodeFor(err); code != exitUsage {
+		t.Errorf("expected exit code %d, got %d (%v)", exitUsage, code, err)
+	}
+}
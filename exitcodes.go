@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// Exit codes, documented by `doorman help exit-codes`
+const (
+	exitOK      = 0
+	exitGeneric = 1
+	exitUsage   = 2
+	exitAborted = 3
+	exitFetch   = 4
+	exitNoKeys  = 5
+	exitFile    = 6
+	exitRemote  = 7
+	// exitProblems is check finding installed keys that break the rules,
+	// or warnings with --strict, or list --stale finding stale keys
+	exitProblems = 8
+	// exitSignature is a key list without a valid signature from
+	// allowed_signers
+	exitSignature = 9
+)
+
+var exitCodeDescriptions = []struct {
+	code        int
+	description string
+}{
+	{exitOK, "success"},
+	{exitGeneric, "unexpected failure"},
+	{exitUsage, "usage error: invalid arguments or flags, or an invalid, unknown or renamed username"},
+	{exitAborted, "aborted: a confirmation was declined, or doorman was interrupted"},
+	{exitFetch, "fetch failure: keys could not be downloaded"},
+	{exitNoKeys, "no keys: the user has no public keys"},
+	{exitFile, "file error: authorized_keys could not be read or written"},
+	{exitRemote, "remote failure: the --host could not be connected to"},
+	{exitProblems, "problems found: check found installed keys that break the configured rules (or, with --strict, warned of duplicate keys or the sshd configuration), or list --stale found stale keys"},
+	{exitSignature, "signature failure: fetched keys weren't signed by a key in allowed_signers"},
+}
+
+// exitError carries the exit code main() should terminate with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func withExitCode(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// exitCodeFor maps an error returned by run() to a process exit code: a code
+// attached with withExitCode wins, and otherwise the error's class decides.
+func exitCodeFor(err error) int {
+	var e *exitError
+	var limitErr *doorman.RateLimitError
+	var fetchErr *doorman.FetchError
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &e):
+		return e.code
+	case errors.Is(err, doorman.ErrAborted), errors.Is(err, context.Canceled):
+		return exitAborted
+	// BEHAVIOR: An unknown user almost always means a mistyped username,
+	// which is the caller's mistake rather than a network problem, as is
+	// asking for a renamed account by its old name
+	case errors.Is(err, doorman.ErrInvalidUser), errors.Is(err, doorman.ErrUserNotFound), errors.As(err, new(*doorman.RenamedUserError)):
+		return exitUsage
+	case errors.Is(err, doorman.ErrNoKeys):
+		return exitNoKeys
+	case errors.As(err, &limitErr), errors.As(err, &fetchErr):
+		return exitFetch
+	case errors.Is(err, doorman.ErrFileMissing), errors.Is(err, doorman.ErrLocked), errors.Is(err, doorman.ErrUnsafePath), errors.As(err, &pathErr), errors.As(err, &linkErr):
+		return exitFile
+	}
+	return exitGeneric
+}
+
+func printExitCodes(w io.Writer) {
+	fmt.Fprintln(w, "Exit codes:")
+	for _, c := range exitCodeDescriptions {
+		fmt.Fprintf(w, "  %d  %s\n", c.code, c.description)
+	}
+	fmt.Fprintln(w, "diff exits like diff(1) instead; see doorman help diff.")
+}
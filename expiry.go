@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// expiryOptions returns the options that have sync and serve drop keys
+// whose doorman-expires= stamp has passed, by more than expiry_grace, or
+// none with --no-expire.
+func (a *app) expiryOptions() ([]doorman.Option, error) {
+	if a.opts.noExpire {
+		return nil, nil
+	}
+	var grace time.Duration
+	if a.cfg.ExpiryGrace != "" {
+		var err error
+		if grace, err = parseAge(a.cfg.ExpiryGrace); err != nil {
+			return nil, withExitCode(exitUsage, fmt.Errorf("invalid expiry_grace '%s': %w", a.cfg.ExpiryGrace, err))
+		}
+	}
+	return []doorman.Option{doorman.WithExpiry(grace)}, nil
+}
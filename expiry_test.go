@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunSyncExpired(t *testing.T) {
+	e := newTestEnv(t)
+	e.now = func() time.Time { return time.Date(2024, 3, 18, 12, 0, 0, 0, time.UTC) }
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	stamped := testKey + " doorman-expires=2024-03-17 contractor\n"
+	writeFile(t, path, stamped)
+	e.mockKeys(testKey)
+
+	// Within the grace period, the key stays
+	configPath := filepath.Join(e.home, "config.toml")
+	writeFile(t, configPath, "expiry_grace = \"24h\"\n")
+	if err := run(e.deps, []string{"doorman", "--config", configPath, "--yes", "sync", "contractor"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readFile(t, path); got != stamped {
+		t.Errorf("expected the key kept within the grace period, got %q", got)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--no-expire", "sync", "contractor"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readFile(t, path); got != stamped {
+		t.Errorf("expected the key kept with --no-expire, got %q", got)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "sync", "contractor"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readFile(t, path); got != "# doorman-expired: "+stamped {
+		t.Errorf("expected the key commented out, got %q", got)
+	}
+	if !strings.Contains(e.out.String(), "Removed 1 expired key for contractor") {
+		t.Errorf("expected the expired key reported, got %q", e.out.String())
+	}
+}
+
+func TestRunExpiryUsage(t *testing.T) {
+	e := newTestEnv(t)
+	e.mockKeys(testKey)
+
+	err := run(e.deps, []string{"doorman", "--yes", "--no-expire", "add", "alice"})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected --no-expire with add to be a usage error, got %v", err)
+	}
+
+	configPath := filepath.Join(e.home, "config.toml")
+	writeFile(t, configPath, "expiry_grace = \"soon\"\n")
+	err = run(e.deps, []string{"doorman", "--config", configPath, "--yes", "sync", "alice"})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "expiry_grace") {
+		t.Errorf("expected an invalid expiry_grace to be a usage error, got %v", err)
+	}
+}
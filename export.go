@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// exportKeys prints the keys doorman manages in store, or only those of
+// usernames if any are named, in the form --format asks for. Only
+// cloud-init exists, so it is the default.
+func (a *app) exportKeys(ctx context.Context, store doorman.KeyStore, usernames []string) error {
+	if a.opts.format != "" && a.opts.format != "cloud-init" {
+		return withExitCode(exitUsage, fmt.Errorf("invalid format '%s' for export: use cloud-init", a.opts.format))
+	}
+	keys, err := a.newManager(doorman.WithStore(store)).List(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", store.Path(), err)
+	}
+
+	byUser := make(map[string][]string)
+	for _, key := range keys {
+		user := a.keyUser(key)
+		if user == "" {
+			continue
+		}
+		if len(usernames) > 0 {
+			i := slices.IndexFunc(usernames, func(username string) bool { return a.sameUser(user, username) })
+			if i < 0 {
+				continue
+			}
+			user = usernames[i]
+		}
+		byUser[user] = append(byUser[user], key.Line)
+	}
+	for _, username := range usernames {
+		if len(byUser[username]) == 0 {
+			return withExitCode(exitNoKeys, fmt.Errorf("no keys installed for %s in %s", username, store.Path()))
+		}
+	}
+
+	owner, err := a.keysUser()
+	if err != nil {
+		return err
+	}
+	writeCloudInit(a.stdout, a.sshUsername(owner.Username), byUser)
+	return nil
+}
+
+// sameUser reports whether a key labeled label belongs to username, whose
+// case only matters when the provider's usernames are case-sensitive.
+func (a *app) sameUser(label, username string) bool {
+	if a.labels.FoldCase {
+		return strings.EqualFold(label, username)
+	}
+	return label == username
+}
+
+// writeCloudInit writes the key lines of byUser as a cloud-init users
+// entry for account, ready to paste into user-data. Users are in
+// alphabetical order, each under a comment naming them, and their key
+// lines are sorted, so the output only changes when the keys do:
+//
+//	users:
+//	  - name: "deploy"
+//	    ssh_authorized_keys:
+//	      # alice
+//	      - "ssh-ed25519 AAAA... alice doorman-added=2025-03-18"
+func writeCloudInit(w io.Writer, account string, byUser map[string][]string) {
+	users := make([]string, 0, len(byUser))
+	for user := range byUser {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	fmt.Fprintln(w, "users:")
+	fmt.Fprintf(w, "  - name: %s\n", yamlQuote(account))
+	if len(users) == 0 {
+		fmt.Fprintln(w, "    ssh_authorized_keys: []")
+		return
+	}
+	fmt.Fprintln(w, "    ssh_authorized_keys:")
+	for _, user := range users {
+		lines := slices.Clone(byUser[user])
+		sort.Strings(lines)
+		fmt.Fprintf(w, "      # %s\n", user)
+		for _, line := range lines {
+			fmt.Fprintf(w, "      - %s\n", yamlQuote(line))
+		}
+	}
+}
+
+// yamlQuote renders s as a YAML double-quoted scalar, which key lines need:
+// their options may hold quotes, and their comments ": " or " #".
+func yamlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
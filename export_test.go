@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// exportedAuthorizedKeys is what testdata/cloud-init.yaml exports: bob's
+// key comes first and alice's are out of order, which export mustn't
+// reflect, and the unlabeled key isn't managed.
+const exportedAuthorizedKeys = `# bastion
+from="10.0.0.0/8",command="echo \"hi\"" ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBMpUdogPMMHu+nQNMCIXHV5Emg2Caeeb8/Qmy8gs/Kc bob: build #3 bob
+ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl work laptop alice doorman-added=2025-03-18
+
+ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBMpUdogPMMHu+nQNMCIXHV5Emg2Caeeb8/Qmy8gs/Kc alice doorman-added=2025-03-18
+ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQC7
+`
+
+// TestRunExportCloudInit compares export with testdata/cloud-init.yaml,
+// and reads the key lines back out of it, so what is pasted into user-data
+// installs exactly the keys it was exported from.
+func TestRunExportCloudInit(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, exportedAuthorizedKeys)
+
+	if err := run(e.deps, []string{"doorman", "export", "--format", "cloud-init"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	golden, err := os.ReadFile(filepath.Join("testdata", "cloud-init.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.out.String() != string(golden) {
+		t.Errorf("expected\n%s\ngot\n%s", golden, e.out.String())
+	}
+
+	var exported []string
+	for _, line := range strings.Split(e.out.String(), "\n") {
+		if quoted, ok := strings.CutPrefix(line, "      - "); ok {
+			unquoted, err := strconv.Unquote(quoted)
+			if err != nil {
+				t.Fatalf("can't read back %s: %v", quoted, err)
+			}
+			exported = append(exported, unquoted)
+		}
+	}
+	installed := strings.Split(exportedAuthorizedKeys, "\n")[1:3]
+	installed = append(installed, strings.Split(exportedAuthorizedKeys, "\n")[4])
+	slices.Sort(exported)
+	slices.Sort(installed)
+	if !slices.Equal(exported, installed) {
+		t.Errorf("expected the installed lines %q back, got %q", installed, exported)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "export"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.String() != string(golden) {
+		t.Error("expected cloud-init to be the default format")
+	}
+}
+
+func TestRunExportUsers(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, exportedAuthorizedKeys)
+
+	if err := run(e.deps, []string{"doorman", "export", "Bob"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out := e.out.String(); !strings.Contains(out, "      # Bob\n") || strings.Contains(out, "alice") {
+		t.Errorf("expected only bob's key, got\n%s", out)
+	}
+
+	err := run(e.deps, []string{"doorman", "export", "carol"})
+	if exitCodeFor(err) != exitNoKeys {
+		t.Errorf("expected exit code %d for a user without keys, got %v", exitNoKeys, err)
+	}
+	err = run(e.deps, []string{"doorman", "export", "--format", "json"})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected exit code %d for an unknown format, got %v", exitUsage, err)
+	}
+	err = run(e.deps, []string{"doorman", "list", "--format", "cloud-init"})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected exit code %d for --format with list, got %v", exitUsage, err)
+	}
+}
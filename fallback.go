@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// fallbackSource gets keys from the first of templates, the URLs of the
+// sources setting, that answers. Each URL's key lists are signed on their
+// own when allowed_signers requires signatures.
+func (a *app) fallbackSource(templates []string) (doorman.KeySource, error) {
+	fallback := doorman.FallbackSource{Names: templates, Answered: a.fetched}
+	for _, template := range templates {
+		source, err := a.providerSource("url", template)
+		if err != nil {
+			return nil, err
+		}
+		fallback.Sources = append(fallback.Sources, source)
+	}
+	return fallback, nil
+}
+
+// fetched notes that username's keys came from the source named name, for
+// the audit log.
+func (a *app) fetched(username, name string) {
+	a.verbosef("Fetched keys for %s from %s\n", username, name)
+	if a.fetchedFrom != nil {
+		a.fetchedFrom.Store(username, name)
+	}
+}
+
+// sourceOf returns the URL of the sources setting username's keys were
+// fetched from, or "" if they weren't fetched from one.
+func (a *app) sourceOf(username string) string {
+	if a.fetchedFrom == nil {
+		return ""
+	}
+	name, _ := a.fetchedFrom.Load(username)
+	source, _ := name.(string)
+	return source
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+func TestRunSources(t *testing.T) {
+	e := newTestEnv(t)
+	configPath := filepath.Join(e.home, "config.toml")
+	writeFile(t, configPath, `sources = ["https://keys.internal/{user}.keys", "https://github.com/{user}.keys"]`+"\n")
+	statuses := map[string]int{"keys.internal": http.StatusServiceUnavailable, "github.com": http.StatusOK}
+	var requested []string
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		requested = append(requested, request.URL.Host)
+		return &http.Response{StatusCode: statuses[request.URL.Host], Body: io.NopCloser(strings.NewReader(testKey))}, nil
+	})
+
+	if err := run(e.deps, []string{"doorman", "--config", configPath, "--yes", "--verbose", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.errOut.String(), "Fetched keys for alice from https://github.com/{user}.keys\n") {
+		t.Errorf("expected the source that answered in verbose output, got %q", e.errOut.String())
+	}
+	auditPath, err := e.auditLogPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, auditPath); !strings.Contains(got, `"source":"https://github.com/{user}.keys"`) {
+		t.Errorf("expected the source in the audit log, got %q", got)
+	}
+
+	// A user the mirror doesn't know isn't looked for elsewhere
+	statuses["keys.internal"] = http.StatusNotFound
+	requested = nil
+	err = run(e.deps, []string{"doorman", "--config", configPath, "--yes", "add", "bob"})
+	if !errors.Is(err, doorman.ErrUserNotFound) || len(requested) != 1 {
+		t.Errorf("expected only the mirror asked, and the user not found, got %v after %q", err, requested)
+	}
+
+	statuses["keys.internal"] = http.StatusBadGateway
+	statuses["github.com"] = http.StatusServiceUnavailable
+	err = run(e.deps, []string{"doorman", "--config", configPath, "--yes", "add", "carol"})
+	if err == nil || !strings.Contains(err.Error(), "https://keys.internal/{user}.keys: fetching keys: HTTP 502") ||
+		!strings.Contains(err.Error(), "https://github.com/{user}.keys: fetching keys: HTTP 503") {
+		t.Errorf("expected what went wrong with each source, got %v", err)
+	}
+}
+
+func TestRunSourcesConflict(t *testing.T) {
+	e := newTestEnv(t)
+	configPath := filepath.Join(e.home, "config.toml")
+	writeFile(t, configPath, `sources = ["https://a/{user}", "https://b/{user}"]`+"\n"+`keys_file = "/srv/{user}.pub"`+"\n")
+
+	err := run(e.deps, []string{"doorman", "--config", configPath, "--yes", "add", "alice"})
+	if err == nil || !strings.Contains(err.Error(), "sources can't be combined") {
+		t.Errorf("expected sources and keys_file to conflict, got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// permFix is what fix-perms would change about one path.
+type permFix struct {
+	path string
+	// mode is the mode path should have, or 0 to leave it alone
+	mode fs.FileMode
+	// owner, when set, should own path
+	owner *user.User
+	// confirm asks before changing path, which other software may rely on
+	confirm bool
+}
+
+// fixPermissions gives ~/.ssh mode 0700 and authorized_keys 0600, as sshd's
+// StrictModes requires, hands both to their user when run as root, and
+// removes group and world write from the home directory after asking.
+// It lists what it changed and what was already right; with --dry-run it
+// only says what it would change.
+func (a *app) fixPermissions(ctx context.Context) error {
+	if a.onWindows() {
+		return withExitCode(exitUsage, errors.New("fix-perms doesn't work on Windows, where ACLs rather than modes govern access"))
+	}
+	keysUser, err := a.keysUser()
+	if err != nil {
+		return err
+	}
+	path, err := a.getAuthorizedKeysPath()
+	if err != nil {
+		return fmt.Errorf("error locating authorized_keys: %w", err)
+	}
+	sshDir, err := a.getSSHDir()
+	if err != nil {
+		return err
+	}
+	currentUser, err := a.currentUser()
+	if err != nil {
+		return err
+	}
+	// Only root can give files away; anyone else's files are already theirs
+	var owner *user.User
+	if currentUser.Uid == "0" && a.opts.homeDir == "" {
+		owner = keysUser
+	}
+
+	fixes := []permFix{
+		{path: keysUser.HomeDir, confirm: true},
+		{path: sshDir, mode: 0700, owner: owner},
+		{path: path, mode: 0600, owner: owner},
+	}
+	changed := 0
+	for _, fix := range fixes {
+		n, err := a.applyPermFix(ctx, fix)
+		if err != nil {
+			return withExitCode(exitFile, err)
+		}
+		changed += n
+	}
+	if a.opts.dryRun && changed > 0 {
+		fmt.Fprintf(a.stdout, "Would make %d %s (--dry-run)\n", changed, plural(changed, "change", "changes"))
+	}
+	return nil
+}
+
+// applyPermFix makes path as fix describes, printing each change, or what
+// was already right, and returns the number of changes.
+func (a *app) applyPermFix(ctx context.Context, fix permFix) (int, error) {
+	info, err := os.Stat(fix.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintf(a.stdout, "Missing   %s\n", fix.path)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	mode := info.Mode().Perm()
+	want := fix.mode
+	if want == 0 {
+		// Group and world write let others replace ~/.ssh, so sshd refuses it
+		want = mode &^ 0022
+	}
+	var changes []func() error
+	var descriptions []string
+	if mode != want {
+		descriptions = append(descriptions, fmt.Sprintf("mode %04o -> %04o", mode, want))
+		changes = append(changes, func() error { return os.Chmod(fix.path, want) })
+	}
+	if fix.owner != nil {
+		uid, gid, ok := fileOwner(info)
+		wantUID, uidErr := strconv.Atoi(fix.owner.Uid)
+		wantGID, gidErr := strconv.Atoi(fix.owner.Gid)
+		if ok && uidErr == nil && gidErr == nil && (uid != wantUID || gid != wantGID) {
+			descriptions = append(descriptions, fmt.Sprintf("owner %d:%d -> %s (%d:%d)", uid, gid, fix.owner.Username, wantUID, wantGID))
+			changes = append(changes, func() error { return os.Chown(fix.path, wantUID, wantGID) })
+		}
+	}
+
+	if len(changes) == 0 {
+		fmt.Fprintf(a.stdout, "OK        %s (mode %04o)\n", fix.path, mode)
+		return 0, nil
+	}
+	if a.opts.dryRun {
+		for _, description := range descriptions {
+			fmt.Fprintf(a.stdout, "Would fix %s: %s\n", fix.path, description)
+		}
+		return len(changes), nil
+	}
+	if fix.confirm {
+		question := fmt.Sprintf("Remove group and world write from %s? Other software may rely on them (yes/no): ", fix.path)
+		confirmed, err := a.promptConfirmation(ctx, question)
+		if err != nil {
+			return 0, err
+		}
+		if !confirmed {
+			fmt.Fprintf(a.stdout, "Skipped   %s: %s\n", fix.path, descriptions[0])
+			return 0, nil
+		}
+	}
+	for i, change := range changes {
+		if err := change(); err != nil {
+			return 0, fmt.Errorf("error fixing %s: %w", fix.path, err)
+		}
+		fmt.Fprintf(a.stdout, "Fixed     %s: %s\n", fix.path, descriptions[i])
+	}
+	return len(changes), nil
+}
@@ -0,0 +1,64 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunFixPerms(t *testing.T) {
+	e := newTestEnv(t)
+	sshDir := filepath.Join(e.home, ".ssh")
+	path := filepath.Join(sshDir, "authorized_keys")
+	writeFile(t, path, testKey+" alice\n")
+	for name, mode := range map[string]os.FileMode{e.home: 0775, sshDir: 0755, path: 0644} {
+		if err := os.Chmod(name, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mode := func(name string) os.FileMode {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode().Perm()
+	}
+
+	if err := run(e.deps, []string{"doorman", "--dry-run", "fix-perms"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{"Would fix " + sshDir + ": mode 0755 -> 0700\n", "Would fix " + path + ": mode 0644 -> 0600\n", "Would make 3 changes (--dry-run)\n"} {
+		if !strings.Contains(e.out.String(), expected) {
+			t.Errorf("expected %q, got %q", expected, e.out.String())
+		}
+	}
+	if mode(sshDir) != 0755 || mode(path) != 0644 || mode(e.home) != 0775 {
+		t.Error("--dry-run should change nothing")
+	}
+
+	e.out.Reset()
+	e.mockStdin("no\n")
+	if err := run(e.deps, []string{"doorman", "fix-perms"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mode(sshDir) != 0700 || mode(path) != 0600 {
+		t.Errorf("expected 0700 and 0600, got %04o and %04o", mode(sshDir), mode(path))
+	}
+	if mode(e.home) != 0775 || !strings.Contains(e.out.String(), "Skipped   "+e.home+": mode 0775 -> 0755\n") {
+		t.Errorf("expected the home directory to be left alone when declined, got %04o and %q", mode(e.home), e.out.String())
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "fix-perms"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mode(e.home) != 0755 || !strings.Contains(e.out.String(), "Fixed     "+e.home+": mode 0775 -> 0755\n") {
+		t.Errorf("expected group write removed from the home directory, got %04o and %q", mode(e.home), e.out.String())
+	}
+	if !strings.Contains(e.out.String(), "OK        "+sshDir+" (mode 0700)\n") || !strings.Contains(e.out.String(), "OK        "+path+" (mode 0600)\n") {
+		t.Errorf("expected the fixed paths to be reported as correct, got %q", e.out.String())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// forcedOptions returns the options the [options] table requires
+// username's keys to be installed with, {user} replaced by username, and
+// the pattern that requires them. Both are "" if no pattern matches. A
+// username matching several patterns is an error, as it can't be told
+// which options were meant. With --set-env-option, the options also set
+// DOORMAN_USER to username, whether or not a pattern matches.
+func (a *app) forcedOptions(username string) (options, pattern string, err error) {
+	var matched []string
+	for pattern, options := range a.cfg.Options {
+		if err := checkForcedOptions(pattern, options); err != nil {
+			return "", "", err
+		}
+		if ok, _ := path.Match(pattern, username); ok {
+			matched = append(matched, pattern)
+		}
+	}
+	switch len(matched) {
+	case 0:
+	case 1:
+		pattern = matched[0]
+		options = strings.ReplaceAll(a.cfg.Options[pattern], "{user}", username)
+		if err := checkForcedOptions(pattern, options); err != nil {
+			return "", "", err
+		}
+	default:
+		sort.Strings(matched)
+		return "", "", fmt.Errorf("%s matches several [options] patterns: %s", username, strings.Join(matched, ", "))
+	}
+	if a.setsEnvOption() && username != "" {
+		if options, err = withEnvOption(options, username); err != nil {
+			return "", "", err
+		}
+	}
+	return options, pattern, nil
+}
+
+// checkForcedOptions checks an entry of the [options] table.
+func checkForcedOptions(pattern, options string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid [options] pattern '%s': %w", pattern, err)
+	}
+	if _, err := doorman.ParseKeyOptions(options); err != nil || options == "" {
+		return fmt.Errorf("invalid [options] for '%s': expected comma-separated options, with spaces only inside quotes, got '%s'", pattern, options)
+	}
+	return nil
+}
+
+// withForcedOptions has source's keys installed with the options [options]
+// and --set-env-option require for their user, if any. Every pattern is
+// checked up front, so a mistake in the table fails before anything is
+// fetched.
+func (a *app) withForcedOptions(source doorman.KeySource) (doorman.KeySource, error) {
+	if len(a.cfg.Options) == 0 && !a.setsEnvOption() {
+		return source, nil
+	}
+	for pattern, options := range a.cfg.Options {
+		if err := checkForcedOptions(pattern, options); err != nil {
+			return nil, err
+		}
+	}
+	return optionsSource{source, a}, nil
+}
+
+// optionsSource sets the ForcedOptions of the keys it fetches.
+type optionsSource struct {
+	doorman.KeySource
+	app *app
+}
+
+func (s optionsSource) Keys(ctx context.Context, username string) ([]doorman.PublicKey, error) {
+	keys, err := s.KeySource.Keys(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	options, _, err := s.app.forcedOptions(username)
+	if err != nil {
+		return nil, withExitCode(exitUsage, err)
+	}
+	for i := range keys {
+		keys[i].ForcedOptions = options
+	}
+	return keys, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const botOptions = `restrict,command="/usr/local/bin/bot-shell bot-deploy"`
+
+// forceBotOptions writes a config file requiring options for bot-* users,
+// returning its path.
+func (e *testEnv) forceBotOptions(t *testing.T) string {
+	t.Helper()
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "[options]\n\"bot-*\" = 'restrict,command=\"/usr/local/bin/bot-shell {user}\"'\n")
+	return config
+}
+
+func TestRunForcedOptions(t *testing.T) {
+	e := newTestEnv(t)
+	config := e.forceBotOptions(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, testKey+" bot-deploy\n")
+	e.source = userSource{"bot-deploy": testKey, "alice": testKey}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--config", config, "sync", "bot-deploy"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != botOptions+" "+testKey+" bot-deploy"+today+"\n" {
+		t.Errorf("expected the key to be reinstalled with the options, got %q", content)
+	}
+	if !strings.Contains(e.out.String(), "+ 1  "+botOptions+" 256 SHA256:") {
+		t.Errorf("expected the preview to show the options, got %q", e.out.String())
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--force", "--config", config, "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); !strings.HasSuffix(content, "\n"+testKey+" alice"+today+"\n") {
+		t.Errorf("expected alice's key without options, got %q", content)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--config", config, "keys", "bot-deploy"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.String() != botOptions+" "+testKey+"\n" {
+		t.Errorf("expected keys to print the options, got %q", e.out.String())
+	}
+}
+
+func TestRunCheckForcedOptions(t *testing.T) {
+	e := newTestEnv(t)
+	config := e.forceBotOptions(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, botOptions+" "+testKey+" bot-deploy\n"+newTestKey(t)+" bot-build\n"+newTestKey(t)+" alice\n")
+
+	err := run(e.deps, []string{"doorman", "--config", config, "check"})
+	if exitCodeFor(err) != exitProblems || err.Error() != "found 1 problem in "+path {
+		t.Errorf("expected one problem, got %v", err)
+	}
+	expected := `missing the options [options] sets for bot-*: restrict,command="/usr/local/bin/bot-shell bot-build"`
+	if !strings.HasPrefix(e.out.String(), "bot-build: ") || !strings.Contains(e.out.String(), expected) {
+		t.Errorf("expected bot-build's key to be flagged, got %q", e.out.String())
+	}
+}
+
+func TestForcedOptionsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  map[string]string
+		expected string
+	}{
+		{"ambiguous", map[string]string{"bot-*": "restrict", "*-deploy": "no-pty"}, "bot-deploy matches several [options] patterns: *-deploy, bot-*"},
+		{"bad pattern", map[string]string{"bot-[": "restrict"}, "invalid [options] pattern 'bot-['"},
+		{"unquoted space", map[string]string{"bot-*": "restrict, no-pty"}, "with spaces only inside quotes"},
+		{"unbalanced quote", map[string]string{"bot-*": `command="/bin/sh`}, "with spaces only inside quotes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.cfg.Options = tt.options
+			if _, _, err := e.forcedOptions("bot-deploy"); err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected an error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
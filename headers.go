@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// headerNamePattern matches the names RFC 9110 allows for header fields
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// secretHeaderWords mark headers whose values are kept out of verbose
+// output: any whose name contains one of them, whatever its case
+var secretHeaderWords = []string{"auth", "token", "key", "secret", "password", "cookie", "session", "signature"}
+
+// extraHeaders returns the headers sent with every request for keys: those
+// of the headers setting, then those of --header, which replace any of the
+// same name.
+func (a *app) extraHeaders() (http.Header, error) {
+	headers := make(http.Header)
+	for name, value := range a.cfg.Headers {
+		if err := checkHeader(name, value); err != nil {
+			return nil, fmt.Errorf("invalid header '%s' in headers: %w", name, err)
+		}
+		headers.Set(name, value)
+	}
+	for _, header := range a.opts.headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid --header '%s': use 'Name: value'", header)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if err := checkHeader(name, value); err != nil {
+			return nil, fmt.Errorf("invalid --header '%s': %w", header, err)
+		}
+		headers.Set(name, value)
+	}
+	return headers, nil
+}
+
+func checkHeader(name, value string) error {
+	if !headerNamePattern.MatchString(name) {
+		return fmt.Errorf("'%s' isn't a header name", name)
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("the value can't contain line breaks")
+	}
+	return nil
+}
+
+// sendsHeadersTo reports whether the extra headers may go to u. Internal
+// tokens must never leak to GitHub, so they only go there with
+// --send-headers-anywhere.
+func (a *app) sendsHeadersTo(u *url.URL) bool {
+	if a.opts.sendHeadersAnywhere {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range []string{"github.com", "githubusercontent.com"} {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// withExtraHeaders returns request with the extra headers set, if it may
+// carry them, saying which were sent with --verbose, secrets redacted.
+func (a *app) withExtraHeaders(request *http.Request) *http.Request {
+	if len(a.headers) == 0 || !a.sendsHeadersTo(request.URL) {
+		return request
+	}
+	request = request.Clone(request.Context())
+	for name, values := range a.headers {
+		request.Header[name] = values
+	}
+	a.verbosef("Sending %s to %s\n", describeHeaders(a.headers), request.URL.Host)
+	return request
+}
+
+// stripExtraHeaders is the client's CheckRedirect: a redirect to where the
+// extra headers may not go, such as from a mirror to GitHub, drops them.
+func (a *app) stripExtraHeaders(request *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	if !a.sendsHeadersTo(request.URL) {
+		for name := range a.headers {
+			request.Header.Del(name)
+		}
+	}
+	return nil
+}
+
+// describeHeaders renders headers as "X-Org-Token: [redacted], X-Tenant:
+// acme", in order of name, with the values of secrets redacted.
+func describeHeaders(headers http.Header) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	described := make([]string, len(names))
+	for i, name := range names {
+		value := strings.Join(headers[name], ", ")
+		if secretHeader(name) {
+			value = "[redacted]"
+		}
+		described[i] = name + ": " + value
+	}
+	return strings.Join(described, ", ")
+}
+
+func secretHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range secretHeaderWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// recordHeaders serves testKey to every request, recording the headers
+// each host was sent, and redirects requests for redirect to GitHub.
+func (e *testEnv) recordHeaders(sent map[string]http.Header) {
+	e.source = nil
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		sent[request.URL.Host] = request.Header.Clone()
+		if strings.HasSuffix(request.URL.Path, "/redirect") {
+			return &http.Response{StatusCode: http.StatusFound, Header: http.Header{"Location": {"https://github.com/redirect.keys"}}, Body: http.NoBody, Request: request}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(testKey + "\n")), Request: request}, nil
+	})
+}
+
+func TestRunHeaders(t *testing.T) {
+	e := newTestEnv(t)
+	sent := map[string]http.Header{}
+	e.recordHeaders(sent)
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "[headers]\nX-Tenant = \"acme\"\nX-Org-Token = \"from-config\"\n")
+
+	err := run(e.deps, []string{"doorman", "--yes", "--verbose", "--config", config, "--url", "https://keys.example.com/{user}", "--header", "X-Org-Token: s3cret", "add", "alice"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	headers := sent["keys.example.com"]
+	if headers.Get("X-Org-Token") != "s3cret" || headers.Get("X-Tenant") != "acme" {
+		t.Errorf("expected --header to replace the setting of the same name, got %v", headers)
+	}
+	if !strings.Contains(e.errOut.String(), "Sending X-Org-Token: [redacted], X-Tenant: acme to keys.example.com") {
+		t.Errorf("expected the headers sent, with the token redacted, got %q", e.errOut.String())
+	}
+	if strings.Contains(e.errOut.String(), "s3cret") {
+		t.Error("expected the token not to be shown")
+	}
+}
+
+func TestRunHeadersNotSentToGitHub(t *testing.T) {
+	e := newTestEnv(t)
+	sent := map[string]http.Header{}
+	e.recordHeaders(sent)
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--header", "X-Org-Token: s3cret", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token := sent["github.com"].Get("X-Org-Token"); token != "" {
+		t.Errorf("expected no header sent to GitHub, got %q", token)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--force", "--url", "https://keys.example.com/{user}", "--header", "X-Org-Token: s3cret", "add", "redirect"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sent["keys.example.com"].Get("X-Org-Token") != "s3cret" || sent["github.com"].Get("X-Org-Token") != "" {
+		t.Errorf("expected the header dropped on a redirect to GitHub, got %v", sent)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--force", "--header", "X-Org-Token: s3cret", "--send-headers-anywhere", "add", "bob"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token := sent["github.com"].Get("X-Org-Token"); token != "s3cret" {
+		t.Errorf("expected the header sent to GitHub with --send-headers-anywhere, got %q", token)
+	}
+}
+
+func TestRunInvalidHeader(t *testing.T) {
+	for _, header := range []string{"X-Org-Token", "X Org: token", "X-Org: a\nb"} {
+		e := newTestEnv(t)
+		err := run(e.deps, []string{"doorman", "--yes", "--header", header, "add", "alice"})
+		if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "invalid --header") {
+			t.Errorf("%q: expected a usage error, got %v", header, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// health remembers when serve last synced each user, for /healthz.
+type health struct {
+	maxAge time.Duration
+
+	mu       sync.Mutex
+	lastSync map[string]time.Time
+}
+
+func newHealth(maxAge time.Duration) *health {
+	return &health{maxAge: maxAge, lastSync: make(map[string]time.Time)}
+}
+
+// recordSync notes a sync of username that returned err. A user whose syncs
+// have only failed is remembered as never synced. A nil health does
+// nothing, so callers needn't check.
+func (h *health) recordSync(username string, err error, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.lastSync[username] = now
+	} else if _, ok := h.lastSync[username]; !ok {
+		h.lastSync[username] = time.Time{}
+	}
+}
+
+// healthReport is the body of a /healthz response.
+type healthReport struct {
+	Status string `json:"status"`
+	MaxAge string `json:"max_age"`
+	// Reason says why the status isn't "ok"
+	Reason string       `json:"reason,omitempty"`
+	Stale  []staleEntry `json:"stale,omitempty"`
+}
+
+type staleEntry struct {
+	User     string     `json:"user"`
+	LastSync *time.Time `json:"last_sync"`
+}
+
+// report checks that every user was synced within maxAge of now.
+func (h *health) report(now time.Time) healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	report := healthReport{Status: "ok", MaxAge: formatAge(h.maxAge)}
+	if len(h.lastSync) == 0 {
+		report.Status, report.Reason = "stale", "no sync has finished yet"
+		return report
+	}
+	for user, synced := range h.lastSync {
+		if now.Sub(synced) <= h.maxAge {
+			continue
+		}
+		entry := staleEntry{User: user}
+		if !synced.IsZero() {
+			synced := synced
+			entry.LastSync = &synced
+		}
+		report.Stale = append(report.Stale, entry)
+	}
+	if len(report.Stale) > 0 {
+		slices.SortFunc(report.Stale, func(a, b staleEntry) int { return cmp.Compare(a.User, b.User) })
+		report.Status, report.Reason = "stale", "users not synced within max_age"
+	}
+	return report
+}
+
+// healthHandler answers GET /healthz with 200 while every user has been
+// synced recently, and 503 otherwise, with a JSON report either way.
+func (a *app) healthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report := a.health.report(a.now())
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
+
+// notifySystemd sends state, such as "READY=1", to systemd when running as
+// a unit with Type=notify or WatchdogSec set, and does nothing otherwise.
+func (a *app) notifySystemd(state string) error {
+	socket := a.getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// An @ names a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often to ping systemd's watchdog: half of
+// WatchdogSec, or 0 if the watchdog isn't on for this process.
+func (a *app) watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(a.getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := a.getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// syncProgress remembers when the sync in progress started, so the watchdog
+// is pinged only while syncs keep finishing, and systemd restarts a serve
+// whose sync loop is stuck.
+type syncProgress struct {
+	mu sync.Mutex
+	// started is zero while no sync is running
+	started time.Time
+}
+
+// track wraps syncFn to record when each call starts and ends.
+func (p *syncProgress) track(now func() time.Time, syncFn func(context.Context)) func(context.Context) {
+	return func(ctx context.Context) {
+		p.mu.Lock()
+		p.started = now()
+		p.mu.Unlock()
+		defer func() {
+			p.mu.Lock()
+			p.started = time.Time{}
+			p.mu.Unlock()
+		}()
+		syncFn(ctx)
+	}
+}
+
+// stuck reports whether a sync has been running longer than limit at now.
+func (p *syncProgress) stuck(now time.Time, limit time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.started.IsZero() && now.Sub(p.started) > limit
+}
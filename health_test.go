@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	now := time.Date(2025, 3, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		syncs      map[string]time.Duration
+		failed     []string
+		wantStatus int
+		wantStale  []string
+	}{
+		{"no sync yet", nil, nil, http.StatusServiceUnavailable, nil},
+		{"fresh", map[string]time.Duration{"alice": time.Hour, "bob": 2 * time.Hour}, nil, http.StatusOK, nil},
+		{"stale", map[string]time.Duration{"alice": time.Hour, "bob": 3 * time.Hour}, nil, http.StatusServiceUnavailable, []string{"bob"}},
+		{"never synced", map[string]time.Duration{"alice": time.Hour}, []string{"bob"}, http.StatusServiceUnavailable, []string{"bob"}},
+		{"failed since a sync", map[string]time.Duration{"alice": time.Hour}, []string{"alice"}, http.StatusOK, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.now = func() time.Time { return now }
+			e.health = newHealth(2 * time.Hour)
+			for user, ago := range tt.syncs {
+				e.health.recordSync(user, nil, now.Add(-ago))
+			}
+			for _, user := range tt.failed {
+				e.health.recordSync(user, errors.New("connection refused"), now)
+			}
+
+			recorder := httptest.NewRecorder()
+			e.healthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			var report healthReport
+			if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+				t.Fatalf("invalid JSON %q: %v", recorder.Body.String(), err)
+			}
+			if (report.Status == "ok") != (tt.wantStatus == http.StatusOK) || report.MaxAge != "2h0m0s" {
+				t.Errorf("unexpected report %+v", report)
+			}
+			var stale []string
+			for _, entry := range report.Stale {
+				stale = append(stale, entry.User)
+			}
+			if len(stale) != len(tt.wantStale) || len(stale) > 0 && stale[0] != tt.wantStale[0] {
+				t.Errorf("expected %v stale, got %v", tt.wantStale, stale)
+			}
+		})
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected time.Duration
+	}{
+		{"off", nil, 0},
+		{"on", map[string]string{"WATCHDOG_USEC": "30000000"}, 15 * time.Second},
+		{"another process", map[string]string{"WATCHDOG_USEC": "30000000", "WATCHDOG_PID": "1"}, 0},
+		{"invalid", map[string]string{"WATCHDOG_USEC": "soon"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			for key, value := range tt.env {
+				e.env[key] = value
+			}
+			if interval := e.watchdogInterval(); interval != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, interval)
+			}
+		})
+	}
+}
+
+func TestSyncProgress(t *testing.T) {
+	now := time.Date(2025, 3, 18, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	var progress syncProgress
+	if progress.stuck(now, time.Minute) {
+		t.Error("expected an idle loop not to be stuck")
+	}
+	track := progress.track(clock, func(ctx context.Context) {
+		if progress.stuck(now.Add(30*time.Second), time.Minute) {
+			t.Error("expected a sync running for 30s not to be stuck")
+		}
+		if !progress.stuck(now.Add(2*time.Minute), time.Minute) {
+			t.Error("expected a sync running for 2m to be stuck")
+		}
+	})
+	track(context.Background())
+	if progress.stuck(now.Add(time.Hour), time.Minute) {
+		t.Error("expected the loop not to be stuck after the sync finished")
+	}
+}
@@ -0,0 +1,43 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNotifySystemd(t *testing.T) {
+	// Socket paths are limited to about 100 bytes, which t.TempDir() can
+	// exceed
+	dir, err := os.MkdirTemp("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	e := newTestEnv(t)
+	if err := e.notifySystemd("READY=1"); err != nil {
+		t.Fatalf("expected nothing to happen outside systemd, got %v", err)
+	}
+	e.env["NOTIFY_SOCKET"] = socket
+	if err := e.notifySystemd("WATCHDOG=1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "WATCHDOG=1" {
+		t.Errorf("expected WATCHDOG=1, got %q", buf[:n])
+	}
+}
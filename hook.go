@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// hookTimeout is how long the post-change hook may run before it is killed,
+// so a hung hook can't wedge cron runs
+const hookTimeout = 30 * time.Second
+
+// postChangeHook returns the command to run after a change: --post-hook, or
+// else the post_change_hook setting.
+func (a *app) postChangeHook() string {
+	if a.opts.postHook != "" {
+		return a.opts.postHook
+	}
+	return a.cfg.PostChangeHook
+}
+
+// runPostChangeHook runs the post-change hook, if any, once change has been
+// written to path. The hook learns what changed from its environment.
+func (a *app) runPostChangeHook(ctx context.Context, change *doorman.Change, path string) error {
+	command := a.postChangeHook()
+	if command == "" || len(change.Added)+len(change.Removed) == 0 {
+		return nil
+	}
+	env := []string{
+		"DOORMAN_ACTION=" + string(change.Action),
+		"DOORMAN_USER=" + change.Username,
+		"DOORMAN_ADDED=" + strconv.Itoa(len(change.Added)),
+		"DOORMAN_REMOVED=" + strconv.Itoa(len(change.Removed)),
+		"DOORMAN_FILE=" + path,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	a.verbosef("Running post-change hook: %s\n", command)
+	output, err := a.runHook(ctx, command, env)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", hookTimeout)
+		}
+		if output := strings.TrimSpace(string(output)); output != "" {
+			return fmt.Errorf("%w; its output was:\n%s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+// runShellCommand runs command with the shell, adding env to doorman's own
+// environment, and returns what it wrote to stdout and stderr.
+func runShellCommand(ctx context.Context, command string, env []string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Children the hook left running mustn't keep doorman waiting for its
+	// output once it is killed
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	return output.Bytes(), err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunPostChangeHook(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	e.mockKeys(testKey)
+
+	var commands []string
+	var envs [][]string
+	e.runHook = func(ctx context.Context, command string, env []string) ([]byte, error) {
+		commands = append(commands, command)
+		envs = append(envs, env)
+		return nil, nil
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--post-hook", "notify-slack", "sync", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		"DOORMAN_ACTION=sync",
+		"DOORMAN_USER=alice",
+		"DOORMAN_ADDED=1",
+		"DOORMAN_REMOVED=0",
+		"DOORMAN_FILE=" + path,
+	}
+	if !reflect.DeepEqual(commands, []string{"notify-slack"}) || !reflect.DeepEqual(envs[0], expected) {
+		t.Errorf("expected notify-slack with %v, got %v with %v", expected, commands, envs)
+	}
+
+	// Nothing changed, so nothing to tell
+	if err := run(e.deps, []string{"doorman", "--yes", "--post-hook", "notify-slack", "sync", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(commands) != 1 {
+		t.Errorf("expected the hook to run once, ran %d times", len(commands))
+	}
+}
+
+func TestRunPostChangeHookFailure(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	writeFile(t, filepath.Join(e.home, ".config", "doorman", "config.toml"), "post_change_hook = 'systemctl reload sshd'\n")
+	e.mockKeys(testKey)
+	e.runHook = func(ctx context.Context, command string, env []string) ([]byte, error) {
+		return []byte("Failed to reload sshd.service: Access denied\n"), errors.New("exit status 1")
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("expected a failed hook not to fail the change, got %v", err)
+	}
+	if !strings.Contains(e.errOut.String(), "post-change hook failed: exit status 1; its output was:\nFailed to reload sshd.service: Access denied") {
+		t.Errorf("expected the hook's failure and output, got %q", e.errOut.String())
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("expected the change to stand, got %q", content)
+	}
+}
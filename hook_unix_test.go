@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRunShellCommand(t *testing.T) {
+	output, err := runShellCommand(context.Background(), `echo "$DOORMAN_USER"; echo oops >&2; exit 3`, []string{"DOORMAN_USER=alice"})
+	if err == nil || err.Error() != "exit status 3" {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+	if string(output) != "alice\noops\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mockConditionalKeys serves keys with an ETag, answering requests that
+// send it back with 304. It returns the requests received.
+func (e *testEnv) mockConditionalKeys(keys string) *[]*http.Request {
+	var requests []*http.Request
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		requests = append(requests, request)
+		if request.Header.Get("If-None-Match") == `"v1"` {
+			return &http.Response{StatusCode: http.StatusNotModified, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Etag": {`"v1"`}},
+			Body:       io.NopCloser(strings.NewReader(keys)),
+		}, nil
+	})
+	return &requests
+}
+
+func TestRunRevalidatesCachedKeys(t *testing.T) {
+	e := newTestEnv(t)
+	requests := e.mockConditionalKeys(testKey + "\n")
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+
+	if err := run(e.deps, []string{"doorman", "--yes", "sync", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e.errOut.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "--verbose", "sync", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*requests) != 2 || (*requests)[1].Header.Get("If-None-Match") != `"v1"` {
+		t.Fatalf("expected a conditional second request, got %v", *requests)
+	}
+	if !strings.Contains(e.errOut.String(), "https://github.com/alice.keys: not modified (etag match)") {
+		t.Errorf("expected the 304 to be explained, got %q", e.errOut.String())
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("expected the cached keys to be used, got %q", content)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--no-cache", "sync", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*requests) != 3 || (*requests)[2].Header.Get("If-None-Match") != "" {
+		t.Errorf("expected --no-cache to fetch unconditionally, got %v", (*requests)[2].Header)
+	}
+}
+
+func TestHTTPCacheKeyedByURL(t *testing.T) {
+	e := newTestEnv(t)
+	github, err := e.httpCachePath("https://github.com/alice.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := e.httpCachePath("https://keys.example.com/alice.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if github == mirror {
+		t.Errorf("expected different URLs to be cached apart, got %s for both", github)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// defaultHTTPTimeout bounds a whole request, from connecting to reading the
+// last of the body, unless http_timeout says otherwise
+const defaultHTTPTimeout = 30 * time.Second
+
+// newHTTPClient returns the client every request is made with. Its one pool
+// of connections is shared, so fetching many users' keys from the same host
+// reuses a connection rather than opening one per user. Proxies are taken
+// from HTTPS_PROXY, HTTP_PROXY and NO_PROXY unless --socks5 names one to
+// connect through instead, ca_file adds to the
+// certificate authorities trusted, and a client certificate is presented to
+// servers that ask for one when --client-cert and --client-key name one.
+func (a *app) newHTTPClient() (*http.Client, error) {
+	timeout := defaultHTTPTimeout
+	if a.cfg.HTTPTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(a.cfg.HTTPTimeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid http_timeout '%s': use a duration such as 30s", a.cfg.HTTPTimeout)
+		}
+	}
+
+	transport := a.transport
+	if transport == nil {
+		roots, err := a.rootCAs()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		if tlsConfig.GetClientCertificate, err = a.clientCertificate(); err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		proxy, dial := http.ProxyFromEnvironment, dialer.DialContext
+		socksDial, err := a.socksDialer(dialer)
+		if err != nil {
+			return nil, err
+		}
+		if socksDial != nil {
+			proxy, dial = nil, socksDial
+		}
+		transport = &http.Transport{
+			Proxy:             proxy,
+			DialContext:       dial,
+			ForceAttemptHTTP2: true,
+			MaxIdleConns:      100,
+			// Enough for every fetch --concurrency runs at once by default
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			TLSClientConfig:       tlsConfig,
+		}
+	}
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	if len(a.headers) > 0 {
+		client.CheckRedirect = a.stripExtraHeaders
+	}
+	return client, nil
+}
+
+// rootCAs returns the system's certificate authorities plus those in
+// ca_file, or nil, meaning the system's alone, when it isn't set.
+func (a *app) rootCAs() (*x509.CertPool, error) {
+	if a.cfg.CAFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(a.cfg.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ca_file: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("ca_file %s holds no PEM certificates", a.cfg.CAFile)
+	}
+	return roots, nil
+}
+
+// clientCertificate loads the certificate and key named by --client-cert
+// and --client-key, or client_cert and client_key, returning the callback
+// that presents them, or nil when neither is set. A key others can read
+// is warned about, as ssh warns about private keys.
+func (a *app) clientCertificate() (func(*tls.CertificateRequestInfo) (*tls.Certificate, error), error) {
+	certFile, keyFile := a.cfg.ClientCert, a.cfg.ClientKey
+	if a.opts.clientCert != "" {
+		certFile = a.opts.clientCert
+	}
+	if a.opts.clientKey != "" {
+		keyFile = a.opts.clientKey
+	}
+	switch {
+	case certFile == "" && keyFile == "":
+		return nil, nil
+	case keyFile == "":
+		return nil, fmt.Errorf("a client certificate needs its key: set --client-key or client_key too")
+	case certFile == "":
+		return nil, fmt.Errorf("a client key needs its certificate: set --client-cert or client_cert too")
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client key: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate %s and key %s can't be used together: %w", certFile, keyFile, err)
+	}
+	// BEHAVIOR: Windows doesn't report permissions as mode bits
+	if info, err := os.Stat(keyFile); err == nil && a.goos != "windows" && info.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(a.stderr, "Warning: client key %s is readable by group or others (mode %04o); chmod 600 it\n", keyFile, info.Mode().Perm())
+	}
+	subject := certFile
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		subject = leaf.Subject.String()
+	}
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		a.verbosef("Presenting client certificate %s\n", subject)
+		return &cert, nil
+	}, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// trustServer writes the certificate of server to a ca_file and sets it.
+func (e *testEnv) trustServer(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	path := filepath.Join(e.home, "ca.pem")
+	writeFile(t, path, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+	e.cfg.CAFile = path
+}
+
+func TestHTTPClientReusesConnections(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, testKey)
+	}))
+	defer server.Close()
+	e := newTestEnv(t)
+	// The real transport, against a local server
+	e.transport = nil
+	e.trustServer(t, server)
+	client, err := e.newHTTPClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var connections, reused atomic.Int32
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connections.Add(1)
+			if info.Reused {
+				reused.Add(1)
+			}
+		},
+	})
+	source := doorman.URLSource{Template: server.URL + "/{user}.keys", Client: client}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if _, err := source.Keys(ctx, user); err != nil {
+			t.Fatalf("unexpected error fetching %s's keys: %v", user, err)
+		}
+	}
+	if connections.Load() != 3 || reused.Load() != 2 {
+		t.Errorf("expected one connection reused for every fetch after the first, got %d of %d reused", reused.Load(), connections.Load())
+	}
+}
+
+func TestHTTPClientUntrustedServer(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	e := newTestEnv(t)
+	e.transport = nil
+	client, err := e.newHTTPClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.Get(server.URL); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected the server's certificate to be refused without ca_file, got %v", err)
+	}
+}
+
+func TestHTTPClientSettings(t *testing.T) {
+	e := newTestEnv(t)
+	e.transport = nil
+	client, err := e.newHTTPClient()
+	if err != nil || client.Timeout != defaultHTTPTimeout {
+		t.Errorf("expected the default timeout, got %v %v", client, err)
+	}
+
+	e.cfg.HTTPTimeout = "10s"
+	if client, err = e.newHTTPClient(); err != nil || client.Timeout != 10*time.Second {
+		t.Errorf("expected http_timeout to set the timeout, got %v %v", client, err)
+	}
+
+	tests := []struct {
+		name     string
+		cfg      config
+		expected string
+	}{
+		{"bad timeout", config{HTTPTimeout: "soon"}, "invalid http_timeout 'soon'"},
+		{"missing ca_file", config{CAFile: filepath.Join(e.home, "missing.pem")}, "error reading ca_file"},
+		{"ca_file without certificates", config{CAFile: filepath.Join(e.home, "sshd_config")}, "holds no PEM certificates"},
+	}
+	writeFile(t, filepath.Join(e.home, "sshd_config"), "Port 22\n")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e.cfg = tt.cfg
+			if _, err := e.newHTTPClient(); err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected an error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+// writeClientCertificate writes a self-signed client certificate and its
+// key to the home directory, the key readable only by its owner, returning
+// their paths and the certificate.
+func (e *testEnv) writeClientCertificate(t *testing.T, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(e.home, name+".crt"), filepath.Join(e.home, name+".key")
+	writeFile(t, certFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestHTTPClientCertificate(t *testing.T) {
+	e := newTestEnv(t)
+	certFile, keyFile, cert := e.writeClientCertificate(t, "doorman-test")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, testKey)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	e.transport = nil
+	e.trustServer(t, server)
+	e.opts.verbose = true
+	source := func(client *http.Client) doorman.URLSource {
+		return doorman.URLSource{Template: server.URL + "/{user}.keys", Client: client}
+	}
+
+	client, err := e.newHTTPClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := source(client).Keys(context.Background(), "alice"); err == nil {
+		t.Fatal("expected the server to refuse a request without a client certificate")
+	}
+
+	e.opts.clientCert, e.cfg.ClientKey = certFile, keyFile
+	if client, err = e.newHTTPClient(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := source(client).Keys(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.errOut.String(), "Presenting client certificate CN=doorman-test") {
+		t.Errorf("expected the certificate presented to be reported, got %q", e.errOut.String())
+	}
+	if strings.Contains(e.errOut.String(), "Warning") {
+		t.Errorf("expected no warning for a private key, got %q", e.errOut.String())
+	}
+}
+
+func TestHTTPClientCertificateErrors(t *testing.T) {
+	e := newTestEnv(t)
+	e.transport = nil
+	certFile, keyFile, _ := e.writeClientCertificate(t, "first")
+	_, otherKeyFile, _ := e.writeClientCertificate(t, "second")
+
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		expected string
+	}{
+		{"mismatched", certFile, otherKeyFile, "client certificate " + certFile + " and key " + otherKeyFile + " can't be used together: tls: private key does not match public key"},
+		{"unreadable", filepath.Join(e.home, "missing.crt"), keyFile, "error reading client certificate: "},
+		{"no key", certFile, "", "a client certificate needs its key"},
+		{"no certificate", "", keyFile, "a client key needs its certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e.opts.clientCert, e.opts.clientKey = tt.cert, tt.key
+			if _, err := e.newHTTPClient(); err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+				t.Errorf("expected %q, got %v", tt.expected, err)
+			}
+		})
+	}
+
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHTTPClientCertificateKeyMode(t *testing.T) {
+	e := newTestEnv(t)
+	e.transport = nil
+	certFile, keyFile, _ := e.writeClientCertificate(t, "doorman-test")
+	if err := os.Chmod(keyFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	e.opts.clientCert, e.opts.clientKey = certFile, keyFile
+	if _, err := e.newHTTPClient(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.errOut.String(), "Warning: client key "+keyFile+" is readable by group or others (mode 0644)") {
+		t.Errorf("expected a warning about the key's mode, got %q", e.errOut.String())
+	}
+}
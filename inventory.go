@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// inventoryConcurrency bounds how many hosts of an --inventory are worked
+// on at once
+const inventoryConcurrency = 8
+
+// readInventory reads the hosts listed in path, one [user@]host[:port] per
+// line. Blank lines and # comments are skipped, and repeated hosts are
+// listed once.
+func readInventory(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading inventory: %w", err)
+	}
+	var hosts []string
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line == "" || seen[line] {
+			continue
+		}
+		if strings.ContainsAny(line, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected one [user@]host[:port], got '%s'", path, i+1, line)
+		}
+		seen[line] = true
+		hosts = append(hosts, line)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("inventory %s lists no hosts", path)
+	}
+	return hosts, nil
+}
+
+// hostResult is how an action went on one host of an inventory.
+type hostResult struct {
+	host string
+	// started is false for hosts skipped after another failed
+	started bool
+	err     error
+}
+
+// runInventory carries out action on every host in --inventory, several at
+// once, after a single confirmation. Each host's output is prefixed with
+// its name. Unless --continue-on-error is set, no more hosts are started
+// once one fails, though those already running finish.
+func (a *app) runInventory(ctx context.Context, action string, positional []string) error {
+	hosts, err := readInventory(a.opts.inventory)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+
+	fmt.Fprintf(a.stdout, "Running '%s' on %d %s:\n", strings.Join(positional, " "), len(hosts), plural(len(hosts), "host", "hosts"))
+	for _, host := range hosts {
+		fmt.Fprintln(a.stdout, "  "+host)
+	}
+	ok, err := a.promptConfirmation(ctx, "Continue? (yes/no): ")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return doorman.ErrAborted
+	}
+
+	// BEHAVIOR: Every host gets the same keys, fetched once, rather than
+	// whatever the provider returns at the moment each host gets to it
+	if !a.opts.all {
+		source, err := a.keySource()
+		if err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		d := *a.deps
+		d.source = &sharedSource{KeySource: source}
+		a.deps = &d
+	}
+	a.audit = &auditLog{deps: a.deps}
+	defer a.audit.close()
+	if a.cfg.StrictAudit {
+		if err := a.audit.open(); err != nil {
+			return withExitCode(exitFile, fmt.Errorf("error opening audit log; nothing was changed because strict_audit is set: %w", err))
+		}
+	}
+	a.localFiles = &sync.Mutex{}
+	if a.events != nil {
+		var mu sync.Mutex
+		events := a.events
+		a.events = func(event doorman.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events(event)
+		}
+	}
+
+	var outputMu sync.Mutex
+	results := make([]hostResult, len(hosts))
+	var failed sync.Once
+	stopped := make(chan struct{})
+	slots := make(chan struct{}, inventoryConcurrency)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		results[i].host = host
+		select {
+		case slots <- struct{}{}:
+		case <-stopped:
+			continue
+		case <-ctx.Done():
+			continue
+		}
+		// Another host may have failed while this one waited for a slot
+		if closed(stopped) || ctx.Err() != nil {
+			<-slots
+			continue
+		}
+		results[i].started = true
+		wg.Add(1)
+		go func(result *hostResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result.err = a.runOnHost(ctx, result.host, &outputMu, action, positional)
+			if result.err != nil && !a.opts.continueOnError {
+				failed.Do(func() { close(stopped) })
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	return a.inventorySummary(results)
+}
+
+// closed reports whether c has been closed, without waiting.
+func closed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// runOnHost carries out action on host as if run with --host and --yes,
+// writing its output through outputMu with host's name before each line.
+func (a *app) runOnHost(ctx context.Context, host string, outputMu *sync.Mutex, action string, positional []string) error {
+	stdout := &prefixWriter{w: a.stdout, mu: outputMu, prefix: host + ": "}
+	stderr := &prefixWriter{w: a.stderr, mu: outputMu, prefix: host + ": "}
+	defer stdout.flush()
+	defer stderr.flush()
+
+	d := *a.deps
+	d.stdout, d.stderr = stdout, stderr
+	// Lines redrawn in place would garble the other hosts' output
+	d.stdoutIsTerminal = func() bool { return false }
+	h := *a
+	h.deps = &d
+	h.opts.host = host
+	h.opts.yes = true
+	h.logger = a.logger.With("host", host)
+	h.progress = nil
+
+	store, closeStore, err := h.openStore(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	return h.runAction(ctx, store, action, positional)
+}
+
+// inventorySummary prints how each host went and returns an error if any
+// failed, with the exit code of the first failure.
+func (a *app) inventorySummary(results []hostResult) error {
+	width := 0
+	for _, result := range results {
+		width = max(width, len(result.host))
+	}
+	fmt.Fprintln(a.stdout, "Summary:")
+	var firstErr error
+	failures := 0
+	for _, result := range results {
+		status := "ok"
+		switch {
+		case !result.started:
+			status = "skipped"
+		case errors.As(result.err, new(*silentError)):
+			status = "failed"
+		case result.err != nil:
+			status = "failed: " + strings.ReplaceAll(result.err.Error(), "\n", "\n"+strings.Repeat(" ", width+4))
+		}
+		fmt.Fprintf(a.stdout, "  %-*s  %s\n", width, result.host, status)
+		if result.err != nil {
+			failures++
+			if firstErr == nil {
+				firstErr = result.err
+			}
+		}
+	}
+	if firstErr == nil {
+		return nil
+	}
+	// The details are in the summary, so the error needn't repeat them
+	return withExitCode(exitCodeFor(firstErr), fmt.Errorf("%d of %d %s failed", failures, len(results), plural(len(results), "host", "hosts")))
+}
+
+// prefixWriter writes complete lines to w with prefix before each,
+// holding a partial line back until it ends or flush is called. mu keeps
+// lines written by different prefixWriters whole.
+type prefixWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	end := bytes.LastIndexByte(p.buf, '\n')
+	if end < 0 {
+		return len(data), nil
+	}
+	var out []byte
+	for _, line := range bytes.SplitAfter(p.buf[:end+1], []byte("\n")) {
+		if len(line) > 0 {
+			out = append(append(out, p.prefix...), line...)
+		}
+	}
+	p.buf = append(p.buf[:0], p.buf[end+1:]...)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// flush writes any partial line, ending it.
+func (p *prefixWriter) flush() {
+	if len(p.buf) > 0 {
+		p.Write([]byte("\n"))
+	}
+}
+
+// sharedSource fetches each user's keys once, however many hosts ask for
+// them, remembering failures too.
+type sharedSource struct {
+	doorman.KeySource
+
+	mu      sync.Mutex
+	fetches map[string]*sharedFetch
+}
+
+type sharedFetch struct {
+	done chan struct{}
+	keys []doorman.PublicKey
+	err  error
+}
+
+func (s *sharedSource) Keys(ctx context.Context, username string) ([]doorman.PublicKey, error) {
+	s.mu.Lock()
+	if s.fetches == nil {
+		s.fetches = make(map[string]*sharedFetch)
+	}
+	fetch, ok := s.fetches[username]
+	if !ok {
+		fetch = &sharedFetch{done: make(chan struct{})}
+		s.fetches[username] = fetch
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		fetch.keys, fetch.err = s.KeySource.Keys(ctx, username)
+		close(fetch.done)
+	}
+	select {
+	case <-fetch.done:
+		return fetch.keys, fetch.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lockLocalFiles keeps hosts worked on in parallel from updating the local
+// audit log and state files at the same time, returning the unlock.
+func (a *app) lockLocalFiles() func() {
+	if a.localFiles == nil {
+		return func() {}
+	}
+	a.localFiles.Lock()
+	return a.localFiles.Unlock
+}
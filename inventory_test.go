@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestReadInventory(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected []string
+		err      string
+	}{
+		{"hosts", "# web servers\nadmin@web1\n\nweb2:2222  # staging\nadmin@web1\n", []string{"admin@web1", "web2:2222"}, ""},
+		{"two on a line", "web1 web2\n", nil, ":1: expected one [user@]host[:port]"},
+		{"empty", "# nothing yet\n", nil, "lists no hosts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hosts.txt")
+			writeFile(t, path, tt.content)
+			hosts, err := readInventory(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected an error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil || strings.Join(hosts, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected %v, got %v %v", tt.expected, hosts, err)
+			}
+		})
+	}
+}
+
+// mockRemotes serves SFTP for each of hosts from a directory of its own,
+// returned by host, and fails to connect to any other.
+func (e *testEnv) mockRemotes(t *testing.T, hosts ...string) map[string]string {
+	t.Helper()
+	dirs := make(map[string]string)
+	for _, host := range hosts {
+		dirs[host] = t.TempDir()
+	}
+	e.openRemote = func(ctx context.Context, host string) (*sftp.Client, func() error, error) {
+		dir, ok := dirs[host]
+		if !ok {
+			return nil, nil, errors.New("connection refused")
+		}
+		return pipeSFTP(dir)
+	}
+	return dirs
+}
+
+func TestRunInventory(t *testing.T) {
+	e := newTestEnv(t)
+	dirs := e.mockRemotes(t, "web1", "web2")
+	e.mockKeys(testKey)
+	inventory := filepath.Join(e.home, "hosts.txt")
+	writeFile(t, inventory, "web1\ndown\nweb2\n")
+
+	err := run(e.deps, []string{"doorman", "--yes", "--continue-on-error", "--inventory", inventory, "add", "alice"})
+	if exitCodeFor(err) != exitRemote || err.Error() != "1 of 3 hosts failed" {
+		t.Errorf("expected one remote failure, got %v", err)
+	}
+	for _, host := range []string{"web1", "web2"} {
+		if content := readFile(t, filepath.Join(dirs[host], ".ssh", "authorized_keys")); content != testKey+" alice"+today+"\n" {
+			t.Errorf("unexpected content on %s: %q", host, content)
+		}
+	}
+	out := e.out.String()
+	for _, expected := range []string{
+		"Running 'add alice' on 3 hosts:\n  web1\n  down\n  web2\n",
+		"web1: Added 1 key for alice",
+		"web2: Added 1 key for alice",
+		"  web1  ok\n  down  failed: error connecting to down: connection refused\n  web2  ok\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output containing %q, got %q", expected, out)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(e.home, ".ssh", "authorized_keys")); err == nil {
+		t.Error("expected the local authorized_keys to be left alone")
+	}
+}
+
+func TestRunInventoryDeclined(t *testing.T) {
+	e := newTestEnv(t)
+	dirs := e.mockRemotes(t, "web1")
+	e.mockKeys(testKey)
+	e.mockStdin("no\n")
+	inventory := filepath.Join(e.home, "hosts.txt")
+	writeFile(t, inventory, "web1\n")
+
+	err := run(e.deps, []string{"doorman", "--inventory", inventory, "add", "alice"})
+	if exitCodeFor(err) != exitAborted {
+		t.Errorf("expected the run to be aborted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dirs["web1"], ".ssh", "authorized_keys")); err == nil {
+		t.Error("expected nothing to be written after declining")
+	}
+}
+
+func TestRunInventoryUnsupported(t *testing.T) {
+	e := newTestEnv(t)
+	for _, args := range [][]string{
+		{"--inventory", "hosts.txt", "list"},
+		{"--inventory", "hosts.txt", "--host", "web1", "add", "alice"},
+	} {
+		err := run(e.deps, append([]string{"doorman"}, args...))
+		if exitCodeFor(err) != exitUsage {
+			t.Errorf("%v: expected a usage error, got %v", args, err)
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out strings.Builder
+	w := &prefixWriter{w: &out, mu: &sync.Mutex{}, prefix: "web1: "}
+	w.Write([]byte("Adding "))
+	w.Write([]byte("1 key\nDone\nhalf"))
+	w.flush()
+	if expected := "web1: Adding 1 key\nweb1: Done\nweb1: half\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// keysFetchTimeout bounds a live fetch in keys mode; sshd is holding a login
+// open meanwhile
+const keysFetchTimeout = 2 * time.Second
+
+// defaultMaxCacheAge is how stale cached keys may be before keys mode
+// refuses them, unless --max-cache-age or max_cache_age says otherwise
+const defaultMaxCacheAge = 7 * 24 * time.Hour
+
+// cacheDir returns where keys mode caches keys: the cache_dir setting, or
+// doorman's directory under the user's cache directory.
+func (a *app) cacheDir() (string, error) {
+	if a.cfg.CacheDir != "" {
+		return a.cfg.CacheDir, nil
+	}
+	if dir := a.getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "doorman"), nil
+	}
+	currentUser, err := a.currentUser()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(currentUser.HomeDir, ".cache", "doorman"), nil
+}
+
+func (a *app) maxCacheAge() (time.Duration, error) {
+	value, setting := a.opts.maxCacheAge, "--max-cache-age"
+	if value == "" {
+		value, setting = a.cfg.MaxCacheAge, "max_cache_age"
+	}
+	if value == "" {
+		return defaultMaxCacheAge, nil
+	}
+	age, err := parseAge(value)
+	if err != nil {
+		return 0, withExitCode(exitUsage, fmt.Errorf("invalid %s '%s': %w", setting, value, err))
+	}
+	return age, nil
+}
+
+// printKeys prints username's keys for sshd's AuthorizedKeysCommand. Keys
+// fetched are cached; when fetching fails or takes too long, cached keys no
+// older than the maximum cache age are printed instead, with a warning.
+//
+// An answer from the source, even that the user has no keys or doesn't
+// exist, replaces the cache, so revoked keys stop working as soon as the
+// source is reachable.
+func (a *app) printKeys(ctx context.Context, username string) error {
+	// BEHAVIOR: The username comes from sshd and names the cache file, so it
+	// must not be able to point outside the cache directory
+	if !cacheableName(username) {
+		return withExitCode(exitUsage, fmt.Errorf("invalid username '%s'", username))
+	}
+	maxAge, err := a.maxCacheAge()
+	if err != nil {
+		return err
+	}
+	dir, err := a.cacheDir()
+	if err != nil {
+		return err
+	}
+	source, err := a.keySource()
+	if err == nil {
+		source, err = a.withRules(source)
+	}
+	if err == nil {
+		source, err = a.withForcedOptions(source)
+	}
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	cache := filepath.Join(dir, username+".keys")
+
+	fetchCtx, cancel := context.WithTimeout(ctx, keysFetchTimeout)
+	defer cancel()
+	keys, err := source.Keys(fetchCtx, username)
+	switch {
+	case err == nil:
+		var lines []string
+		for _, key := range keys {
+			lines = append(lines, key.AuthorizedKey())
+		}
+		content := strings.Join(lines, "\n")
+		if content != "" {
+			content += "\n"
+		}
+		if err := writeFileAtomic(cache, []byte(content)); err != nil {
+			a.logger.Warn("cache_write_failed", "user", username, "path", cache, "error", err)
+		}
+		fmt.Fprint(a.stdout, content)
+		return nil
+	// BEHAVIOR: Keys the rules no longer allow, or whose list is no longer
+	// signed, must not be served from the cache either
+	case errors.Is(err, doorman.ErrInvalidUser), errors.Is(err, doorman.ErrUserNotFound), errors.As(err, new(*refusedKeysError)), errors.As(err, new(*signatureError)):
+		if removeErr := os.Remove(cache); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			a.logger.Warn("cache_write_failed", "user", username, "path", cache, "error", removeErr)
+		}
+		return err
+	case ctx.Err() != nil:
+		return ctx.Err()
+	}
+
+	fetchErr := err
+	info, err := os.Stat(cache)
+	if err != nil {
+		return fmt.Errorf("error fetching keys for %s, and none are cached: %w", username, fetchErr)
+	}
+	age := a.now().Sub(info.ModTime())
+	if age > maxAge {
+		return fmt.Errorf("error fetching keys for %s, and the cached keys are %s old, more than the %s allowed: %w", username, age.Round(time.Second), formatAge(maxAge), fetchErr)
+	}
+	content, err := os.ReadFile(cache)
+	if err != nil {
+		return fmt.Errorf("error reading cached keys: %w", err)
+	}
+	a.logger.Warn("serving_cached_keys", "user", username, "age", age.Round(time.Second), "error", fetchErr)
+	_, err = a.stdout.Write(content)
+	return err
+}
+
+// writeFileAtomic replaces the file at path with content, readable only by
+// its owner. The new file is renamed into place, so concurrent readers see
+// either the old or the new content, never a mix.
+func writeFileAtomic(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp already makes the file 0600
+	return os.Rename(tmp.Name(), path)
+}
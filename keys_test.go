@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+func TestRunKeysCaches(t *testing.T) {
+	e := newTestEnv(t)
+	// sshd gives AuthorizedKeysCommand no terminal
+	e.stdinIsTerminal = func() bool { return false }
+	e.mockKeys(testKey)
+
+	if err := run(e.deps, []string{"doorman", "keys", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.String() != testKey+"\n" {
+		t.Errorf("expected the key, got %q", e.out.String())
+	}
+
+	cache := filepath.Join(e.home, ".cache", "doorman", "alice.keys")
+	if content := readFile(t, cache); content != testKey+"\n" {
+		t.Errorf("expected the key to be cached, got %q", content)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("expected the cache to be 0600, got %o", info.Mode().Perm())
+		}
+	}
+	entries, err := os.ReadDir(filepath.Dir(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the cache file, got %v", entries)
+	}
+}
+
+func TestRunKeysFallsBackToCache(t *testing.T) {
+	fetchErr := &doorman.FetchError{Err: errors.New("connection refused")}
+	tests := []struct {
+		name    string
+		cached  bool
+		age     time.Duration
+		args    []string
+		config  string
+		fetch   error
+		wantOut string
+		wantErr string
+	}{
+		{"fresh cache", true, time.Hour, nil, "", fetchErr, testKey + "\n", ""},
+		{"timeout", true, time.Hour, nil, "", context.DeadlineExceeded, testKey + "\n", ""},
+		{"no cache", false, 0, nil, "", fetchErr, "", "none are cached"},
+		{"stale cache", true, 8 * 24 * time.Hour, nil, "", fetchErr, "", "more than the 7 days allowed"},
+		{"max-cache-age", true, 2 * time.Hour, []string{"--max-cache-age", "1h"}, "", fetchErr, "", "more than the 1h0m0s allowed"},
+		{"max_cache_age", true, 2 * time.Hour, nil, "max_cache_age = \"3h\"\n", fetchErr, testKey + "\n", ""},
+		{"invalid max-cache-age", true, time.Hour, []string{"--max-cache-age", "soon"}, "", fetchErr, "", "invalid --max-cache-age 'soon'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			cacheDir := filepath.Join(e.home, "cache")
+			configPath := filepath.Join(e.home, "config.toml")
+			writeFile(t, configPath, "cache_dir = '"+cacheDir+"'\n"+tt.config)
+			if tt.cached {
+				cache := filepath.Join(cacheDir, "alice.keys")
+				if err := writeFileAtomic(cache, []byte(testKey+"\n")); err != nil {
+					t.Fatal(err)
+				}
+				modified := time.Now().Add(-tt.age)
+				if err := os.Chtimes(cache, modified, modified); err != nil {
+					t.Fatal(err)
+				}
+			}
+			e.mockKeysError(tt.fetch)
+
+			args := append([]string{"doorman", "--config", configPath}, tt.args...)
+			err := run(e.deps, append(args, "keys", "alice"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if e.out.String() != tt.wantOut {
+				t.Errorf("expected %q, got %q", tt.wantOut, e.out.String())
+			}
+			if tt.wantOut != "" && !strings.Contains(e.errOut.String(), "serving_cached_keys") {
+				t.Errorf("expected a warning, got %q", e.errOut.String())
+			}
+		})
+	}
+}
+
+func TestRunKeysUnknownUserClearsCache(t *testing.T) {
+	e := newTestEnv(t)
+	e.env["XDG_CACHE_HOME"] = filepath.Join(e.home, "xdg")
+	cache := filepath.Join(e.home, "xdg", "doorman", "alice.keys")
+	if err := writeFileAtomic(cache, []byte(testKey+"\n")); err != nil {
+		t.Fatal(err)
+	}
+	e.mockKeysError(doorman.ErrUserNotFound)
+
+	if code := runMain(e.deps, []string{"doorman", "keys", "alice"}); code != exitUsage {
+		t.Errorf("expected exit code %d, got %d", exitUsage, code)
+	}
+	if e.out.Len() != 0 {
+		t.Errorf("expected no keys, got %q", e.out.String())
+	}
+	if _, err := os.Stat(cache); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the cache to be removed, got %v", err)
+	}
+}
+
+func TestRunKeysInvalidArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no username", []string{"keys"}},
+		{"two usernames", []string{"keys", "alice", "bob"}},
+		{"path", []string{"keys", "../alice"}},
+		{"hidden", []string{"keys", ".alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.mockKeys(testKey)
+			if code := runMain(e.deps, append([]string{"doorman"}, tt.args...)); code != exitUsage {
+				t.Errorf("expected exit code %d, got %d", exitUsage, code)
+			}
+			if e.out.Len() != 0 {
+				t.Errorf("expected no keys, got %q", e.out.String())
+			}
+		})
+	}
+}
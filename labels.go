@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// commentFormat returns the format the keys doorman installs are labeled
+// with, from --comment-format or the comment_format setting, or "" for the
+// bare username.
+func (a *app) commentFormat() (string, error) {
+	format := a.cfg.CommentFormat
+	if a.opts.commentFormat != "" {
+		format = a.opts.commentFormat
+	}
+	if format == "" {
+		return "", nil
+	}
+	if err := doorman.CheckLabelFormat(format); err != nil {
+		return "", withExitCode(exitUsage, err)
+	}
+	return format, nil
+}
+
+// keyLabels returns how keys in store are labeled: with the configured
+// comment format, while recognizing every format the state file records
+// for store, so that keys labeled before the format changed still count.
+func (a *app) keyLabels(store doorman.KeyStore) (doorman.Labels, error) {
+	format, err := a.commentFormat()
+	if err != nil {
+		return doorman.Labels{}, err
+	}
+	labels := doorman.Labels{Format: format}
+	provider, _, providerErr := a.providerChoice()
+	if strings.Contains(format, "{provider}") {
+		if providerErr != nil {
+			return doorman.Labels{}, withExitCode(exitUsage, providerErr)
+		}
+		labels.Provider = provider
+	}
+	// BEHAVIOR: GitHub usernames are case-insensitive, so "add Alice" and a
+	// later "remove alice" must find the same keys
+	labels.FoldCase = providerErr == nil && provider == "github"
+	if strings.Contains(format, "{host}") {
+		if labels.Host, err = a.labelHost(); err != nil {
+			return doorman.Labels{}, err
+		}
+	}
+
+	// BEHAVIOR: Without the state file only the current format and bare
+	// usernames are recognized; listing keys shouldn't fail for that
+	state, _, err := a.loadState()
+	if err != nil {
+		a.logger.Warn("state_unreadable", "error", err)
+		return labels, nil
+	}
+	for _, previous := range state.CommentFormats[store.Path()] {
+		if previous != format && !slices.Contains(labels.Previous, previous) {
+			labels.Previous = append(labels.Previous, previous)
+		}
+	}
+	return labels, nil
+}
+
+// labelHost returns the host name {host} stands for: that of --host, or
+// of this machine.
+func (a *app) labelHost() (string, error) {
+	if a.opts.host == "" {
+		host, err := a.hostname()
+		if err != nil {
+			return "", fmt.Errorf("error finding the host name for {host}: %w", err)
+		}
+		return host, nil
+	}
+	_, host, found := strings.Cut(a.opts.host, "@")
+	if !found {
+		host = a.opts.host
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return host, nil
+}
+
+// canonicalUsers returns usernames spelled as GitHub's API spells their
+// logins, when GITHUB_TOKEN is set, warning about each whose case differed.
+// A username the API can't resolve is kept, for fetching its keys to report
+// why.
+func (a *app) canonicalUsers(ctx context.Context, usernames []string) []string {
+	token := a.getenv(gitHubTokenVariable)
+	if token == "" {
+		return usernames
+	}
+	source := doorman.GitHubSource{Client: httpClient{a}, Token: token}
+	canonical := make([]string, len(usernames))
+	for i, username := range usernames {
+		canonical[i] = username
+		login, err := source.Login(ctx, username)
+		if err != nil {
+			a.logger.Warn("login_unresolved", "user", username, "error", err)
+			continue
+		}
+		// A different name altogether is a renamed account, which fetching
+		// its keys reports
+		if login != username && strings.EqualFold(login, username) {
+			fmt.Fprintf(a.stderr, "Using '%s', as GitHub spells it, for '%s'\n", login, username)
+			canonical[i] = login
+		}
+	}
+	return canonical
+}
+
+// keyUser returns the user key is labeled with, in whichever comment format.
+func (a *app) keyUser(key doorman.Key) string {
+	return a.labels.User(key.PublicKey)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCommentFormat(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	first, second := newTestKey(t), newTestKey(t)
+	e.source = userSource{"alice": first}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--comment-format", "{user}@{host}", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); !strings.HasSuffix(content, " alice@testhost"+today+"\n") {
+		t.Fatalf("expected the key labeled alice@testhost, got %q", content)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--comment-format", "doorman:{user}", "--output", "json", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), `"alice"`) {
+		t.Errorf("expected list to recognize the earlier format, got %q", e.out.String())
+	}
+
+	e.source = userSource{"alice": first + "\n" + second}
+	if err := run(e.deps, []string{"doorman", "--yes", "--comment-format", "doorman:{user}", "sync", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content := readFile(t, path)
+	if strings.Count(content, "\n") != 2 || !strings.Contains(content, " alice@testhost"+today+"\n") || !strings.HasSuffix(content, " doorman:alice"+today+"\n") {
+		t.Fatalf("expected the old key kept and the new one in the new format, got %q", content)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "remove", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != "" {
+		t.Errorf("expected both formats removed, got %q", content)
+	}
+
+	err := run(e.deps, []string{"doorman", "--comment-format", "doorman {user}", "list"})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected a usage error for a bad format, got %v", err)
+	}
+}
+
+func TestRunGitHubUsernameCase(t *testing.T) {
+	e := newTestEnv(t)
+	e.env["GITHUB_TOKEN"] = "secret"
+	var requested []string
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		requested = append(requested, request.URL.Path)
+		body := `{"login": "Alice"}`
+		switch {
+		case strings.HasSuffix(request.URL.Path, "/keys"):
+			body = `[{"id": 4242, "key": "` + testKey + `"}]`
+		case strings.HasSuffix(request.URL.Path, ".keys"):
+			body = testKey
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+	})
+
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.errOut.String(), "Using 'Alice', as GitHub spells it, for 'alice'") {
+		t.Errorf("expected a warning about the case, got %q", e.errOut.String())
+	}
+	if len(requested) != 2 || requested[1] != "/users/Alice/keys" {
+		t.Errorf("expected the keys fetched for Alice, got %v", requested)
+	}
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	if got := readFile(t, path); got != testKey+" gh-key-id=4242 alice"+today+"\n" {
+		t.Errorf("expected the key labeled in lowercase, got %q", got)
+	}
+
+	// Without the API, the label is matched whatever the case
+	delete(e.env, "GITHUB_TOKEN")
+	if err := run(e.deps, []string{"doorman", "--yes", "remove", "ALICE"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readFile(t, path); got != "" {
+		t.Errorf("expected the key removed, got %q", got)
+	}
+}
+
+func TestRunGitHubUserRenamed(t *testing.T) {
+	e := newTestEnv(t)
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		final, err := http.NewRequest(http.MethodGet, "https://github.com/alice-new.keys", nil)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(testKey)), Request: final}, nil
+	})
+
+	err := run(e.deps, []string{"doorman", "--yes", "add", "alice"})
+	if exitCodeFor(err) != exitUsage || err.Error() != "GitHub user 'alice' was renamed to 'alice-new'; update your records" {
+		t.Errorf("expected the rename reported as a usage error, got %v", err)
+	}
+}
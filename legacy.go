@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// legacyFileName is the second file older sshd configurations read keys
+// from, which keys removed from authorized_keys could survive in
+const legacyFileName = "authorized_keys2"
+
+// readsLegacyFile reports whether action acts on authorized_keys2 as well
+// when it is included. Keys are only ever added to authorized_keys.
+func readsLegacyFile(action string) bool {
+	return action == "remove" || action == "list" || action == "check"
+}
+
+// legacyStore returns authorized_keys2 next to store when action reads it
+// and it is included with --include-legacy-file or include_legacy_file,
+// and nil otherwise: when it doesn't exist, when store is on --host, or
+// when store is authorized_keys2 itself.
+func (a *app) legacyStore(store doorman.KeyStore, action string) (doorman.KeyStore, error) {
+	if !readsLegacyFile(action) || a.opts.host != "" || !(a.opts.includeLegacyFile || a.cfg.IncludeLegacyFile) {
+		return nil, nil
+	}
+	path := filepath.Join(filepath.Dir(store.Path()), legacyFileName)
+	if path == store.Path() {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	legacy := doorman.NewFileStore(path)
+	legacy.SkipChown = a.opts.homeDir != ""
+	legacy.MaxLineLength = a.cfg.MaxLineLength
+	if a.opts.cron {
+		legacy.LockWait = cronLockWait
+	}
+	return a.sortedStore(a.dryRunStore(legacy)), nil
+}
+
+// runWithLegacyFile runs action on store and then, when it is included, on
+// authorized_keys2, so the keys remove takes away don't survive there and
+// check covers it too. list reads both files itself.
+func (a *app) runWithLegacyFile(ctx context.Context, store doorman.KeyStore, action string, positional []string) error {
+	legacy, err := a.legacyStore(store, action)
+	if err != nil {
+		return err
+	}
+	if legacy != nil && action == "check" && a.opts.output == "json" {
+		return withExitCode(exitUsage, fmt.Errorf("check --output json reports on a single file; check %s separately with --file", legacy.Path()))
+	}
+
+	err = a.runAction(ctx, store, action, positional)
+	// BEHAVIOR: check goes on to authorized_keys2 after finding problems in
+	// authorized_keys, so both are reported, but remove stops at a failure
+	if legacy == nil || action == "list" || err != nil && action != "check" {
+		return err
+	}
+	if action == "remove" && !a.opts.cron {
+		fmt.Fprintf(a.stdout, "Also removing from %s:\n", legacy.Path())
+	}
+	legacyErr := a.runAction(ctx, legacy, action, positional)
+	if err != nil {
+		return err
+	}
+	return legacyErr
+}
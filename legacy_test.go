@@ -0,0 +1,81 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunIncludeLegacyFile(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	legacyPath := filepath.Join(e.home, ".ssh", "authorized_keys2")
+	other := newTestKey(t)
+	writeFile(t, path, testKey+" alice\n"+other+" bob\n")
+	writeFile(t, legacyPath, testKey+" alice\n")
+	e.mockKeys(testKey)
+
+	if err := run(e.deps, []string{"doorman", "--yes", "remove", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readFile(t, legacyPath); got != testKey+" alice\n" {
+		t.Errorf("expected authorized_keys2 left alone without --include-legacy-file, got %q", got)
+	}
+
+	writeFile(t, path, testKey+" alice\n"+other+" bob\n")
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--include-legacy-file", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(e.out.String(), "\n")
+	if !strings.HasPrefix(lines[0], "FILE              USER") || !strings.HasPrefix(lines[1], "authorized_keys   alice") ||
+		!strings.HasPrefix(lines[2], "authorized_keys   bob") || !strings.HasPrefix(lines[3], "authorized_keys2  alice") {
+		t.Errorf("expected each key listed with its file, got %q", e.out.String())
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "--include-legacy-file", "remove", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readFile(t, path); got != other+" bob\n" {
+		t.Errorf("expected alice's key removed from authorized_keys, got %q", got)
+	}
+	if got := readFile(t, legacyPath); got != "" {
+		t.Errorf("expected alice's key removed from authorized_keys2, got %q", got)
+	}
+	if !strings.Contains(e.out.String(), "Also removing from "+legacyPath+":\n") {
+		t.Errorf("expected the second file to be announced, got %q", e.out.String())
+	}
+
+	// Adding goes to authorized_keys alone, whatever the configuration says
+	configPath := filepath.Join(e.home, "config.toml")
+	writeFile(t, configPath, "include_legacy_file = true\n")
+	if err := run(e.deps, []string{"doorman", "--config", configPath, "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readFile(t, legacyPath); got != "" {
+		t.Errorf("expected nothing added to authorized_keys2, got %q", got)
+	}
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--config", configPath, "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(e.out.String(), "FILE") {
+		t.Errorf("expected include_legacy_file to list both files, got %q", e.out.String())
+	}
+}
+
+func TestRunIncludeLegacyFileErrors(t *testing.T) {
+	e := newTestEnv(t)
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys2"), "")
+	tests := [][]string{
+		{"doorman", "--include-legacy-file", "add", "alice"},
+		{"doorman", "--include-legacy-file", "--host", "example.com", "remove", "alice"},
+		{"doorman", "--include-legacy-file", "--output", "json", "check"},
+	}
+	for _, args := range tests {
+		if err := run(e.deps, args); exitCodeFor(err) != exitUsage {
+			t.Errorf("%q: expected exit code %d, got %v", args, exitUsage, err)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// listRow describes one key for list's table, and the JSON of list
+// --stale. list --output json builds its entries from it too, so they
+// always agree.
+type listRow struct {
+	User        string `json:"user"`
+	Type        string `json:"type"`
+	Bits        int    `json:"bits"`
+	Fingerprint string `json:"fingerprint"`
+	// GitHubKeyID is the ID GitHub gave the key, if it was fetched with a
+	// token
+	GitHubKeyID int64  `json:"github_key_id,omitempty"`
+	Added       string `json:"added,omitempty"`
+	// Created is the day GitHub says the key was created, if recorded
+	Created string `json:"created,omitempty"`
+	// AgeDays is how many days ago the key was created, or else added, if
+	// either is known
+	AgeDays *int   `json:"age_days,omitempty"`
+	Comment string `json:"comment"`
+	// CA marks a cert-authority line, whose User is the label add-ca wrote
+	// it under
+	CA         bool     `json:"ca,omitempty"`
+	Principals []string `json:"principals,omitempty"`
+	// File is the path of the file the key is in, set only when
+	// authorized_keys2 is listed too
+	File string `json:"file,omitempty"`
+}
+
+func newListRow(key doorman.Key, user string, now time.Time) listRow {
+	row := listRow{
+		User:        user,
+		Type:        key.ShortType(),
+		Bits:        key.Bits(),
+		Fingerprint: key.Fingerprint(),
+		Comment:     key.Note(),
+	}
+	if id, ok := key.GitHubKeyID(); ok {
+		row.GitHubKeyID = id
+	}
+	if added, ok := key.Added(); ok {
+		row.Added = added.Format(time.DateOnly)
+	}
+	if created, ok := key.GitHubCreated(); ok {
+		row.Created = created.Format(time.DateOnly)
+	}
+	if born, ok := keyBorn(key); ok {
+		days := ageDays(born, now)
+		row.AgeDays = &days
+	}
+	if label, principals, ok := certAuthority(key); ok {
+		row.CA, row.Principals = true, principals
+		if label != "" {
+			row.User = label
+		}
+	}
+	return row
+}
+
+// listKeys prints every key in the store as chosen by --output, followed
+// by those in authorized_keys2 when it is included, each with its file;
+// with --output json as a listReport.
+func (a *app) listKeys(ctx context.Context, store doorman.KeyStore) error {
+	stores := []doorman.KeyStore{store}
+	legacy, err := a.legacyStore(store, "list")
+	if err != nil {
+		return err
+	}
+	if legacy != nil {
+		stores = append(stores, legacy)
+	}
+
+	if a.opts.output == "json" {
+		return a.writeListReport(ctx, stores)
+	}
+
+	now := a.now()
+	rows := []listRow{}
+	for _, s := range stores {
+		keys, err := a.newManager(doorman.WithStore(s)).List(ctx)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", s.Path(), err)
+		}
+		for _, key := range keys {
+			row := newListRow(key, a.keyUser(key), now)
+			if legacy != nil {
+				row.File = s.Path()
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	writeTable(a.stdout, rows, !a.opts.noHeader, a.terminalWidth())
+	return nil
+}
+
+// listReportVersion is the version of the report list --output json
+// prints. It changes when a field is removed or changes meaning, not when
+// one is added.
+const listReportVersion = 1
+
+// listReport is what list --output json prints: every key line of the
+// files listed, for inventories and audits.
+type listReport struct {
+	SchemaVersion int `json:"schema_version"`
+	// Files are those listed, authorized_keys and then authorized_keys2
+	// when it is included, as they were when read, so a consumer can tell
+	// when what it has is out of date
+	Files   []listFile  `json:"files"`
+	Entries []listEntry `json:"entries"`
+}
+
+type listFile struct {
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+	// Modified is when the file was last written, in UTC; it is left out
+	// for files on another host
+	Modified string `json:"modified,omitempty"`
+	// SHA256 is the hex digest of the file's content
+	SHA256 string `json:"sha256"`
+}
+
+type listEntry struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	// Managed reports whether doorman installed the key, as remove
+	// --unmanaged decides
+	Managed           bool         `json:"managed"`
+	User              string       `json:"user"`
+	Type              string       `json:"type"`
+	Bits              int          `json:"bits"`
+	FingerprintSHA256 string       `json:"fingerprint_sha256"`
+	FingerprintMD5    string       `json:"fingerprint_md5"`
+	Options           []listOption `json:"options"`
+	// OptionsError says why the options can't be parsed, for which sshd
+	// ignores the line
+	OptionsError string       `json:"options_error,omitempty"`
+	Comment      string       `json:"comment"`
+	Metadata     listMetadata `json:"metadata"`
+	AgeDays      *int         `json:"age_days,omitempty"`
+	CA           bool         `json:"ca,omitempty"`
+	Principals   []string     `json:"principals,omitempty"`
+}
+
+type listOption struct {
+	Name string `json:"name"`
+	// Value is left out for options without one, such as no-pty
+	Value *string `json:"value,omitempty"`
+}
+
+// listMetadata is what doorman recorded about a key: the tokens in its
+// comment, and the provider the state file says its user's keys come from.
+type listMetadata struct {
+	Added string `json:"added,omitempty"`
+	// Expires is when the key stops being installed, as an RFC 3339 time
+	Expires     string `json:"expires,omitempty"`
+	Provider    string `json:"provider,omitempty"`
+	GitHubKeyID int64  `json:"github_key_id,omitempty"`
+	Created     string `json:"created,omitempty"`
+}
+
+// writeListReport prints every key in stores as a listReport.
+func (a *app) writeListReport(ctx context.Context, stores []doorman.KeyStore) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	state, _, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	now := a.now()
+	report := listReport{SchemaVersion: listReportVersion, Files: []listFile{}, Entries: []listEntry{}}
+	for _, s := range stores {
+		file, entries, err := a.readListFile(s)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", s.Path(), err)
+		}
+		report.Files = append(report.Files, file)
+
+		recorded := recordedFingerprints(state, s.Path())
+		for i, entry := range entries {
+			key, ok := entry.Key()
+			if !ok {
+				continue
+			}
+			row := newListRow(key, a.keyUser(key), now)
+			listed := listEntry{
+				File:              s.Path(),
+				Line:              i + 1,
+				Managed:           managedKey(key, recorded),
+				User:              row.User,
+				Type:              key.Type,
+				Bits:              row.Bits,
+				FingerprintSHA256: row.Fingerprint,
+				FingerprintMD5:    key.FingerprintMD5(),
+				Options:           []listOption{},
+				Comment:           row.Comment,
+				Metadata:          listMetadata{Added: row.Added, GitHubKeyID: row.GitHubKeyID, Created: row.Created},
+				AgeDays:           row.AgeDays,
+				CA:                row.CA,
+				Principals:        row.Principals,
+			}
+			options, err := key.OptionList()
+			if err != nil {
+				listed.OptionsError = err.Error()
+			}
+			for _, option := range options {
+				parsed := listOption{Name: option.Name}
+				if option.HasValue {
+					value := option.Value
+					parsed.Value = &value
+				}
+				listed.Options = append(listed.Options, parsed)
+			}
+			if expires, ok := key.Expires(); ok {
+				listed.Metadata.Expires = expires.UTC().Format(time.RFC3339)
+			}
+			if user, ok := state.Files[s.Path()][row.User]; ok && listed.Managed && !row.CA {
+				listed.Metadata.Provider = user.Provider
+			}
+			report.Entries = append(report.Entries, listed)
+		}
+	}
+	encoder := json.NewEncoder(a.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+// readListFile loads store's entries and describes the file they came
+// from. A local file is hashed as it is on disk, line endings and all; one
+// on another host as doorman read it.
+func (a *app) readListFile(store doorman.KeyStore) (listFile, []doorman.Entry, error) {
+	file := listFile{Path: store.Path(), Exists: true}
+	local := a.opts.host == ""
+	if local {
+		if info, err := os.Stat(store.Path()); err == nil {
+			file.Modified = info.ModTime().UTC().Format(time.RFC3339)
+		}
+	}
+	entries, err := store.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		file.Exists, file.Modified, err = false, "", nil
+	}
+	if err != nil {
+		return file, nil, err
+	}
+	data := doorman.FormatEntries(entries)
+	if local && file.Exists {
+		if raw, err := os.ReadFile(store.Path()); err == nil {
+			data = raw
+		}
+	}
+	sum := sha256.Sum256(data)
+	file.SHA256 = hex.EncodeToString(sum[:])
+	return file, entries, nil
+}
+
+// minCommentWidth is the narrowest a comment is cut to for a narrow terminal
+const minCommentWidth = 10
+
+// writeTable prints rows as aligned columns, with the ADDED column only when
+// a key has a date, showing the others' as unknown and both dates of keys
+// whose GitHub creation day is recorded, and the KEY ID column only when a
+// key has a GitHub key ID. When the table is wider than width, comments are
+// cut to fit; no other column is, so fingerprints can always be compared. A
+// width of 0 means there is no terminal to fit.
+func writeTable(w io.Writer, rows []listRow, header bool, width int) {
+	headers := []string{"USER", "TYPE", "BITS", "FINGERPRINT", "COMMENT"}
+	hasAdded, hasFile, hasKeyID := false, false, false
+	for _, row := range rows {
+		hasAdded = hasAdded || row.AgeDays != nil
+		hasFile = hasFile || row.File != ""
+		hasKeyID = hasKeyID || row.GitHubKeyID != 0
+	}
+	if hasAdded {
+		headers = []string{"USER", "TYPE", "BITS", "FINGERPRINT", "ADDED", "COMMENT"}
+	}
+	if hasKeyID {
+		headers = slices.Insert(headers, len(headers)-1, "KEY ID")
+	}
+	if hasFile {
+		headers = append([]string{"FILE"}, headers...)
+	}
+
+	cells := make([][]string, 0, len(rows)+1)
+	if header {
+		cells = append(cells, headers)
+	}
+	for _, row := range rows {
+		line := []string{row.User, row.Type, fmt.Sprint(row.Bits), row.Fingerprint, row.Comment}
+		if row.Bits == 0 {
+			line[2] = "?"
+		}
+		if row.CA {
+			line[0] = "ca:" + row.User
+			line[4] = "cert-authority for any principal"
+			if len(row.Principals) > 0 {
+				line[4] = "cert-authority for " + strings.Join(row.Principals, ",")
+			}
+		}
+		if hasAdded {
+			added := "unknown"
+			switch {
+			case row.Created != "" && row.Added != "":
+				added = "created " + row.Created + ", installed " + row.Added
+			case row.Created != "":
+				added = "created " + row.Created + " (" + formatDaysAgo(*row.AgeDays) + ")"
+			case row.AgeDays != nil:
+				added = row.Added + " (" + formatDaysAgo(*row.AgeDays) + ")"
+			}
+			line = []string{line[0], line[1], line[2], line[3], added, line[4]}
+		}
+		if hasKeyID {
+			id := ""
+			if row.GitHubKeyID != 0 {
+				id = strconv.FormatInt(row.GitHubKeyID, 10)
+			}
+			line = slices.Insert(line, len(line)-1, id)
+		}
+		if hasFile {
+			line = append([]string{filepath.Base(row.File)}, line...)
+		}
+		cells = append(cells, line)
+	}
+
+	widths := make([]int, len(headers))
+	for _, line := range cells {
+		for i, cell := range line {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	last := len(headers) - 1
+	if width > 0 {
+		fixed := 0
+		for _, w := range widths[:last] {
+			fixed += w + 2
+		}
+		widths[last] = min(widths[last], max(width-fixed, minCommentWidth))
+	}
+
+	for _, line := range cells {
+		var b strings.Builder
+		for i, cell := range line[:last] {
+			b.WriteString(cell)
+			b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+2))
+		}
+		b.WriteString(truncate(line[last], widths[last]))
+		fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+	}
+}
+
+// ageDays returns how many whole days before now added was.
+func ageDays(added, now time.Time) int {
+	return int(now.Sub(added).Hours() / 24)
+}
+
+// daysAgo describes how long before now added was, e.g. "412 days ago".
+func daysAgo(added, now time.Time) string {
+	return formatDaysAgo(ageDays(added, now))
+}
+
+func formatDaysAgo(days int) string {
+	switch {
+	case days <= 0:
+		return "today"
+	case days == 1:
+		return "yesterday"
+	}
+	return fmt.Sprintf("%d days ago", days)
+}
+
+// truncate cuts s to n characters, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:n-1]) + "…"
+}
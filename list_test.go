@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const listFixture = "# managed by doorman\n" +
+	"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBMpUdogPMMHu+nQNMCIXHV5Emg2Caeeb8/Qmy8gs/Kc alice\n" +
+	"ssh-rsa KEY2... work laptop bob\n"
+
+func TestRunList(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    []string
+		expected string
+	}{
+		{"table", nil, "" +
+			"USER   TYPE     BITS  FINGERPRINT                                         COMMENT\n" +
+			"alice  ed25519  256   SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I\n" +
+			"bob    rsa      ?                                                         work laptop\n"},
+		{"no header", []string{"--no-header"}, "" +
+			"alice  ed25519  256  SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I\n" +
+			"bob    rsa      ?                                                        work laptop\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), listFixture)
+			// Listing asks nothing, so it works without a terminal or --yes
+			e.stdinIsTerminal = func() bool { return false }
+
+			if err := run(e.deps, append([]string{"doorman", "list"}, tt.flags...)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if e.out.String() != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, e.out.String())
+			}
+		})
+	}
+}
+
+// TestRunListJSON compares list --output json with testdata/list.json,
+// which locks the schema. A change to the report that is meant to be made
+// updates the file, and listReportVersion if a field is removed or
+// changes meaning.
+func TestRunListJSON(t *testing.T) {
+	e := newTestEnv(t)
+	e.now = func() time.Time { return time.Date(2026, 5, 4, 12, 0, 0, 0, time.UTC) }
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	bob := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBOn3TBov3B0UZp0HGKn7os0dWuSgmtHs6RGUP2iSHrkxtscIipIrEnAKicU86H4JXwp0TRy/417kiPJvydzbtPk="
+	carol := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJYgr1474Dqzl3QKBUlyKA2YY2GfiqgAK/4hNGjeSMv/"
+	writeFile(t, path, "# managed by doorman\n"+
+		`no-pty,command="echo hi" `+testKey+" laptop gh-key-id=4242 gh-created=2024-01-02 alice doorman-added=2025-03-18 doorman-expires=2026-06-30\n"+
+		bob+" bob\n"+
+		"\n"+
+		`cert-authority,principals="alice,bob" `+carol+" doorman-ca:user_ca\n"+
+		"from=10.0.0.1 "+carol+" carol\r\n")
+	modified := time.Date(2026, 5, 1, 9, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	statePath, err := e.statePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := managedState{Version: stateVersion, Files: map[string]map[string]managedUser{path: {
+		"alice": {Provider: "github", Fingerprints: []string{"SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I"}},
+		"bob":   {Provider: "gitlab", Fingerprints: []string{"SHA256:4oZtYdU79gikeUGGyjqGaIoY8Y5IjQ91TzTnLBjunFk"}},
+	}}}
+	if err := saveState(statePath, state); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(e.deps, []string{"doorman", "list", "--output", "json"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	golden, err := os.ReadFile(filepath.Join("testdata", "list.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.ReplaceAll(e.out.String(), path, "/home/alice/.ssh/authorized_keys"); got != string(golden) {
+		t.Errorf("expected\n%s\ngot\n%s", golden, got)
+	}
+}
+
+func TestRunListJSONMissingFile(t *testing.T) {
+	e := newTestEnv(t)
+	if err := run(e.deps, []string{"doorman", "list", "--output", "json"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	expected := `{
+  "schema_version": 1,
+  "files": [
+    {
+      "path": "` + path + `",
+      "exists": false,
+      "sha256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+    }
+  ],
+  "entries": []
+}
+`
+	if e.out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, e.out.String())
+	}
+}
+
+func TestRunListErrors(t *testing.T) {
+	e := newTestEnv(t)
+	os.WriteFile(filepath.Join(e.home, ".ssh", "authorized_keys"), []byte(listFixture), 0600)
+
+	if err := run(e.deps, []string{"doorman", "list", "alice"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected usage error for list with a username, got %v", err)
+	}
+	if err := run(e.deps, []string{"doorman", "list", "--output", "yaml"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected usage error for an unknown output, got %v", err)
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	age := 412
+	rows := []listRow{
+		{User: "alice", Type: "ed25519", Bits: 256, Fingerprint: "SHA256:abc", Added: "2025-03-18", AgeDays: &age, Comment: "a rather long comment about this key"},
+		{User: "bob", Type: "rsa", Bits: 4096, Fingerprint: "SHA256:defghi", Comment: "laptop"},
+	}
+
+	tests := []struct {
+		name     string
+		width    int
+		expected string
+	}{
+		{"no terminal", 0, "" +
+			"USER   TYPE     BITS  FINGERPRINT    ADDED                      COMMENT\n" +
+			"alice  ed25519  256   SHA256:abc     2025-03-18 (412 days ago)  a rather long comment about this key\n" +
+			"bob    rsa      4096  SHA256:defghi  unknown                    laptop\n"},
+		{"narrow terminal", 79, "" +
+			"USER   TYPE     BITS  FINGERPRINT    ADDED                      COMMENT\n" +
+			"alice  ed25519  256   SHA256:abc     2025-03-18 (412 days ago)  a rather long …\n" +
+			"bob    rsa      4096  SHA256:defghi  unknown                    laptop\n"},
+		{"too narrow for the fingerprints", 20, "" +
+			"USER   TYPE     BITS  FINGERPRINT    ADDED                      COMMENT\n" +
+			"alice  ed25519  256   SHA256:abc     2025-03-18 (412 days ago)  a rather …\n" +
+			"bob    rsa      4096  SHA256:defghi  unknown                    laptop\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			writeTable(&out, rows, true, tt.width)
+			if out.String() != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestRunListAdded(t *testing.T) {
+	e := newTestEnv(t)
+	e.now = func() time.Time { return time.Date(2026, 5, 4, 12, 0, 0, 0, time.UTC) }
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), ""+
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBMpUdogPMMHu+nQNMCIXHV5Emg2Caeeb8/Qmy8gs/Kc alice doorman-added=2025-03-18\n"+
+		"ssh-rsa KEY2... work laptop bob\n")
+
+	if err := run(e.deps, []string{"doorman", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "" +
+		"USER   TYPE     BITS  FINGERPRINT                                         ADDED                      COMMENT\n" +
+		"alice  ed25519  256   SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I  2025-03-18 (412 days ago)\n" +
+		"bob    rsa      ?                                                         unknown                    work laptop\n"
+	if e.out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, e.out.String())
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "list", "--output", "json"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), `"added": "2025-03-18"
+      },
+      "age_days": 412`) {
+		t.Errorf("expected the date and age in JSON, got %s", e.out.String())
+	}
+}
+
+func TestRunListGitHubKeyIDs(t *testing.T) {
+	e := newTestEnv(t)
+	e.env["GITHUB_TOKEN"] = "secret"
+	var authorization string
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		authorization = request.Header.Get("Authorization")
+		body := `[{"id": 4242, "key": "` + testKey + `"}]`
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+	})
+
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if authorization != "Bearer secret" {
+		t.Errorf("expected the token to be sent, got %q", authorization)
+	}
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	if got := readFile(t, path); got != testKey+" gh-key-id=4242 alice"+today+"\n" {
+		t.Errorf("expected the key ID recorded, got %q", got)
+	}
+
+	// Keys without IDs are listed alongside
+	writeFile(t, path, readFile(t, path)+newTestKey(t)+" bob\n")
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(e.out.String(), "\n")
+	if !strings.Contains(lines[0], "KEY ID  COMMENT") || !strings.Contains(lines[1], "  4242") || strings.Contains(lines[1], "gh-key-id") {
+		t.Errorf("expected a KEY ID column, got %q", e.out.String())
+	}
+}
+
+func TestRunListGitHubCreated(t *testing.T) {
+	e := newTestEnv(t)
+	e.now = func() time.Time { return time.Date(2024, 6, 11, 12, 0, 0, 0, time.UTC) }
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), ""+
+		testKey+" gh-key-id=4242 gh-created=2023-11-02 alice doorman-added=2024-06-01\n"+
+		"ssh-rsa KEY2... bob doorman-added=2024-06-01\n")
+
+	if err := run(e.deps, []string{"doorman", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(e.out.String(), "\n")
+	if !strings.Contains(lines[1], "created 2023-11-02, installed 2024-06-01") || !strings.Contains(lines[2], "2024-06-01 (10 days ago)") {
+		t.Errorf("expected both dates of alice's key, got %q", e.out.String())
+	}
+
+	// Age counts from creation
+	e.out.Reset()
+	err := run(e.deps, []string{"doorman", "list", "--stale", "180d"})
+	if exitCodeFor(err) != exitProblems {
+		t.Errorf("expected alice's key to be stale, got %v", err)
+	}
+	if !strings.Contains(e.out.String(), "created 2023-11-02, installed 2024-06-01, 222 days ago") || strings.Contains(e.out.String(), "bob:") {
+		t.Errorf("expected only alice's key stale, got %q", e.out.String())
+	}
+}
+
+func TestRunListLongLines(t *testing.T) {
+	e := newTestEnv(t)
+	addresses := make([]string, 30000)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255)
+	}
+	long := `from="` + strings.Join(addresses, ",") + `" ` + newTestKey(t) + " bob"
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, long+"\n")
+
+	if err := run(e.deps, []string{"doorman", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), "bob") {
+		t.Errorf("expected the long line's key listed, got %q", e.out.String())
+	}
+	e.mockKeys(testKey)
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readFile(t, path); got != long+"\n"+testKey+" alice"+today+"\n" {
+		t.Errorf("expected the long line kept byte for byte, got %d bytes", len(got))
+	}
+
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "max_line_length = 65536\n")
+	err := run(e.deps, []string{"doorman", "--config", config, "list"})
+	if err == nil || !strings.Contains(err.Error(), "line 1 is longer than 65536 bytes") {
+		t.Errorf("expected the line over max_line_length reported, got %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	manName        = "doorman - manage SSH access using GitHub usernames"
+	manDescription = "doorman fetches users' public SSH keys from GitHub, or another key provider, and adds them to or removes them from the authorized_keys file sshd reads. Each key is labeled with the username it was added for, so it can be found again. Every change is previewed and confirmed before it is written, unless --yes or --cron is given."
+)
+
+// manFiles are the files doorman reads and writes, and what for.
+var manFiles = []flagHelp{
+	{"~/.config/doorman/config.toml", "settings, under $XDG_CONFIG_HOME if set"},
+	{"~/.ssh/authorized_keys", "the file managed unless --file, the configuration or sshd_config say otherwise"},
+	{"~/.ssh/.doorman_audit.jsonl", "the audit log of every change"},
+	{"~/.local/state/doorman/state.json", "the users doorman manages, under $XDG_STATE_HOME if set"},
+	{"~/.cache/doorman", "keys cached by the keys action, key lists kept for conditional requests, and the copies --offline uses, under $XDG_CACHE_HOME if set"},
+}
+
+// printManual writes the manual in format, roff or markdown. It holds
+// nothing that changes between runs, so packages can ship its output.
+func (d *deps) printManual(format string) error {
+	switch format {
+	case "", "roff":
+		writeRoffManual(d.stdout)
+	case "markdown":
+		writeMarkdownManual(d.stdout)
+	default:
+		return withExitCode(exitUsage, fmt.Errorf("invalid format '%s': use roff or markdown", format))
+	}
+	return nil
+}
+
+// commandName returns the part of a command's usage after [flags].
+func commandName(c commandHelp) string {
+	return strings.TrimPrefix(c.usage, "[flags] ")
+}
+
+func writeRoffManual(w io.Writer) {
+	fmt.Fprintln(w, `.TH DOORMAN 1 "" "doorman" "User Commands"`)
+	fmt.Fprintln(w, ".SH NAME")
+	fmt.Fprintln(w, roffEscape(manName))
+	fmt.Fprintln(w, ".SH SYNOPSIS")
+	fmt.Fprintln(w, ".nf")
+	for _, c := range commands {
+		fmt.Fprintln(w, roffEscape("doorman "+c.usage))
+	}
+	fmt.Fprintln(w, ".fi")
+	fmt.Fprintln(w, ".SH DESCRIPTION")
+	fmt.Fprintln(w, roffEscape(manDescription))
+	fmt.Fprintln(w, ".SH COMMANDS")
+	for _, c := range commands {
+		fmt.Fprintln(w, ".TP")
+		fmt.Fprintln(w, ".B "+roffEscape(commandName(c)))
+		fmt.Fprintln(w, roffEscape(c.summary))
+	}
+	fmt.Fprintln(w, ".SH OPTIONS")
+	for _, group := range flagGroups() {
+		fmt.Fprintln(w, ".SS "+roffEscape(group.title))
+		for _, f := range group.flags {
+			fmt.Fprintln(w, ".TP")
+			fmt.Fprintln(w, ".B "+roffEscape(f.name))
+			fmt.Fprintln(w, roffEscape(f.description))
+		}
+	}
+	fmt.Fprintln(w, ".SH EXIT STATUS")
+	for _, c := range exitCodeDescriptions {
+		fmt.Fprintln(w, ".TP")
+		fmt.Fprintf(w, ".B %d\n", c.code)
+		fmt.Fprintln(w, roffEscape(c.description))
+	}
+	fmt.Fprintln(w, ".SH FILES")
+	for _, f := range manFiles {
+		fmt.Fprintln(w, ".TP")
+		fmt.Fprintln(w, ".I "+roffEscape(f.name))
+		fmt.Fprintln(w, roffEscape(f.description))
+	}
+	fmt.Fprintln(w, ".SH EXAMPLES")
+	for _, e := range examples {
+		fmt.Fprintln(w, ".PP")
+		fmt.Fprintln(w, roffEscape(e.description)+":")
+		fmt.Fprintln(w, ".PP")
+		fmt.Fprintln(w, ".RS")
+		fmt.Fprintln(w, ".B "+roffEscape(e.command))
+		fmt.Fprintln(w, ".RE")
+	}
+	fmt.Fprintln(w, ".SH SEE ALSO")
+	fmt.Fprintln(w, ".BR ssh-keygen (1),")
+	fmt.Fprintln(w, ".BR sshd_config (5)")
+}
+
+// roffEscape makes text safe to put on a roff line: backslashes and
+// hyphens are escaped, and a leading control character is neutralized.
+func roffEscape(text string) string {
+	text = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(text)
+	if strings.HasPrefix(text, ".") || strings.HasPrefix(text, "'") {
+		text = `\&` + text
+	}
+	return text
+}
+
+func writeMarkdownManual(w io.Writer) {
+	fmt.Fprintln(w, "# doorman(1)")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Name")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, manName)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Synopsis")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "```")
+	for _, c := range commands {
+		fmt.Fprintln(w, "doorman "+c.usage)
+	}
+	fmt.Fprintln(w, "```")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Description")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, manDescription)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Commands")
+	fmt.Fprintln(w)
+	markdownTable(w, "Command", "Description")
+	for _, c := range commands {
+		markdownRow(w, "`"+commandName(c)+"`", c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Options")
+	for _, group := range flagGroups() {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "### "+group.title)
+		fmt.Fprintln(w)
+		markdownTable(w, "Flag", "Description")
+		for _, f := range group.flags {
+			markdownRow(w, "`"+f.name+"`", f.description)
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Exit status")
+	fmt.Fprintln(w)
+	markdownTable(w, "Code", "Meaning")
+	for _, c := range exitCodeDescriptions {
+		markdownRow(w, fmt.Sprint(c.code), c.description)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Files")
+	fmt.Fprintln(w)
+	markdownTable(w, "File", "Purpose")
+	for _, f := range manFiles {
+		markdownRow(w, "`"+f.name+"`", f.description)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "## Examples")
+	for _, e := range examples {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, e.description+":")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "```")
+		fmt.Fprintln(w, e.command)
+		fmt.Fprintln(w, "```")
+	}
+}
+
+func markdownTable(w io.Writer, headers ...string) {
+	fmt.Fprintln(w, "| "+strings.Join(headers, " | ")+" |")
+	fmt.Fprintln(w, strings.Repeat("|---", len(headers))+"|")
+}
+
+// markdownRow writes a table row, escaping the pipes that would otherwise
+// end a cell early.
+func markdownRow(w io.Writer, cells ...string) {
+	for i, cell := range cells {
+		cells[i] = strings.ReplaceAll(cell, "|", `\|`)
+	}
+	fmt.Fprintln(w, "| "+strings.Join(cells, " | ")+" |")
+}
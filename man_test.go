@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+// TestFlagsDocumented keeps usage and the man page from drifting from the
+// flags parseArgs accepts.
+func TestFlagsDocumented(t *testing.T) {
+	documented := map[string]bool{}
+	for _, group := range flagGroups() {
+		for _, f := range group.flags {
+			for _, name := range strings.Split(f.name, ", ") {
+				documented[strings.TrimLeft(strings.Fields(name)[0], "-")] = true
+			}
+		}
+	}
+	e := newTestEnv(t)
+	e.flagSet(&options{}).VisitAll(func(f *flag.Flag) {
+		if !documented[f.Name] {
+			t.Errorf("flag -%s is not documented in flagGroups", f.Name)
+		}
+	})
+}
+
+func TestRunMan(t *testing.T) {
+	e := newTestEnv(t)
+	if err := run(e.deps, []string{"doorman", "man"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	roff := e.out.String()
+	for _, expected := range []string{
+		".TH DOORMAN 1",
+		".B \\-\\-file <path>\nmanage this authorized_keys file",
+		".B 5\nno keys: the user has no public keys",
+		".B doorman remove alice bob",
+	} {
+		if !strings.Contains(roff, expected) {
+			t.Errorf("expected %q in the man page", expected)
+		}
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "man"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.String() != roff {
+		t.Error("expected the man page to be the same every time")
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "man", "--format", "markdown"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), "| `--log-format text\\|json` | format of log events (default text) |") {
+		t.Errorf("unexpected markdown %q", e.out.String())
+	}
+
+	if err := run(e.deps, []string{"doorman", "man", "--format", "html"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected a usage error for an unknown format, got %v", err)
+	}
+}
+
+func TestRoffEscape(t *testing.T) {
+	tests := map[string]string{
+		"--file <path>":  `\-\-file <path>`,
+		`C:\ssh`:         `C:\essh`,
+		".doorman_audit": `\&.doorman_audit`,
+	}
+	for text, expected := range tests {
+		if actual := roffEscape(text); actual != expected {
+			t.Errorf("roffEscape(%q) = %q, expected %q", text, actual, expected)
+		}
+	}
+}
+
+func TestPrintUsageWraps(t *testing.T) {
+	var out bytes.Buffer
+	printUsage(&out)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if len(line) > usageWidth {
+			t.Errorf("line longer than %d characters: %q", usageWidth, line)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// metrics counts what serve does, for Prometheus to scrape.
+type metrics struct {
+	registry *prometheus.Registry
+
+	syncsAttempted prometheus.Counter
+	syncsSucceeded prometheus.Counter
+	syncsFailed    prometheus.Counter
+	keysAdded      prometheus.Counter
+	keysRemoved    prometheus.Counter
+	fetchErrors    *prometheus.CounterVec
+	lastSuccess    *prometheus.GaugeVec
+	managedKeys    prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		syncsAttempted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "doorman_syncs_attempted_total",
+			Help: "Syncs of a user's keys attempted.",
+		}),
+		syncsSucceeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "doorman_syncs_succeeded_total",
+			Help: "Syncs of a user's keys that succeeded.",
+		}),
+		syncsFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "doorman_syncs_failed_total",
+			Help: "Syncs of a user's keys that failed.",
+		}),
+		keysAdded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "doorman_keys_added_total",
+			Help: "Keys written to authorized_keys.",
+		}),
+		keysRemoved: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "doorman_keys_removed_total",
+			Help: "Keys deleted from authorized_keys.",
+		}),
+		fetchErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "doorman_fetch_errors_total",
+			Help: "Failures fetching keys, by class: network, rate_limit, timeout, not_found or no_keys.",
+		}, []string{"class"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "doorman_last_successful_sync_timestamp_seconds",
+			Help: "When each user's keys were last synced successfully, as a Unix time.",
+		}, []string{"user"}),
+		managedKeys: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "doorman_managed_keys",
+			Help: "Keys in authorized_keys after the last sync.",
+		}),
+	}
+	m.registry.MustRegister(m.syncsAttempted, m.syncsSucceeded, m.syncsFailed,
+		m.keysAdded, m.keysRemoved, m.fetchErrors, m.lastSuccess, m.managedKeys)
+	return m
+}
+
+// observe counts the keys a Manager writes and deletes.
+func (m *metrics) observe(event doorman.Event) {
+	switch event.Type {
+	case doorman.EventKeyAdded:
+		m.keysAdded.Inc()
+	case doorman.EventKeyRemoved:
+		m.keysRemoved.Inc()
+	}
+}
+
+// recordSync counts a sync of username that returned err. A nil metrics
+// does nothing, so callers needn't check.
+func (m *metrics) recordSync(username string, err error, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.syncsAttempted.Inc()
+	if err == nil {
+		m.syncsSucceeded.Inc()
+		m.lastSuccess.WithLabelValues(username).Set(float64(now.Unix()))
+		return
+	}
+	m.syncsFailed.Inc()
+	if class := fetchErrorClass(err); class != "" {
+		m.fetchErrors.WithLabelValues(class).Inc()
+	}
+}
+
+// fetchErrorClass names the kind of fetch failure err is, or returns "" if
+// it isn't one.
+func fetchErrorClass(err error) string {
+	switch {
+	// A rate limit outlasting the wait is also a FetchError, so check it first
+	case errors.As(err, new(*doorman.RateLimitError)):
+		return "rate_limit"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, new(*doorman.FetchError)):
+		return "network"
+	case errors.Is(err, doorman.ErrInvalidUser), errors.Is(err, doorman.ErrUserNotFound), errors.As(err, new(*doorman.RenamedUserError)):
+		return "not_found"
+	case errors.Is(err, doorman.ErrNoKeys):
+		return "no_keys"
+	}
+	return ""
+}
+
+// metricsAddress returns where serve exposes /metrics: --metrics-address,
+// the metrics_address setting, or "" for nowhere.
+func (a *app) metricsAddress() string {
+	if a.opts.metricsAddress != "" {
+		return a.opts.metricsAddress
+	}
+	return a.cfg.MetricsAddress
+}
+
+// handleEvent passes a Manager's event on to --events and the metrics,
+// whichever are on.
+func (a *app) handleEvent(event doorman.Event) {
+	if a.events != nil {
+		a.events(event)
+	}
+	if a.metrics != nil {
+		a.metrics.observe(event)
+	}
+}
+
+func (a *app) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(a.metrics.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// serveMetrics exposes /metrics on listener until ctx is done.
+func (a *app) serveMetrics(ctx context.Context, listener net.Listener) error {
+	server := &http.Server{
+		Handler:           a.metricsHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+func TestMetricsAfterSync(t *testing.T) {
+	e := newTestEnv(t)
+	e.opts.yes = true
+	e.metrics = newMetrics()
+	e.audit = &auditLog{deps: e.deps}
+	defer e.audit.close()
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	store := doorman.NewFileStore(path)
+	manager := e.newManager(doorman.WithSource(userSource{"alice": testKey}), doorman.WithStore(store))
+
+	e.syncAll(context.Background(), manager, store, []string{"alice", "bob"})
+
+	server := httptest.NewServer(e.metricsHandler())
+	defer server.Close()
+	response, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"doorman_syncs_attempted_total 2\n",
+		"doorman_syncs_succeeded_total 1\n",
+		"doorman_syncs_failed_total 1\n",
+		"doorman_keys_added_total 1\n",
+		"doorman_keys_removed_total 0\n",
+		`doorman_fetch_errors_total{class="not_found"} 1` + "\n",
+		`doorman_last_successful_sync_timestamp_seconds{user="alice"} `,
+		"doorman_managed_keys 1\n",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("expected %q in:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(string(body), `user="bob"`) {
+		t.Errorf("expected no successful sync for bob:\n%s", body)
+	}
+}
+
+func TestFetchErrorClass(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"network", &doorman.FetchError{Err: errors.New("connection refused")}, "network"},
+		{"rate limit", &doorman.FetchError{Err: &doorman.RateLimitError{}}, "rate_limit"},
+		{"timeout", &doorman.FetchError{Err: context.DeadlineExceeded}, "timeout"},
+		{"unknown user", doorman.ErrUserNotFound, "not_found"},
+		{"no keys", doorman.ErrNoKeys, "no_keys"},
+		{"not a fetch error", errors.New("disk full"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if class := fetchErrorClass(tt.err); class != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, class)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// offlineDir returns where the key lists fetched from provider at location
+// are kept for --offline: a directory per source, so a user's keys from one
+// provider are never mistaken for their keys from another.
+func (a *app) offlineDir(provider, location string) (string, error) {
+	dir, err := a.cacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(provider + "\n" + location))
+	return filepath.Join(dir, "offline", hex.EncodeToString(sum[:8])), nil
+}
+
+// cachingSource keeps a copy of every key list its source returns, one file
+// per user, and with --offline reads the copy instead of the source.
+type cachingSource struct {
+	doorman.KeySource
+	app *app
+	dir string
+}
+
+func (s cachingSource) Keys(ctx context.Context, username string) ([]doorman.PublicKey, error) {
+	// BEHAVIOR: The username names the cache file, so it must not be able
+	// to point outside the cache directory
+	cacheable := cacheableName(username)
+	if s.app.opts.offline {
+		if !cacheable {
+			return nil, fmt.Errorf("%w '%s'", doorman.ErrInvalidUser, username)
+		}
+		return s.app.readOffline(filepath.Join(s.dir, username+".keys"), username)
+	}
+	if !cacheable {
+		return s.KeySource.Keys(ctx, username)
+	}
+	path := filepath.Join(s.dir, username+".keys")
+
+	keys, err := s.KeySource.Keys(ctx, username)
+	if err == nil {
+		if err := writeFileAtomic(path, formatPublicKeys(keys)); err != nil {
+			s.app.logger.Warn("cache_write_failed", "user", username, "path", path, "error", err)
+		}
+	}
+	return keys, err
+}
+
+// cacheableName reports whether username can safely name a cache file.
+func cacheableName(username string) bool {
+	return username != "" && !strings.ContainsAny(username, `/\`) && !strings.HasPrefix(username, ".")
+}
+
+// formatPublicKeys formats keys one per line, as providers publish them.
+func formatPublicKeys(keys []doorman.PublicKey) []byte {
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key.String())
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// readOffline returns the keys cached at path for username, refusing them
+// if they are older than max_offline_age, and notes when they were fetched
+// so the preview can say.
+func (a *app) readOffline(path, username string) ([]doorman.PublicKey, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no cached keys for %s (last fetch never)", username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	maxAge, err := a.maxOfflineAge()
+	if err != nil {
+		return nil, err
+	}
+	age := a.now().Sub(info.ModTime())
+	if maxAge > 0 && age > maxAge {
+		return nil, fmt.Errorf("cached keys for %s are too old to use offline (last fetch %s ago, max_offline_age is %s)", username, age.Round(time.Second), formatAge(maxAge))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cached keys: %w", err)
+	}
+	a.offlineFetched.Store(username, info.ModTime())
+	return doorman.ParsePublicKeys(data), nil
+}
+
+// maxOfflineAge returns how old keys --offline may use, or 0 for no limit.
+func (a *app) maxOfflineAge() (time.Duration, error) {
+	if a.cfg.MaxOfflineAge == "" {
+		return 0, nil
+	}
+	age, err := parseAge(a.cfg.MaxOfflineAge)
+	if err != nil {
+		return 0, withExitCode(exitUsage, fmt.Errorf("invalid max_offline_age '%s': %w", a.cfg.MaxOfflineAge, err))
+	}
+	return age, nil
+}
+
+// offlineNotice says how stale the cached keys are as each user's keys are
+// handed to the Manager, just before their preview. Cached copies are read
+// through cachingSource, possibly several at once, so it only records when
+// the keys were fetched.
+type offlineNotice struct {
+	doorman.KeySource
+	app *app
+}
+
+func (s offlineNotice) Keys(ctx context.Context, username string) ([]doorman.PublicKey, error) {
+	keys, err := s.KeySource.Keys(ctx, username)
+	if fetched, ok := s.app.offlineFetched.Load(username); ok && err == nil {
+		fetched := fetched.(time.Time)
+		s.app.progress.interrupt()
+		fmt.Fprintf(s.app.stdout, "Offline: using %s's keys cached %s ago (fetched %s)\n", username, s.app.now().Sub(fetched).Round(time.Second), fetched.Local().Format(time.DateTime))
+	}
+	return keys, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunOffline(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	requests := 0
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		requests++
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(testKey + "\n"))}, nil
+	})
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	writeFile(t, path, "")
+
+	e.mockHTTPError(errors.New("the network is down"))
+	fetched := time.Now()
+	e.now = func() time.Time { return fetched.Add(3 * time.Hour) }
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "--offline", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("expected the cached keys to be added, got %q", content)
+	}
+	if !strings.Contains(e.out.String(), "Offline: using alice's keys cached 3h0m") {
+		t.Errorf("expected the age of the cached keys to be shown, got %q", e.out.String())
+	}
+	if requests != 1 {
+		t.Errorf("expected no requests offline, got %d in all", requests)
+	}
+
+	err := run(e.deps, []string{"doorman", "--yes", "--offline", "add", "bob"})
+	if exitCodeFor(err) != exitFetch || !strings.Contains(err.Error(), "no cached keys for bob (last fetch never)") {
+		t.Errorf("expected bob's keys to be missing from the cache, got %v", err)
+	}
+
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "max_offline_age = \"2h\"\n")
+	err = run(e.deps, []string{"doorman", "--yes", "--offline", "--config", config, "add", "alice"})
+	if err == nil || !strings.Contains(err.Error(), "too old to use offline") || !strings.Contains(err.Error(), "max_offline_age is 2h0m0s") {
+		t.Errorf("expected the cached keys to be refused as too old, got %v", err)
+	}
+}
+
+func TestRunOfflineKeepsSourcesApart(t *testing.T) {
+	e := newTestEnv(t)
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), "")
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(testKey + "\n"))}, nil
+	})
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := run(e.deps, []string{"doorman", "--yes", "--offline", "--url", "https://keys.example.com/{user}", "add", "alice"})
+	if err == nil || !strings.Contains(err.Error(), "no cached keys for alice") {
+		t.Errorf("expected GitHub's keys not to stand in for another source's, got %v", err)
+	}
+}
+
+func TestRunOfflineUnsupportedAction(t *testing.T) {
+	e := newTestEnv(t)
+	err := run(e.deps, []string{"doorman", "--offline", "list"})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected a usage error, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// fileOwner is only meaningful on Unix; elsewhere owners aren't uids.
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// pins are the SHA256 fingerprints of the keys each user listed in
+// pin_file may have installed. Users it doesn't list aren't pinned.
+type pins struct {
+	path         string
+	fingerprints map[string]map[string]bool
+}
+
+// loadPins reads pin_file, returning nil when it isn't set or doesn't
+// exist, in which case no keys are pinned.
+func (a *app) loadPins() (*pins, error) {
+	if a.cfg.PinFile == "" {
+		return nil, nil
+	}
+	p, err := readPins(a.cfg.PinFile)
+	if errors.Is(err, os.ErrNotExist) {
+		a.verbosef("No pin file at %s; keys aren't pinned\n", a.cfg.PinFile)
+		return nil, nil
+	}
+	return p, err
+}
+
+// readPins reads a pin file: lines of a username followed by the
+// fingerprints of the keys it may have, e.g.
+//
+//	alice SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I
+//
+// A user may be listed on several lines. Blank lines and # comments are
+// skipped.
+func readPins(path string) (*pins, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pin file: %w", err)
+	}
+	p := &pins{path: path, fingerprints: make(map[string]map[string]bool)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("%s:%d: expected a username followed by SHA256 fingerprints", path, i+1)
+		}
+		username := fields[0]
+		if p.fingerprints[username] == nil {
+			p.fingerprints[username] = make(map[string]bool)
+		}
+		for _, fingerprint := range fields[1:] {
+			if !strings.HasPrefix(fingerprint, "SHA256:") {
+				return nil, fmt.Errorf("%s:%d: expected a SHA256 fingerprint, as ssh-keygen -lf prints, got '%s'", path, i+1, fingerprint)
+			}
+			p.fingerprints[username][fingerprint] = true
+		}
+	}
+	return p, nil
+}
+
+// violation explains why key may not be installed for username, or is ""
+// if it may.
+func (p *pins) violation(username string, key doorman.PublicKey) string {
+	allowed, pinned := p.fingerprints[username]
+	if !pinned || allowed[key.Fingerprint()] {
+		return ""
+	}
+	return "not in the pin file " + p.path
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testKeyFingerprint is the SHA256 fingerprint of testKey
+const testKeyFingerprint = "SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I"
+
+// newTestKey returns a freshly generated public key, for tests that need a
+// key other than testKey.
+func newTestKey(t *testing.T) string {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// pinTestKey writes a pin file allowing alice only testKey, and a config
+// file naming it, returning the config file's path.
+func (e *testEnv) pinTestKey(t *testing.T) string {
+	t.Helper()
+	pins := filepath.Join(e.home, "pins")
+	writeFile(t, pins, "# break-glass accounts\nalice "+testKeyFingerprint+"  # laptop\n")
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "pin_file = '"+pins+"'\n")
+	return config
+}
+
+func TestReadPins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pins")
+	writeFile(t, path, "# comment\n\nalice SHA256:one SHA256:two\nbob SHA256:three # spare\nalice SHA256:four\n")
+	p, err := readPins(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(p.fingerprints["alice"]) != 3 || !p.fingerprints["alice"]["SHA256:four"] || len(p.fingerprints["bob"]) != 1 {
+		t.Errorf("unexpected pins %v", p.fingerprints)
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"no fingerprint", "alice\n", ":1: expected a username followed by SHA256 fingerprints"},
+		{"not a fingerprint", "# comment\nalice MD5:aa:bb\n", ":2: expected a SHA256 fingerprint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeFile(t, path, tt.content)
+			if _, err := readPins(path); err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected an error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestRunPinnedKeys(t *testing.T) {
+	e := newTestEnv(t)
+	config := e.pinTestKey(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	other := newTestKey(t)
+	e.source = userSource{"alice": testKey + "\n" + other, "bob": other, "carol": other}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--config", config, "add", "alice", "bob"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n"+other+" bob"+today+"\n" {
+		t.Errorf("expected only alice's pinned key, and all of bob's, got %q", content)
+	}
+	if !strings.Contains(e.errOut.String(), "Refusing 1 of alice's 2 keys:\n  256 SHA256:") || !strings.Contains(e.errOut.String(), "(ED25519): not in the pin file") {
+		t.Errorf("expected the refused key to be reported, got %q", e.errOut.String())
+	}
+
+	writeFile(t, filepath.Join(e.home, "pins"), "carol "+testKeyFingerprint+"\n")
+	err := run(e.deps, []string{"doorman", "--yes", "--config", config, "add", "carol"})
+	if exitCodeFor(err) != exitNoKeys || !strings.Contains(err.Error(), "none of carol's keys may be installed") {
+		t.Errorf("expected carol's keys to be refused, got %v", err)
+	}
+}
+
+func TestRunCheckPins(t *testing.T) {
+	e := newTestEnv(t)
+	config := e.pinTestKey(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, testKey+" alice\n"+newTestKey(t)+" bob\n")
+
+	if err := run(e.deps, []string{"doorman", "--config", config, "check"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), "No problems found in "+path) {
+		t.Errorf("expected no problems, got %q", e.out.String())
+	}
+
+	other := newTestKey(t)
+	writeFile(t, path, testKey+" alice\n"+other+" alice\n")
+	e.out.Reset()
+	err := run(e.deps, []string{"doorman", "--config", config, "check"})
+	if exitCodeFor(err) != exitProblems || err.Error() != "found 1 problem in "+path {
+		t.Errorf("expected one problem, got %v", err)
+	}
+	if !strings.HasPrefix(e.out.String(), "alice: 256 SHA256:") || !strings.Contains(e.out.String(), "(ED25519): not in the pin file") {
+		t.Errorf("expected alice's unpinned key to be flagged, got %q", e.out.String())
+	}
+}
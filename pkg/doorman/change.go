@@ -0,0 +1,223 @@
+package doorman
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Action names an operation on an authorized_keys file.
+type Action string
+
+const (
+	ActionAdd    Action = "add"
+	ActionRemove Action = "remove"
+	ActionSync   Action = "sync"
+	// ActionReconcile removes the keys a user no longer publishes, adding
+	// nothing
+	ActionReconcile Action = "reconcile"
+)
+
+// Change records what an operation did to an authorized_keys file. It is
+// computed from the file's content before and after the write, so it reports
+// what actually changed rather than what was requested.
+type Change struct {
+	Action   Action
+	Username string
+	Added    []Key
+	Removed  []Key
+	// Expired are the keys of Removed that were dropped because they had
+	// expired, by a Manager configured WithExpiry
+	Expired []Key
+	// Existing is the number of keys labeled with Username before the change
+	Existing int
+	// Created reports that the file did not exist before the change
+	Created bool
+	// Gone reports that, for Manager.SyncUsers, the source no longer knows
+	// the user: their keys were left as they were, or removed when pruning
+	Gone bool
+	// BeforeSHA256 and AfterSHA256 are the hex SHA256 of the file's content
+	// before and after the change, formatted as FormatEntries does. A
+	// missing file hashes as empty content.
+	BeforeSHA256 string
+	AfterSHA256  string
+}
+
+// KeyDiff is how the keys installed for a user differ from those they
+// publish: what a sync would add and remove.
+type KeyDiff struct {
+	Username string
+	// Missing are the published keys that aren't installed
+	Missing []PublicKey
+	// Extra are the installed keys that are no longer published
+	Extra []Key
+	// Installed is the number of keys installed for Username
+	Installed int
+}
+
+// Differs reports whether the installed keys differ from those published.
+func (d *KeyDiff) Differs() bool {
+	return len(d.Missing) > 0 || len(d.Extra) > 0
+}
+
+func newChange(action Action, username string, before, after []byte, labels Labels) *Change {
+	added, removed := DiffKeys(before, after)
+	return &Change{
+		Action:   action,
+		Username: username,
+		Added:    added,
+		Removed:  removed,
+		Expired:  expiredKeys(removed, after),
+		Existing: len(labels.UserKeys(before, username)),
+
+		BeforeSHA256: sha256Hex(before),
+		AfterSHA256:  sha256Hex(after),
+	}
+}
+
+// expiredKeys returns the keys of removed whose lines after comments out as
+// expired.
+func expiredKeys(removed []Key, after []byte) []Key {
+	if !bytes.Contains(after, []byte(expiredPrefix)) {
+		return nil
+	}
+	commented := make(map[KeyID]bool)
+	for _, entry := range ParseEntries(after) {
+		if key, ok := expiredKey(entry); ok {
+			commented[key.ID()] = true
+		}
+	}
+	var expired []Key
+	for _, key := range removed {
+		if commented[key.ID()] {
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
+// linesChange is newChange for RemoveLines, which removes keys for no
+// user in particular.
+func linesChange(before, after []byte) *Change {
+	change := newChange(ActionRemove, "", before, after, Labels{})
+	change.Existing = len(ParseKeys(before))
+	return change
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// String summarizes the change, e.g. "Added 3 keys for alice (2 ed25519,
+// 1 rsa)", "Removed 2 of 2 keys for bob (2 rsa)" or "Synced keys for carol:
+// added 1 (1 ed25519), removed 1 (1 rsa)". A removal for no user, by
+// RemoveLines, counts every key: "Removed 2 of 9 keys (2 rsa)". A
+// reconciliation reads "Removed 1 of 3 keys for dave no longer published
+// (1 rsa)". A change that changed nothing says so, e.g. "Keys for alice
+// are already installed (2 keys)" or "No keys for bob to remove". Expired
+// keys a sync removed are reported apart: "Removed 1 expired key for
+// contractor (1 rsa)", or after the rest of the sync, "...; removed 1
+// expired key (1 rsa)".
+func (c *Change) String() string {
+	switch c.Action {
+	case ActionSync:
+		if len(c.Added) == 0 && len(c.Removed) == 0 {
+			return fmt.Sprintf("Keys for %s are up to date (%d %s)", c.Username, c.Existing, pluralKeys(c.Existing))
+		}
+		removed := withoutKeys(c.Removed, c.Expired)
+		expired := ""
+		if len(c.Expired) > 0 {
+			if len(c.Added) == 0 && len(removed) == 0 {
+				return fmt.Sprintf("Removed %d expired %s for %s%s", len(c.Expired), pluralKeys(len(c.Expired)), c.Username, typeBreakdown(c.Expired))
+			}
+			expired = fmt.Sprintf("; removed %d expired %s%s", len(c.Expired), pluralKeys(len(c.Expired)), typeBreakdown(c.Expired))
+		}
+		return fmt.Sprintf("Synced keys for %s: added %d%s, removed %d%s%s", c.Username, len(c.Added), typeBreakdown(c.Added), len(removed), typeBreakdown(removed), expired)
+	case ActionReconcile:
+		if len(c.Removed) == 0 {
+			return fmt.Sprintf("Keys for %s are all still published (%d %s)", c.Username, c.Existing, pluralKeys(c.Existing))
+		}
+		return fmt.Sprintf("Removed %d of %d %s for %s no longer published%s", len(c.Removed), c.Existing, pluralKeys(c.Existing), c.Username, typeBreakdown(c.Removed))
+	case ActionRemove:
+		if len(c.Removed) == 0 && c.Username == "" {
+			return "No keys to remove"
+		}
+		if len(c.Removed) == 0 {
+			return fmt.Sprintf("No keys for %s to remove", c.Username)
+		}
+		if c.Username == "" {
+			return fmt.Sprintf("Removed %d of %d %s%s", len(c.Removed), c.Existing, pluralKeys(c.Existing), typeBreakdown(c.Removed))
+		}
+		return fmt.Sprintf("Removed %d of %d %s for %s%s", len(c.Removed), c.Existing, pluralKeys(c.Existing), c.Username, typeBreakdown(c.Removed))
+	default:
+		if len(c.Added) == 0 && c.Existing == 0 {
+			return fmt.Sprintf("No keys to add for %s", c.Username)
+		}
+		if len(c.Added) == 0 {
+			return fmt.Sprintf("Keys for %s are already installed (%d %s)", c.Username, c.Existing, pluralKeys(c.Existing))
+		}
+		return fmt.Sprintf("Added %d %s for %s%s", len(c.Added), pluralKeys(len(c.Added)), c.Username, typeBreakdown(c.Added))
+	}
+}
+
+// withoutKeys returns keys without those in drop.
+func withoutKeys(keys, drop []Key) []Key {
+	if len(drop) == 0 {
+		return keys
+	}
+	dropping := make(map[KeyID]bool)
+	for _, key := range drop {
+		dropping[key.ID()] = true
+	}
+	var kept []Key
+	for _, key := range keys {
+		if !dropping[key.ID()] {
+			kept = append(kept, key)
+		}
+	}
+	return kept
+}
+
+func pluralKeys(n int) string {
+	if n == 1 {
+		return "key"
+	}
+	return "keys"
+}
+
+// typeBreakdown renders " (2 ed25519, 1 rsa)", or "" for no keys.
+func typeBreakdown(keys []Key) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	return " (" + CountTypes(keys) + ")"
+}
+
+// CountTypes summarizes keys by algorithm, e.g. "2 ed25519, 1 rsa", most
+// common type first.
+func CountTypes(keys []Key) string {
+	counts := make(map[string]int)
+	for _, key := range keys {
+		counts[key.ShortType()]++
+	}
+	types := make([]string, 0, len(counts))
+	for keyType := range counts {
+		types = append(types, keyType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if counts[types[i]] != counts[types[j]] {
+			return counts[types[i]] > counts[types[j]]
+		}
+		return types[i] < types[j]
+	})
+
+	parts := make([]string, len(types))
+	for i, keyType := range types {
+		parts[i] = fmt.Sprintf("%d %s", counts[keyType], keyType)
+	}
+	return strings.Join(parts, ", ")
+}
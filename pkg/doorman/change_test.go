@@ -0,0 +1,87 @@
+package doorman
+
+import (
+	"testing"
+)
+
+func TestChangeString(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   Action
+		username string
+		before   string
+		after    string
+		expected string
+	}{
+		{
+			"add mixed types",
+			"add", "alice",
+			"ssh-rsa OTHER bob",
+			"ssh-rsa OTHER bob\nssh-ed25519 K1 alice\nssh-rsa K2 alice\nssh-ed25519 K3 alice",
+			"Added 3 keys for alice (2 ed25519, 1 rsa)",
+		},
+		{
+			"add single",
+			"add", "alice",
+			"",
+			"ssh-ed25519 K1 alice",
+			"Added 1 key for alice (1 ed25519)",
+		},
+		{
+			"add nothing new",
+			"add", "alice",
+			"ssh-ed25519 K1 alice",
+			"ssh-ed25519 K1 alice\nssh-ed25519 K1 alice",
+			"Added 1 key for alice (1 ed25519)",
+		},
+		{
+			"remove all",
+			"remove", "bob",
+			"ssh-rsa K1 bob\nssh-ed25519 K2 bob\nssh-rsa K3 bobby",
+			"ssh-rsa K3 bobby",
+			"Removed 2 of 2 keys for bob (1 ed25519, 1 rsa)",
+		},
+		{
+			"remove none",
+			"remove", "bob",
+			"ssh-rsa K3 bobby",
+			"ssh-rsa K3 bobby",
+			"No keys for bob to remove",
+		},
+		{
+			"sync",
+			"sync", "carol",
+			"ssh-rsa OLD carol\nssh-ed25519 KEEP carol",
+			"ssh-ed25519 KEEP carol\nssh-ed25519 NEW carol",
+			"Synced keys for carol: added 1 (1 ed25519), removed 1 (1 rsa)",
+		},
+		{
+			"sync up to date",
+			"sync", "carol",
+			"ssh-ed25519 KEEP carol",
+			"ssh-ed25519 KEEP carol",
+			"Keys for carol are up to date (1 key)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary := newChange(tt.action, tt.username, []byte(tt.before), []byte(tt.after), Labels{})
+			if got := summary.String(); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestChangeHashes(t *testing.T) {
+	change := newChange(ActionAdd, "alice", nil, []byte("ssh-ed25519 K1 alice\n"), Labels{})
+
+	// sha256sum of an empty file, and of one holding the new line
+	if change.BeforeSHA256 != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("unexpected before hash %s", change.BeforeSHA256)
+	}
+	if change.AfterSHA256 != "fe13b838b58d44551248f43adf864ec00c7d74e99e1d5e6a254992119782e9b4" {
+		t.Errorf("unexpected after hash %s", change.AfterSHA256)
+	}
+}
@@ -0,0 +1,25 @@
+// Package doorman manages SSH access from public keys published by services
+// such as GitHub. It fetches a user's keys, labels them with the username and
+// adds them to or removes them from an authorized_keys file.
+//
+// A Manager ties the pieces together: keys come from a KeySource, are kept
+// in a KeyStore, and every change is confirmed by a Prompter first, each set
+// with an Option passed to NewManager. The package never reads input itself
+// and keeps no global state beyond a registry of key sources, so callers
+// decide where keys come from, where they are written, and what is confirmed
+// with whom. The doorman command is a thin wrapper around it. What a
+// Manager does is logged for people with WithLogger, and reported as Events
+// for programs with WithEventHandler.
+//
+// Each key source registers a ProviderFactory under a name, such as
+// "github", "url" or "file", with RegisterProvider; programs offer the names
+// from ListProviders and build the chosen source with LookupProvider. A
+// FallbackSource tries several sources in turn, for when some can't be
+// reached.
+//
+// Errors are meant to be matched with errors.Is and errors.As: the sentinels
+// ErrInvalidUser, ErrUserNotFound, ErrNoKeys, ErrAborted and ErrFileMissing
+// classify the common failures, keys that could not be fetched are
+// reported as a *FetchError, and a renamed GitHub account as a
+// *RenamedUserError.
+package doorman
@@ -0,0 +1,454 @@
+package doorman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+)
+
+// AddKeys labels keys with username and appends them to the entries in
+// store, creating the file if it doesn't exist. Keys already installed for
+// username are left out, and nothing is written if that leaves none. The
+// returned Change describes what the store gained.
+//
+// AddKeys, RemoveKeys and SyncKeys check ctx once the store is locked and
+// loaded, and write nothing if it is already done.
+func AddKeys(ctx context.Context, store KeyStore, keys []PublicKey, username string) (*Change, error) {
+	return addKeys(ctx, store, keys, username, Labels{})
+}
+
+func addKeys(ctx context.Context, store KeyStore, keys []PublicKey, username string, labels Labels) (*Change, error) {
+	var change *Change
+	err := withLock(store, func() error {
+		entries, err := store.Load()
+		missing := errors.Is(err, fs.ErrNotExist)
+		if err != nil && !missing {
+			return err
+		}
+		before := FormatEntries(entries)
+		added := addEntries(entries, keys, username, labels)
+		if len(added) == len(entries) {
+			change = newChange(ActionAdd, username, before, before, labels)
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		added, err = ordered(store, added)
+		if err != nil {
+			return err
+		}
+		if err := store.Save(added); err != nil {
+			return err
+		}
+		change = newChange(ActionAdd, username, before, FormatEntries(added), labels)
+		change.Created = missing
+		return nil
+	})
+	return change, err
+}
+
+// RemoveKeys removes every key labeled with username from store. Unlike
+// AddKeys, it fails with ErrFileMissing if the file does not exist.
+func RemoveKeys(ctx context.Context, store KeyStore, username string) (*Change, error) {
+	return removeKeys(ctx, store, username, Labels{}, nil)
+}
+
+func removeKeys(ctx context.Context, store KeyStore, username string, labels Labels, only map[KeyID]bool) (*Change, error) {
+	var change *Change
+	err := withLock(store, func() error {
+		entries, err := store.Load()
+		if errors.Is(err, fs.ErrNotExist) {
+			return fileMissing(store, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		kept := removeEntries(entries, username, labels, only)
+		kept, err = saveRemoval(ctx, store, entries, kept)
+		if err != nil {
+			return err
+		}
+		change = newChange(ActionRemove, username, FormatEntries(entries), FormatEntries(kept), labels)
+		return nil
+	})
+	return change, err
+}
+
+// RemoveLines removes the key lines in lines from store, whoever they are
+// labeled with, such as keys doorman didn't install. The Change has no
+// Username, and its Existing counts every key in the file. Like RemoveKeys,
+// it fails with ErrFileMissing if the file does not exist.
+func RemoveLines(ctx context.Context, store KeyStore, lines []string) (*Change, error) {
+	var change *Change
+	err := withLock(store, func() error {
+		entries, err := store.Load()
+		if errors.Is(err, fs.ErrNotExist) {
+			return fileMissing(store, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		kept := removeLines(entries, lines)
+		kept, err = saveRemoval(ctx, store, entries, kept)
+		if err != nil {
+			return err
+		}
+		change = linesChange(FormatEntries(entries), FormatEntries(kept))
+		return nil
+	})
+	return change, err
+}
+
+// SyncKeys makes the keys labeled with username in store match keys: keys
+// no longer published are removed and new ones appended, while entries that
+// are still current keep their place. An entry without the ForcedOptions its
+// key must have is replaced by one with them. Nothing is written when the
+// keys are already up to date. Keys Manager.Sync found expired stay out
+// while they are still published.
+func SyncKeys(ctx context.Context, store KeyStore, keys []PublicKey, username string) (*Change, error) {
+	return syncKeys(ctx, store, keys, username, Labels{}, nil, nil)
+}
+
+// syncKeys is SyncKeys with labels and expiry. merge, if set, is called
+// with the entries as loaded under the lock, and an error from it stops
+// the sync.
+func syncKeys(ctx context.Context, store KeyStore, keys []PublicKey, username string, labels Labels, expired expiry, merge func([]Entry) error) (*Change, error) {
+	var change *Change
+	err := withLock(store, func() error {
+		entries, err := store.Load()
+		missing := errors.Is(err, fs.ErrNotExist)
+		if err != nil && !missing {
+			return err
+		}
+		if merge != nil {
+			if err := merge(entries); err != nil {
+				return err
+			}
+		}
+
+		before := FormatEntries(entries)
+		synced := syncEntries(entries, keys, username, labels, expired)
+		after := FormatEntries(synced)
+		changed := !bytes.Equal(before, after)
+		if changed {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			synced, err = ordered(store, synced)
+			if err != nil {
+				return err
+			}
+			after = FormatEntries(synced)
+			if err := store.Save(synced); err != nil {
+				return err
+			}
+		}
+		change = newChange(ActionSync, username, before, after, labels)
+		change.Created = missing && changed
+		return nil
+	})
+	return change, err
+}
+
+// UserKeySet is a user's keys, for adding the keys of several users at
+// once.
+type UserKeySet struct {
+	Username string
+	Keys     []PublicKey
+}
+
+// AddKeysForUsers is AddKeys for several users in a single write. It
+// returns a Change for each user, in order, describing the additions as if
+// they had been made one after another.
+func AddKeysForUsers(ctx context.Context, store KeyStore, sets []UserKeySet) ([]*Change, error) {
+	return addKeysForUsers(ctx, store, sets, Labels{})
+}
+
+func addKeysForUsers(ctx context.Context, store KeyStore, sets []UserKeySet, labels Labels) ([]*Change, error) {
+	var changes []*Change
+	err := withLock(store, func() error {
+		entries, err := store.Load()
+		missing := errors.Is(err, fs.ErrNotExist)
+		if err != nil && !missing {
+			return err
+		}
+
+		changes = nil
+		added := entries
+		for _, set := range sets {
+			before := FormatEntries(added)
+			if next := addEntries(added, set.Keys, set.Username, labels); len(next) != len(added) {
+				if added, err = ordered(store, next); err != nil {
+					return err
+				}
+			}
+			changes = append(changes, newChange(ActionAdd, set.Username, before, FormatEntries(added), labels))
+		}
+		if len(added) == len(entries) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := store.Save(added); err != nil {
+			return err
+		}
+		changes[0].Created = missing
+		return nil
+	})
+	return changes, err
+}
+
+// RemoveKeysForUsers is RemoveKeys for several users in a single write,
+// returning a Change for each user as AddKeysForUsers does.
+func RemoveKeysForUsers(ctx context.Context, store KeyStore, usernames []string) ([]*Change, error) {
+	return removeKeysForUsers(ctx, store, usernames, Labels{})
+}
+
+func removeKeysForUsers(ctx context.Context, store KeyStore, usernames []string, labels Labels) ([]*Change, error) {
+	var changes []*Change
+	err := withLock(store, func() error {
+		entries, err := store.Load()
+		if errors.Is(err, fs.ErrNotExist) {
+			return fileMissing(store, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		changes = nil
+		kept := entries
+		for _, username := range usernames {
+			before := FormatEntries(kept)
+			if next := removeEntries(kept, username, labels, nil); len(next) != len(kept) {
+				if kept, err = ordered(store, next); err != nil {
+					return err
+				}
+			}
+			changes = append(changes, newChange(ActionRemove, username, before, FormatEntries(kept), labels))
+		}
+		_, err = saveRemoval(ctx, store, entries, kept)
+		return err
+	})
+	return changes, err
+}
+
+// saveRemoval saves kept, what a removal left of entries, in store's order,
+// and returns what it saved. Nothing is saved if nothing was removed, so a
+// file the removal didn't change is left byte for byte as it was, even
+// without a final newline.
+func saveRemoval(ctx context.Context, store KeyStore, entries, kept []Entry) ([]Entry, error) {
+	if len(kept) == len(entries) {
+		return kept, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	kept, err := ordered(store, kept)
+	if err != nil {
+		return nil, err
+	}
+	return kept, store.Save(kept)
+}
+
+// SyncKeysForUsers is SyncKeys for several users in a single write, which
+// also removes every key of the users in prune. It returns a Change for
+// each user of sets, then of prune, as AddKeysForUsers does.
+func SyncKeysForUsers(ctx context.Context, store KeyStore, sets []UserKeySet, prune []string) ([]*Change, error) {
+	return syncKeysForUsers(ctx, store, sets, prune, Labels{}, nil)
+}
+
+func syncKeysForUsers(ctx context.Context, store KeyStore, sets []UserKeySet, prune []string, labels Labels, expired expiry) ([]*Change, error) {
+	var changes []*Change
+	err := withLock(store, func() error {
+		entries, err := store.Load()
+		missing := errors.Is(err, fs.ErrNotExist)
+		if err != nil && !missing {
+			return err
+		}
+
+		changes = nil
+		synced := entries
+		for _, set := range sets {
+			before := FormatEntries(synced)
+			if synced, err = syncedInOrder(store, synced, syncEntries(synced, set.Keys, set.Username, labels, expired)); err != nil {
+				return err
+			}
+			changes = append(changes, newChange(ActionSync, set.Username, before, FormatEntries(synced), labels))
+		}
+		for _, username := range prune {
+			before := FormatEntries(synced)
+			if synced, err = syncedInOrder(store, synced, removeEntries(synced, username, labels, nil)); err != nil {
+				return err
+			}
+			changes = append(changes, newChange(ActionRemove, username, before, FormatEntries(synced), labels))
+		}
+		if bytes.Equal(FormatEntries(entries), FormatEntries(synced)) {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := store.Save(synced); err != nil {
+			return err
+		}
+		if len(changes) > 0 {
+			changes[0].Created = missing
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// syncedInOrder returns synced, what a sync made of entries, in store's
+// order, unless the sync changed nothing.
+func syncedInOrder(store KeyStore, entries, synced []Entry) ([]Entry, error) {
+	if bytes.Equal(FormatEntries(entries), FormatEntries(synced)) {
+		return synced, nil
+	}
+	return ordered(store, synced)
+}
+
+// addEntries returns entries with keys, labeled with username, appended,
+// but for those already installed for username.
+func addEntries(entries []Entry, keys []PublicKey, username string, labels Labels) []Entry {
+	installed := make(map[KeyID]bool)
+	for _, entry := range entries {
+		if key, ok := entry.Key(); ok && labels.labeled(key.PublicKey, username) {
+			installed[key.ID()] = true
+		}
+	}
+	added := append([]Entry(nil), entries...)
+	for _, key := range keys {
+		// BEHAVIOR: Adding a user again installs only their new keys,
+		// rather than a second copy of each
+		if installed[key.ID()] {
+			continue
+		}
+		installed[key.ID()] = true
+		added = append(added, Entry{Line: key.AuthorizedKey() + " " + labels.comment(username)})
+	}
+	return added
+}
+
+// removeEntries returns entries without the keys labeled with username, or
+// only those of them in only if it isn't nil.
+func removeEntries(entries []Entry, username string, labels Labels, only map[KeyID]bool) []Entry {
+	var kept []Entry
+	for _, entry := range entries {
+		if !labels.has(entry.Line, username) {
+			kept = append(kept, entry)
+			continue
+		}
+		if key, _ := entry.Key(); only != nil && !only[key.ID()] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// removeLines returns entries without the keys of the key lines in lines,
+// however their lines are written.
+func removeLines(entries []Entry, lines []string) []Entry {
+	removing := make(map[KeyID]bool)
+	for _, line := range lines {
+		if key, ok := ParseKey(line); ok {
+			removing[key.ID()] = true
+		}
+	}
+	var kept []Entry
+	for _, entry := range entries {
+		if key, ok := entry.Key(); !ok || !removing[key.ID()] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// syncEntries returns entries with username's keys replaced by keys, as
+// described for SyncKeys. Keys that expired are commented out, and those
+// already commented out aren't added again, until they are no longer
+// published.
+func syncEntries(entries []Entry, keys []PublicKey, username string, labels Labels, expired expiry) []Entry {
+	wanted := make(map[KeyID]PublicKey)
+	for _, key := range keys {
+		wanted[key.ID()] = key
+	}
+
+	present := make(map[KeyID]bool)
+	var synced []Entry
+	for _, entry := range entries {
+		if key, ok := expiredKey(entry); ok && labels.labeled(key.PublicKey, username) {
+			// An expired key stays out while it is still published
+			if _, ok := wanted[key.ID()]; ok {
+				present[key.ID()] = true
+				synced = append(synced, entry)
+			}
+			continue
+		}
+		if key, ok := entry.Key(); ok && labels.labeled(key.PublicKey, username) {
+			want, ok := wanted[key.ID()]
+			if !ok {
+				continue
+			}
+			seen := present[key.ID()]
+			present[key.ID()] = true
+			if expired.expired(key.PublicKey) || expired.expired(want) {
+				synced = append(synced, Entry{Line: expiredPrefix + entry.Line})
+				continue
+			}
+			// BEHAVIOR: Options edited into a line by hand are kept, unless
+			// the key must have others; the line is then rewritten in place
+			// with the date it was added
+			if want.ForcedOptions != "" && key.Options() != want.ForcedOptions {
+				if seen {
+					continue
+				}
+				keyLabels := labels
+				if date, ok := key.Added(); ok {
+					keyLabels.Date = date
+				}
+				synced = append(synced, Entry{Line: want.AuthorizedKey() + " " + keyLabels.comment(username)})
+				continue
+			}
+		}
+		synced = append(synced, entry)
+	}
+	for _, key := range keys {
+		if !present[key.ID()] && !expired.expired(key) {
+			synced = append(synced, Entry{Line: key.AuthorizedKey() + " " + labels.comment(username)})
+			present[key.ID()] = true
+		}
+	}
+	return synced
+}
+
+func fileMissing(store KeyStore, cause error) error {
+	return &kindError{kind: ErrFileMissing, msg: store.Path() + " does not exist", cause: cause}
+}
+
+// List returns the keys in store. A missing file has no keys.
+func List(ctx context.Context, store KeyStore) ([]Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	entries, err := store.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Key
+	for _, entry := range entries {
+		if key, ok := entry.Key(); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,370 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingStore fails every operation with err.
+type failingStore struct {
+	err error
+}
+
+func (s failingStore) Load() ([]Entry, error)     { return nil, s.err }
+func (s failingStore) Save(entries []Entry) error { return s.err }
+func (s failingStore) Path() string               { return "failing" }
+
+// lockCountingStore records how the lock is used around Load and Save.
+type lockCountingStore struct {
+	*MemoryStore
+	events []string
+}
+
+func (s *lockCountingStore) Lock() (func() error, error) {
+	s.events = append(s.events, "lock")
+	return func() error {
+		s.events = append(s.events, "unlock")
+		return nil
+	}, nil
+}
+
+func (s *lockCountingStore) Load() ([]Entry, error) {
+	s.events = append(s.events, "load")
+	return s.MemoryStore.Load()
+}
+
+func (s *lockCountingStore) Save(entries []Entry) error {
+	s.events = append(s.events, "save")
+	return s.MemoryStore.Save(entries)
+}
+
+// sortingStore keeps its entries sorted by line.
+type sortingStore struct {
+	*MemoryStore
+}
+
+func (s sortingStore) Order(entries []Entry) ([]Entry, error) {
+	sorted := append([]Entry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Line < sorted[j].Line })
+	return sorted, nil
+}
+
+// today is the token stamped on keys added today.
+var today = " doorman-added=" + time.Now().Format(time.DateOnly)
+
+func content(t *testing.T, store KeyStore) string {
+	t.Helper()
+	entries, err := store.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(FormatEntries(entries))
+}
+
+func TestAddKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		store    *MemoryStore
+		keys     string
+		expected string
+		summary  string
+	}{
+		{"new file", &MemoryStore{}, "ssh-ed25519 K1\nssh-rsa K2\n", "ssh-ed25519 K1 alice" + today + "\nssh-rsa K2 alice" + today + "\n", "Added 2 keys for alice (1 ed25519, 1 rsa)"},
+		{"existing file", NewMemoryStore(Entry{"ssh-rsa OTHER bob"}), "ssh-ed25519 K1", "ssh-rsa OTHER bob\nssh-ed25519 K1 alice" + today + "\n", "Added 1 key for alice (1 ed25519)"},
+		{"empty file", NewMemoryStore(), "ssh-ed25519 K1", "ssh-ed25519 K1 alice" + today + "\n", "Added 1 key for alice (1 ed25519)"},
+		{"no keys", NewMemoryStore(Entry{"ssh-rsa OTHER bob"}), "\n", "ssh-rsa OTHER bob\n", "No keys to add for alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change, err := AddKeys(context.Background(), tt.store, ParsePublicKeys([]byte(tt.keys)), "alice")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := content(t, tt.store); got != tt.expected {
+				t.Errorf("expected content %q, got %q", tt.expected, got)
+			}
+			if change.String() != tt.summary {
+				t.Errorf("expected summary %q, got %q", tt.summary, change)
+			}
+		})
+	}
+}
+
+func TestRemoveKeys(t *testing.T) {
+	store := NewMemoryStore(ParseEntries([]byte("# team keys\nssh-rsa K1 bob\nssh-ed25519 K2 alice\n\nssh-rsa K3 bobby\n"))...)
+
+	change, err := RemoveKeys(context.Background(), store, "bob")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "# team keys\nssh-ed25519 K2 alice\n\nssh-rsa K3 bobby\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if change.String() != "Removed 1 of 1 key for bob (1 rsa)" {
+		t.Errorf("unexpected summary %q", change)
+	}
+}
+
+func TestRemoveKeysMissingFile(t *testing.T) {
+	_, err := RemoveKeys(context.Background(), &MemoryStore{}, "bob")
+	if !errors.Is(err, ErrFileMissing) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrFileMissing, got %v", err)
+	}
+}
+
+func TestSyncKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		store    *MemoryStore
+		keys     string
+		expected string
+		summary  string
+		created  bool
+	}{
+		{"new file", &MemoryStore{}, "ssh-ed25519 K1", "ssh-ed25519 K1 carol" + today + "\n", "Synced keys for carol: added 1 (1 ed25519), removed 0", true},
+		{
+			"replace stale keys",
+			NewMemoryStore(Entry{"ssh-rsa OLD carol"}, Entry{"ssh-rsa OTHER bob"}, Entry{"ssh-ed25519 KEEP carol"}),
+			"ssh-ed25519 KEEP\nssh-ed25519 NEW",
+			"ssh-rsa OTHER bob\nssh-ed25519 KEEP carol\nssh-ed25519 NEW carol" + today + "\n",
+			"Synced keys for carol: added 1 (1 ed25519), removed 1 (1 rsa)",
+			false,
+		},
+		{"up to date", NewMemoryStore(Entry{"ssh-ed25519 KEEP carol"}), "ssh-ed25519 KEEP", "ssh-ed25519 KEEP carol\n", "Keys for carol are up to date (1 key)", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change, err := SyncKeys(context.Background(), tt.store, ParsePublicKeys([]byte(tt.keys)), "carol")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := content(t, tt.store); got != tt.expected {
+				t.Errorf("expected content %q, got %q", tt.expected, got)
+			}
+			if change.String() != tt.summary {
+				t.Errorf("expected summary %q, got %q", tt.summary, change)
+			}
+			if change.Created != tt.created {
+				t.Errorf("expected Created %v, got %v", tt.created, change.Created)
+			}
+		})
+	}
+}
+
+func TestSyncKeysForcedOptions(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-ed25519 BARE carol doorman-added=2024-03-18"}, Entry{`no-pty ssh-ed25519 EDITED carol`}, Entry{"restrict ssh-ed25519 DONE carol"})
+	keys := ParsePublicKeys([]byte("ssh-ed25519 BARE\nssh-ed25519 EDITED\nssh-ed25519 DONE"))
+	keys[0].ForcedOptions, keys[2].ForcedOptions = "restrict", "restrict"
+	if _, err := SyncKeys(context.Background(), store, keys, "carol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The line getting the options is rewritten where it was
+	expected := "restrict ssh-ed25519 BARE carol doorman-added=2024-03-18\nno-pty ssh-ed25519 EDITED carol\nrestrict ssh-ed25519 DONE carol\n"
+	if got := content(t, store); got != expected {
+		t.Errorf("expected content %q, got %q", expected, got)
+	}
+}
+
+func TestSyncKeysUpToDateDoesNotWrite(t *testing.T) {
+	store := &lockCountingStore{MemoryStore: NewMemoryStore(Entry{"ssh-ed25519 KEEP carol"})}
+	if _, err := SyncKeys(context.Background(), store, ParsePublicKeys([]byte("ssh-ed25519 KEEP")), "carol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, event := range store.events {
+		if event == "save" {
+			t.Errorf("expected no save, got events %v", store.events)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	keys, err := List(context.Background(), NewMemoryStore(ParseEntries([]byte("# managed by doorman\nssh-rsa K1 bob\n\nssh-ed25519 K2 alice\n"))...))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0].Comment != "bob" || keys[1].Comment != "alice" {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+
+	if keys, err := List(context.Background(), &MemoryStore{}); err != nil || len(keys) != 0 {
+		t.Errorf("expected no keys for a missing file, got %+v (%v)", keys, err)
+	}
+}
+
+func TestStoreErrorsArePropagated(t *testing.T) {
+	failing := errors.New("disk on fire")
+	store := failingStore{err: failing}
+
+	if _, err := AddKeys(context.Background(), store, []PublicKey{{Type: "ssh-rsa", Blob: "K1"}}, "alice"); !errors.Is(err, failing) {
+		t.Errorf("AddKeys: expected %v, got %v", failing, err)
+	}
+	if _, err := RemoveKeys(context.Background(), store, "alice"); !errors.Is(err, failing) {
+		t.Errorf("RemoveKeys: expected %v, got %v", failing, err)
+	}
+	if _, err := List(context.Background(), store); !errors.Is(err, failing) {
+		t.Errorf("List: expected %v, got %v", failing, err)
+	}
+}
+
+func TestChangesHoldTheLock(t *testing.T) {
+	store := &lockCountingStore{MemoryStore: NewMemoryStore()}
+
+	AddKeys(context.Background(), store, []PublicKey{{Type: "ssh-rsa", Blob: "K1"}}, "alice")
+	RemoveKeys(context.Background(), store, "alice")
+
+	expected := "[lock load save unlock lock load save unlock]"
+	if got := fmt.Sprint(store.events); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestChangesDescribeOrderedEntries(t *testing.T) {
+	store := sortingStore{NewMemoryStore(ParseEntries([]byte("ssh-rsa K3 bob\nssh-rsa K1 carol\n"))...)}
+	ctx := context.Background()
+
+	changes := map[string]func() (*Change, error){
+		"add": func() (*Change, error) {
+			return AddKeys(ctx, store, []PublicKey{{Type: "ssh-rsa", Blob: "K2"}}, "alice")
+		},
+		"sync": func() (*Change, error) {
+			return SyncKeys(ctx, store, []PublicKey{{Type: "ssh-rsa", Blob: "K0"}}, "alice")
+		},
+		"remove": func() (*Change, error) { return RemoveKeys(ctx, store, "carol") },
+		"remove lines": func() (*Change, error) {
+			return RemoveLines(ctx, store, []string{"ssh-rsa K3 bob"})
+		},
+	}
+	for _, name := range []string{"add", "sync", "remove", "remove lines"} {
+		change, err := changes[name]()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		saved := content(t, store)
+		if change.AfterSHA256 != sha256Hex([]byte(saved)) {
+			t.Errorf("%s: expected the change to describe what was saved, %q", name, saved)
+		}
+		if lines := strings.Split(strings.TrimSuffix(saved, "\n"), "\n"); !sort.StringsAreSorted(lines) {
+			t.Errorf("%s: expected the entries sorted, got %q", name, saved)
+		}
+	}
+}
+
+// TestRewritesKeepAnnotations runs each rewrite over testdata's annotated
+// file, whose comments and blank lines are the owner's to keep.
+func TestRewritesKeepAnnotations(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "annotated_authorized_keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotated := string(data)
+	entries := ParseEntries(data)
+
+	// Nothing matching, nothing changed: the file comes back byte for byte
+	unchanged := map[string][]Entry{
+		"remove":       removeEntries(entries, "dave", Labels{}, nil),
+		"remove lines": removeLines(entries, []string{"ssh-ed25519 K9 dave"}),
+		"sync":         syncEntries(entries, ParsePublicKeys([]byte("ssh-rsa K3")), "bob", Labels{}, nil),
+	}
+	for name, rewritten := range unchanged {
+		if got := string(FormatEntries(rewritten)); got != annotated {
+			t.Errorf("%s: expected the file unchanged, got\n%s", name, got)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		rewrite  []Entry
+		expected string
+	}{
+		{
+			"remove keeps comments",
+			removeEntries(entries, "alice", Labels{}, nil),
+			strings.Replace(annotated, "ssh-ed25519 K1 alice doorman-added=2024-03-01\n# alice's desktop\nssh-ed25519 K2 alice doorman-added=2024-03-01\n", "# alice's desktop\n", 1),
+		},
+		{
+			"remove keeps doubled blank lines",
+			removeEntries(entries, "bob", Labels{}, nil),
+			strings.Replace(annotated, "ssh-rsa K3 bob doorman-added=2024-03-01\n", "", 1),
+		},
+		{
+			"sync replaces in place",
+			syncEntries(entries, ParsePublicKeys([]byte("ssh-ed25519 K1")), "alice", Labels{}, nil),
+			strings.Replace(annotated, "ssh-ed25519 K2 alice doorman-added=2024-03-01\n", "", 1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(FormatEntries(tt.rewrite)); got != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestRemoveKeysExactLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"middle", "ssh-rsa K1 carol\nssh-rsa K2 alice\nssh-rsa K3 bob\n", "ssh-rsa K1 carol\nssh-rsa K3 bob\n"},
+		{"middle without final newline", "ssh-rsa K1 carol\nssh-rsa K2 alice\nssh-rsa K3 bob", "ssh-rsa K1 carol\nssh-rsa K3 bob\n"},
+		{"first", "ssh-rsa K2 alice\nssh-rsa K3 bob\n", "ssh-rsa K3 bob\n"},
+		{"last", "ssh-rsa K1 carol\nssh-rsa K2 alice\n", "ssh-rsa K1 carol\n"},
+		{"last without final newline", "ssh-rsa K1 carol\nssh-rsa K2 alice", "ssh-rsa K1 carol\n"},
+		{"consecutive", "ssh-rsa K1 carol\nssh-rsa K2 alice\nssh-rsa K3 alice\nssh-rsa K4 bob\n", "ssh-rsa K1 carol\nssh-rsa K4 bob\n"},
+		{"consecutive at end", "ssh-rsa K1 carol\nssh-rsa K2 alice\nssh-rsa K3 alice\n", "ssh-rsa K1 carol\n"},
+		{"consecutive at end without final newline", "ssh-rsa K1 carol\nssh-rsa K2 alice\nssh-rsa K3 alice", "ssh-rsa K1 carol\n"},
+		{"apart", "ssh-rsa K2 alice\nssh-rsa K1 carol\nssh-rsa K3 alice\nssh-rsa K4 bob\nssh-rsa K5 alice", "ssh-rsa K1 carol\nssh-rsa K4 bob\n"},
+		{"every line", "ssh-rsa K2 alice\nssh-rsa K3 alice\n", ""},
+		{"every line without final newline", "ssh-rsa K2 alice", ""},
+		{"crlf", "ssh-rsa K1 carol\r\nssh-rsa K2 alice\r\nssh-rsa K3 bob\r\n", "ssh-rsa K1 carol\nssh-rsa K3 bob\n"},
+		{"none without final newline", "ssh-rsa K1 carol\nssh-rsa K3 bob", "ssh-rsa K1 carol\nssh-rsa K3 bob"},
+		{"other users' blank line at end", "ssh-rsa K1 carol\nssh-rsa K2 alice\nssh-rsa K3 bob\n\n", "ssh-rsa K1 carol\nssh-rsa K3 bob\n\n"},
+		{"between blank lines", "ssh-rsa K1 carol\n\nssh-rsa K2 alice\n\nssh-rsa K3 bob\n", "ssh-rsa K1 carol\n\n\nssh-rsa K3 bob\n"},
+		{"before a blank line", "ssh-rsa K2 alice\n\nssh-rsa K3 bob\n", "\nssh-rsa K3 bob\n"},
+		{"after a blank line", "ssh-rsa K1 carol\n\nssh-rsa K2 alice\n", "ssh-rsa K1 carol\n\n"},
+		{"blank lines apart", "\nssh-rsa K2 alice\nssh-rsa K1 carol\n\nssh-rsa K3 alice\n\n", "\nssh-rsa K1 carol\n\n\n"},
+		{"only blank lines left", "\nssh-rsa K2 alice\n\n", "\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "authorized_keys")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := RemoveKeys(context.Background(), NewFileStore(path), "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := os.ReadFile(path); string(got) != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestAddKeysAfterLineWithoutNewline(t *testing.T) {
+	for _, content := range []string{"ssh-rsa K1 carol", "ssh-rsa K1 carol\nssh-rsa K2 bob"} {
+		path := filepath.Join(t.TempDir(), "authorized_keys")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := AddKeys(context.Background(), NewFileStore(path), []PublicKey{{Type: "ssh-rsa", Blob: "K3"}}, "alice"); err != nil {
+			t.Fatal(err)
+		}
+		expected := content + "\nssh-rsa K3 alice" + today + "\n"
+		if got, _ := os.ReadFile(path); string(got) != expected {
+			t.Errorf("expected %q, got %q", expected, got)
+		}
+	}
+}
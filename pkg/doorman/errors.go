@@ -0,0 +1,88 @@
+package doorman
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidUser is matched by errors for usernames a KeySource rejects
+	// before making any request.
+	ErrInvalidUser = errors.New("invalid username")
+	// ErrUserNotFound is matched by errors for users a KeySource doesn't know.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrNoKeys is matched by errors for users who publish no keys.
+	ErrNoKeys = errors.New("no public keys found")
+	// ErrAborted is returned when a Prompter declines a change.
+	ErrAborted = errors.New("operation aborted")
+	// ErrFileMissing is matched by errors for removing keys from a KeyStore
+	// that doesn't exist. Such errors also match fs.ErrNotExist.
+	ErrFileMissing = errors.New("authorized_keys file does not exist")
+	// ErrLocked is matched by errors for a FileStore lock that another
+	// process held for longer than the store's LockWait.
+	ErrLocked = errors.New("authorized_keys is locked by another process")
+	// ErrUnsafePath is matched by errors for a FileStore whose file is a
+	// symlink, or whose directory is a symlink, isn't owned by the expected
+	// user or can be written by others: someone else could then redirect
+	// the write.
+	ErrUnsafePath = errors.New("authorized_keys path is unsafe")
+	// ErrConflict is matched by errors for a sync that was skipped because
+	// another process edited a line of authorized_keys the sync would also
+	// have rewritten or removed, after the sync was planned.
+	ErrConflict = errors.New("authorized_keys was edited by another process")
+)
+
+// kindError is an error with its own message that still matches one of the
+// sentinel errors with errors.Is, as well as its cause, if any.
+type kindError struct {
+	kind  error
+	msg   string
+	cause error
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.cause
+}
+
+func errorOfKind(kind error, format string, a ...any) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, a...)}
+}
+
+// UserError is the failure of one user of an operation on several users.
+type UserError struct {
+	User string
+	Err  error
+}
+
+// UsersError reports every user of an operation on several users that
+// failed, in the order the users were given. Nothing was changed.
+type UsersError struct {
+	Failures []UserError
+}
+
+func (e *UsersError) Error() string {
+	messages := make([]string, len(e.Failures))
+	for i, failure := range e.Failures {
+		messages[i] = failure.Err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns every failure, so errors.Is and errors.As match any of
+// them.
+func (e *UsersError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, failure := range e.Failures {
+		errs[i] = failure.Err
+	}
+	return errs
+}
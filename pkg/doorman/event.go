@@ -0,0 +1,36 @@
+package doorman
+
+import "time"
+
+// EventType names something significant a Manager did.
+type EventType string
+
+const (
+	// EventStarted begins an Add, Remove or Sync; Action and User are set
+	EventStarted EventType = "operation_started"
+	// EventKeysFetched reports the number of keys fetched for User
+	EventKeysFetched EventType = "keys_fetched"
+	// EventFetchFailed reports why User's keys could not be fetched
+	EventFetchFailed EventType = "fetch_failed"
+	// EventKeyAdded and EventKeyRemoved report a key of User written to or
+	// deleted from the store at Path
+	EventKeyAdded   EventType = "key_added"
+	EventKeyRemoved EventType = "key_removed"
+	// EventFileRewritten reports that the store at Path was written, with
+	// the SHA256 of its new content
+	EventFileRewritten EventType = "file_rewritten"
+)
+
+// Event is reported to the handler set with WithEventHandler. Only the
+// fields that apply to Type are set.
+type Event struct {
+	Type        EventType `json:"type"`
+	Time        time.Time `json:"time"`
+	Action      Action    `json:"action,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Keys        int       `json:"keys,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
@@ -0,0 +1,37 @@
+package doorman
+
+import (
+	"strings"
+	"time"
+)
+
+// expiredPrefix starts the comment an expired key's line is turned into when
+// syncing, e.g. "# doorman-expired: ssh-ed25519 AAAA... alice". It keeps the
+// key from being added again while it is still published, and goes once it
+// no longer is.
+const expiredPrefix = "# doorman-expired: "
+
+// expiredKey parses an entry left in place of an expired key.
+func expiredKey(entry Entry) (Key, bool) {
+	line, ok := strings.CutPrefix(entry.Line, expiredPrefix)
+	if !ok {
+		return Key{}, false
+	}
+	return ParseKey(line)
+}
+
+// expiry reports whether a key has expired. The nil expiry expires nothing.
+type expiry func(key PublicKey) bool
+
+// expiresBy returns the expiry of keys whose doorman-expires= stamp, plus
+// grace, has passed at now.
+func expiresBy(now time.Time, grace time.Duration) expiry {
+	return func(key PublicKey) bool {
+		expires, ok := key.Expires()
+		return ok && !now.Before(expires.Add(grace))
+	}
+}
+
+func (e expiry) expired(key PublicKey) bool {
+	return e != nil && e(key)
+}
@@ -0,0 +1,126 @@
+package doorman
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPublicKeyExpires(t *testing.T) {
+	tests := []struct {
+		comment string
+		want    time.Time
+		ok      bool
+	}{
+		{"alice doorman-expires=2024-03-17", time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC), true},
+		{"alice doorman-expires=2024-03-17T18:00:00Z", time.Date(2024, 3, 17, 18, 0, 0, 0, time.UTC), true},
+		{"alice doorman-expires=soon", time.Time{}, false},
+		{"alice doorman-added=2024-03-17", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := PublicKey{Type: "ssh-ed25519", Blob: "KEY", Comment: tt.comment}.Expires()
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("Expires() of %q = %v, %v; want %v, %v", tt.comment, got, ok, tt.want, tt.ok)
+		}
+	}
+	if label := (PublicKey{Comment: "laptop alice doorman-expires=2024-03-17"}).Label(); label != "alice" {
+		t.Errorf("expected the stamp to be left out of the label, got %q", label)
+	}
+}
+
+func TestManagerSyncExpired(t *testing.T) {
+	store := NewMemoryStore(
+		Entry{"ssh-ed25519 KEEP carol"},
+		Entry{"ssh-ed25519 OLD laptop doorman-expires=2024-03-17 carol"},
+	)
+	clock := &fakeClock{}
+	source := staticSource{keys: "ssh-ed25519 KEEP\nssh-ed25519 OLD\nssh-ed25519 GONE doorman-expires=2024-03-01"}
+	m := NewManager(WithSource(source), WithStore(store), WithPrompter(yes(1)), WithClock(clock), WithExpiry(0))
+
+	change, err := m.Sync(context.Background(), "carol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "ssh-ed25519 KEEP carol\n# doorman-expired: ssh-ed25519 OLD laptop doorman-expires=2024-03-17 carol\n"
+	if got := content(t, store); got != expected {
+		t.Errorf("unexpected content %q", got)
+	}
+	if got := change.String(); got != "Removed 1 expired key for carol (1 ed25519)" {
+		t.Errorf("unexpected summary %q", got)
+	}
+	if len(change.Expired) != 1 || len(change.Removed) != 1 {
+		t.Errorf("unexpected change %+v", change)
+	}
+
+	// Still published, but not added back
+	change, err = m.Sync(context.Background(), "carol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := change.String(); got != "Keys for carol are up to date (1 key)" {
+		t.Errorf("unexpected summary %q", got)
+	}
+
+	// No longer published: the comment goes too
+	m = NewManager(WithSource(staticSource{keys: "ssh-ed25519 KEEP"}), WithStore(store), WithPrompter(yes(1)), WithClock(clock), WithExpiry(0))
+	if _, err := m.Sync(context.Background(), "carol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-ed25519 KEEP carol\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+}
+
+func TestManagerSyncExpiryGrace(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-ed25519 KEEP carol"}, Entry{"ssh-rsa OLD doorman-expires=2024-03-17 carol"})
+	clock := &fakeClock{}
+	source := staticSource{keys: "ssh-ed25519 KEEP\nssh-rsa OLD\nssh-ed25519 NEW"}
+	m := NewManager(WithSource(source), WithStore(store), WithPrompter(yes(2)), WithClock(clock), WithExpiry(24*time.Hour))
+
+	change, err := m.Sync(context.Background(), "carol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(change.Added) != 1 || len(change.Removed) != 0 {
+		t.Errorf("expected the key to be kept within the grace period, got %q", change)
+	}
+
+	clock.now = time.Date(2024, 3, 19, 0, 0, 0, 0, time.UTC)
+	store.Save(append(store.entries, Entry{"ssh-ed25519 EXTRA carol"}))
+	change, err = m.Sync(context.Background(), "carol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := change.String(); got != "Synced keys for carol: added 0, removed 1 (1 ed25519); removed 1 expired key (1 rsa)" {
+		t.Errorf("unexpected summary %q", got)
+	}
+}
+
+func TestManagerSyncWithoutExpiry(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-ed25519 OLD doorman-expires=2024-03-17 carol"})
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 OLD"}), WithStore(store), WithClock(&fakeClock{}))
+
+	change, err := m.Sync(context.Background(), "carol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := change.String(); got != "Keys for carol are up to date (1 key)" {
+		t.Errorf("expected stamps to be ignored, got %q", got)
+	}
+}
+
+func TestManagerSyncUsersExpired(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-ed25519 OLD doorman-expires=2024-03-17 carol"}, Entry{"ssh-ed25519 OLD dave"})
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 OLD"}), WithStore(store), WithPrompter(yes(1)), WithClock(&fakeClock{}), WithExpiry(0))
+
+	changes, err := m.SyncUsers(context.Background(), []string{"carol", "dave"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := changes[0].String(); got != "Removed 1 expired key for carol (1 ed25519)" {
+		t.Errorf("unexpected summary %q", got)
+	}
+	if got := changes[1].String(); got != "Keys for dave are up to date (1 key)" {
+		t.Errorf("unexpected summary %q", got)
+	}
+}
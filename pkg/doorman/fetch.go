@@ -0,0 +1,151 @@
+package doorman
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"time"
+)
+
+// HTTPClient performs the requests FetchKeys makes. *http.Client satisfies
+// it.
+type HTTPClient interface {
+	Do(request *http.Request) (*http.Response, error)
+}
+
+// FetchError reports that keys could not be fetched for a reason other than
+// the user being invalid or unknown: an unexpected HTTP status, a network
+// failure, or any other error from a KeySource.
+type FetchError struct {
+	// User whose keys were requested; empty from FetchKeys, which doesn't
+	// know
+	User string
+	// URL that was requested, if the keys were fetched over HTTP
+	URL string
+	// Status is the HTTP status received, or 0 when there was no response
+	Status int
+	// Err is the underlying error; nil for an unexpected status
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	msg := "fetching keys"
+	if e.User != "" {
+		msg += " for " + e.User
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return fmt.Sprintf("%s: HTTP %d from %s", msg, e.Status, e.URL)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// RateLimitError reports that the key source refused a request because of
+// rate limiting: a 429, or a 403 with no remaining quota.
+type RateLimitError struct {
+	// RetryAfter is the delay given by a Retry-After header in seconds, or
+	// negative when there was none
+	RetryAfter time.Duration
+	// Reset is when the limit ends according to a Retry-After date or the
+	// X-RateLimit-Reset header, or the zero time when neither was given
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Reset.IsZero() {
+		return "rate limit exceeded"
+	}
+	return "rate limit exceeded until " + e.Reset.Format(time.RFC3339)
+}
+
+// Wait returns how long after now a retry may succeed, or -1 when the source
+// didn't say.
+func (e *RateLimitError) Wait(now time.Time) time.Duration {
+	switch {
+	case e.RetryAfter >= 0:
+		return e.RetryAfter
+	case !e.Reset.IsZero():
+		return max(e.Reset.Sub(now), 0)
+	default:
+		return -1
+	}
+}
+
+// FetchKeys downloads the key list at url with a single request, which is
+// abandoned when ctx is done; ctx's error is then returned as is. Other
+// failures are reported as a *RateLimitError or a *FetchError, which for
+// recognized network problems wraps a *NetworkError.
+func FetchKeys(ctx context.Context, client HTTPClient, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, &FetchError{URL: url, Err: err}
+	}
+	keys, _, err := fetch(ctx, client, request)
+	return keys, err
+}
+
+// fetch is FetchKeys for a request with headers of its own. It also returns
+// the URL the response came from, which differs from the request's after a
+// redirect.
+func fetch(ctx context.Context, client HTTPClient, request *http.Request) ([]byte, *neturl.URL, error) {
+	url := request.URL.String()
+	response, err := client.Do(request)
+	if err != nil {
+		// BEHAVIOR: A cancelled or expired ctx is the caller's doing, so
+		// don't suggest checking the network
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+		return nil, nil, &FetchError{URL: url, Err: withNetworkHint(err)}
+	}
+	defer response.Body.Close()
+
+	if limitErr, limited := rateLimitFromResponse(response); limited {
+		return nil, nil, limitErr
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, &FetchError{URL: url, Status: response.StatusCode}
+	}
+
+	keys, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, &FetchError{URL: url, Status: response.StatusCode, Err: err}
+	}
+
+	final := request.URL
+	if response.Request != nil {
+		final = response.Request.URL
+	}
+	return keys, final, nil
+}
+
+func rateLimitFromResponse(response *http.Response) (*RateLimitError, bool) {
+	switch {
+	case response.StatusCode == http.StatusTooManyRequests:
+	case response.StatusCode == http.StatusForbidden && response.Header.Get("X-RateLimit-Remaining") == "0":
+	default:
+		return nil, false
+	}
+
+	limitErr := &RateLimitError{RetryAfter: -1}
+	if retryAfter := response.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			limitErr.RetryAfter = time.Duration(max(seconds, 0)) * time.Second
+		} else if at, err := http.ParseTime(retryAfter); err == nil {
+			limitErr.Reset = at
+		}
+	}
+	if reset := response.Header.Get("X-RateLimit-Reset"); reset != "" && limitErr.Reset.IsZero() {
+		if epoch, err := strconv.ParseInt(reset, 10, 64); err == nil {
+			limitErr.Reset = time.Unix(epoch, 0)
+		}
+	}
+	return limitErr, true
+}
@@ -0,0 +1,142 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClient answers every request with response, or fails with err.
+type fakeClient struct {
+	response *http.Response
+	err      error
+}
+
+func (c fakeClient) Do(request *http.Request) (*http.Response, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.response, nil
+}
+
+func respond(status int, headers map[string]string, body string) *http.Response {
+	h := http.Header{}
+	for k, v := range headers {
+		h.Set(k, v)
+	}
+	return &http.Response{StatusCode: status, Header: h, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("read failed") }
+
+func TestFetchKeys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/alice.keys":
+			fmt.Fprint(w, "ssh-ed25519 KEY...")
+		case "/broken.keys":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	keys, err := FetchKeys(context.Background(), server.Client(), server.URL+"/alice.keys")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(keys) != "ssh-ed25519 KEY..." {
+		t.Errorf("unexpected keys %q", keys)
+	}
+
+	for path, status := range map[string]int{"/nobody.keys": http.StatusNotFound, "/broken.keys": http.StatusInternalServerError} {
+		_, err := FetchKeys(context.Background(), server.Client(), server.URL+path)
+		var fetchErr *FetchError
+		if !errors.As(err, &fetchErr) || fetchErr.Status != status || fetchErr.URL != server.URL+path {
+			t.Errorf("%s: expected HTTP %d, got %v", path, status, err)
+		}
+	}
+}
+
+func TestFetchKeysDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := FetchKeys(ctx, server.Client(), server.URL+"/alice.keys")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to abort the request, got %v", err)
+	}
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		t.Errorf("expected the context's error rather than a FetchError, got %v", err)
+	}
+}
+
+func TestFetchKeysReadError(t *testing.T) {
+	client := fakeClient{response: &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(failingReader{})}}
+	if _, err := FetchKeys(context.Background(), client, "https://github.com/alice.keys"); err == nil || !strings.Contains(err.Error(), "read failed") {
+		t.Errorf("expected read error, got %v", err)
+	}
+}
+
+func TestFetchKeysRequestError(t *testing.T) {
+	client := fakeClient{err: urlError(errors.New("something else"))}
+	_, err := FetchKeys(context.Background(), client, "https://github.com/alice.keys")
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.Status != 0 {
+		t.Fatalf("expected a *FetchError without a status, got %v", err)
+	}
+	var netErr *NetworkError
+	if errors.As(err, &netErr) {
+		t.Errorf("expected the unrecognized error without a hint, got %v", err)
+	}
+}
+
+func TestFetchKeysRateLimited(t *testing.T) {
+	now := time.Date(2024, 3, 18, 12, 0, 0, 0, time.UTC)
+	resetIn := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+
+	tests := []struct {
+		name     string
+		response *http.Response
+		limited  bool
+		wait     time.Duration
+	}{
+		{"plain 403", respond(http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "12"}, ""), false, 0},
+		{"429 retry-after seconds", respond(http.StatusTooManyRequests, map[string]string{"Retry-After": "5"}, ""), true, 5 * time.Second},
+		{"429 retry-after zero", respond(http.StatusTooManyRequests, map[string]string{"Retry-After": "0"}, ""), true, 0},
+		{"429 retry-after date", respond(http.StatusTooManyRequests, map[string]string{"Retry-After": now.Add(time.Minute).Format(http.TimeFormat)}, ""), true, time.Minute},
+		{"403 exhausted with reset", respond(http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": resetIn(20 * time.Minute)}, ""), true, 20 * time.Minute},
+		{"reset in the past", respond(http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": resetIn(-time.Minute)}, ""), true, 0},
+		{"429 without hints", respond(http.StatusTooManyRequests, nil, ""), true, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := FetchKeys(context.Background(), fakeClient{response: tt.response}, "https://github.com/alice.keys")
+			var limitErr *RateLimitError
+			if limited := errors.As(err, &limitErr); limited != tt.limited {
+				t.Fatalf("expected limited=%v, got %v", tt.limited, err)
+			}
+			if tt.limited {
+				if wait := limitErr.Wait(now); wait != tt.wait {
+					t.Errorf("expected wait %v, got %v", tt.wait, wait)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package doorman
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// KeyOption is one of the options before the key in an authorized_keys
+// line, e.g. restrict, or from="10.0.0.0/8,192.168.0.0/16".
+type KeyOption struct {
+	Name string
+	// Value is the option's argument without its quotes, and with \" as
+	// a plain quote; HasValue tells an empty argument from none
+	Value    string
+	HasValue bool
+}
+
+// String formats the option as it appears in a line.
+func (o KeyOption) String() string {
+	if !o.HasValue {
+		return o.Name
+	}
+	return o.Name + `="` + strings.ReplaceAll(o.Value, `"`, `\"`) + `"`
+}
+
+// ParseKeyOptions parses the options field of an authorized_keys line as
+// sshd does (see AUTHORIZED_KEYS FILE FORMAT in sshd(8)): comma-separated
+// options, each a bare name such as restrict or a name, "=" and a quoted
+// argument, in which \" stands for a quote and commas and spaces are plain
+// text. FormatKeyOptions gives the field back.
+func ParseKeyOptions(field string) ([]KeyOption, error) {
+	if field == "" {
+		return nil, nil
+	}
+	var options []KeyOption
+	rest := field
+	for {
+		end := strings.IndexAny(rest, "=,\" \t\r\n")
+		if end < 0 {
+			end = len(rest)
+		}
+		option := KeyOption{Name: rest[:end]}
+		if !optionNamePattern.MatchString(option.Name) {
+			return nil, fmt.Errorf("invalid options '%s': expected an option name at %q", field, rest)
+		}
+		rest = rest[end:]
+		if value, ok := strings.CutPrefix(rest, "="); ok {
+			var err error
+			if option.Value, rest, err = unquoteOption(value); err != nil {
+				return nil, fmt.Errorf("invalid options '%s': %s %w", field, option.Name, err)
+			}
+			option.HasValue = true
+		}
+		options = append(options, option)
+		if rest == "" {
+			return options, nil
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("invalid options '%s': unexpected %q after %s", field, rest[0], option.Name)
+		}
+		rest = rest[1:]
+	}
+}
+
+// unquoteOption reads the quoted argument at the start of s, returning it
+// and what follows.
+func unquoteOption(s string) (value, rest string, err error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", fmt.Errorf("needs its argument in quotes")
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '"':
+			b.WriteByte('"')
+			i++
+		case c == '"':
+			return b.String(), s[i+1:], nil
+		case c == '\n' || c == '\r':
+			return "", "", fmt.Errorf("has a line break in its argument")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("has an unterminated quote")
+}
+
+// optionNamePattern matches the names of options, such as no-pty, and of
+// vendor extensions, such as no-touch-required@example.com.
+var optionNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]*$`)
+
+// FormatKeyOptions formats options as the options field of an
+// authorized_keys line, the inverse of ParseKeyOptions.
+func FormatKeyOptions(options []KeyOption) string {
+	formatted := make([]string, len(options))
+	for i, option := range options {
+		formatted[i] = option.String()
+	}
+	return strings.Join(formatted, ",")
+}
+
+// optionsEnd returns where the options field at the start of line ends:
+// at the first space or tab outside quotes, as sshd finds it.
+func optionsEnd(line string) int {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && i+1 < len(line) && line[i+1] == '"':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case (c == ' ' || c == '\t') && !quoted:
+			return i
+		}
+	}
+	return len(line)
+}
+
+// splitKeyLine splits a key line into its options field, key type, blob
+// and comment, the comment's words separated by single spaces. As for
+// sshd, a line has an options field unless it starts with a key type.
+func splitKeyLine(line string) (options, keyType, blob, comment string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", "", "", false
+	}
+	first := line
+	if end := strings.IndexAny(line, " \t"); end >= 0 {
+		first = line[:end]
+	}
+	if !isKeyType(first) {
+		end := optionsEnd(line)
+		options, line = line[:end], line[end:]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !isKeyType(fields[0]) {
+		return "", "", "", "", false
+	}
+	return options, fields[0], fields[1], strings.Join(fields[2:], " "), true
+}
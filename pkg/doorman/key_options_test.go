@@ -0,0 +1,88 @@
+package doorman
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyOptions(t *testing.T) {
+	tests := []struct {
+		field    string
+		expected []KeyOption
+	}{
+		{"", nil},
+		{"restrict", []KeyOption{{Name: "restrict"}}},
+		{`from="10.0.0.0/8,192.168.0.0/16",no-pty`, []KeyOption{{Name: "from", Value: "10.0.0.0/8,192.168.0.0/16", HasValue: true}, {Name: "no-pty"}}},
+		{`command="rsync --server",restrict`, []KeyOption{{Name: "command", Value: "rsync --server", HasValue: true}, {Name: "restrict"}}},
+		{`cert-authority,principals="alice,bob",command="echo \"a,b\""`, []KeyOption{{Name: "cert-authority"}, {Name: "principals", Value: "alice,bob", HasValue: true}, {Name: "command", Value: `echo "a,b"`, HasValue: true}}},
+		{`environment="PATH=/bin:/usr/bin"`, []KeyOption{{Name: "environment", Value: "PATH=/bin:/usr/bin", HasValue: true}}},
+		{`command=""`, []KeyOption{{Name: "command", HasValue: true}}},
+		{`command="C:\tools\x.exe"`, []KeyOption{{Name: "command", Value: `C:\tools\x.exe`, HasValue: true}}},
+	}
+	for _, tt := range tests {
+		options, err := ParseKeyOptions(tt.field)
+		if err != nil || !reflect.DeepEqual(options, tt.expected) {
+			t.Errorf("ParseKeyOptions(%q) = %+v, %v, expected %+v", tt.field, options, err, tt.expected)
+		}
+		if formatted := FormatKeyOptions(options); formatted != tt.field {
+			t.Errorf("FormatKeyOptions gave %q for %q", formatted, tt.field)
+		}
+	}
+
+	for _, field := range []string{",restrict", "restrict,", "from=10.0.0.1", `command="unterminated`, `command="a"b`, "no-pty no-agent-forwarding", `command="a` + "\n" + `"`} {
+		if _, err := ParseKeyOptions(field); err == nil || !strings.HasPrefix(err.Error(), "invalid options") {
+			t.Errorf("expected ParseKeyOptions(%q) to fail, got %v", field, err)
+		}
+	}
+}
+
+func TestParseKeyWithOptions(t *testing.T) {
+	tests := []struct {
+		line    string
+		options string
+		comment string
+	}{
+		{"ssh-ed25519 K1 alice", "", "alice"},
+		{`command="rsync --server -e ssh-ed25519 K9" ssh-ed25519 K1 alice`, `command="rsync --server -e ssh-ed25519 K9"`, "alice"},
+		{`from="10.0.0.0/8, 192.168.0.0/16",no-pty ssh-ed25519 K1 work laptop alice`, `from="10.0.0.0/8, 192.168.0.0/16",no-pty`, "work laptop alice"},
+		{`command="echo \"hi there\"" ssh-ed25519 K1`, `command="echo \"hi there\""`, ""},
+	}
+	for _, tt := range tests {
+		key, ok := ParseKey(tt.line)
+		if !ok || key.Type != "ssh-ed25519" || key.Blob != "K1" || key.Comment != tt.comment || key.Options() != tt.options {
+			t.Errorf("ParseKey(%q) = %+v with options %q, %v", tt.line, key, key.Options(), ok)
+		}
+	}
+
+	// Words before the key that aren't a single options field aren't a key
+	if key, ok := ParseKey("no-pty no-agent-forwarding ssh-ed25519 K1 alice"); ok {
+		t.Errorf("expected a line sshd rejects to be rejected, got %+v", key)
+	}
+}
+
+// FuzzParseKeyOptions checks that formatting what ParseKeyOptions accepts
+// gives back the field it was given.
+func FuzzParseKeyOptions(f *testing.F) {
+	for _, seed := range []string{"restrict", `from="10.0.0.0/8,192.168.0.0/16",no-pty`, `command="echo \"a,b\"",environment="A=B"`, `command="\\"`, `x=""`} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, field string) {
+		options, err := ParseKeyOptions(field)
+		if err != nil {
+			return
+		}
+		if formatted := FormatKeyOptions(options); formatted != field {
+			t.Errorf("FormatKeyOptions(ParseKeyOptions(%q)) = %q", field, formatted)
+		}
+		// A field that looks like a key type isn't one sshd
+		// reads as options either
+		if field == "" || isKeyType(options[0].Name) {
+			return
+		}
+		line := field + " ssh-ed25519 K1 alice"
+		if key, ok := ParseKey(line); !ok || key.Options() != field || key.Blob != "K1" {
+			t.Errorf("ParseKey(%q) = %+v with options %q, %v", line, key, key.Options(), ok)
+		}
+	})
+}
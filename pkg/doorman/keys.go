@@ -0,0 +1,484 @@
+package doorman
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// PublicKey is an SSH public key as published by a KeySource.
+type PublicKey struct {
+	// Type is the key algorithm, e.g. "ssh-ed25519"
+	Type string
+	// Blob is the base64-encoded public key
+	Blob string
+	// Comment is everything after the key; for keys added by doorman it ends
+	// with the username
+	Comment string
+	// ForcedOptions, if set, are the options the key must be installed with,
+	// e.g. `restrict,command="/usr/local/bin/bot-shell"`. Sources leave it
+	// empty; it is set by whoever decides how keys are installed.
+	ForcedOptions string
+}
+
+// String formats the key as an authorized_keys line without options.
+func (k PublicKey) String() string {
+	if k.Comment == "" {
+		return k.Type + " " + k.Blob
+	}
+	return k.Type + " " + k.Blob + " " + k.Comment
+}
+
+// AuthorizedKey formats the key as an authorized_keys line, with its
+// ForcedOptions first.
+func (k PublicKey) AuthorizedKey() string {
+	if k.ForcedOptions == "" {
+		return k.String()
+	}
+	return k.ForcedOptions + " " + k.String()
+}
+
+// keygenTypes maps key algorithms to the names ssh-keygen -l gives them.
+var keygenTypes = map[string]string{
+	"ssh-ed25519":                        "ED25519",
+	"ssh-rsa":                            "RSA",
+	"ssh-dss":                            "DSA",
+	"ecdsa-sha2-nistp256":                "ECDSA",
+	"ecdsa-sha2-nistp384":                "ECDSA",
+	"ecdsa-sha2-nistp521":                "ECDSA",
+	"sk-ssh-ed25519@openssh.com":         "ED25519-SK",
+	"sk-ecdsa-sha2-nistp256@openssh.com": "ECDSA-SK",
+}
+
+// parse decodes the key, reporting false if Blob isn't a valid key of Type.
+func (k PublicKey) parse() (ssh.PublicKey, bool) {
+	blob, err := base64.StdEncoding.DecodeString(k.Blob)
+	if err != nil {
+		return nil, false
+	}
+	parsed, err := ssh.ParsePublicKey(blob)
+	if err != nil || parsed.Type() != k.Type {
+		return nil, false
+	}
+	return parsed, true
+}
+
+// Fingerprint returns the key's SHA256 fingerprint as ssh-keygen prints it,
+// e.g. "SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I", or "" if the
+// key can't be parsed.
+func (k PublicKey) Fingerprint() string {
+	parsed, ok := k.parse()
+	if !ok {
+		return ""
+	}
+	return ssh.FingerprintSHA256(parsed)
+}
+
+// FingerprintMD5 returns the key's MD5 fingerprint as ssh-keygen -E md5
+// prints it, e.g. "MD5:0b:3c:...", for tools that still show the old form,
+// or "" if the key can't be parsed.
+func (k PublicKey) FingerprintMD5() string {
+	parsed, ok := k.parse()
+	if !ok {
+		return ""
+	}
+	return "MD5:" + ssh.FingerprintLegacyMD5(parsed)
+}
+
+// FingerprintLine describes the key exactly as ssh-keygen -lf does, e.g.
+// "256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice (ED25519)",
+// so it can be compared with GitHub's settings page and sshd's logs. It is
+// "" if the key can't be parsed. Everything doorman shows about a key is
+// built from it or from Fingerprint.
+func (k PublicKey) FingerprintLine() string {
+	fingerprint := k.Fingerprint()
+	if fingerprint == "" {
+		return ""
+	}
+	comment := k.Comment
+	if comment == "" {
+		comment = "no comment"
+	}
+	return fmt.Sprintf("%d %s %s (%s)", k.Bits(), fingerprint, comment, keygenTypes[k.Type])
+}
+
+// Describe is FingerprintLine, falling back to the whole line for keys that
+// can't be parsed. Options come first, as in the file.
+func (k Key) Describe() string {
+	description := k.FingerprintLine()
+	if description == "" {
+		return k.Line
+	}
+	if options := k.Options(); options != "" {
+		return options + " " + description
+	}
+	return description
+}
+
+// Options returns the options before the key in its line, e.g.
+// `no-pty,from="10.0.0.1"`, or "" if there are none.
+func (k Key) Options() string {
+	options, _, _, _, _ := splitKeyLine(k.Line)
+	return options
+}
+
+// OptionList returns the options before the key in its line, parsed by
+// ParseKeyOptions.
+func (k Key) OptionList() ([]KeyOption, error) {
+	return ParseKeyOptions(k.Options())
+}
+
+// ShortType returns the name of the key's algorithm used in summaries, e.g.
+// "ed25519" or "rsa".
+func (k PublicKey) ShortType() string {
+	if short, ok := shortKeyTypes[k.Type]; ok {
+		return short
+	}
+	return k.Type
+}
+
+// Bits returns the size of the key as ssh-keygen reports it, or 0 if the
+// key can't be parsed.
+func (k PublicKey) Bits() int {
+	parsed, ok := k.parse()
+	if !ok {
+		return 0
+	}
+	switch k.Type {
+	case "ssh-ed25519", "sk-ssh-ed25519@openssh.com", "ecdsa-sha2-nistp256", "sk-ecdsa-sha2-nistp256@openssh.com":
+		return 256
+	case "ecdsa-sha2-nistp384":
+		return 384
+	case "ecdsa-sha2-nistp521":
+		return 521
+	}
+
+	crypto, ok := parsed.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch key := crypto.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return key.N.BitLen()
+	case *dsa.PublicKey:
+		return key.P.BitLen()
+	}
+	return 0
+}
+
+// Label returns the username the key is labeled with: the last word of its
+// comment, ignoring doorman's tokens. It is "" without a comment.
+func (k PublicKey) Label() string {
+	words := commentWords(k.Comment)
+	if len(words) == 0 {
+		return ""
+	}
+	return words[len(words)-1]
+}
+
+// Note returns the key's comment without the label and doorman's tokens;
+// for keys doorman added, whatever the user published.
+func (k PublicKey) Note() string {
+	words := commentWords(k.Comment)
+	if len(words) == 0 {
+		return ""
+	}
+	return strings.Join(words[:len(words)-1], " ")
+}
+
+// addedToken marks the date doorman added a key, e.g.
+// "doorman-added=2025-03-18".
+const addedToken = "doorman-added="
+
+// Added returns the date doorman added the key, if its comment records it.
+func (k PublicKey) Added() (time.Time, bool) {
+	for _, word := range strings.Fields(k.Comment) {
+		if date, ok := strings.CutPrefix(word, addedToken); ok {
+			added, err := time.Parse(time.DateOnly, date)
+			return added, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// expiresToken marks the day after which a key is no longer installed, e.g.
+// "doorman-expires=2025-06-30". Keys stop working once that day is over, in
+// UTC; an RFC 3339 time, e.g. "doorman-expires=2025-06-30T18:00:00Z", is
+// exact.
+const expiresToken = "doorman-expires="
+
+// Expires returns when the key expires, if its comment says so.
+func (k PublicKey) Expires() (time.Time, bool) {
+	for _, word := range strings.Fields(k.Comment) {
+		value, ok := strings.CutPrefix(word, expiresToken)
+		if !ok {
+			continue
+		}
+		if date, err := time.Parse(time.DateOnly, value); err == nil {
+			return date.AddDate(0, 0, 1), true
+		}
+		expires, err := time.Parse(time.RFC3339, value)
+		return expires, err == nil
+	}
+	return time.Time{}, false
+}
+
+// gitHubKeyIDToken records the ID GitHub gave a key, e.g.
+// "gh-key-id=12345678", for keys fetched through its API.
+const gitHubKeyIDToken = "gh-key-id="
+
+// GitHubKeyID returns the ID GitHub gave the key, if its comment records it.
+func (k PublicKey) GitHubKeyID() (int64, bool) {
+	for _, word := range strings.Fields(k.Comment) {
+		if value, ok := strings.CutPrefix(word, gitHubKeyIDToken); ok {
+			id, err := strconv.ParseInt(value, 10, 64)
+			return id, err == nil
+		}
+	}
+	return 0, false
+}
+
+// gitHubCreatedToken records the day GitHub says a key was created, e.g.
+// "gh-created=2023-11-02", for keys fetched through its API.
+const gitHubCreatedToken = "gh-created="
+
+// GitHubCreated returns the day GitHub says the key was created, if its
+// comment records it. It may be long before doorman added the key.
+func (k PublicKey) GitHubCreated() (time.Time, bool) {
+	for _, word := range strings.Fields(k.Comment) {
+		if date, ok := strings.CutPrefix(word, gitHubCreatedToken); ok {
+			created, err := time.Parse(time.DateOnly, date)
+			return created, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// isGitHubToken reports whether word is one of the tokens recording what
+// GitHub's API says about a key.
+func isGitHubToken(word string) bool {
+	return strings.HasPrefix(word, gitHubKeyIDToken) || strings.HasPrefix(word, gitHubCreatedToken)
+}
+
+// commentWords splits a comment into words, leaving out doorman's tokens
+// and GitHub's.
+func commentWords(comment string) []string {
+	var words []string
+	for _, word := range strings.Fields(comment) {
+		if isGitHubToken(word) {
+			continue
+		}
+		if !strings.HasPrefix(word, "doorman-") || !strings.Contains(word, "=") {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// KeyID identifies a key by its algorithm and decoded blob, so the same
+// key matches whatever its options, comment and spacing, and however its
+// base64 is padded. It is comparable, to key maps with.
+type KeyID struct {
+	Type string
+	blob string
+}
+
+// ID returns the key's KeyID. A blob that isn't base64 is matched as it is
+// written.
+func (k PublicKey) ID() KeyID {
+	if blob, err := base64.RawStdEncoding.Strict().DecodeString(strings.TrimRight(k.Blob, "=")); err == nil {
+		return KeyID{Type: k.Type, blob: string(blob)}
+	}
+	// The NUL keeps these apart from decoded blobs, which are never valid
+	// base64 text after one
+	return KeyID{Type: k.Type, blob: "\x00" + k.Blob}
+}
+
+// keySet holds published keys. An installed key is one of them if it is
+// the same key, or if both record the same GitHub key ID; keys installed
+// before IDs were recorded are still matched by key.
+type keySet struct {
+	keys map[KeyID]bool
+	ids  map[int64]bool
+}
+
+func newKeySet(keys []PublicKey) keySet {
+	set := keySet{keys: make(map[KeyID]bool), ids: make(map[int64]bool)}
+	for _, key := range keys {
+		set.add(key)
+	}
+	return set
+}
+
+func (s keySet) add(key PublicKey) {
+	s.keys[key.ID()] = true
+	if id, ok := key.GitHubKeyID(); ok {
+		s.ids[id] = true
+	}
+}
+
+func (s keySet) has(key PublicKey) bool {
+	if s.keys[key.ID()] {
+		return true
+	}
+	id, ok := key.GitHubKeyID()
+	return ok && s.ids[id]
+}
+
+// Key is a single key line from an authorized_keys file.
+type Key struct {
+	// Line is the whole line, including any options and the comment
+	Line string
+	PublicKey
+}
+
+// shortKeyTypes maps key algorithms to the names used in summaries.
+var shortKeyTypes = map[string]string{
+	"ssh-ed25519":                        "ed25519",
+	"ssh-rsa":                            "rsa",
+	"ssh-dss":                            "dsa",
+	"ecdsa-sha2-nistp256":                "ecdsa",
+	"ecdsa-sha2-nistp384":                "ecdsa",
+	"ecdsa-sha2-nistp521":                "ecdsa",
+	"sk-ssh-ed25519@openssh.com":         "ed25519-sk",
+	"sk-ecdsa-sha2-nistp256@openssh.com": "ecdsa-sk",
+}
+
+func isKeyType(field string) bool {
+	_, ok := shortKeyTypes[field]
+	return ok
+}
+
+// ParseKey parses a key line, skipping over any leading options, which are
+// split off as sshd splits them, so quoted spaces in them don't end them.
+// It reports false for blank lines, comments and unrecognized lines.
+func ParseKey(line string) (Key, bool) {
+	_, keyType, blob, comment, ok := splitKeyLine(line)
+	if !ok {
+		return Key{}, false
+	}
+	return Key{
+		Line:      strings.TrimSpace(line),
+		PublicKey: PublicKey{Type: keyType, Blob: blob, Comment: comment},
+	}, true
+}
+
+// ParseKeys returns the keys in data, skipping lines ParseKey rejects.
+func ParseKeys(data []byte) []Key {
+	var keys []Key
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, ok := ParseKey(line); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ParsePublicKeys parses a published key list, one key per line, skipping
+// lines ParseKey rejects.
+func ParsePublicKeys(data []byte) []PublicKey {
+	var keys []PublicKey
+	for _, key := range ParseKeys(data) {
+		keys = append(keys, key.PublicKey)
+	}
+	return keys
+}
+
+// DiffKeys compares the key lines of two versions of a file and returns the
+// keys only present after (added) and only present before (removed). Keys
+// are the same if their KeyIDs and options are, whatever their comments
+// and spacing; a key whose options changed, and so grants other access, is
+// both removed and added. Duplicate lines are counted individually.
+func DiffKeys(before, after []byte) (added, removed []Key) {
+	if bytes.Equal(before, after) {
+		return nil, nil
+	}
+	// Identical lines are matched before they are parsed, so only the few
+	// that differ are, however long the file
+	counts := make(map[string]int)
+	for _, line := range strings.Split(string(before), "\n") {
+		counts[strings.TrimSpace(line)]++
+	}
+	var afterOnly []Key
+	for _, line := range strings.Split(string(after), "\n") {
+		line = strings.TrimSpace(line)
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		if key, ok := ParseKey(line); ok {
+			afterOnly = append(afterOnly, key)
+		}
+	}
+	grants := make(map[keyGrant]int)
+	for _, line := range strings.Split(string(before), "\n") {
+		line = strings.TrimSpace(line)
+		if counts[line] == 0 {
+			continue
+		}
+		counts[line]--
+		if key, ok := ParseKey(line); ok {
+			removed = append(removed, key)
+			grants[grantOf(key)]++
+		}
+	}
+	for _, key := range afterOnly {
+		if grant := grantOf(key); grants[grant] > 0 {
+			grants[grant]--
+			removed = slices.DeleteFunc(removed, once(func(k Key) bool { return grantOf(k) == grant }))
+			continue
+		}
+		added = append(added, key)
+	}
+	return added, removed
+}
+
+// keyGrant is the access a key line grants: the key, and its options.
+type keyGrant struct {
+	id      KeyID
+	options string
+}
+
+func grantOf(key Key) keyGrant {
+	options := key.Options()
+	if parsed, err := ParseKeyOptions(options); err == nil {
+		options = FormatKeyOptions(parsed)
+	}
+	return keyGrant{key.ID(), options}
+}
+
+// once returns a predicate that is true only for the first element match
+// is true for.
+func once[T any](match func(T) bool) func(T) bool {
+	done := false
+	return func(v T) bool {
+		if done || !match(v) {
+			return false
+		}
+		done = true
+		return true
+	}
+}
+
+// LabelKeys formats keys as authorized_keys lines ending with username,
+// which is how the keys are found again by UserKeys and RemoveKeys.
+func LabelKeys(keys []PublicKey, username string) []byte {
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		lines[i] = key.AuthorizedKey() + " " + username
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// UserKeys returns the keys in content labeled with the bare username.
+func UserKeys(content []byte, username string) []Key {
+	return Labels{}.UserKeys(content, username)
+}
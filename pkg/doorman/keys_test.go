@@ -0,0 +1,293 @@
+package doorman
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keys generated with ssh-keygen
+const (
+	ed25519Blob  = "AAAAC3NzaC1lZDI1NTE5AAAAIBMpUdogPMMHu+nQNMCIXHV5Emg2Caeeb8/Qmy8gs/Kc"
+	rsa2048Blob  = "AAAAB3NzaC1yc2EAAAADAQABAAABAQCJisPQKwzjrKg7yHcMa5+9xUuSXe3l9LfuF6slLKN5PrDVc5j3CJIZrbTtDSRfwlJs9qwpsXOJaRs1TBzlkT3S3VMsD4x/9DyfNFBUsXqqeTi/y8BlSnakxKufIpo306Q25S1tasfYxvQI6biy29KQxniPvDsDDcM7cLLkujF9aFYCR8xBo1BEP2s/mmoSLtmLF0+Ga00s0HfQ1zFg+MAYz9K2ZQ1XDyAIJrQURZj7ejtbDxD0XhQAYnqqz0ResI8r0aA6lip+wz4qwaW0i+EpetBYbc2BhelDMjViCmxu9xMdIl6NOlfOL/V6MrejoZSovLFh+fLwi0KDnQYyXoGR"
+	ecdsa384Blob = "AAAAE2VjZHNhLXNoYTItbmlzdHAzODQAAAAIbmlzdHAzODQAAABhBBFsnd/OfkkL0m7vKk66whPSheBfRHNqCCpTzFM59H16NIVvlait3RHr4iHcAc5h8i+3U7aWq0bwwpOVg2gNooMXbpVUcwCUfzY99jwBp5jCTDLtvOXJjpcZFGbWLePeKA=="
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		ok      bool
+		keyType string
+		blob    string
+		comment string
+	}{
+		{"plain", "ssh-ed25519 AAAAC3 alice", true, "ssh-ed25519", "AAAAC3", "alice"},
+		{"no comment", "ssh-rsa AAAAB3", true, "ssh-rsa", "AAAAB3", ""},
+		{"multi-word comment", "ssh-rsa AAAAB3 work laptop alice", true, "ssh-rsa", "AAAAB3", "work laptop alice"},
+		{"options", `no-pty,from="10.0.0.1" ecdsa-sha2-nistp256 AAAAE2 bob`, true, "ecdsa-sha2-nistp256", "AAAAE2", "bob"},
+		{"security key", "sk-ssh-ed25519@openssh.com AAAAGn carol", true, "sk-ssh-ed25519@openssh.com", "AAAAGn", "carol"},
+		{"surrounding space", "  ssh-rsa AAAAB3 alice \r", true, "ssh-rsa", "AAAAB3", "alice"},
+		{"blank", "   ", false, "", "", ""},
+		{"comment line", "# ssh-rsa AAAAB3 alice", false, "", "", ""},
+		{"garbage", "not a key", false, "", "", ""},
+		{"type without blob", "ssh-rsa", false, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := ParseKey(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("expected ok=%v, got %v", tt.ok, ok)
+			}
+			if key.Type != tt.keyType || key.Blob != tt.blob || key.Comment != tt.comment {
+				t.Errorf("expected (%q, %q, %q), got (%q, %q, %q)", tt.keyType, tt.blob, tt.comment, key.Type, key.Blob, key.Comment)
+			}
+		})
+	}
+}
+
+// TestFingerprintLine compares each key in testdata/keys with what
+// ssh-keygen -lf printed for it, saved next to it as a .fp file.
+func TestFingerprintLine(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "keys", "*.pub"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no key fixtures found (%v)", err)
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := os.ReadFile(strings.TrimSuffix(file, ".pub") + ".fp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := ParsePublicKeys(data)
+			if len(keys) != 1 {
+				t.Fatalf("expected one key in %s, got %d", file, len(keys))
+			}
+
+			if got := keys[0].FingerprintLine(); got != strings.TrimSpace(string(expected)) {
+				t.Errorf("expected %q, got %q", strings.TrimSpace(string(expected)), got)
+			}
+			if got := keys[0].Fingerprint(); got != strings.Fields(string(expected))[1] {
+				t.Errorf("Fingerprint %q doesn't match ssh-keygen's", got)
+			}
+		})
+	}
+}
+
+func TestFingerprintMD5(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "keys", "ed25519.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := ParsePublicKeys(data)
+	// As ssh-keygen -E md5 -lf prints it
+	if got, expected := keys[0].FingerprintMD5(), "MD5:59:ed:61:77:83:aa:d8:e2:7d:d1:cd:14:e2:f8:b9:20"; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestFingerprintInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		key  PublicKey
+	}{
+		{"invalid base64", PublicKey{Type: "ssh-ed25519", Blob: "AAAAC3!"}},
+		{"not a key", PublicKey{Type: "ssh-ed25519", Blob: "AAAAC3Nz"}},
+		{"wrong type", PublicKey{Type: "ssh-rsa", Blob: ed25519Blob}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key.Fingerprint(); got != "" {
+				t.Errorf("expected no fingerprint, got %q", got)
+			}
+			if got := tt.key.FingerprintMD5(); got != "" {
+				t.Errorf("expected no MD5 fingerprint, got %q", got)
+			}
+			if got := tt.key.FingerprintLine(); got != "" {
+				t.Errorf("expected no fingerprint line, got %q", got)
+			}
+		})
+	}
+}
+
+func TestKeyDescribe(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected string
+	}{
+		{"key", "ssh-ed25519 " + ed25519Blob + " alice", "256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice (ED25519)"},
+		{"options", `restrict,from="10.0.0.1" ssh-ed25519 ` + ed25519Blob + " alice", `restrict,from="10.0.0.1" 256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice (ED25519)`},
+		{"no comment", "ssh-ed25519 " + ed25519Blob, "256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I no comment (ED25519)"},
+		{"unparseable", "ssh-rsa AAAAB3 bob", "ssh-rsa AAAAB3 bob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ok := ParseKey(tt.line)
+			if !ok {
+				t.Fatalf("failed to parse %q", tt.line)
+			}
+			if got := key.Describe(); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestKeyDetails(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       PublicKey
+		shortType string
+		bits      int
+		label     string
+		note      string
+		added     string
+	}{
+		{"ed25519", PublicKey{Type: "ssh-ed25519", Blob: ed25519Blob, Comment: "alice"}, "ed25519", 256, "alice", "", ""},
+		{"rsa", PublicKey{Type: "ssh-rsa", Blob: rsa2048Blob, Comment: "work laptop bob"}, "rsa", 2048, "bob", "work laptop", ""},
+		{"ecdsa", PublicKey{Type: "ecdsa-sha2-nistp384", Blob: ecdsa384Blob, Comment: "carol doorman-added=2025-03-18"}, "ecdsa", 384, "carol", "", "2025-03-18"},
+		{"unparseable security key", PublicKey{Type: "sk-ssh-ed25519@openssh.com", Blob: "AAAAGn", Comment: "dave"}, "ed25519-sk", 0, "dave", "", ""},
+		{"unparseable rsa", PublicKey{Type: "ssh-rsa", Blob: "AAAAB3", Comment: ""}, "rsa", 0, "", "", ""},
+		{"bad date", PublicKey{Type: "ssh-ed25519", Blob: ed25519Blob, Comment: "erin doorman-added=soon"}, "ed25519", 256, "erin", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key.ShortType(); got != tt.shortType {
+				t.Errorf("expected type %q, got %q", tt.shortType, got)
+			}
+			if got := tt.key.Bits(); got != tt.bits {
+				t.Errorf("expected %d bits, got %d", tt.bits, got)
+			}
+			if got := tt.key.Label(); got != tt.label {
+				t.Errorf("expected label %q, got %q", tt.label, got)
+			}
+			if got := tt.key.Note(); got != tt.note {
+				t.Errorf("expected note %q, got %q", tt.note, got)
+			}
+			added, ok := tt.key.Added()
+			if got := added.Format(time.DateOnly); ok != (tt.added != "") || ok && got != tt.added {
+				t.Errorf("expected added %q, got %q (%v)", tt.added, got, ok)
+			}
+		})
+	}
+}
+
+func TestDiffKeys(t *testing.T) {
+	before := []byte("ssh-rsa KEY1 alice\nssh-rsa KEY2 bob\nssh-rsa KEY2 bob\n# comment\n")
+	after := []byte("ssh-rsa KEY1 alice\nssh-rsa KEY2 bob\nssh-ed25519 KEY3 carol\n")
+
+	added, removed := DiffKeys(before, after)
+	if len(added) != 1 || added[0].Blob != "KEY3" {
+		t.Errorf("expected KEY3 added, got %+v", added)
+	}
+	if len(removed) != 1 || removed[0].Blob != "KEY2" {
+		t.Errorf("expected one duplicate KEY2 removed, got %+v", removed)
+	}
+}
+
+func TestDiffKeysSameKey(t *testing.T) {
+	before := []byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl alice\n")
+
+	for _, after := range []string{
+		"ssh-ed25519  AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl alice@laptop\n",
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+	} {
+		if added, removed := DiffKeys(before, []byte(after)); len(added) > 0 || len(removed) > 0 {
+			t.Errorf("%q: expected no change, got added %+v and removed %+v", after, added, removed)
+		}
+	}
+
+	after := []byte("restrict ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl alice\n")
+	if added, removed := DiffKeys(before, after); len(added) != 1 || len(removed) != 1 {
+		t.Errorf("expected new options to remove and add the key, got added %+v and removed %+v", added, removed)
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	const blob = "AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	key, ok := ParseKey("ssh-ed25519 " + blob + " alice")
+	if !ok {
+		t.Fatal("expected the key to parse")
+	}
+
+	tests := []struct {
+		name  string
+		line  string
+		equal bool
+	}{
+		{"other comment", "ssh-ed25519 " + blob + " alice@laptop", true},
+		{"no comment", "ssh-ed25519 " + blob, true},
+		{"extra spaces", "ssh-ed25519   " + blob + "\t alice", true},
+		{"options", `restrict,from="10.0.0.0/8" ssh-ed25519 ` + blob + " alice", true},
+		{"truncated blob", "ssh-ed25519 " + blob[:len(blob)-4] + " alice", false},
+		{"other key", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBDUWt6qpMbuQUWvbMRfwdeX0lX3wsgZQ2rCT3vuZHGe alice", false},
+		{"other type", "ssh-rsa " + blob + " alice", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other, ok := ParseKey(tt.line)
+			if !ok {
+				t.Fatalf("expected %q to parse", tt.line)
+			}
+			if equal := other.ID() == key.ID(); equal != tt.equal {
+				t.Errorf("expected equal %v, got %v", tt.equal, equal)
+			}
+		})
+	}
+}
+
+func TestLabelKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     string
+		username string
+		expected string
+	}{
+		{"single key", "ssh-rsa AAAAB3...", "user", "ssh-rsa AAAAB3... user"},
+		{"multiple keys", "ssh-rsa KEY1...\nssh-ed25519 KEY2...", "user", "ssh-rsa KEY1... user\nssh-ed25519 KEY2... user"},
+		{"trailing newline", "ssh-rsa KEY...\n", "user", "ssh-rsa KEY... user"},
+		{"empty lines", "ssh-rsa KEY1...\n\nssh-rsa KEY2...", "user", "ssh-rsa KEY1... user\nssh-rsa KEY2... user"},
+		{"whitespace", "  ssh-rsa KEY...  ", "user", "ssh-rsa KEY... user"},
+		{"empty input", "", "user", ""},
+		{"only whitespace", "   \n   ", "user", ""},
+		{"not a key", "<html>login required</html>", "user", ""},
+		{"existing comment", "ssh-ed25519 KEY... laptop", "user", "ssh-ed25519 KEY... laptop user"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := LabelKeys(ParsePublicKeys([]byte(tt.keys)), tt.username)
+			if string(result) != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, string(result))
+			}
+		})
+	}
+}
+
+func TestUserKeys(t *testing.T) {
+	content := []byte("ssh-rsa K1 bob\r\n# ssh-rsa K2 bob\nssh-ed25519 K3 bobby\nssh-ed25519 K4 work bob\n")
+
+	keys := UserKeys(content, "bob")
+	if len(keys) != 2 || keys[0].Blob != "K1" || keys[1].Blob != "K4" {
+		t.Errorf("expected K1 and K4, got %+v", keys)
+	}
+}
+
+func BenchmarkLabelKeys(b *testing.B) {
+	keys := ParsePublicKeys([]byte("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQC...\nssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI..."))
+	for i := 0; i < b.N; i++ {
+		LabelKeys(keys, "testuser")
+	}
+}
@@ -0,0 +1,185 @@
+package doorman
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLabelFormat labels keys with the bare username.
+const DefaultLabelFormat = "{user}"
+
+// Labels says how keys are labeled with the user they were installed for.
+// The label is the last word of a key's comment, not counting doorman's
+// tokens: Format with {user}, and optionally {provider}, {date} and {host},
+// filled in, e.g. "doorman:alice:2025-03-18" for "doorman:{user}:{date}".
+// Keys labeled in any of Previous, or with the bare username, are still
+// recognized, so changing Format doesn't orphan them. The zero Labels
+// labels keys with the bare username.
+type Labels struct {
+	Format   string
+	Previous []string
+	// Provider and Host fill in {provider} and {host}
+	Provider string
+	Host     string
+	// Date fills in {date}; the zero Time means the day a key is labeled
+	Date time.Time
+	// FoldCase is for providers whose usernames are case-insensitive, such
+	// as GitHub: keys are labeled with the username lowercased, and
+	// recognized whatever the case of the username in their label
+	FoldCase bool
+}
+
+// labelTokens maps the tokens a label format may contain to the pattern
+// each matches in a label.
+var labelTokens = map[string]string{
+	"user":     `(\S+?)`,
+	"provider": `\S*?`,
+	"date":     `\d{4}-\d{2}-\d{2}`,
+	"host":     `\S*?`,
+}
+
+var labelToken = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// CheckLabelFormat reports whether format can label keys: a single word
+// containing {user} exactly once, and no tokens but {provider}, {date} and
+// {host} besides.
+func CheckLabelFormat(format string) error {
+	if fields := strings.Fields(format); len(fields) != 1 || fields[0] != format {
+		return fmt.Errorf("label format '%s' must be a single word", format)
+	}
+	if strings.Count(format, "{user}") != 1 {
+		return fmt.Errorf("label format '%s' must contain {user} once", format)
+	}
+	for _, match := range labelToken.FindAllStringSubmatch(format, -1) {
+		if _, ok := labelTokens[match[1]]; !ok {
+			return fmt.Errorf("label format '%s' has an unknown token {%s}; use {user}, {provider}, {date} or {host}", format, match[1])
+		}
+	}
+	if strings.HasPrefix(format, "doorman-") && strings.Contains(format, "=") || isGitHubToken(format) {
+		return fmt.Errorf("label format '%s' would be taken for one of doorman's tokens", format)
+	}
+	return nil
+}
+
+// Label returns the label for keys installed for username.
+func (l Labels) Label(username string) string {
+	if l.FoldCase {
+		username = strings.ToLower(username)
+	}
+	if l.Format == "" || l.Format == DefaultLabelFormat {
+		return username
+	}
+	date := l.date()
+	return labelToken.ReplaceAllStringFunc(l.Format, func(token string) string {
+		switch token {
+		case "{user}":
+			return username
+		case "{provider}":
+			return l.Provider
+		case "{date}":
+			return date.Format(time.DateOnly)
+		case "{host}":
+			return l.Host
+		}
+		return token
+	})
+}
+
+// comment returns what follows a key installed for username: its label,
+// and the date it was added, e.g. "alice doorman-added=2025-03-18".
+func (l Labels) comment(username string) string {
+	return l.Label(username) + " " + addedToken + l.date().Format(time.DateOnly)
+}
+
+// date returns the day keys are labeled and stamped with.
+func (l Labels) date() time.Time {
+	if l.Date.IsZero() {
+		return time.Now()
+	}
+	return l.Date
+}
+
+// User returns the username key is labeled with, or "" if it has no label.
+func (l Labels) User(key PublicKey) string {
+	label := key.Label()
+	if label == "" {
+		return ""
+	}
+	for _, format := range append([]string{l.Format}, l.Previous...) {
+		if format == "" || format == DefaultLabelFormat {
+			continue
+		}
+		if match := labelPattern(format).FindStringSubmatch(label); match != nil {
+			return match[1]
+		}
+	}
+	return label
+}
+
+// labeled reports whether key is labeled with username.
+func (l Labels) labeled(key PublicKey, username string) bool {
+	user := l.User(key)
+	return user == username || l.FoldCase && user != "" && strings.EqualFold(user, username)
+}
+
+// mentions reports whether username appears in line, which rules most
+// lines out as keys labeled with username before the cost of parsing them.
+func (l Labels) mentions(line, username string) bool {
+	if l.FoldCase {
+		return strings.Contains(strings.ToLower(line), strings.ToLower(username))
+	}
+	return strings.Contains(line, username)
+}
+
+// has reports whether line is a key labeled with username.
+func (l Labels) has(line, username string) bool {
+	if !l.mentions(line, username) {
+		return false
+	}
+	key, ok := ParseKey(line)
+	return ok && l.labeled(key.PublicKey, username)
+}
+
+// UserKeys returns the keys in content labeled with username.
+func (l Labels) UserKeys(content []byte, username string) []Key {
+	var keys []Key
+	for _, line := range strings.Split(string(content), "\n") {
+		if !l.mentions(line, username) {
+			continue
+		}
+		if key, ok := ParseKey(line); ok && l.labeled(key.PublicKey, username) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// labelPatterns caches the pattern compiled for each label format.
+var labelPatterns sync.Map
+
+// labelPattern returns a pattern matching the labels format produces, with
+// the username as its only group.
+func labelPattern(format string) *regexp.Regexp {
+	if pattern, ok := labelPatterns.Load(format); ok {
+		return pattern.(*regexp.Regexp)
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, match := range labelToken.FindAllStringSubmatchIndex(format, -1) {
+		b.WriteString(regexp.QuoteMeta(format[last:match[0]]))
+		if token, ok := labelTokens[format[match[2]:match[3]]]; ok {
+			b.WriteString(token)
+		} else {
+			b.WriteString(regexp.QuoteMeta(format[match[0]:match[1]]))
+		}
+		last = match[1]
+	}
+	b.WriteString(regexp.QuoteMeta(format[last:]) + "$")
+	pattern := regexp.MustCompile(b.String())
+	labelPatterns.Store(format, pattern)
+	return pattern
+}
@@ -0,0 +1,110 @@
+package doorman
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLabelFormat(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"{user}", ""},
+		{"doorman:{user}:{date}", ""},
+		{"{provider}/{user}@{host}", ""},
+		{"doorman {user}", "must be a single word"},
+		{"doorman:{date}", "must contain {user} once"},
+		{"{user}:{user}", "must contain {user} once"},
+		{"{user}:{when}", "unknown token {when}"},
+		{"doorman-user={user}", "taken for one of doorman's tokens"},
+	}
+	for _, tt := range tests {
+		err := CheckLabelFormat(tt.format)
+		if (tt.expected == "") != (err == nil) || err != nil && !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("CheckLabelFormat(%q): expected %q, got %v", tt.format, tt.expected, err)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	labels := Labels{
+		Format:   "doorman:{user}:{date}",
+		Previous: []string{"{provider}/{user}@{host}"},
+		Provider: "github",
+		Host:     "web1",
+		Date:     time.Date(2025, 3, 18, 12, 0, 0, 0, time.UTC),
+	}
+	if label := labels.Label("alice"); label != "doorman:alice:2025-03-18" {
+		t.Errorf("unexpected label %q", label)
+	}
+	if label := (Labels{}).Label("alice"); label != "alice" {
+		t.Errorf("expected the bare username by default, got %q", label)
+	}
+
+	tests := []struct {
+		comment  string
+		expected string
+	}{
+		{"doorman:alice:2025-03-18", "alice"},
+		{"laptop doorman:alice:2025-03-18 doorman-added=2025-03-18", "alice"},
+		{"github/bob@web2", "bob"},
+		{"carol", "carol"},
+		{"doorman:dave:yesterday", "doorman:dave:yesterday"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if user := labels.User(PublicKey{Comment: tt.comment}); user != tt.expected {
+			t.Errorf("User(%q) = %q, expected %q", tt.comment, user, tt.expected)
+		}
+	}
+}
+
+func TestLabelsFoldCase(t *testing.T) {
+	store := NewMemoryStore(
+		Entry{"ssh-ed25519 K1 Alice doorman-added=2024-03-01"},
+		Entry{"ssh-ed25519 K2 bob doorman-added=2024-03-01"},
+	)
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 K3"}), WithStore(store), WithPrompter(yes(2)), WithLabels(Labels{FoldCase: true}))
+
+	if _, err := m.Add(context.Background(), "Carol"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := m.Remove(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "ssh-ed25519 K2 bob doorman-added=2024-03-01\nssh-ed25519 K3 carol" + today + "\n"
+	if got := content(t, store); got != expected {
+		t.Errorf("expected labels matched whatever their case, got\n%s", got)
+	}
+}
+
+func TestManagerLabels(t *testing.T) {
+	store := &MemoryStore{}
+	store.Save([]Entry{{"ssh-ed25519 OLD alice"}, {"ssh-ed25519 OTHER bob"}})
+	labels := Labels{Format: "doorman:{user}:{date}"}
+	m := NewManager(
+		WithStore(store),
+		WithSource(staticSource{keys: "ssh-ed25519 OLD\nssh-ed25519 NEW"}),
+		WithClock(&fakeClock{}),
+		WithLabels(labels),
+	)
+
+	if _, err := m.Sync(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "ssh-ed25519 OLD alice\nssh-ed25519 OTHER bob\nssh-ed25519 NEW doorman:alice:2024-03-18 doorman-added=2024-03-18\n"
+	if content := string(FormatEntries(store.entries)); content != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+
+	change, err := m.Remove(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(change.Removed) != 2 {
+		t.Errorf("expected both of alice's keys removed, whatever their label, got %v", change.Removed)
+	}
+}
@@ -0,0 +1,1011 @@
+package doorman
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prompter asks whoever runs a Manager to confirm changes. The package never
+// reads input itself.
+type Prompter interface {
+	// Confirm shows preview, unless it is empty, then asks question and
+	// reports whether the answer was yes.
+	Confirm(ctx context.Context, preview, question string) (bool, error)
+	// Notify tells the person about something that doesn't need an answer,
+	// such as a wait or a change made by another process.
+	Notify(message string)
+}
+
+// SummaryPrompter is a Prompter that can confirm a long preview from a
+// summary, showing the full preview only on request. Previews of more than
+// maxPreviewLines lines are summarized for such prompters; other prompters
+// are always shown everything.
+type SummaryPrompter interface {
+	Prompter
+	// ConfirmSummary is Confirm with summary shown instead of the full
+	// preview.
+	ConfirmSummary(ctx context.Context, summary, full, question string) (bool, error)
+}
+
+// maxPreviewLines is the longest preview shown in full to a SummaryPrompter
+const maxPreviewLines = 10
+
+// Clock tells the time and waits, so rate-limit handling can be tested
+// without waiting.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d, returning early with ctx's error if ctx is done.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// maxFetchAttempts bounds retries after waiting out a rate limit
+const maxFetchAttempts = 3
+
+// DefaultRateLimitWait is the longest rate limit a Manager waits out unless
+// configured with WithRateLimitWait.
+const DefaultRateLimitWait = 10 * time.Second
+
+// Manager adds, removes and synchronizes the keys of users in a KeyStore,
+// fetching them from a KeySource and asking a Prompter before each change.
+// Each operation gives up as soon as its context is done, returning the
+// context's error, and never writes after that.
+type Manager struct {
+	source        KeySource
+	store         KeyStore
+	prompter      Prompter
+	logger        *slog.Logger
+	clock         Clock
+	rateLimitWait time.Duration
+	removalCheck  func(ctx context.Context, removing []Key, username string) error
+	additionCheck func(ctx context.Context, adding, installed []Key, username string) error
+	labels        Labels
+	events        func(Event)
+	expire        bool
+	expiryGrace   time.Duration
+}
+
+// Option configures a Manager.
+type Option func(*Manager)
+
+// WithSource sets where keys are fetched from. The default is GitHub.
+func WithSource(source KeySource) Option {
+	return func(m *Manager) { m.source = source }
+}
+
+// WithStore sets where keys are kept. A Manager has no default store; every
+// operation fails until one is set.
+func WithStore(store KeyStore) Option {
+	return func(m *Manager) { m.store = store }
+}
+
+// WithPrompter sets who confirms changes. By default every change is made
+// without asking.
+func WithPrompter(prompter Prompter) Option {
+	return func(m *Manager) { m.prompter = prompter }
+}
+
+// WithLogger sets where the Manager logs what it does. By default nothing is
+// logged. Messages are event names: fetch_keys and rate_limited while
+// fetching, and key_added or key_removed for each key changed, with the
+// user, the key's fingerprint and the store's path.
+func WithLogger(logger *slog.Logger) Option {
+	return func(m *Manager) { m.logger = logger }
+}
+
+// WithClock replaces the system clock, for tests.
+func WithClock(clock Clock) Option {
+	return func(m *Manager) { m.clock = clock }
+}
+
+// WithRateLimitWait sets the longest rate limit the Manager waits out before
+// retrying, instead of failing. The default is DefaultRateLimitWait.
+func WithRateLimitWait(wait time.Duration) Option {
+	return func(m *Manager) { m.rateLimitWait = wait }
+}
+
+// WithRemovalCheck sets a check run after a removal has been confirmed and
+// before anything is written, given the stored keys about to be removed. An
+// error from check cancels the removal.
+func WithRemovalCheck(check func(ctx context.Context, removing []Key, username string) error) Option {
+	return func(m *Manager) { m.removalCheck = check }
+}
+
+// WithAdditionCheck sets a check run after an addition has been confirmed
+// and before anything is written, given the keys about to be added for
+// username and every key already installed. An error from check cancels
+// the addition.
+func WithAdditionCheck(check func(ctx context.Context, adding, installed []Key, username string) error) Option {
+	return func(m *Manager) { m.additionCheck = check }
+}
+
+// WithLabels sets how keys are labeled with their user. By default they
+// are labeled with the bare username. Unless labels.Date is set, {date} is
+// the day of the change by the Manager's clock.
+func WithLabels(labels Labels) Option {
+	return func(m *Manager) { m.labels = labels }
+}
+
+// WithExpiry has Sync and SyncUsers drop keys whose doorman-expires= stamp,
+// in the stored line or the published key, has passed by more than grace by
+// the Manager's clock. Their lines are commented out rather than deleted, so
+// they aren't added back while the user still publishes them. By default
+// stamps are ignored.
+func WithExpiry(grace time.Duration) Option {
+	return func(m *Manager) {
+		m.expire = true
+		m.expiryGrace = grace
+	}
+}
+
+// WithEventHandler sets a function called with each Event, as it happens.
+// Unlike log messages, events are meant to be consumed by programs. By
+// default they are discarded.
+func WithEventHandler(handler func(Event)) Option {
+	return func(m *Manager) { m.events = handler }
+}
+
+// NewManager returns a Manager configured by opts.
+func NewManager(opts ...Option) *Manager {
+	m := &Manager{
+		source:        GitHubSource{},
+		prompter:      autoConfirm{},
+		logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		clock:         systemClock{},
+		rateLimitWait: DefaultRateLimitWait,
+		events:        func(Event) {},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+var errNoStore = errors.New("no KeyStore configured; use WithStore")
+
+// Add fetches username's keys and, once confirmed, appends those not yet
+// installed for username to the store, creating it if it doesn't exist; the
+// question says so. Nothing is asked when every key is already installed.
+func (m *Manager) Add(ctx context.Context, username string) (*Change, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	labels := m.currentLabels()
+	m.emit(Event{Type: EventStarted, Action: ActionAdd, User: username})
+	keys, err := m.fetch(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := snapshotStore(m.store)
+	if err != nil {
+		return nil, err
+	}
+	if snap.exists && len(addEntries(snap.entries, keys, username, labels)) == len(snap.entries) {
+		return newChange(ActionAdd, username, snap.content, snap.content, labels), nil
+	}
+	entries := snap.entries
+	added := addEntries(entries, keys, username, labels)
+	question := addQuestion(len(added) - len(entries))
+	installed := installedLines(entries, keys, username, labels)
+	if err := m.confirmAddition(ctx, entries, added, installed, creating(snap, question)); err != nil {
+		return nil, err
+	}
+	if err := m.checkAddition(ctx, entries, added, username); err != nil {
+		return nil, err
+	}
+
+	// BEHAVIOR: Never append to content the user didn't see in the preview
+	if _, err := m.confirmUnchanged(ctx, snap, question); err != nil {
+		return nil, err
+	}
+
+	change, err := addKeys(ctx, m.store, keys, username, labels)
+	if err != nil {
+		return nil, err
+	}
+	m.logChange(change)
+	return change, nil
+}
+
+// Remove removes every key labeled with username from the store once
+// confirmed. The keys are fetched first, so a misspelled or unknown username
+// fails before anything is asked. Nothing is asked when the store has no
+// keys labeled with username. It fails with ErrFileMissing when the store
+// doesn't exist.
+func (m *Manager) Remove(ctx context.Context, username string) (*Change, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	m.emit(Event{Type: EventStarted, Action: ActionRemove, User: username})
+	if _, err := m.fetch(ctx, username); err != nil {
+		return nil, err
+	}
+	return m.remove(ctx, username, nil)
+}
+
+// RemoveKeys removes keys from those labeled with username, once
+// confirmed, as Remove does but without fetching anything: for keys picked
+// out of the store, such as those added too long ago. Keys that are no
+// longer in the store are left out.
+func (m *Manager) RemoveKeys(ctx context.Context, username string, keys []Key) (*Change, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	m.emit(Event{Type: EventStarted, Action: ActionRemove, User: username})
+	only := make(map[KeyID]bool)
+	for _, key := range keys {
+		only[key.ID()] = true
+	}
+	return m.remove(ctx, username, only)
+}
+
+// Reconcile fetches username's keys and, once confirmed, removes the stored
+// keys labeled with username that are no longer published, adding nothing,
+// so access only shrinks as the user revokes it. As for Sync, a user who
+// publishes no keys is an error, since an empty list may be a bad
+// response, unless allowEmpty says every key is then to be removed. A
+// stored key is still published if its blob is, or its GitHub key ID.
+func (m *Manager) Reconcile(ctx context.Context, username string, allowEmpty bool) (*Change, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	m.emit(Event{Type: EventStarted, Action: ActionReconcile, User: username})
+	keys, err := m.fetch(ctx, username)
+	if err != nil && !(allowEmpty && errors.Is(err, ErrNoKeys)) {
+		return nil, err
+	}
+	published := newKeySet(keys)
+
+	snap, err := snapshotStore(m.store)
+	if err != nil {
+		return nil, err
+	}
+	revoked := make(map[KeyID]bool)
+	for _, key := range m.labels.UserKeys(snap.content, username) {
+		if !published.has(key.PublicKey) {
+			revoked[key.ID()] = true
+		}
+	}
+	change, err := m.remove(ctx, username, revoked)
+	if err != nil {
+		return nil, err
+	}
+	change.Action = ActionReconcile
+	return change, nil
+}
+
+// Diff fetches username's keys and compares them with the keys labeled
+// with username in the store, changing nothing. A missing store has no
+// keys installed. A user who publishes no keys is an error, as for Sync.
+// Keys are matched by blob, or by GitHub key ID when both record one.
+func (m *Manager) Diff(ctx context.Context, username string) (*KeyDiff, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	keys, err := m.fetch(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := snapshotStore(m.store)
+	if err != nil {
+		return nil, err
+	}
+
+	installed := m.labels.UserKeys(snap.content, username)
+	diff := &KeyDiff{Username: username, Installed: len(installed)}
+	present := newKeySet(nil)
+	for _, key := range installed {
+		present.add(key.PublicKey)
+	}
+	published := newKeySet(nil)
+	for _, key := range keys {
+		if !present.has(key) && !published.has(key) {
+			diff.Missing = append(diff.Missing, key)
+		}
+		published.add(key)
+	}
+	for _, key := range installed {
+		if !published.has(key.PublicKey) {
+			diff.Extra = append(diff.Extra, key)
+		}
+	}
+	return diff, nil
+}
+
+// RemoveLines removes the lines of keys from the store, whoever they are
+// labeled with, once confirmed, as the package-level RemoveLines does: for
+// keys doorman didn't install. Keys that are no longer in the store are
+// left out, and nothing is asked if none are left.
+func (m *Manager) RemoveLines(ctx context.Context, keys []Key) (*Change, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	m.emit(Event{Type: EventStarted, Action: ActionRemove})
+	snap, err := snapshotStore(m.store)
+	if err != nil {
+		return nil, err
+	}
+	if !snap.exists {
+		return nil, fileMissing(m.store, &fs.PathError{Op: "open", Path: m.store.Path(), Err: fs.ErrNotExist})
+	}
+
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		lines[i] = key.Line
+	}
+	entries := snap.entries
+	kept := removeLines(entries, lines)
+	if len(kept) == len(entries) {
+		return linesChange(snap.content, snap.content), nil
+	}
+
+	const question = "Do you want to remove these keys?"
+	if err := m.confirmPreview(ctx, entries, kept, question); err != nil {
+		return nil, err
+	}
+	_, removing := DiffKeys(snap.content, FormatEntries(kept))
+	if err := m.checkRemoval(ctx, removing, ""); err != nil {
+		return nil, err
+	}
+	if _, err := m.confirmUnchanged(ctx, snap, question); err != nil {
+		return nil, err
+	}
+
+	change, err := RemoveLines(ctx, m.store, lines)
+	if err != nil {
+		return nil, err
+	}
+	m.logChange(change)
+	return change, nil
+}
+
+// remove removes the keys labeled with username, or only those in only if
+// it isn't nil, once confirmed.
+func (m *Manager) remove(ctx context.Context, username string, only map[KeyID]bool) (*Change, error) {
+	labels := m.currentLabels()
+	snap, err := snapshotStore(m.store)
+	if err != nil {
+		return nil, err
+	}
+	if !snap.exists {
+		return nil, fileMissing(m.store, &fs.PathError{Op: "open", Path: m.store.Path(), Err: fs.ErrNotExist})
+	}
+
+	entries := snap.entries
+	kept := removeEntries(entries, username, labels, only)
+	if len(kept) == len(entries) {
+		return newChange(ActionRemove, username, snap.content, snap.content, labels), nil
+	}
+
+	const question = "Do you want to remove these keys?"
+	if err := m.confirmPreview(ctx, entries, kept, question); err != nil {
+		return nil, err
+	}
+	_, removing := DiffKeys(snap.content, FormatEntries(kept))
+	if err := m.checkRemoval(ctx, removing, username); err != nil {
+		return nil, err
+	}
+
+	// BEHAVIOR: Recompute the removal against the file as it is now rather
+	// than overwriting changes made since the preview
+	if _, err := m.confirmUnchanged(ctx, snap, question); err != nil {
+		return nil, err
+	}
+
+	change, err := removeKeys(ctx, m.store, username, labels, only)
+	if err != nil {
+		return nil, err
+	}
+	m.logChange(change)
+	return change, nil
+}
+
+// Sync fetches username's keys and, once confirmed, makes the stored keys
+// labeled with username match them, as SyncKeys does. Nothing is asked when
+// they already match. A user who publishes no keys is an error rather than a
+// reason to remove every stored key; use Remove for that. With WithExpiry,
+// expired keys are dropped in the same write. Lines another process
+// changes after the preview are kept, but if it edits a line the sync also
+// rewrites or removes, nothing is written and the error matches
+// ErrConflict.
+func (m *Manager) Sync(ctx context.Context, username string) (*Change, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	labels := m.currentLabels()
+	expired := m.currentExpiry()
+	m.emit(Event{Type: EventStarted, Action: ActionSync, User: username})
+	keys, err := m.fetch(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := snapshotStore(m.store)
+	if err != nil {
+		return nil, err
+	}
+	entries := snap.entries
+	synced := syncEntries(entries, keys, username, labels, expired)
+	if bytes.Equal(snap.content, FormatEntries(synced)) {
+		return newChange(ActionSync, username, snap.content, snap.content, labels), nil
+	}
+
+	const question = "Do you want to update these keys?"
+	if err := m.confirmPreview(ctx, entries, synced, creating(snap, question)); err != nil {
+		return nil, err
+	}
+	_, removed := DiffKeys(snap.content, FormatEntries(synced))
+	if err := m.checkRemoval(ctx, removed, username); err != nil {
+		return nil, err
+	}
+	if err := m.checkAddition(ctx, entries, synced, username); err != nil {
+		return nil, err
+	}
+
+	if _, err := m.confirmUnchanged(ctx, snap, question); err != nil {
+		return nil, err
+	}
+
+	// BEHAVIOR: The keys are synced onto the file as it is when locked, so
+	// lines another process added or edited since the preview are kept;
+	// only an edit to a line the sync rewrites or removes makes it give up
+	merge := func(current []Entry) error {
+		content := FormatEntries(current)
+		if bytes.Equal(content, snap.content) {
+			return nil
+		}
+		m.logger.Warn("concurrent_change", "path", m.store.Path(), "user", username)
+		planned := FormatEntries(synced)
+		if keys := conflicts(snap.content, planned, content); len(keys) > 0 {
+			described := make([]string, len(keys))
+			for i, key := range keys {
+				described[i] = key.Describe()
+			}
+			return errorOfKind(ErrConflict, "%s was edited by another process while syncing %s, on %d %s the sync would also change (%s); skipped until the next sync",
+				m.store.Path(), username, len(keys), pluralLines(len(keys)), strings.Join(described, ", "))
+		}
+		return nil
+	}
+	change, err := syncKeys(ctx, m.store, keys, username, labels, expired, merge)
+	if err != nil {
+		return nil, err
+	}
+	m.logChange(change)
+	return change, nil
+}
+
+// AddUsers is Add for several users at once: every user's keys are fetched,
+// a single preview of all the additions is confirmed, and the store is
+// written once. If any user's keys can't be fetched, nothing is asked or
+// written, and the error is a *UsersError listing every failure. The
+// Changes are AddKeysForUsers'.
+func (m *Manager) AddUsers(ctx context.Context, usernames []string) ([]*Change, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	labels := m.currentLabels()
+	for _, username := range usernames {
+		m.emit(Event{Type: EventStarted, Action: ActionAdd, User: username})
+	}
+	sets, err := m.fetchUsers(ctx, usernames)
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := snapshotStore(m.store)
+	if err != nil {
+		return nil, err
+	}
+	added := snap.entries
+	for _, set := range sets {
+		added = addEntries(added, set.Keys, set.Username, labels)
+	}
+	if snap.exists && len(added) == len(snap.entries) {
+		var changes []*Change
+		for _, set := range sets {
+			changes = append(changes, newChange(ActionAdd, set.Username, snap.content, snap.content, labels))
+		}
+		return changes, nil
+	}
+	entries := snap.entries
+	added = entries
+	var installed []PreviewLine
+	for _, set := range sets {
+		added = addEntries(added, set.Keys, set.Username, labels)
+		installed = append(installed, installedLines(entries, set.Keys, set.Username, labels)...)
+	}
+	sort.Slice(installed, func(i, j int) bool { return installed[i].Number < installed[j].Number })
+	question := addQuestion(len(added) - len(entries))
+	if err := m.confirmAddition(ctx, entries, added, installed, creating(snap, question)); err != nil {
+		return nil, err
+	}
+	// Each user's keys are checked against those of the users before them
+	// too, so the same key given to two of them is caught
+	before := entries
+	for _, set := range sets {
+		after := addEntries(before, set.Keys, set.Username, labels)
+		if err := m.checkAddition(ctx, before, after, set.Username); err != nil {
+			return nil, err
+		}
+		before = after
+	}
+	if _, err := m.confirmUnchanged(ctx, snap, question); err != nil {
+		return nil, err
+	}
+
+	changes, err := addKeysForUsers(ctx, m.store, sets, labels)
+	if err != nil {
+		return nil, err
+	}
+	m.logChange(changes...)
+	return changes, nil
+}
+
+// SyncUsers is Sync for several users at once, with a single preview and a
+// single write. Every user's keys are fetched first, and any failure is a
+// *UsersError before anything is asked, except that the keys of a user the
+// source reports doesn't exist are left as they are, or removed if prune is
+// set. The Changes are SyncKeysForUsers', followed by those of such users
+// whose keys were left alone; both kinds for users who don't exist are
+// marked Gone.
+func (m *Manager) SyncUsers(ctx context.Context, usernames []string, prune bool) ([]*Change, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	labels := m.currentLabels()
+	expired := m.currentExpiry()
+	for _, username := range usernames {
+		m.emit(Event{Type: EventStarted, Action: ActionSync, User: username})
+	}
+	var sets []UserKeySet
+	var gone []string
+	var failed UsersError
+	for _, username := range usernames {
+		keys, err := m.fetch(ctx, username)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			gone = append(gone, username)
+		case err != nil:
+			failed.Failures = append(failed.Failures, UserError{User: username, Err: err})
+		default:
+			sets = append(sets, UserKeySet{Username: username, Keys: keys})
+		}
+	}
+	if len(failed.Failures) > 0 {
+		return nil, &failed
+	}
+	var pruned, kept []string
+	if prune {
+		pruned = gone
+	} else {
+		kept = gone
+	}
+
+	snap, err := snapshotStore(m.store)
+	if err != nil {
+		return nil, err
+	}
+	withGone := func(changes []*Change) []*Change {
+		for _, change := range changes[len(sets):] {
+			change.Gone = true
+		}
+		for _, username := range kept {
+			change := newChange(ActionSync, username, snap.content, snap.content, labels)
+			change.Gone = true
+			changes = append(changes, change)
+		}
+		return changes
+	}
+
+	entries := snap.entries
+	synced := entries
+	for _, set := range sets {
+		synced = syncEntries(synced, set.Keys, set.Username, labels, expired)
+	}
+	for _, username := range pruned {
+		synced = removeEntries(synced, username, labels, nil)
+	}
+	if bytes.Equal(snap.content, FormatEntries(synced)) {
+		var changes []*Change
+		for _, set := range sets {
+			changes = append(changes, newChange(ActionSync, set.Username, snap.content, snap.content, labels))
+		}
+		for _, username := range pruned {
+			changes = append(changes, newChange(ActionRemove, username, snap.content, snap.content, labels))
+		}
+		return withGone(changes), nil
+	}
+
+	const question = "Do you want to update these keys?"
+	if err := m.confirmPreview(ctx, entries, synced, creating(snap, question)); err != nil {
+		return nil, err
+	}
+	// Each user's change is checked against the file as the users before
+	// them left it, as AddUsers does
+	before := entries
+	for _, set := range sets {
+		after := syncEntries(before, set.Keys, set.Username, labels, expired)
+		_, removed := DiffKeys(FormatEntries(before), FormatEntries(after))
+		if err := m.checkRemoval(ctx, removed, set.Username); err != nil {
+			return nil, err
+		}
+		if err := m.checkAddition(ctx, before, after, set.Username); err != nil {
+			return nil, err
+		}
+		before = after
+	}
+	for _, username := range pruned {
+		after := removeEntries(before, username, labels, nil)
+		_, removed := DiffKeys(FormatEntries(before), FormatEntries(after))
+		if err := m.checkRemoval(ctx, removed, username); err != nil {
+			return nil, err
+		}
+		before = after
+	}
+	if _, err := m.confirmUnchanged(ctx, snap, question); err != nil {
+		return nil, err
+	}
+
+	changes, err := syncKeysForUsers(ctx, m.store, sets, pruned, labels, expired)
+	if err != nil {
+		return nil, err
+	}
+	m.logChange(changes...)
+	return withGone(changes), nil
+}
+
+// RemoveUsers is Remove for several users at once, with a single preview
+// and a single write. As with AddUsers, every user is fetched first, and
+// any failure is a *UsersError before anything is asked.
+func (m *Manager) RemoveUsers(ctx context.Context, usernames []string) ([]*Change, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	labels := m.currentLabels()
+	for _, username := range usernames {
+		m.emit(Event{Type: EventStarted, Action: ActionRemove, User: username})
+	}
+	if _, err := m.fetchUsers(ctx, usernames); err != nil {
+		return nil, err
+	}
+
+	snap, err := snapshotStore(m.store)
+	if err != nil {
+		return nil, err
+	}
+	if !snap.exists {
+		return nil, fileMissing(m.store, &fs.PathError{Op: "open", Path: m.store.Path(), Err: fs.ErrNotExist})
+	}
+
+	entries := snap.entries
+	kept := entries
+	for _, username := range usernames {
+		kept = removeEntries(kept, username, labels, nil)
+	}
+	if len(kept) == len(entries) {
+		changes := make([]*Change, len(usernames))
+		for i, username := range usernames {
+			changes[i] = newChange(ActionRemove, username, snap.content, snap.content, labels)
+		}
+		return changes, nil
+	}
+
+	const question = "Do you want to remove these keys?"
+	if err := m.confirmPreview(ctx, entries, kept, question); err != nil {
+		return nil, err
+	}
+	for _, username := range usernames {
+		if err := m.checkRemoval(ctx, labels.UserKeys(snap.content, username), username); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := m.confirmUnchanged(ctx, snap, question); err != nil {
+		return nil, err
+	}
+
+	changes, err := removeKeysForUsers(ctx, m.store, usernames, labels)
+	if err != nil {
+		return nil, err
+	}
+	m.logChange(changes...)
+	return changes, nil
+}
+
+// List returns the keys in the store. A missing store has no keys.
+func (m *Manager) List(ctx context.Context) ([]Key, error) {
+	if m.store == nil {
+		return nil, errNoStore
+	}
+	return List(ctx, m.store)
+}
+
+// fetch gets username's keys from the source, waiting out rate limits no
+// longer than m.rateLimitWait. Failures other than an invalid or unknown
+// user are returned as a *FetchError, and an empty key list as ErrNoKeys.
+func (m *Manager) fetch(ctx context.Context, username string) ([]PublicKey, error) {
+	keys, err := m.fetchWithRetries(ctx, username)
+	if err != nil {
+		m.emit(Event{Type: EventFetchFailed, User: username, Error: err.Error()})
+		return nil, err
+	}
+	m.emit(Event{Type: EventKeysFetched, User: username, Keys: len(keys)})
+	return keys, nil
+}
+
+// fetchUsers fetches the keys of every user, returning a *UsersError with
+// every failure if any fails. Only the context being done stops it early.
+func (m *Manager) fetchUsers(ctx context.Context, usernames []string) ([]UserKeySet, error) {
+	var sets []UserKeySet
+	var failed UsersError
+	for _, username := range usernames {
+		keys, err := m.fetch(ctx, username)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			failed.Failures = append(failed.Failures, UserError{User: username, Err: err})
+			continue
+		}
+		sets = append(sets, UserKeySet{Username: username, Keys: keys})
+	}
+	if len(failed.Failures) > 0 {
+		return nil, &failed
+	}
+	return sets, nil
+}
+
+func (m *Manager) fetchWithRetries(ctx context.Context, username string) ([]PublicKey, error) {
+	for attempt := 1; ; attempt++ {
+		m.logger.Debug("fetch_keys", "user", username, "attempt", attempt)
+		keys, err := m.source.Keys(ctx, username)
+		var limitErr *RateLimitError
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case err == nil && len(keys) == 0:
+			return nil, errorOfKind(ErrNoKeys, "no public keys found for user '%s'", username)
+		case err == nil:
+			return keys, nil
+		case errors.Is(err, ErrInvalidUser), errors.Is(err, ErrUserNotFound), errors.As(err, new(*RenamedUserError)):
+			return nil, err
+		case !errors.As(err, &limitErr):
+			return nil, fetchError(username, err)
+		}
+
+		wait := limitErr.Wait(m.clock.Now())
+		if attempt == maxFetchAttempts || wait < 0 || wait > m.rateLimitWait {
+			return nil, fetchError(username, err)
+		}
+		m.logger.Warn("rate_limited", "user", username, "wait", wait)
+		m.prompter.Notify(fmt.Sprintf("Rate limited while fetching keys for %s; waiting %s before retrying", username, wait.Round(time.Second)))
+		if err := m.clock.Sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fetchError returns err as a *FetchError for username, filling in the user
+// of one returned by FetchKeys. The failures of a FallbackSource are kept
+// together.
+func fetchError(username string, err error) *FetchError {
+	var fetchErr *FetchError
+	if !errors.As(err, new(*FallbackError)) && errors.As(err, &fetchErr) && fetchErr.User == "" {
+		withUser := *fetchErr
+		withUser.User = username
+		return &withUser
+	}
+	return &FetchError{User: username, Err: err}
+}
+
+// addQuestion asks whether to add n new keys; keys already installed
+// aren't counted.
+func addQuestion(n int) string {
+	return fmt.Sprintf("Do you want to add %d new %s?", n, pluralKeys(n))
+}
+
+// installedLines returns the lines of entries with any of keys installed
+// for username, which adding keys leaves alone.
+func installedLines(entries []Entry, keys []PublicKey, username string, labels Labels) []PreviewLine {
+	asked := make(map[KeyID]bool)
+	for _, key := range keys {
+		asked[key.ID()] = true
+	}
+	var lines []PreviewLine
+	for i, entry := range entries {
+		if key, ok := entry.Key(); ok && asked[key.ID()] && labels.labeled(key.PublicKey, username) {
+			lines = append(lines, PreviewLine{Number: i + 1, Text: entry.Line})
+		}
+	}
+	return lines
+}
+
+// creating prefixes question with a warning that the store will be
+// created, when snap says it doesn't exist, so that isn't asked separately.
+func creating(snap fileSnapshot, question string) string {
+	if snap.exists {
+		return question
+	}
+	return "The authorized_keys file does not exist and will be created. " + question
+}
+
+// confirm asks question after showing preview, returning ErrAborted unless
+// the answer is yes.
+func (m *Manager) confirm(ctx context.Context, preview, question string) error {
+	confirmed, err := m.prompter.Confirm(ctx, preview, question)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return ErrAborted
+	}
+	return nil
+}
+
+// confirmUnchanged re-reads the store just before a write. If it no longer
+// matches snap, the change made in the meantime is shown and question is
+// asked again, as often as the store keeps changing. It returns the snapshot
+// the write must be based on.
+func (m *Manager) confirmUnchanged(ctx context.Context, snap fileSnapshot, question string) (fileSnapshot, error) {
+	for {
+		current, err := snapshotStore(m.store)
+		if err != nil {
+			return snap, err
+		}
+		if current.equal(snap) {
+			return current, nil
+		}
+
+		m.prompter.Notify(fmt.Sprintf("Warning: %s was modified by another process since the preview.", m.store.Path()))
+		preview := []string{"Changes made in the meantime:"}
+		added, removed := diffLines(snap.content, current.content)
+		for _, line := range removed {
+			preview = append(preview, "- "+line)
+		}
+		for _, line := range added {
+			preview = append(preview, "+ "+line)
+		}
+
+		if err := m.confirm(ctx, strings.Join(preview, "\n"), question); err != nil {
+			return current, err
+		}
+		snap = current
+	}
+}
+
+// confirmPreview asks question after showing how the store changes from
+// before to after. A long preview is summarized for a SummaryPrompter.
+func (m *Manager) confirmPreview(ctx context.Context, before, after []Entry, question string) error {
+	preview := NewPreview(before, after)
+	return m.confirmLines(ctx, preview, preview.String(), len(preview), question)
+}
+
+// confirmAddition is confirmPreview for adding keys: each key added is
+// marked [new], and the lines of installed, keys asked to be added that are
+// already installed, are shown as well, so adding again shows what it does.
+func (m *Manager) confirmAddition(ctx context.Context, before, after []Entry, installed []PreviewLine, question string) error {
+	preview := NewPreview(before, after)
+	return m.confirmLines(ctx, preview, preview.additionString(installed), len(preview)+len(installed), question)
+}
+
+// confirmLines asks question after showing full, preview rendered in lines
+// lines, or preview's summary when full is too long for a SummaryPrompter.
+func (m *Manager) confirmLines(ctx context.Context, preview Preview, full string, lines int, question string) error {
+	header := fmt.Sprintf("Changes to %s:\n", m.store.Path())
+	summarizer, ok := m.prompter.(SummaryPrompter)
+	if !ok || lines <= maxPreviewLines {
+		return m.confirm(ctx, header+full, question)
+	}
+	confirmed, err := summarizer.ConfirmSummary(ctx, header+preview.Summary(), header+full, question)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return ErrAborted
+	}
+	return nil
+}
+
+func (m *Manager) checkRemoval(ctx context.Context, removing []Key, username string) error {
+	if m.removalCheck == nil || len(removing) == 0 {
+		return nil
+	}
+	return m.removalCheck(ctx, removing, username)
+}
+
+// currentExpiry returns the expiry Sync and SyncUsers apply, as of now by
+// m's clock, or nil when WithExpiry wasn't given.
+func (m *Manager) currentExpiry() expiry {
+	if !m.expire {
+		return nil
+	}
+	return expiresBy(m.clock.Now(), m.expiryGrace)
+}
+
+// currentLabels returns m.labels with {date} set to today, so one change
+// labels every key alike.
+func (m *Manager) currentLabels() Labels {
+	labels := m.labels
+	if labels.Date.IsZero() {
+		labels.Date = m.clock.Now()
+	}
+	return labels
+}
+
+func (m *Manager) checkAddition(ctx context.Context, before, after []Entry, username string) error {
+	if m.additionCheck == nil {
+		return nil
+	}
+	content := FormatEntries(before)
+	adding, _ := DiffKeys(content, FormatEntries(after))
+	if len(adding) == 0 {
+		return nil
+	}
+	return m.additionCheck(ctx, adding, ParseKeys(content), username)
+}
+
+// logChange logs a key_added or key_removed event for each key change
+// made by changes, written together, and reports them as events followed by
+// a single EventFileRewritten.
+func (m *Manager) logChange(changes ...*Change) {
+	path := m.store.Path()
+	for _, change := range changes {
+		for _, key := range change.Added {
+			m.logger.Info("key_added", "user", change.Username, "fingerprint", key.Fingerprint(), "path", path)
+			m.emit(Event{Type: EventKeyAdded, User: change.Username, Fingerprint: key.Fingerprint(), Path: path})
+		}
+		for _, key := range change.Removed {
+			m.logger.Info("key_removed", "user", change.Username, "fingerprint", key.Fingerprint(), "path", path)
+			m.emit(Event{Type: EventKeyRemoved, User: change.Username, Fingerprint: key.Fingerprint(), Path: path})
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	first, last := changes[0], changes[len(changes)-1]
+	if first.BeforeSHA256 != last.AfterSHA256 {
+		m.emit(Event{Type: EventFileRewritten, Path: path, SHA256: last.AfterSHA256})
+	}
+}
+
+func (m *Manager) emit(event Event) {
+	event.Time = m.clock.Now()
+	m.events(event)
+}
+
+// autoConfirm is the default Prompter: it confirms everything and tells
+// no-one.
+type autoConfirm struct{}
+
+func (autoConfirm) Confirm(ctx context.Context, preview, question string) (bool, error) {
+	return true, nil
+}
+
+func (autoConfirm) Notify(message string) {}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,901 @@
+package doorman
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// staticSource serves the same keys, or error, for every user.
+type staticSource struct {
+	keys string
+	err  error
+}
+
+func (s staticSource) Keys(ctx context.Context, user string) ([]PublicKey, error) {
+	return ParsePublicKeys([]byte(s.keys)), s.err
+}
+
+// userSource serves each user's keys from keys, and ErrUserNotFound for
+// anyone else.
+type userSource map[string]string
+
+func (s userSource) Keys(ctx context.Context, user string) ([]PublicKey, error) {
+	keys, ok := s[user]
+	if !ok {
+		return nil, errorOfKind(ErrUserNotFound, "user '%s' not found", user)
+	}
+	return ParsePublicKeys([]byte(keys)), nil
+}
+
+// rateLimitedSource is rate limited for the first limited calls.
+type rateLimitedSource struct {
+	limited int
+	wait    time.Duration
+	calls   int
+}
+
+func (s *rateLimitedSource) Keys(ctx context.Context, user string) ([]PublicKey, error) {
+	s.calls++
+	if s.calls <= s.limited {
+		return nil, &RateLimitError{RetryAfter: s.wait}
+	}
+	return ParsePublicKeys([]byte("ssh-ed25519 K1")), nil
+}
+
+// blockingSource never answers, until ctx is done.
+type blockingSource struct{}
+
+func (blockingSource) Keys(ctx context.Context, user string) ([]PublicKey, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// scriptedPrompter answers with answers in order, declining once they run
+// out, and records what it was shown. hook runs before the first answer.
+type scriptedPrompter struct {
+	answers   []bool
+	previews  []string
+	questions []string
+	notices   []string
+	hook      func()
+}
+
+func (p *scriptedPrompter) Confirm(ctx context.Context, preview, question string) (bool, error) {
+	if p.hook != nil {
+		p.hook()
+		p.hook = nil
+	}
+	p.previews = append(p.previews, preview)
+	p.questions = append(p.questions, question)
+	if len(p.answers) == 0 {
+		return false, nil
+	}
+	answer := p.answers[0]
+	p.answers = p.answers[1:]
+	return answer, nil
+}
+
+func (p *scriptedPrompter) Notify(message string) {
+	p.notices = append(p.notices, message)
+}
+
+// summaryPrompter is a scriptedPrompter that also confirms summaries,
+// recording them and the full previews they stand for.
+type summaryPrompter struct {
+	scriptedPrompter
+	summaries []string
+}
+
+func (p *summaryPrompter) ConfirmSummary(ctx context.Context, summary, full, question string) (bool, error) {
+	p.summaries = append(p.summaries, summary)
+	return p.Confirm(ctx, full, question)
+}
+
+// fakeClock records sleeps instead of sleeping. It is noon on 2024-03-18
+// unless now is set.
+type fakeClock struct {
+	slept []time.Duration
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	if !c.now.IsZero() {
+		return c.now
+	}
+	return time.Date(2024, 3, 18, 12, 0, 0, 0, time.UTC)
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.slept = append(c.slept, d)
+	return nil
+}
+
+func yes(n int) *scriptedPrompter {
+	answers := make([]bool, n)
+	for i := range answers {
+		answers[i] = true
+	}
+	return &scriptedPrompter{answers: answers}
+}
+
+func TestManagerAdd(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa OTHER bob"})
+	prompter := yes(1)
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 K1"}), WithStore(store), WithPrompter(prompter))
+
+	change, err := m.Add(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa OTHER bob\nssh-ed25519 K1 alice"+today+"\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if change.String() != "Added 1 key for alice (1 ed25519)" || change.Created {
+		t.Errorf("unexpected change %q (created %v)", change, change.Created)
+	}
+	if !reflect.DeepEqual(prompter.previews, []string{"Changes to (memory):\n+ 2  ssh-ed25519 K1 alice" + today + " [new]"}) {
+		t.Errorf("unexpected previews %q", prompter.previews)
+	}
+}
+
+func TestManagerAddAgain(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa OLD alice"}, Entry{"ssh-rsa OLD bob"})
+	prompter := yes(1)
+	m := NewManager(WithSource(staticSource{keys: "ssh-rsa OLD\nssh-ed25519 NEW"}), WithStore(store), WithPrompter(prompter), WithClock(&fakeClock{}))
+
+	change, err := m.Add(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa OLD alice\nssh-rsa OLD bob\nssh-ed25519 NEW alice doorman-added=2024-03-18\n" {
+		t.Errorf("expected only the new key added, got %q", got)
+	}
+	if change.String() != "Added 1 key for alice (1 ed25519)" {
+		t.Errorf("unexpected change %q", change)
+	}
+	expected := "Changes to (memory):\n" +
+		"= 1  ssh-rsa OLD alice [already installed]\n" +
+		"+ 3  ssh-ed25519 NEW alice doorman-added=2024-03-18 [new]"
+	if !reflect.DeepEqual(prompter.previews, []string{expected}) || prompter.questions[0] != "Do you want to add 1 new key?" {
+		t.Errorf("expected only the new key counted, got %q and %q", prompter.previews, prompter.questions)
+	}
+
+	change, err = m.Add(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(prompter.questions) != 1 || change.AfterSHA256 != change.BeforeSHA256 {
+		t.Errorf("expected nothing asked or changed, got %q and %+v", prompter.questions, change)
+	}
+	if change.String() != "Keys for alice are already installed (2 keys)" {
+		t.Errorf("unexpected change %q", change)
+	}
+}
+
+func TestManagerLogsChanges(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa " + rsa2048Blob + " alice"})
+	var log bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&log, nil))
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 " + ed25519Blob}), WithStore(store), WithLogger(logger))
+
+	if _, err := m.Sync(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(log.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if record["user"] != "alice" || record["path"] != "(memory)" {
+			t.Errorf("unexpected attributes in %q", line)
+		}
+		events = append(events, fmt.Sprintf("%s %s", record["msg"], record["fingerprint"]))
+	}
+	expected := []string{
+		"key_added SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I",
+		"key_removed SHA256:FxJVIn0ns9maGklTi/WHJCuFFS8S5WxS5hUqaTYT/Rg",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %q, got %q", expected, events)
+	}
+}
+
+func TestManagerSummarizesLongPreviews(t *testing.T) {
+	keys := func(n int) string {
+		var lines []string
+		for i := 0; i < n; i++ {
+			lines = append(lines, fmt.Sprintf("ssh-ed25519 K%d", i))
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	tests := []struct {
+		name       string
+		keys       int
+		summarized bool
+	}{
+		{"short", maxPreviewLines, false},
+		{"long", maxPreviewLines + 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompter := &summaryPrompter{scriptedPrompter: *yes(1)}
+			m := NewManager(WithSource(staticSource{keys: keys(tt.keys)}), WithStore(NewMemoryStore()), WithPrompter(prompter))
+			if _, err := m.Add(context.Background(), "alice"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(prompter.previews) != 1 || strings.Count(prompter.previews[0], "\n") != tt.keys {
+				t.Errorf("expected the full preview, got %q", prompter.previews)
+			}
+			if !tt.summarized {
+				if len(prompter.summaries) != 0 {
+					t.Errorf("unexpected summaries %q", prompter.summaries)
+				}
+				return
+			}
+			expected := fmt.Sprintf("Changes to (memory):\nAdding %d keys for 1 user (%d ed25519)\n", tt.keys, tt.keys)
+			if len(prompter.summaries) != 1 || !strings.HasPrefix(prompter.summaries[0], expected) {
+				t.Errorf("expected a summary starting %q, got %q", expected, prompter.summaries)
+			}
+		})
+	}
+}
+
+func TestManagerEvents(t *testing.T) {
+	const key = "ssh-ed25519 " + ed25519Blob
+	store := NewMemoryStore(Entry{"ssh-rsa OTHER bob"})
+	var events []Event
+	m := NewManager(WithSource(staticSource{keys: key}), WithStore(store), WithClock(&fakeClock{}), WithEventHandler(func(event Event) {
+		events = append(events, event)
+	}))
+
+	change, err := m.Add(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m.source = staticSource{err: errors.New("offline")}
+	if _, err := m.Sync(context.Background(), "alice"); err == nil {
+		t.Fatal("expected the fetch to fail")
+	}
+
+	now := (&fakeClock{}).Now()
+	expected := []Event{
+		{Type: EventStarted, Time: now, Action: ActionAdd, User: "alice"},
+		{Type: EventKeysFetched, Time: now, User: "alice", Keys: 1},
+		{Type: EventKeyAdded, Time: now, User: "alice", Fingerprint: "SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I", Path: "(memory)"},
+		{Type: EventFileRewritten, Time: now, Path: "(memory)", SHA256: change.AfterSHA256},
+		{Type: EventStarted, Time: now, Action: ActionSync, User: "alice"},
+		{Type: EventFetchFailed, Time: now, User: "alice", Error: "fetching keys for alice: offline"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events:\n%+v\ngot:\n%+v", expected, events)
+	}
+}
+
+func TestManagerAddCreatesStore(t *testing.T) {
+	store := &MemoryStore{}
+	prompter := yes(1)
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 K1"}), WithStore(store), WithPrompter(prompter))
+
+	change, err := m.Add(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !change.Created {
+		t.Error("expected the change to report creating the store")
+	}
+	if len(prompter.questions) != 1 || prompter.questions[0] != "The authorized_keys file does not exist and will be created. Do you want to add 1 new key?" {
+		t.Errorf("expected a single question saying the file will be created, got %q", prompter.questions)
+	}
+}
+
+func TestManagerDeclined(t *testing.T) {
+	store := &MemoryStore{}
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 K1"}), WithStore(store), WithPrompter(&scriptedPrompter{answers: []bool{false}}))
+
+	if _, err := m.Add(context.Background(), "alice"); !errors.Is(err, ErrAborted) {
+		t.Errorf("expected ErrAborted, got %v", err)
+	}
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("the store should not be created")
+	}
+}
+
+func TestManagerWithoutPrompterConfirms(t *testing.T) {
+	store := &MemoryStore{}
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 K1"}), WithStore(store))
+
+	if _, err := m.Add(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-ed25519 K1 alice"+today+"\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+}
+
+func TestManagerWithoutStore(t *testing.T) {
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 K1"}))
+	if _, err := m.Add(context.Background(), "alice"); err == nil {
+		t.Error("expected an error without a store")
+	}
+}
+
+func TestManagerFetchErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    staticSource
+		target    error
+		fetchErr  bool
+		assertion string
+	}{
+		{"network", staticSource{err: errors.New("connection refused")}, nil, true, "fetching keys for alice: connection refused"},
+		{"status", staticSource{err: &FetchError{URL: "https://example.com/alice.keys", Status: 503}}, nil, true, "fetching keys for alice: HTTP 503 from https://example.com/alice.keys"},
+		{"unknown user", staticSource{err: errorOfKind(ErrUserNotFound, "GitHub user 'alice' not found")}, ErrUserNotFound, false, "GitHub user 'alice' not found"},
+		{"invalid user", staticSource{err: errorOfKind(ErrInvalidUser, "invalid username")}, ErrInvalidUser, false, "invalid username"},
+		{"no keys", staticSource{keys: "\n"}, ErrNoKeys, false, "no public keys found for user 'alice'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(WithSource(tt.source), WithStore(&MemoryStore{}))
+			_, err := m.Add(context.Background(), "alice")
+			if err == nil || err.Error() != tt.assertion {
+				t.Fatalf("expected %q, got %v", tt.assertion, err)
+			}
+			if tt.target != nil && !errors.Is(err, tt.target) {
+				t.Errorf("expected error matching %v", tt.target)
+			}
+			var fetchErr *FetchError
+			if errors.As(err, &fetchErr) != tt.fetchErr {
+				t.Errorf("expected *FetchError: %v, got %T", tt.fetchErr, err)
+			}
+		})
+	}
+}
+
+func TestManagerRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  *rateLimitedSource
+		opts    []Option
+		slept   []time.Duration
+		limited bool
+	}{
+		{"short wait", &rateLimitedSource{limited: 1, wait: 3 * time.Second}, nil, []time.Duration{3 * time.Second}, false},
+		{"long wait", &rateLimitedSource{limited: 1, wait: 30 * time.Minute}, nil, nil, true},
+		{"long wait allowed", &rateLimitedSource{limited: 1, wait: 30 * time.Minute}, []Option{WithRateLimitWait(time.Hour)}, []time.Duration{30 * time.Minute}, false},
+		{"repeated", &rateLimitedSource{limited: 5, wait: time.Second}, nil, []time.Duration{time.Second, time.Second}, true},
+		{"unknown wait", &rateLimitedSource{limited: 1, wait: -1}, nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{}
+			prompter := yes(1)
+			opts := append([]Option{WithSource(tt.source), WithStore(&MemoryStore{}), WithPrompter(prompter), WithClock(clock)}, tt.opts...)
+
+			_, err := NewManager(opts...).Add(context.Background(), "alice")
+			var limitErr *RateLimitError
+			if errors.As(err, &limitErr) != tt.limited {
+				t.Errorf("expected rate limit error: %v, got %v", tt.limited, err)
+			}
+			if !reflect.DeepEqual(clock.slept, tt.slept) {
+				t.Errorf("expected sleeps %v, got %v", tt.slept, clock.slept)
+			}
+			if len(tt.slept) > 0 && !strings.Contains(strings.Join(prompter.notices, "\n"), "waiting "+tt.slept[0].String()+" before retrying") {
+				t.Errorf("expected a wait notice, got %q", prompter.notices)
+			}
+		})
+	}
+}
+
+func TestManagerRemove(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa K1 alice"}, Entry{"ssh-rsa K2 bob"})
+	var checked []Key
+	check := func(ctx context.Context, removing []Key, username string) error {
+		checked = removing
+		return nil
+	}
+	m := NewManager(WithSource(staticSource{keys: "ssh-rsa K1"}), WithStore(store), WithPrompter(yes(1)), WithRemovalCheck(check))
+
+	change, err := m.Remove(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa K2 bob\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if change.String() != "Removed 1 of 1 key for alice (1 rsa)" {
+		t.Errorf("unexpected change %q", change)
+	}
+	if len(checked) != 1 || checked[0].Line != "ssh-rsa K1 alice" {
+		t.Errorf("expected the removal check to see alice's stored key, got %v", checked)
+	}
+}
+
+func TestManagerRemoveKeys(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa OLD alice"}, Entry{"ssh-rsa OLD bob"}, Entry{"ssh-ed25519 NEW alice"})
+	var checked []Key
+	check := func(ctx context.Context, removing []Key, username string) error {
+		checked = removing
+		return nil
+	}
+	// A source that fails shows nothing is fetched
+	m := NewManager(WithSource(staticSource{err: errors.New("fetched")}), WithStore(store), WithPrompter(yes(1)), WithRemovalCheck(check))
+
+	old := ParseKeys([]byte("ssh-rsa OLD alice"))
+	change, err := m.RemoveKeys(context.Background(), "alice", old)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa OLD bob\nssh-ed25519 NEW alice\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if change.String() != "Removed 1 of 2 keys for alice (1 rsa)" {
+		t.Errorf("unexpected change %q", change)
+	}
+	if len(checked) != 1 || checked[0].Line != "ssh-rsa OLD alice" {
+		t.Errorf("expected the removal check to see only the key removed, got %v", checked)
+	}
+}
+
+func TestManagerReconcile(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa OLD alice"}, Entry{"ssh-rsa OLD bob"}, Entry{"ssh-ed25519 KEEP alice"})
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 KEEP\nssh-ed25519 NEW"}), WithStore(store), WithPrompter(yes(1)))
+
+	change, err := m.Reconcile(context.Background(), "alice", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa OLD bob\nssh-ed25519 KEEP alice\n" {
+		t.Errorf("expected the revoked key removed and nothing added, got %q", got)
+	}
+	if change.Action != ActionReconcile || change.String() != "Removed 1 of 2 keys for alice no longer published (1 rsa)" {
+		t.Errorf("unexpected change %q", change)
+	}
+
+	m = NewManager(WithSource(staticSource{}), WithStore(store), WithPrompter(yes(1)))
+	if _, err := m.Reconcile(context.Background(), "alice", false); !errors.Is(err, ErrNoKeys) {
+		t.Errorf("expected ErrNoKeys, got %v", err)
+	}
+	if _, err := m.Reconcile(context.Background(), "alice", true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa OLD bob\n" {
+		t.Errorf("expected every key of alice removed, got %q", got)
+	}
+}
+
+func TestManagerRemoveLines(t *testing.T) {
+	store := NewMemoryStore(Entry{"# by hand"}, Entry{"ssh-rsa OLD ops@jumphost"}, Entry{"ssh-rsa K2 bob"}, Entry{"no-pty ssh-ed25519 K3"})
+	var checked []Key
+	check := func(ctx context.Context, removing []Key, username string) error {
+		checked = removing
+		return nil
+	}
+	m := NewManager(WithStore(store), WithPrompter(yes(1)), WithRemovalCheck(check))
+
+	change, err := m.RemoveLines(context.Background(), ParseKeys([]byte("ssh-rsa OLD ops@jumphost\nno-pty ssh-ed25519 K3\nssh-rsa GONE")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "# by hand\nssh-rsa K2 bob\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if change.String() != "Removed 2 of 3 keys (1 ed25519, 1 rsa)" {
+		t.Errorf("unexpected change %q", change)
+	}
+	if len(checked) != 2 {
+		t.Errorf("expected the removal check to see both keys, got %v", checked)
+	}
+
+	change, err = m.RemoveLines(context.Background(), ParseKeys([]byte("ssh-rsa OLD ops@jumphost")))
+	if err != nil || len(change.Removed) != 0 {
+		t.Errorf("expected nothing to remove, got %v, %v", change, err)
+	}
+}
+
+func TestManagerSyncUsers(t *testing.T) {
+	entries := []Entry{{"ssh-rsa OLD alice"}, {"ssh-rsa K2 bob"}, {"ssh-rsa K3 carol"}}
+	source := userSource{"alice": "ssh-ed25519 NEW", "bob": "ssh-rsa K2"}
+
+	store := NewMemoryStore(entries...)
+	prompter := yes(1)
+	m := NewManager(WithSource(source), WithStore(store), WithPrompter(prompter))
+	changes, err := m.SyncUsers(context.Background(), []string{"alice", "bob", "carol"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa K2 bob\nssh-rsa K3 carol\nssh-ed25519 NEW alice"+today+"\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	var summaries []string
+	for _, change := range changes {
+		summaries = append(summaries, fmt.Sprintf("%s gone=%v", change, change.Gone))
+	}
+	expected := []string{
+		"Synced keys for alice: added 1 (1 ed25519), removed 1 (1 rsa) gone=false",
+		"Keys for bob are up to date (1 key) gone=false",
+		"Keys for carol are up to date (1 key) gone=true",
+	}
+	if !reflect.DeepEqual(summaries, expected) || len(prompter.questions) != 1 {
+		t.Errorf("expected %q after one question, got %q after %q", expected, summaries, prompter.questions)
+	}
+
+	store = NewMemoryStore(entries...)
+	m = NewManager(WithSource(source), WithStore(store), WithPrompter(yes(1)))
+	changes, err = m.SyncUsers(context.Background(), []string{"alice", "bob", "carol"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa K2 bob\nssh-ed25519 NEW alice"+today+"\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if last := changes[len(changes)-1]; len(changes) != 3 || last.Action != ActionRemove || !last.Gone || len(last.Removed) != 1 {
+		t.Errorf("expected carol's keys to be pruned, got %+v", last)
+	}
+
+	store = NewMemoryStore(entries...)
+	m = NewManager(WithSource(userSource{"alice": ""}), WithStore(store), WithPrompter(&scriptedPrompter{}))
+	var usersErr *UsersError
+	if _, err := m.SyncUsers(context.Background(), []string{"alice", "bob"}, true); !errors.As(err, &usersErr) || len(usersErr.Failures) != 1 {
+		t.Errorf("expected alice's lack of keys to fail everything, got %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa OLD alice\nssh-rsa K2 bob\nssh-rsa K3 carol\n" {
+		t.Errorf("expected nothing to change, got %q", got)
+	}
+}
+
+func TestManagerRemoveNothing(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa K2 bob"})
+	prompter := &scriptedPrompter{}
+	m := NewManager(WithSource(staticSource{keys: "ssh-rsa K1"}), WithStore(store), WithPrompter(prompter))
+
+	change, err := m.Remove(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(prompter.questions) != 0 || change.String() != "No keys for alice to remove" {
+		t.Errorf("expected no questions and no change, got %q and %q", prompter.questions, change)
+	}
+}
+
+func TestManagerRemoveCheckFails(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa K1 alice"})
+	checkErr := errors.New("that is your own key")
+	check := func(ctx context.Context, removing []Key, username string) error { return checkErr }
+	m := NewManager(WithSource(staticSource{keys: "ssh-rsa K1"}), WithStore(store), WithPrompter(yes(1)), WithRemovalCheck(check))
+
+	if _, err := m.Remove(context.Background(), "alice"); !errors.Is(err, checkErr) {
+		t.Fatalf("expected the check's error, got %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa K1 alice\n" {
+		t.Errorf("store should not change, got %q", got)
+	}
+}
+
+func TestManagerAdditionCheck(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa K1 bob"})
+	var checked []string
+	check := func(ctx context.Context, adding, installed []Key, username string) error {
+		checked = append(checked, fmt.Sprintf("%s %d %d", username, len(adding), len(installed)))
+		return nil
+	}
+	m := NewManager(WithSource(staticSource{keys: "ssh-rsa K1"}), WithStore(store), WithPrompter(yes(3)), WithAdditionCheck(check))
+
+	if _, err := m.Add(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := m.AddUsers(context.Background(), []string{"carol", "dave"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := m.Sync(context.Background(), "erin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"alice 1 1", "carol 1 2", "dave 1 3", "erin 1 4"}
+	if !reflect.DeepEqual(checked, expected) {
+		t.Errorf("expected checks %q, got %q", expected, checked)
+	}
+
+	checkErr := errors.New("that key is bob's")
+	m = NewManager(WithSource(staticSource{keys: "ssh-rsa K1"}), WithStore(store), WithPrompter(yes(1)), WithAdditionCheck(func(ctx context.Context, adding, installed []Key, username string) error { return checkErr }))
+	if _, err := m.Add(context.Background(), "frank"); !errors.Is(err, checkErr) {
+		t.Fatalf("expected the check's error, got %v", err)
+	}
+	if got := content(t, store); strings.Contains(got, "frank") {
+		t.Errorf("store should not change, got %q", got)
+	}
+}
+
+func TestManagerRemoveMissingStore(t *testing.T) {
+	m := NewManager(WithSource(staticSource{keys: "ssh-rsa K1"}), WithStore(&MemoryStore{}))
+	_, err := m.Remove(context.Background(), "alice")
+	if !errors.Is(err, ErrFileMissing) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrFileMissing, got %v", err)
+	}
+}
+
+func TestManagerAddUsers(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa OTHER bob"})
+	prompter := yes(1)
+	var events []Event
+	source := userSource{"alice": "ssh-ed25519 K1", "carol": "ssh-ed25519 K2\nssh-ed25519 K3"}
+	m := NewManager(WithSource(source), WithStore(store), WithPrompter(prompter), WithEventHandler(func(e Event) { events = append(events, e) }))
+
+	changes, err := m.AddUsers(context.Background(), []string{"alice", "carol"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa OTHER bob\nssh-ed25519 K1 alice"+today+"\nssh-ed25519 K2 carol"+today+"\nssh-ed25519 K3 carol"+today+"\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if len(changes) != 2 || changes[0].String() != "Added 1 key for alice (1 ed25519)" || changes[1].String() != "Added 2 keys for carol (2 ed25519)" {
+		t.Errorf("unexpected changes %v", changes)
+	}
+	if changes[0].AfterSHA256 != changes[1].BeforeSHA256 {
+		t.Error("expected the changes to follow one another")
+	}
+	if len(prompter.previews) != 1 || strings.Count(prompter.previews[0], "\n") != 3 {
+		t.Errorf("expected a single preview of all three keys, got %q", prompter.previews)
+	}
+	rewritten := 0
+	for _, event := range events {
+		if event.Type == EventFileRewritten {
+			rewritten++
+		}
+	}
+	if rewritten != 1 {
+		t.Errorf("expected one file_rewritten event, got %d", rewritten)
+	}
+}
+
+func TestManagerAddUsersFetchFailures(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa OTHER bob"})
+	prompter := yes(1)
+	m := NewManager(WithSource(userSource{"alice": "ssh-ed25519 K1"}), WithStore(store), WithPrompter(prompter))
+
+	_, err := m.AddUsers(context.Background(), []string{"bob", "alice", "carol"})
+	var usersErr *UsersError
+	if !errors.As(err, &usersErr) || !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected a UsersError, got %v", err)
+	}
+	if len(usersErr.Failures) != 2 || usersErr.Failures[0].User != "bob" || usersErr.Failures[1].User != "carol" {
+		t.Errorf("unexpected failures %+v", usersErr.Failures)
+	}
+	if len(prompter.questions) != 0 {
+		t.Errorf("expected nothing to be asked, got %q", prompter.questions)
+	}
+	if got := content(t, store); got != "ssh-rsa OTHER bob\n" {
+		t.Errorf("expected nothing to be written, got %q", got)
+	}
+}
+
+func TestManagerRemoveUsers(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa K1 alice"}, Entry{"ssh-rsa K2 bob"}, Entry{"ssh-rsa K3 carol"})
+	prompter := yes(1)
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 K"}), WithStore(store), WithPrompter(prompter))
+
+	changes, err := m.RemoveUsers(context.Background(), []string{"alice", "carol"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-rsa K2 bob\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if len(changes) != 2 || len(changes[0].Removed) != 1 || len(changes[1].Removed) != 1 {
+		t.Errorf("unexpected changes %v", changes)
+	}
+	if len(prompter.previews) != 1 {
+		t.Errorf("expected a single preview, got %q", prompter.previews)
+	}
+}
+
+func TestManagerSync(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa OLD carol"}, Entry{"ssh-ed25519 KEEP carol"})
+	prompter := yes(1)
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 KEEP\nssh-ed25519 NEW"}), WithStore(store), WithPrompter(prompter))
+
+	change, err := m.Sync(context.Background(), "carol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := content(t, store); got != "ssh-ed25519 KEEP carol\nssh-ed25519 NEW carol"+today+"\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if len(change.Added) != 1 || len(change.Removed) != 1 {
+		t.Errorf("unexpected change %q", change)
+	}
+	expected := "Changes to (memory):\n- 1  ssh-rsa OLD carol\n+ 2  ssh-ed25519 NEW carol" + today
+	if !reflect.DeepEqual(prompter.previews, []string{expected}) {
+		t.Errorf("unexpected previews %q", prompter.previews)
+	}
+
+	// Nothing to do: nothing asked
+	prompter = &scriptedPrompter{}
+	m = NewManager(WithSource(staticSource{keys: "ssh-ed25519 KEEP\nssh-ed25519 NEW"}), WithStore(store), WithPrompter(prompter))
+	change, err = m.Sync(context.Background(), "carol")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(prompter.questions) != 0 || change.String() != "Keys for carol are up to date (2 keys)" {
+		t.Errorf("expected no questions and no change, got %q and %q", prompter.questions, change)
+	}
+}
+
+func TestManagerConcurrentModification(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa EXISTING bob"})
+	prompter := yes(2)
+	prompter.hook = func() {
+		store.Save([]Entry{{"ssh-rsa EXISTING bob"}, {"ssh-rsa INTRUDER mallory"}})
+	}
+	m := NewManager(WithSource(staticSource{keys: "ssh-rsa NEW"}), WithStore(store), WithPrompter(prompter))
+
+	change, err := m.Add(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(prompter.notices) != 1 || !strings.Contains(prompter.notices[0], "modified by another process") {
+		t.Errorf("expected a concurrent modification notice, got %q", prompter.notices)
+	}
+	if len(prompter.previews) != 2 || prompter.previews[1] != "Changes made in the meantime:\n+ ssh-rsa INTRUDER mallory" {
+		t.Errorf("expected the external change to be shown, got %q", prompter.previews)
+	}
+	if got := content(t, store); got != "ssh-rsa EXISTING bob\nssh-rsa INTRUDER mallory\nssh-rsa NEW alice"+today+"\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if len(change.Added) != 1 {
+		t.Errorf("the change should only count alice's key, got %d", len(change.Added))
+	}
+}
+
+// editingStore makes edit, standing in for another process, just as the
+// store is locked for the write.
+type editingStore struct {
+	*MemoryStore
+	edit func()
+}
+
+func (s *editingStore) Lock() (func() error, error) {
+	if s.edit != nil {
+		s.edit()
+		s.edit = nil
+	}
+	return func() error { return nil }, nil
+}
+
+func TestManagerSyncConcurrentEdit(t *testing.T) {
+	oldKey := "ssh-rsa " + rsa2048Blob + " alice"
+	keepKey := "ssh-ed25519 " + ed25519Blob + " alice"
+	bobKey := "ssh-ed25519 " + ed25519Blob + " bob"
+	tests := []struct {
+		name     string
+		edit     []Entry
+		err      error
+		expected string
+	}{
+		{
+			name:     "key added",
+			edit:     []Entry{{oldKey}, {keepKey}, {"ssh-ecdsa-sha2-nistp384 " + ecdsa384Blob + " carol"}},
+			expected: keepKey + "\nssh-ecdsa-sha2-nistp384 " + ecdsa384Blob + " carol\n",
+		},
+		{
+			name:     "removed key removed",
+			edit:     []Entry{{keepKey}},
+			expected: keepKey + "\n",
+		},
+		{
+			name:     "removed key edited",
+			edit:     []Entry{{`from="10.0.0.1" ` + oldKey}, {keepKey}},
+			err:      ErrConflict,
+			expected: `from="10.0.0.1" ` + oldKey + "\n" + keepKey + "\n",
+		},
+		{
+			name:     "other line edited",
+			edit:     []Entry{{oldKey}, {`no-pty ` + keepKey}, {bobKey}},
+			expected: `no-pty ` + keepKey + "\n" + bobKey + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &editingStore{MemoryStore: NewMemoryStore(Entry{oldKey}, Entry{keepKey})}
+			store.edit = func() { store.MemoryStore.Save(tt.edit) }
+			var log bytes.Buffer
+			m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 " + ed25519Blob}), WithStore(store), WithLogger(slog.New(slog.NewTextHandler(&log, nil))))
+
+			_, err := m.Sync(context.Background(), "alice")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if got := content(t, store); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+			if !strings.Contains(log.String(), "msg=concurrent_change") {
+				t.Errorf("expected the concurrent change to be logged, got %q", log.String())
+			}
+		})
+	}
+}
+
+func TestManagerList(t *testing.T) {
+	m := NewManager(WithStore(NewMemoryStore(Entry{"# comment"}, Entry{"ssh-rsa K1 alice"})))
+	keys, err := m.List(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Line != "ssh-rsa K1 alice" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+}
+
+func TestManagerContextDone(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   KeySource
+		prompter func(cancel context.CancelFunc) Prompter
+		timeout  time.Duration
+		expected error
+	}{
+		{"deadline while fetching", blockingSource{}, func(context.CancelFunc) Prompter { return yes(1) }, 20 * time.Millisecond, context.DeadlineExceeded},
+		{"deadline while waiting out a rate limit", &rateLimitedSource{limited: 1, wait: time.Second}, func(context.CancelFunc) Prompter { return yes(1) }, 20 * time.Millisecond, context.DeadlineExceeded},
+		{"cancelled while confirming", staticSource{keys: "ssh-ed25519 K1"}, func(cancel context.CancelFunc) Prompter {
+			prompter := yes(1)
+			prompter.hook = cancel
+			return prompter
+		}, time.Minute, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			store := NewMemoryStore(Entry{"ssh-rsa OTHER bob"})
+			m := NewManager(WithSource(tt.source), WithStore(store), WithPrompter(tt.prompter(cancel)))
+
+			start := time.Now()
+			_, err := m.Add(ctx, "alice")
+			if !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, err)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("took %s to give up", elapsed)
+			}
+			if got := content(t, store); got != "ssh-rsa OTHER bob\n" {
+				t.Errorf("expected the store to be unchanged, got %q", got)
+			}
+		})
+	}
+}
+
+func TestManagerDiff(t *testing.T) {
+	store := NewMemoryStore(Entry{"ssh-rsa OLD alice"}, Entry{"ssh-ed25519 KEEP alice"}, Entry{"ssh-rsa K2 bob"})
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 KEEP\nssh-ed25519 NEW"}), WithStore(store))
+
+	diff, err := m.Diff(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !diff.Differs() || diff.Installed != 2 || len(diff.Missing) != 1 || diff.Missing[0].Blob != "NEW" || len(diff.Extra) != 1 || diff.Extra[0].Line != "ssh-rsa OLD alice" {
+		t.Errorf("unexpected diff %+v", diff)
+	}
+	if got := content(t, store); got != "ssh-rsa OLD alice\nssh-ed25519 KEEP alice\nssh-rsa K2 bob\n" {
+		t.Errorf("expected nothing changed, got %q", got)
+	}
+
+	m = NewManager(WithSource(staticSource{keys: "ssh-rsa K2"}), WithStore(store))
+	if diff, err := m.Diff(context.Background(), "bob"); err != nil || diff.Differs() {
+		t.Errorf("expected bob's keys to match, got %+v, %v", diff, err)
+	}
+}
@@ -0,0 +1,64 @@
+package doorman
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// NetworkError decorates a failed request with a hint about the likely
+// cause. The underlying error is kept in full for debugging.
+type NetworkError struct {
+	Err  error
+	Hint string
+}
+
+func (e *NetworkError) Error() string {
+	return e.Err.Error() + "\nhint: " + e.Hint
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// withNetworkHint wraps err in a NetworkError when its cause is recognized,
+// and returns it unchanged otherwise.
+func withNetworkHint(err error) error {
+	if hint := networkErrorHint(err); hint != "" {
+		return &NetworkError{Err: err, Hint: hint}
+	}
+	return err
+}
+
+// networkErrorHint classifies common reasons a request fails before any
+// response arrives: DNS resolution, refused connections, TLS handshakes and
+// timeouts.
+func networkErrorHint(err error) string {
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalidCert x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var verifyErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &dnsErr) && !dnsErr.IsTimeout:
+		return "the host name could not be resolved; this host may not have internet access or working DNS"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "the connection was refused; check the proxy settings (HTTPS_PROXY) and any firewall in between"
+	case errors.As(err, &unknownAuthority), errors.As(err, &invalidCert),
+		errors.As(err, &hostnameErr), errors.As(err, &verifyErr):
+		return "the server's certificate could not be verified; check the system clock and CA certificates, or whether a proxy intercepts TLS"
+	case errors.As(err, &recordErr):
+		return "the TLS handshake failed; check the proxy settings (HTTPS_PROXY), the server may not speak HTTPS"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "the request timed out; the network may be slow or filtered, check the proxy settings (HTTPS_PROXY)"
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package doorman
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// urlError wraps err the way http.Get reports failed requests.
+func urlError(err error) error {
+	return &url.Error{Op: "Get", URL: "https://github.com/alice.keys", Err: err}
+}
+
+func TestNetworkErrorHint(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		hint string
+	}{
+		{"dns", urlError(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "github.com", IsNotFound: true}}), "could not be resolved"},
+		{"refused", urlError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), "connection was refused"},
+		{"unknown authority", urlError(x509.UnknownAuthorityError{}), "certificate could not be verified"},
+		{"hostname mismatch", urlError(x509.HostnameError{Certificate: &x509.Certificate{}, Host: "github.com"}), "certificate could not be verified"},
+		{"verification", urlError(&tls.CertificateVerificationError{Err: errors.New("expired")}), "certificate could not be verified"},
+		{"not tls", urlError(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), "TLS handshake failed"},
+		{"dial timeout", urlError(&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}), "timed out"},
+		{"dns timeout", urlError(&net.DNSError{Err: "i/o timeout", Name: "github.com", IsTimeout: true}), "timed out"},
+		{"context deadline", urlError(context.DeadlineExceeded), "timed out"},
+		{"unrecognized", urlError(errors.New("something else")), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hint := networkErrorHint(tt.err)
+			if tt.hint == "" {
+				if hint != "" {
+					t.Errorf("expected no hint, got %q", hint)
+				}
+				return
+			}
+			if !strings.Contains(hint, tt.hint) {
+				t.Errorf("expected hint containing %q, got %q", tt.hint, hint)
+			}
+		})
+	}
+}
+
+func TestWithNetworkHintKeepsUnderlyingError(t *testing.T) {
+	dnsErr := &net.DNSError{Err: "no such host", Name: "github.com", IsNotFound: true}
+	err := withNetworkHint(urlError(&net.OpError{Op: "dial", Net: "tcp", Err: dnsErr}))
+
+	msg := err.Error()
+	if !strings.Contains(msg, "lookup github.com: no such host") {
+		t.Errorf("expected underlying error in message, got %q", msg)
+	}
+	if !strings.Contains(msg, "\nhint: ") {
+		t.Errorf("expected a hint line, got %q", msg)
+	}
+	var target *net.DNSError
+	if !errors.As(err, &target) {
+		t.Error("expected the DNS error to remain reachable with errors.As")
+	}
+
+	plain := errors.New("something else")
+	if withNetworkHint(plain) != plain {
+		t.Error("expected unrecognized errors to be returned unchanged")
+	}
+}
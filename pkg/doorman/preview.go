@@ -0,0 +1,181 @@
+package doorman
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PreviewLine is a line an operation will add to or delete from an
+// authorized_keys file.
+type PreviewLine struct {
+	// Added is true for a line to be added and false for one to be deleted
+	Added bool
+	// Number is the line's number in the file as it is now for a deleted
+	// line, and in the file as it will be for an added one
+	Number int
+	Text   string
+}
+
+// Preview is the exact change an operation will make to an authorized_keys
+// file. Add, Remove and Sync all confirm what Preview shows, so the preview
+// and the write can't disagree.
+type Preview []PreviewLine
+
+// NewPreview compares the entries of a file before and after a change.
+// Entries kept in order are unchanged; operations only ever delete entries,
+// rewrite a key in place or append new ones, so for them the result is the
+// smallest change. A key rewritten in place, such as with new options or
+// commented out as expired, is shown deleted and added at its line.
+func NewPreview(before, after []Entry) Preview {
+	var preview Preview
+	j := 0
+	for i, entry := range before {
+		if j < len(after) && after[j].Line == entry.Line {
+			j++
+			continue
+		}
+		preview = append(preview, PreviewLine{Number: i + 1, Text: entry.Line})
+		if j < len(after) && sameKey(entry, after[j]) {
+			preview = append(preview, PreviewLine{Added: true, Number: j + 1, Text: after[j].Line})
+			j++
+		}
+	}
+	for ; j < len(after); j++ {
+		preview = append(preview, PreviewLine{Added: true, Number: j + 1, Text: after[j].Line})
+	}
+	return preview
+}
+
+// sameKey reports whether after is before's key rewritten: the same key,
+// or before commented out as expired.
+func sameKey(before, after Entry) bool {
+	old, ok := before.Key()
+	if !ok {
+		return false
+	}
+	key, ok := after.Key()
+	if !ok {
+		key, ok = expiredKey(after)
+	}
+	return ok && key.ID() == old.ID()
+}
+
+// String renders the preview diff-style: each line prefixed with "+" or "-"
+// and its line number, with keys described by their fingerprints. For a
+// preview deleting line 3 and adding line 7:
+//
+//	fmt.Println(preview)
+//
+//	- 3  256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice (ED25519)
+//	+ 7  256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I bob (ED25519)
+func (p Preview) String() string {
+	width := numberWidth(p)
+	lines := make([]string, len(p))
+	for i, line := range p {
+		op := '-'
+		if line.Added {
+			op = '+'
+		}
+		lines[i] = formatPreviewLine(op, width, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// additionString renders p, which only adds keys, as String does but with
+// each key marked [new], after the lines of installed: keys that were asked
+// to be added but are already installed, marked "=" and [already
+// installed]:
+//
+//	= 2  256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice (ED25519) [already installed]
+//	+ 7  256 SHA256:Gq2mAFEwJKQyVbVRoBYGZk1xUOh7IGQNHqE4bZQ5CdA alice (ED25519) [new]
+func (p Preview) additionString(installed []PreviewLine) string {
+	width := max(numberWidth(p), numberWidth(installed))
+	var lines []string
+	for _, line := range installed {
+		lines = append(lines, formatPreviewLine('=', width, line)+" [already installed]")
+	}
+	for _, line := range p {
+		lines = append(lines, formatPreviewLine('+', width, line)+" [new]")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// numberWidth is how wide the widest line number of lines is.
+func numberWidth(lines []PreviewLine) int {
+	width := 0
+	for _, line := range lines {
+		width = max(width, len(strconv.Itoa(line.Number)))
+	}
+	return width
+}
+
+// formatPreviewLine renders line after op and its number, padded to width,
+// describing a key by its fingerprint.
+func formatPreviewLine(op rune, width int, line PreviewLine) string {
+	text := line.Text
+	if key, ok := ParseKey(line.Text); ok {
+		text = key.Describe()
+	}
+	return fmt.Sprintf("%c %*d  %s", op, width, line.Number, text)
+}
+
+// summaryLines is how many lines of a preview its summary shows
+const summaryLines = 5
+
+// Summary describes the preview in a few lines: how many keys for how many
+// users are added and deleted, by type, and the first lines of the preview,
+// e.g.
+//
+//	Adding 120 keys for 14 users (100 ed25519, 20 rsa)
+//	Deleting 2 keys for 1 user (2 rsa)
+//	+ 31  256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice (ED25519)
+//	...
+//	and 117 more lines
+func (p Preview) Summary() string {
+	var added, deleted []Key
+	for _, line := range p {
+		key, ok := ParseKey(line.Text)
+		switch {
+		case !ok:
+		case line.Added:
+			added = append(added, key)
+		default:
+			deleted = append(deleted, key)
+		}
+	}
+
+	var lines []string
+	if len(added) > 0 {
+		lines = append(lines, "Adding "+countKeysAndUsers(added))
+	}
+	if len(deleted) > 0 {
+		lines = append(lines, "Deleting "+countKeysAndUsers(deleted))
+	}
+	shown := p[:min(len(p), summaryLines)]
+	lines = append(lines, shown.String())
+	if more := len(p) - len(shown); more > 0 {
+		lines = append(lines, fmt.Sprintf("and %d more %s", more, pluralLines(more)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// countKeysAndUsers renders "3 keys for 2 users (2 ed25519, 1 rsa)".
+func countKeysAndUsers(keys []Key) string {
+	users := make(map[string]bool)
+	for _, key := range keys {
+		users[key.Label()] = true
+	}
+	userWord := "users"
+	if len(users) == 1 {
+		userWord = "user"
+	}
+	return fmt.Sprintf("%d %s for %d %s%s", len(keys), pluralKeys(len(keys)), len(users), userWord, typeBreakdown(keys))
+}
+
+func pluralLines(n int) string {
+	if n == 1 {
+		return "line"
+	}
+	return "lines"
+}
@@ -0,0 +1,92 @@
+package doorman
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func entries(lines ...string) []Entry {
+	result := make([]Entry, len(lines))
+	for i, line := range lines {
+		result[i] = Entry{Line: line}
+	}
+	return result
+}
+
+func TestNewPreview(t *testing.T) {
+	tests := []struct {
+		name     string
+		before   []Entry
+		after    []Entry
+		expected Preview
+	}{
+		{"unchanged", entries("a", "b"), entries("a", "b"), nil},
+		{"append", entries("a"), entries("a", "b", "c"), Preview{{true, 2, "b"}, {true, 3, "c"}}},
+		{"new file", nil, entries("a"), Preview{{true, 1, "a"}}},
+		{"delete", entries("a", "b", "c", "b"), entries("a", "c"), Preview{{false, 2, "b"}, {false, 4, "b"}}},
+		{"delete and append", entries("a", "b", "c"), entries("a", "c", "d"), Preview{{false, 2, "b"}, {true, 3, "d"}}},
+		{"delete everything", entries("a", "b"), nil, Preview{{false, 1, "a"}, {false, 2, "b"}}},
+		{
+			"rewrite in place",
+			entries("ssh-rsa K1 alice", "ssh-rsa K2 bob", "ssh-rsa K3 carol"),
+			entries("ssh-rsa K1 alice", `restrict ssh-rsa K2 bob`, "ssh-rsa K3 carol"),
+			Preview{{false, 2, "ssh-rsa K2 bob"}, {true, 2, "restrict ssh-rsa K2 bob"}},
+		},
+		{
+			"expire in place",
+			entries("ssh-rsa K1 alice", "ssh-rsa K2 bob", "ssh-rsa K3 carol"),
+			entries("ssh-rsa K1 alice", expiredPrefix+"ssh-rsa K2 bob", "ssh-rsa K3 carol"),
+			Preview{{false, 2, "ssh-rsa K2 bob"}, {true, 2, expiredPrefix + "ssh-rsa K2 bob"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewPreview(tt.before, tt.after); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPreviewString(t *testing.T) {
+	before := entries("a", "b", "c", "d", "e", "f", "g", "h", "i", "ssh-rsa K1 alice")
+	after := append(entries("a", "b", "c", "d", "e", "f", "g", "h", "i"), entries("ssh-ed25519 K2 alice")...)
+
+	after = append(after, entries("ssh-ed25519 "+ed25519Blob+" alice")...)
+
+	expected := "- 10  ssh-rsa K1 alice\n+ 10  ssh-ed25519 K2 alice\n+ 11  256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice (ED25519)"
+	if got := NewPreview(before, after).String(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestPreviewSummary(t *testing.T) {
+	var before, after []Entry
+	for i := 0; i < 7; i++ {
+		after = append(after, entries(fmt.Sprintf("ssh-ed25519 K%d alice", i))...)
+	}
+	after = append(after, entries("ssh-rsa R1 bob", "# managed by doorman")...)
+	before = append(before, entries("ssh-rsa OLD carol")...)
+
+	expected := strings.Join([]string{
+		"Adding 8 keys for 2 users (7 ed25519, 1 rsa)",
+		"Deleting 1 key for 1 user (1 rsa)",
+		"- 1  ssh-rsa OLD carol",
+		"+ 1  ssh-ed25519 K0 alice",
+		"+ 2  ssh-ed25519 K1 alice",
+		"+ 3  ssh-ed25519 K2 alice",
+		"+ 4  ssh-ed25519 K3 alice",
+		"and 5 more lines",
+	}, "\n")
+	if got := NewPreview(before, after).Summary(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+
+	expected = "Adding 1 key for 1 user (1 rsa)\n+ 1  ssh-rsa R1 bob"
+	if got := NewPreview(nil, entries("ssh-rsa R1 bob")).Summary(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
@@ -0,0 +1,72 @@
+package doorman
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProviderOptions configures the KeySource a ProviderFactory builds.
+type ProviderOptions struct {
+	// Location is where the provider finds keys, in a form of its own: a URL
+	// template for "url", a path for "file". Providers with a fixed location,
+	// such as "github", require it to be empty.
+	Location string
+	// Client makes HTTP requests for providers that need them; nil means
+	// http.DefaultClient
+	Client HTTPClient
+	// GitHubToken has "github" fetch keys through GitHub's API, with their
+	// key IDs; the other providers ignore it, so it is never sent elsewhere
+	GitHubToken string
+}
+
+// ProviderFactory builds a KeySource, reporting options it can't use.
+type ProviderFactory func(opts ProviderOptions) (KeySource, error)
+
+// providers is the one piece of global state in the package. It is only
+// written by init functions, each source registering itself from its own
+// file.
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]ProviderFactory)
+)
+
+// RegisterProvider makes a key source available by name to LookupProvider,
+// so programs can let their users choose it. It is meant to be called from
+// init functions, and panics if name is already registered or factory is nil.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if factory == nil {
+		panic("doorman: RegisterProvider factory is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("doorman: RegisterProvider called twice for provider " + name)
+	}
+	providers[name] = factory
+}
+
+// ListProviders returns the names of the registered providers, sorted.
+func ListProviders() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupProvider returns the factory registered as name. The error for an
+// unknown name lists the known ones.
+func LookupProvider(name string) (ProviderFactory, error) {
+	providersMu.RLock()
+	factory, ok := providers[name]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provider '%s': use one of %s", name, strings.Join(ListProviders(), ", "))
+	}
+	return factory, nil
+}
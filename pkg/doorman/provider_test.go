@@ -0,0 +1,65 @@
+package doorman
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListProviders(t *testing.T) {
+	if got, expected := ListProviders(), []string{"file", "github", "url"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestLookupProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		location string
+		expected KeySource
+		err      string
+	}{
+		{"github", "github", "", GitHubSource{}, ""},
+		{"github with a location", "github", "https://example.com", nil, "no location"},
+		{"url", "url", "https://keys.example.com/{user}", URLSource{Template: "https://keys.example.com/{user}"}, ""},
+		{"url over http", "url", "http://keys.example.com/{user}", nil, "only https:// URLs"},
+		{"url without user", "url", "https://keys.example.com/keys", nil, "must contain {user}"},
+		{"file", "file", "/srv/keys/{user}.pub", FileSource{Path: "/srv/keys/{user}.pub"}, ""},
+		{"file without path", "file", "", nil, "needs the path"},
+		{"unknown", "gitlub", "", nil, "unknown provider 'gitlub': use one of file, github, url"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := func() (KeySource, error) {
+				factory, err := LookupProvider(tt.provider)
+				if err != nil {
+					return nil, err
+				}
+				return factory(ProviderOptions{Location: tt.location})
+			}()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(source, tt.expected) {
+				t.Errorf("expected %#v, got %#v", tt.expected, source)
+			}
+		})
+	}
+}
+
+func TestRegisterProviderTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering github again to panic")
+		}
+	}()
+	RegisterProvider("github", func(ProviderOptions) (KeySource, error) { return GitHubSource{}, nil })
+}
@@ -0,0 +1,97 @@
+package doorman
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+// fileSnapshot captures authorized_keys as it was when the preview was shown,
+// so a change made by another process before the write can be detected.
+type fileSnapshot struct {
+	exists  bool
+	sum     [sha256.Size]byte
+	content []byte
+	// entries is content as loaded, so it needn't be parsed again
+	entries []Entry
+}
+
+func snapshotStore(store KeyStore) (fileSnapshot, error) {
+	entries, err := store.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileSnapshot{}, nil
+	}
+	if err != nil {
+		return fileSnapshot{}, err
+	}
+
+	content := FormatEntries(entries)
+	return fileSnapshot{
+		exists:  true,
+		sum:     sha256.Sum256(content),
+		content: content,
+		entries: entries,
+	}, nil
+}
+
+func (s fileSnapshot) equal(other fileSnapshot) bool {
+	return s.exists == other.exists && s.sum == other.sum
+}
+
+// diffLines returns the non-blank lines only present in after (added) and
+// only present in before (removed), ignoring order.
+func diffLines(before, after []byte) (added, removed []string) {
+	counts := make(map[string]int)
+	for _, line := range strings.Split(string(before), "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			counts[line]++
+		}
+	}
+	for _, line := range strings.Split(string(after), "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) == "" {
+			continue
+		}
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		added = append(added, line)
+	}
+	for _, line := range strings.Split(string(before), "\n") {
+		if line = strings.TrimRight(line, "\r"); counts[line] > 0 {
+			counts[line]--
+			removed = append(removed, line)
+		}
+	}
+	return added, removed
+}
+
+// conflicts returns the keys of base that a change planned against it,
+// from base to planned, and a change made by another process since, from
+// base to current, both changed: the plan rewrites or removes them, and
+// their key is now on a line of its own, edited by hand. Lines only one
+// of them changed merge, as the plan is applied to current.
+func conflicts(base, planned, current []byte) []Key {
+	if bytes.Equal(base, current) {
+		return nil
+	}
+	_, rewritten := diffLines(base, planned)
+	edited, gone := diffLines(base, current)
+	editedKeys := make(map[KeyID]bool)
+	for _, line := range edited {
+		if key, ok := ParseKey(line); ok {
+			editedKeys[key.ID()] = true
+		}
+	}
+	var keys []Key
+	for _, line := range rewritten {
+		key, ok := ParseKey(line)
+		if ok && editedKeys[key.ID()] && slices.Contains(gone, line) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,50 @@
+package doorman
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	before := []byte("a\nb\r\nb\n\nc\n")
+	after := []byte("a\nb\nd\n")
+
+	added, removed := diffLines(before, after)
+	if !reflect.DeepEqual(added, []string{"d"}) {
+		t.Errorf("unexpected added lines: %q", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"b", "c"}) {
+		t.Errorf("unexpected removed lines: %q", removed)
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "authorized_keys"))
+
+	missing, err := snapshotStore(store)
+	if err != nil || missing.exists {
+		t.Fatalf("expected missing snapshot, got %+v, %v", missing, err)
+	}
+
+	os.WriteFile(store.Path(), []byte("ssh-rsa KEY... alice"), 0600)
+	first, err := snapshotStore(store)
+	if err != nil || !first.exists {
+		t.Fatalf("expected snapshot, got %+v, %v", first, err)
+	}
+	if first.equal(missing) {
+		t.Error("creating the file should be detected")
+	}
+
+	second, _ := snapshotStore(store)
+	if !first.equal(second) {
+		t.Error("unchanged file should compare equal")
+	}
+
+	os.WriteFile(store.Path(), []byte("ssh-rsa KEY... bobby"), 0600)
+	third, _ := snapshotStore(store)
+	if first.equal(third) {
+		t.Error("changed content should be detected")
+	}
+}
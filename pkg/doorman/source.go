@@ -0,0 +1,42 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+)
+
+// KeySource provides the public keys of a user.
+//
+// Sources report malformed usernames with errors matching ErrInvalidUser,
+// and unknown users with errors matching ErrUserNotFound.
+type KeySource interface {
+	Keys(ctx context.Context, user string) ([]PublicKey, error)
+}
+
+// userPlaceholder marks where URLSource and FileSource insert the username.
+const userPlaceholder = "{user}"
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// validateUser applies to sources without rules of their own. It keeps
+// usernames from escaping the path or URL they are substituted into.
+func validateUser(user string) error {
+	if !usernamePattern.MatchString(user) {
+		return errorOfKind(ErrInvalidUser, "invalid username '%s': usernames may only contain letters, digits, '_', '.' and '-', and cannot begin with '.' or '-'", user)
+	}
+	return nil
+}
+
+func clientOrDefault(client HTTPClient) HTTPClient {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
+
+func isNotFound(err error) bool {
+	var fetchErr *FetchError
+	return errors.As(err, &fetchErr) && fetchErr.Status == http.StatusNotFound
+}
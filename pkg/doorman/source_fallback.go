@@ -0,0 +1,92 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// FallbackSource gets keys from the first of Sources that answers, such as
+// an internal mirror and then GitHub, for networks where some of them can't
+// be reached. It only moves on from a source that couldn't be reached or
+// failed with a server error (5xx); any other answer, including that the
+// user doesn't exist, is authoritative.
+type FallbackSource struct {
+	Sources []KeySource
+	// Names name the sources in errors and for Answered, in the same order;
+	// a source without one is named by its position, e.g. "source 2"
+	Names []string
+	// Answered, if set, is called with the name of the source each user's
+	// keys came from
+	Answered func(user, name string)
+}
+
+func (s FallbackSource) Keys(ctx context.Context, user string) ([]PublicKey, error) {
+	failed := &FallbackError{User: user}
+	for i, source := range s.Sources {
+		keys, err := source.Keys(ctx, user)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil && unreachable(err) {
+			failed.Failures = append(failed.Failures, SourceError{Name: s.name(i), Err: err})
+			continue
+		}
+		if err == nil && s.Answered != nil {
+			s.Answered(user, s.name(i))
+		}
+		return keys, err
+	}
+	return nil, failed
+}
+
+func (s FallbackSource) name(i int) string {
+	if i < len(s.Names) && s.Names[i] != "" {
+		return s.Names[i]
+	}
+	return "source " + strconv.Itoa(i+1)
+}
+
+// unreachable reports whether err means a source couldn't give an answer,
+// so the next may be tried: it couldn't be reached, or failed with a server
+// error.
+func unreachable(err error) bool {
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		return false
+	}
+	return fetchErr.Status == 0 && fetchErr.Err != nil || fetchErr.Status >= http.StatusInternalServerError
+}
+
+// SourceError is the failure of one source of a FallbackSource.
+type SourceError struct {
+	Name string
+	Err  error
+}
+
+// FallbackError reports that none of a FallbackSource's sources could be
+// reached, with what went wrong with each, in order.
+type FallbackError struct {
+	User     string
+	Failures []SourceError
+}
+
+func (e *FallbackError) Error() string {
+	messages := make([]string, len(e.Failures))
+	for i, failure := range e.Failures {
+		messages[i] = failure.Name + ": " + failure.Err.Error()
+	}
+	return "no source could be reached: " + strings.Join(messages, "; ")
+}
+
+// Unwrap returns every failure, so errors.Is and errors.As match any of
+// them.
+func (e *FallbackError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, failure := range e.Failures {
+		errs[i] = failure.Err
+	}
+	return errs
+}
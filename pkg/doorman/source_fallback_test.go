@@ -0,0 +1,48 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFallbackSource(t *testing.T) {
+	down := staticSource{err: &FetchError{URL: "https://mirror/alice.keys", Err: errors.New("connection refused")}}
+	failing := staticSource{err: &FetchError{URL: "https://backup/alice.keys", Status: http.StatusBadGateway}}
+	up := staticSource{keys: "ssh-ed25519 K1"}
+
+	var answered []string
+	source := FallbackSource{
+		Sources:  []KeySource{down, failing, up},
+		Names:    []string{"mirror", "backup"},
+		Answered: func(user, name string) { answered = append(answered, user+" from "+name) },
+	}
+	keys, err := source.Keys(context.Background(), "alice")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("unexpected result %+v (%v)", keys, err)
+	}
+	if len(answered) != 1 || answered[0] != "alice from source 3" {
+		t.Errorf("unexpected answers %q", answered)
+	}
+
+	// A user the first source doesn't know isn't looked for elsewhere
+	source.Sources = []KeySource{staticSource{err: errorOfKind(ErrUserNotFound, "user 'alice' not found")}, up}
+	if _, err := source.Keys(context.Background(), "alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	source.Sources = []KeySource{down, failing}
+	_, err = source.Keys(context.Background(), "alice")
+	var fallbackErr *FallbackError
+	if !errors.As(err, &fallbackErr) || len(fallbackErr.Failures) != 2 {
+		t.Fatalf("expected a FallbackError for both sources, got %v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "mirror: fetching keys: connection refused") || !strings.Contains(msg, "backup: fetching keys: HTTP 502") {
+		t.Errorf("expected every failure in the message, got %q", msg)
+	}
+	if !errors.As(err, new(*FetchError)) {
+		t.Errorf("expected the failures to be matchable, got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+func init() {
+	RegisterProvider("file", func(opts ProviderOptions) (KeySource, error) {
+		if opts.Location == "" {
+			return nil, fmt.Errorf("the file provider needs the path of a keys file")
+		}
+		return FileSource{Path: opts.Location}, nil
+	})
+}
+
+// FileSource provides keys from local files in authorized_keys format. If
+// Path contains {user}, it is replaced by the username; otherwise every user
+// gets the keys in the same file.
+type FileSource struct {
+	Path string
+}
+
+func (s FileSource) Keys(ctx context.Context, user string) ([]PublicKey, error) {
+	if err := validateUser(user); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	path := strings.ReplaceAll(s.Path, userPlaceholder, user)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && strings.Contains(s.Path, userPlaceholder) {
+		return nil, errorOfKind(ErrUserNotFound, "no keys file for user '%s' (%s does not exist)", user, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKeys(data), nil
+}
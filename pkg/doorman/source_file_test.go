@@ -0,0 +1,51 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "alice.pub"), []byte("ssh-ed25519 K1 alice@laptop\n# old key\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "team.pub"), []byte("ssh-rsa K2\nssh-rsa K3\n"), 0600)
+
+	perUser := FileSource{Path: filepath.Join(dir, "{user}.pub")}
+	keys, err := perUser.Keys(context.Background(), "alice")
+	if err != nil || len(keys) != 1 || keys[0].Comment != "alice@laptop" {
+		t.Fatalf("unexpected result %+v (%v)", keys, err)
+	}
+	if _, err := perUser.Keys(context.Background(), "bob"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound for a missing file, got %v", err)
+	}
+	if _, err := perUser.Keys(context.Background(), ".."); !errors.Is(err, ErrInvalidUser) {
+		t.Errorf("expected ErrInvalidUser, got %v", err)
+	}
+
+	shared := FileSource{Path: filepath.Join(dir, "team.pub")}
+	keys, err = shared.Keys(context.Background(), "bob")
+	if err != nil || len(keys) != 2 {
+		t.Errorf("unexpected result %+v (%v)", keys, err)
+	}
+
+	missing := FileSource{Path: filepath.Join(dir, "missing.pub")}
+	if _, err := missing.Keys(context.Background(), "bob"); errors.Is(err, ErrUserNotFound) || err == nil {
+		t.Errorf("a missing shared file is not a missing user, got %v", err)
+	}
+}
+
+func TestFileSourceCancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("ssh-ed25519 K1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (FileSource{Path: path}).Keys(ctx, "alice"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
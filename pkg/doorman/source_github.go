@@ -0,0 +1,178 @@
+package doorman
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterProvider("github", func(opts ProviderOptions) (KeySource, error) {
+		if opts.Location != "" {
+			return nil, fmt.Errorf("the github provider has no location to set")
+		}
+		return GitHubSource{Client: opts.Client, Token: opts.GitHubToken}, nil
+	})
+}
+
+// GitHubSource provides the keys users publish at
+// https://github.com/<user>.keys. With a Token, they are fetched from
+// GitHub's API instead, which gives each key's ID, and the day it was
+// created when GitHub says: the keys' comments are then "gh-key-id=<id>",
+// followed by "gh-created=<date>" if known.
+type GitHubSource struct {
+	// Client makes the requests; http.DefaultClient when nil
+	Client HTTPClient
+	// Token authenticates requests to GitHub's API; without one the plain
+	// .keys URL is used
+	Token string
+}
+
+// gitHubAPI is where GitHubSource fetches keys with a Token.
+var gitHubAPI = "https://api.github.com"
+
+func (s GitHubSource) Keys(ctx context.Context, user string) ([]PublicKey, error) {
+	if err := ValidateGitHubUsername(user); err != nil {
+		return nil, err
+	}
+
+	var keys []PublicKey
+	var err error
+	if s.Token != "" {
+		keys, err = s.apiKeys(ctx, user)
+	} else {
+		keys, err = s.webKeys(ctx, user)
+	}
+	if isNotFound(err) {
+		return nil, errorOfKind(ErrUserNotFound, "GitHub user '%s' not found — check the spelling", user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// webKeys fetches user's keys from https://github.com/<user>.keys, which
+// GitHub redirects to the new name of a renamed account.
+func (s GitHubSource) webKeys(ctx context.Context, user string) ([]PublicKey, error) {
+	keysURL := fmt.Sprintf("https://github.com/%s.keys", user)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, keysURL, nil)
+	if err != nil {
+		return nil, &FetchError{URL: keysURL, Err: err}
+	}
+	data, final, err := fetch(ctx, clientOrDefault(s.Client), request)
+	if err != nil {
+		return nil, err
+	}
+	if login, ok := strings.CutSuffix(strings.TrimPrefix(final.Path, "/"), ".keys"); ok && !strings.EqualFold(login, user) {
+		return nil, &RenamedUserError{User: user, Login: login}
+	}
+	return ParsePublicKeys(data), nil
+}
+
+// apiKeys fetches user's keys from GET /users/{user}/keys, recording each
+// key's ID and creation day in its comment.
+func (s GitHubSource) apiKeys(ctx context.Context, user string) ([]PublicKey, error) {
+	keysURL := fmt.Sprintf("%s/users/%s/keys", gitHubAPI, user)
+	data, final, err := s.api(ctx, keysURL)
+	if err != nil {
+		return nil, err
+	}
+	// GitHub's API redirects a renamed account's requests to its ID, so ask
+	// it for the new name
+	if final.String() != keysURL {
+		if login, err := s.Login(ctx, user); err == nil && !strings.EqualFold(login, user) {
+			return nil, &RenamedUserError{User: user, Login: login}
+		}
+	}
+
+	var entries []struct {
+		ID        int64     `json:"id"`
+		Key       string    `json:"key"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, &FetchError{URL: keysURL, Status: http.StatusOK, Err: fmt.Errorf("invalid response from GitHub's API: %w", err)}
+	}
+	var keys []PublicKey
+	for _, entry := range entries {
+		key, ok := ParseKey(entry.Key)
+		if !ok {
+			continue
+		}
+		key.Comment = gitHubKeyIDToken + strconv.FormatInt(entry.ID, 10)
+		if !entry.CreatedAt.IsZero() {
+			key.Comment += " " + gitHubCreatedToken + entry.CreatedAt.UTC().Format(time.DateOnly)
+		}
+		keys = append(keys, key.PublicKey)
+	}
+	return keys, nil
+}
+
+// Login returns user's login as GitHub spells it, e.g. "Alice" for
+// "alice", from GET /users/{user} on GitHub's API. That of a renamed
+// account is its new name. The Token is used if set.
+func (s GitHubSource) Login(ctx context.Context, user string) (string, error) {
+	if err := ValidateGitHubUsername(user); err != nil {
+		return "", err
+	}
+	userURL := fmt.Sprintf("%s/users/%s", gitHubAPI, user)
+	data, _, err := s.api(ctx, userURL)
+	if isNotFound(err) {
+		return "", errorOfKind(ErrUserNotFound, "GitHub user '%s' not found — check the spelling", user)
+	}
+	if err != nil {
+		return "", err
+	}
+	var account struct {
+		Login string `json:"login"`
+	}
+	if err := json.Unmarshal(data, &account); err != nil || account.Login == "" {
+		return "", &FetchError{URL: userURL, Status: http.StatusOK, Err: fmt.Errorf("invalid response from GitHub's API: no login")}
+	}
+	return account.Login, nil
+}
+
+// api makes a GET request to url on GitHub's API, returning the body and
+// the URL it came from.
+func (s GitHubSource) api(ctx context.Context, url string) ([]byte, *neturl.URL, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, &FetchError{URL: url, Err: err}
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+	if s.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	return fetch(ctx, clientOrDefault(s.Client), request)
+}
+
+// RenamedUserError reports that a GitHub account was renamed, so keys are
+// being asked for under its old name.
+type RenamedUserError struct {
+	User  string
+	Login string
+}
+
+func (e *RenamedUserError) Error() string {
+	return fmt.Sprintf("GitHub user '%s' was renamed to '%s'; update your records", e.User, e.Login)
+}
+
+var githubUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+// ValidateGitHubUsername reports whether username is one GitHub could have
+// issued. The returned error matches ErrInvalidUser.
+func ValidateGitHubUsername(username string) error {
+	// BEHAVIOR: Reject usernames GitHub would never issue before any network
+	// call, so values like "alice/../evil" can't produce a nonsense URL
+	if len(username) > 39 || !githubUsernamePattern.MatchString(username) {
+		return errorOfKind(ErrInvalidUser, "invalid GitHub username '%s': usernames may only contain alphanumeric characters and hyphens, cannot begin or end with a hyphen, and are at most 39 characters long", username)
+	}
+	return nil
+}
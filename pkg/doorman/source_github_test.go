@@ -0,0 +1,214 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitHubSource(t *testing.T) {
+	client := &recordingClient{status: http.StatusOK, body: "ssh-ed25519 K1\nssh-rsa K2\n"}
+	keys, err := GitHubSource{Client: client}.Keys(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0].Blob != "K1" || keys[1].Type != "ssh-rsa" {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+	if len(client.urls) != 1 || client.urls[0] != "https://github.com/alice.keys" {
+		t.Errorf("unexpected requests %v", client.urls)
+	}
+}
+
+func TestGitHubSourceUserNotFound(t *testing.T) {
+	client := &recordingClient{status: http.StatusNotFound, body: "Not Found"}
+	_, err := GitHubSource{Client: client}.Keys(context.Background(), "alcie")
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if err.Error() != "GitHub user 'alcie' not found — check the spelling" {
+		t.Errorf("unexpected message %q", err)
+	}
+
+	client.status = http.StatusServiceUnavailable
+	_, err = GitHubSource{Client: client}.Keys(context.Background(), "alice")
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.Status != http.StatusServiceUnavailable || errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected a plain fetch error for 503, got %v", err)
+	}
+}
+
+func TestGitHubSourceInvalidUser(t *testing.T) {
+	client := &recordingClient{status: http.StatusOK}
+	_, err := GitHubSource{Client: client}.Keys(context.Background(), "alice/../evil")
+	if !errors.Is(err, ErrInvalidUser) {
+		t.Errorf("expected ErrInvalidUser, got %v", err)
+	}
+	if len(client.urls) != 0 {
+		t.Errorf("no request should be made for an invalid username, got %v", client.urls)
+	}
+}
+
+func TestValidateGitHubUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		valid    bool
+	}{
+		{"simple", "alice", true},
+		{"with hyphen", "alice-smith", true},
+		{"digits", "user123", true},
+		{"single char", "a", true},
+		{"max length", strings.Repeat("a", 39), true},
+		{"too long", strings.Repeat("a", 40), false},
+		{"leading hyphen", "-alice", false},
+		{"trailing hyphen", "alice-", false},
+		{"path traversal", "alice/../evil", false},
+		{"space", "alice smith", false},
+		{"underscore", "alice_smith", false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateGitHubUsername(tt.username)
+			if tt.valid && err != nil {
+				t.Errorf("expected %q to be valid, got: %v", tt.username, err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidUser) {
+				t.Errorf("expected %q to be invalid, got %v", tt.username, err)
+			}
+		})
+	}
+}
+
+func TestGitHubSourceAPI(t *testing.T) {
+	client := &recordingClient{status: http.StatusOK, body: `[{"id": 101, "key": "ssh-ed25519 K1"}, {"id": 102, "key": "ssh-rsa K2", "created_at": "2023-11-02T09:30:00Z"}]`}
+	keys, err := GitHubSource{Client: client, Token: "secret"}.Keys(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 2 || keys[0].Blob != "K1" || keys[0].Comment != "gh-key-id=101" || keys[1].Comment != "gh-key-id=102 gh-created=2023-11-02" {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+	if client.urls[0] != "https://api.github.com/users/alice/keys" || client.headers[0].Get("Authorization") != "Bearer secret" {
+		t.Errorf("unexpected request to %s with %v", client.urls[0], client.headers[0])
+	}
+	if id, ok := keys[0].GitHubKeyID(); !ok || id != 101 {
+		t.Errorf("expected key ID 101, got %d, %v", id, ok)
+	}
+	if created, ok := keys[1].GitHubCreated(); !ok || created != time.Date(2023, 11, 2, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("expected the creation day, got %v, %v", created, ok)
+	}
+
+	client.status = http.StatusNotFound
+	if _, err := (GitHubSource{Client: client, Token: "secret"}).Keys(context.Background(), "alcie"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	client.status, client.body = http.StatusOK, "<html>"
+	var fetchErr *FetchError
+	if _, err := (GitHubSource{Client: client, Token: "secret"}).Keys(context.Background(), "alice"); !errors.As(err, &fetchErr) {
+		t.Errorf("expected a FetchError for an invalid response, got %v", err)
+	}
+}
+
+// redirectingClient answers every request from the URL its redirect
+// function maps the request's to, as http.Client does when it follows a
+// redirect.
+type redirectingClient struct {
+	body     string
+	redirect func(url string) string
+}
+
+func (c redirectingClient) Do(request *http.Request) (*http.Response, error) {
+	final, err := http.NewRequest(http.MethodGet, c.redirect(request.URL.String()), nil)
+	if err != nil {
+		return nil, err
+	}
+	response := respond(http.StatusOK, nil, c.body)
+	response.Request = final
+	return response, nil
+}
+
+func TestGitHubSourceRenamed(t *testing.T) {
+	client := redirectingClient{body: "ssh-ed25519 K1\n", redirect: func(string) string { return "https://github.com/alice-new.keys" }}
+	_, err := GitHubSource{Client: client}.Keys(context.Background(), "alice")
+	var renamed *RenamedUserError
+	if !errors.As(err, &renamed) || renamed.Login != "alice-new" {
+		t.Fatalf("expected a RenamedUserError, got %v", err)
+	}
+	if err.Error() != "GitHub user 'alice' was renamed to 'alice-new'; update your records" {
+		t.Errorf("unexpected message %q", err)
+	}
+
+	// A redirect to the same name in another case isn't a rename
+	client.redirect = func(string) string { return "https://github.com/Alice.keys" }
+	if keys, err := (GitHubSource{Client: client}).Keys(context.Background(), "alice"); err != nil || len(keys) != 1 {
+		t.Errorf("expected the keys, got %v, %v", keys, err)
+	}
+
+	// The API redirects to the account's ID, and then names it
+	client = redirectingClient{redirect: func(url string) string {
+		if strings.HasSuffix(url, "/keys") {
+			return "https://api.github.com/user/42/keys"
+		}
+		return url
+	}}
+	client.body = `{"login": "alice-new"}`
+	if _, err := (GitHubSource{Client: client, Token: "secret"}).Keys(context.Background(), "alice"); !errors.As(err, &renamed) || renamed.Login != "alice-new" {
+		t.Errorf("expected a RenamedUserError from the API, got %v", err)
+	}
+}
+
+func TestGitHubSourceLogin(t *testing.T) {
+	client := &recordingClient{status: http.StatusOK, body: `{"login": "Alice", "id": 42}`}
+	login, err := GitHubSource{Client: client, Token: "secret"}.Login(context.Background(), "alice")
+	if err != nil || login != "Alice" {
+		t.Fatalf("expected Alice, got %q, %v", login, err)
+	}
+	if client.urls[0] != "https://api.github.com/users/alice" || client.headers[0].Get("Authorization") != "Bearer secret" {
+		t.Errorf("unexpected request to %s with %v", client.urls[0], client.headers[0])
+	}
+
+	client.status = http.StatusNotFound
+	if _, err := (GitHubSource{Client: client}).Login(context.Background(), "alcie"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+	if client.headers[1].Get("Authorization") != "" {
+		t.Errorf("expected no token to be sent without one, got %v", client.headers[1])
+	}
+}
+
+func TestGitHubKeyIDsInStore(t *testing.T) {
+	// Keys installed before IDs were recorded are matched by blob
+	store := NewMemoryStore(
+		Entry{"ssh-ed25519 K1 alice doorman-added=2024-03-01"},
+		Entry{"ssh-rsa K2 gh-key-id=102 alice doorman-added=2024-03-01"},
+		Entry{"ssh-rsa K3 gh-key-id=103 alice doorman-added=2024-03-01"},
+	)
+	source := staticSource{keys: "ssh-ed25519 K1 gh-key-id=101\nssh-rsa K2 gh-key-id=102"}
+	m := NewManager(WithSource(source), WithStore(store))
+
+	diff, err := m.Diff(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(diff.Missing) != 0 || len(diff.Extra) != 1 || diff.Extra[0].Blob != "K3" {
+		t.Errorf("unexpected diff %+v", diff)
+	}
+	if label := diff.Extra[0].Label(); label != "alice" {
+		t.Errorf("expected the key ID left out of the label, got %q", label)
+	}
+
+	change, err := m.Reconcile(context.Background(), "alice", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(change.Removed) != 1 || change.Removed[0].Blob != "K3" {
+		t.Errorf("unexpected change %q", change)
+	}
+}
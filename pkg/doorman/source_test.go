@@ -0,0 +1,17 @@
+package doorman
+
+import "net/http"
+
+// recordingClient serves body with status and records the requested URLs.
+type recordingClient struct {
+	status  int
+	body    string
+	urls    []string
+	headers []http.Header
+}
+
+func (c *recordingClient) Do(request *http.Request) (*http.Response, error) {
+	c.urls = append(c.urls, request.URL.String())
+	c.headers = append(c.headers, request.Header)
+	return respond(c.status, nil, c.body), nil
+}
@@ -0,0 +1,47 @@
+package doorman
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	RegisterProvider("url", func(opts ProviderOptions) (KeySource, error) {
+		// BEHAVIOR: Keys decide who can log in, so never fetch them over a
+		// connection that could be tampered with
+		if !strings.HasPrefix(opts.Location, "https://") {
+			return nil, fmt.Errorf("invalid keys URL '%s': only https:// URLs are supported", opts.Location)
+		}
+		if !strings.Contains(opts.Location, userPlaceholder) {
+			return nil, fmt.Errorf("invalid keys URL '%s': it must contain %s", opts.Location, userPlaceholder)
+		}
+		return URLSource{Template: opts.Location, Client: opts.Client}, nil
+	})
+}
+
+// URLSource provides keys from any server publishing them in the same
+// format as GitHub, such as an internal mirror. Template is a URL in which
+// {user} is replaced by the path-escaped username.
+type URLSource struct {
+	Template string
+	// Client makes the requests; http.DefaultClient when nil
+	Client HTTPClient
+}
+
+func (s URLSource) Keys(ctx context.Context, user string) ([]PublicKey, error) {
+	if err := validateUser(user); err != nil {
+		return nil, err
+	}
+
+	keysURL := strings.ReplaceAll(s.Template, userPlaceholder, url.PathEscape(user))
+	data, err := FetchKeys(ctx, clientOrDefault(s.Client), keysURL)
+	if isNotFound(err) {
+		return nil, errorOfKind(ErrUserNotFound, "user '%s' not found at %s", user, keysURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKeys(data), nil
+}
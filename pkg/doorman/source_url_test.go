@@ -0,0 +1,37 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestURLSource(t *testing.T) {
+	client := &recordingClient{status: http.StatusOK, body: "ssh-ed25519 K1"}
+	source := URLSource{Template: "https://keys.example.com/users/{user}/keys", Client: client}
+
+	keys, err := source.Keys(context.Background(), "alice.smith")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("unexpected result %+v (%v)", keys, err)
+	}
+	if client.urls[0] != "https://keys.example.com/users/alice.smith/keys" {
+		t.Errorf("unexpected URL %q", client.urls[0])
+	}
+
+	client.status = http.StatusNotFound
+	_, err = source.Keys(context.Background(), "bob")
+	if !errors.Is(err, ErrUserNotFound) || !strings.Contains(err.Error(), "https://keys.example.com/users/bob/keys") {
+		t.Errorf("expected ErrUserNotFound naming the URL, got %v", err)
+	}
+
+	for _, user := range []string{"../admin", "a/b", "alice?x=1", ""} {
+		if _, err := source.Keys(context.Background(), user); !errors.Is(err, ErrInvalidUser) {
+			t.Errorf("%q: expected ErrInvalidUser, got %v", user, err)
+		}
+	}
+	if len(client.urls) != 2 {
+		t.Errorf("invalid usernames should not be requested, got %v", client.urls)
+	}
+}
@@ -0,0 +1,334 @@
+package doorman
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one line of an authorized_keys file. Lines that are not keys,
+// such as comments and blank lines, are entries too, so saving what was
+// loaded never loses them.
+type Entry struct {
+	Line string
+}
+
+// Key parses the entry, reporting false if it is not a key line.
+func (e Entry) Key() (Key, bool) {
+	return ParseKey(e.Line)
+}
+
+// ParseEntries splits authorized_keys content into entries. The line ending
+// of the last line does not start another entry, and CRLF endings are
+// dropped.
+func ParseEntries(data []byte) []Entry {
+	if len(data) == 0 {
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	entries := make([]Entry, len(lines))
+	for i, line := range lines {
+		// BEHAVIOR: Rewrite CRLF files with plain LF endings, which both
+		// OpenSSH and Win32-OpenSSH accept, so "\r" never hides a match
+		entries[i] = Entry{Line: strings.TrimSuffix(line, "\r")}
+	}
+	return entries
+}
+
+// DefaultMaxLineLength bounds the lines ReadEntries accepts. Key lines are
+// rarely more than a few kilobytes, but a large RSA key with a long from=
+// list can take them past bufio.Scanner's default limit of 64 KiB.
+const DefaultMaxLineLength = 1 << 20
+
+// ReadEntries reads authorized_keys content from r a line at a time, with
+// the same result as ParseEntries on the whole content, so large files are
+// never held in memory twice. A line longer than DefaultMaxLineLength is an
+// error.
+func ReadEntries(r io.Reader) ([]Entry, error) {
+	return ReadEntriesLimit(r, DefaultMaxLineLength)
+}
+
+// ReadEntriesLimit is ReadEntries with lines of up to limit bytes, or
+// DefaultMaxLineLength if limit isn't positive. The error for a longer line
+// gives its number.
+func ReadEntriesLimit(r io.Reader, limit int) ([]Entry, error) {
+	if limit <= 0 {
+		limit = DefaultMaxLineLength
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, min(64*1024, limit)), limit)
+	var entries []Entry
+	for scanner.Scan() {
+		// bufio.ScanLines drops a CR before the LF, as ParseEntries does
+		entries = append(entries, Entry{Line: scanner.Text()})
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return nil, fmt.Errorf("line %d is longer than %d bytes", len(entries)+1, limit)
+	}
+	return entries, scanner.Err()
+}
+
+// FormatEntries is the inverse of ParseEntries. Every line, including the
+// last, ends with LF.
+func FormatEntries(entries []Entry) []byte {
+	size := 0
+	for _, entry := range entries {
+		size += len(entry.Line) + 1
+	}
+	var b bytes.Buffer
+	b.Grow(size)
+	WriteEntries(&b, entries)
+	return b.Bytes()
+}
+
+// WriteEntries writes entries to w as FormatEntries formats them, a line at
+// a time.
+func WriteEntries(w io.Writer, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		bw.WriteString(entry.Line)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// KeyStore holds the entries of an authorized_keys file.
+type KeyStore interface {
+	// Load returns the stored entries, or an error matching fs.ErrNotExist
+	// when nothing has been stored yet.
+	Load() ([]Entry, error)
+	// Save replaces the stored entries.
+	Save(entries []Entry) error
+	// Path names the store in messages; for files, the file's path.
+	Path() string
+}
+
+// Locker is implemented by KeyStores that can be locked against concurrent
+// writers. AddKeys and RemoveKeys hold the lock from Load until Save.
+type Locker interface {
+	Lock() (unlock func() error, err error)
+}
+
+// Orderer is implemented by KeyStores that keep their entries in an order
+// of their own. Whenever entries are about to be saved, they are put in
+// that order first, so the Change describes exactly what is written. An
+// error from Order stops the write.
+type Orderer interface {
+	Order(entries []Entry) ([]Entry, error)
+}
+
+// ordered returns entries in store's order, if it has one.
+func ordered(store KeyStore, entries []Entry) ([]Entry, error) {
+	if orderer, ok := store.(Orderer); ok {
+		return orderer.Order(entries)
+	}
+	return entries, nil
+}
+
+// withLock runs fn with store locked, if it supports locking.
+func withLock(store KeyStore, fn func() error) (err error) {
+	locker, ok := store.(Locker)
+	if !ok {
+		return fn()
+	}
+
+	unlock, err := locker.Lock()
+	if err != nil {
+		return fmt.Errorf("locking %s: %w", store.Path(), err)
+	}
+	defer func() {
+		if unlockErr := unlock(); err == nil {
+			err = unlockErr
+		}
+	}()
+	return fn()
+}
+
+// FileStore is a KeyStore backed by an authorized_keys file.
+//
+// Saves are atomic: entries are written to a temporary file in the same
+// directory, which then replaces the original, so sshd never sees a partial
+// file. An existing file keeps its mode and owner; new files are only
+// accessible by their owner, as sshd's StrictModes requires. Since whoever
+// controls the directory could otherwise redirect an administrator's
+// write, a symlink is never followed, and nothing is written unless the
+// directory is a real one, owned by root, the writer or DirOwner, that
+// only its owner can write to. Lock holds an exclusive lock on a ".lock" file next
+// to the file, which other doorman processes respect.
+type FileStore struct {
+	path string
+
+	// LockWait bounds how long Lock waits for another process to release
+	// the lock before failing with ErrLocked. Zero waits as long as it
+	// takes.
+	LockWait time.Duration
+	// SkipChown leaves a rewritten file owned by the writer, for files
+	// prepared for another system whose owners mean nothing here. The
+	// directory's owner then isn't checked either.
+	SkipChown bool
+	// DirOwner is the uid, as user.User's Uid gives it, of the user whose
+	// file this is, who may own its directory besides root and the writer
+	DirOwner string
+	// MaxLineLength bounds the lines Load accepts, in bytes;
+	// DefaultMaxLineLength when zero
+	MaxLineLength int
+}
+
+// NewFileStore returns a store for the authorized_keys file at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) Path() string {
+	return s.path
+}
+
+func (s *FileStore) Load() ([]Entry, error) {
+	f, err := openNoFollow(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := ReadEntriesLimit(f, s.MaxLineLength)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", s.path, err)
+	}
+	return entries, nil
+}
+
+func (s *FileStore) Save(entries []Entry) error {
+	if err := s.checkDir(); err != nil {
+		return err
+	}
+	target := s.path
+	mode := fs.FileMode(0600)
+	info, err := os.Lstat(target)
+	switch {
+	case err == nil && info.Mode()&fs.ModeSymlink != 0:
+		return errorOfKind(ErrUnsafePath, "%s is a symlink; refusing to write through it", target)
+	case err == nil && !info.Mode().IsRegular():
+		return errorOfKind(ErrUnsafePath, "%s is not a regular file", target)
+	case err == nil:
+		mode = info.Mode().Perm()
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	// BEHAVIOR: The temporary file goes in the directory just checked,
+	// never somewhere shared like /tmp
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := WriteEntries(tmp, entries); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// The umask may have stripped bits from the requested mode
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if info != nil && !s.SkipChown {
+		if err := copyAccess(tmp.Name(), target, info); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+func (s *FileStore) Lock() (func() error, error) {
+	if err := s.checkDir(); err != nil {
+		return nil, err
+	}
+	return lockFile(s.path+".lock", s.LockWait)
+}
+
+// checkDir makes sure the file's directory is safe to write to: a real
+// directory, not a symlink, that nobody but its owner, who must be root,
+// the writer or DirOwner, can change.
+func (s *FileStore) checkDir() error {
+	dir := filepath.Dir(s.path)
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return errorOfKind(ErrUnsafePath, "%s is a symlink; refusing to write through it", dir)
+	}
+	if !info.IsDir() {
+		return errorOfKind(ErrUnsafePath, "%s is not a directory", dir)
+	}
+	return checkDirAccess(dir, info, s.DirOwner, !s.SkipChown)
+}
+
+// lockPollInterval is how often a lock is retried while waiting for it
+const lockPollInterval = 50 * time.Millisecond
+
+// retryLock calls tryLock until it takes the lock at path, giving up with
+// ErrLocked once wait has passed.
+func retryLock(path string, wait time.Duration, tryLock func() (bool, error)) error {
+	deadline := time.Now().Add(wait)
+	for {
+		locked, err := tryLock()
+		if err != nil || locked {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errorOfKind(ErrLocked, "%s is locked by another process; gave up after %s", path, wait)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// MemoryStore is a KeyStore kept in memory, for tests and previews. The
+// zero value holds no file: Load fails with fs.ErrNotExist until the first
+// Save.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries []Entry
+	exists  bool
+}
+
+// NewMemoryStore returns a store holding entries.
+func NewMemoryStore(entries ...Entry) *MemoryStore {
+	return &MemoryStore{entries: entries, exists: true}
+}
+
+func (s *MemoryStore) Path() string {
+	return "(memory)"
+}
+
+func (s *MemoryStore) Load() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.exists {
+		return nil, &fs.PathError{Op: "open", Path: s.Path(), Err: fs.ErrNotExist}
+	}
+	return append([]Entry(nil), s.entries...), nil
+}
+
+func (s *MemoryStore) Save(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append([]Entry(nil), entries...)
+	s.exists = true
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !unix && !windows
+
+package doorman
+
+import (
+	"io/fs"
+	"time"
+)
+
+// lockFile is a no-op where file locking is unavailable.
+func lockFile(path string, wait time.Duration) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func copyAccess(path, src string, info fs.FileInfo) error {
+	return nil
+}
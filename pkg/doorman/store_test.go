@@ -0,0 +1,370 @@
+package doorman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEntries(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		lines    []string
+		expected string
+	}{
+		{"empty", "", nil, ""},
+		{"trailing newline", "a\nb\n", []string{"a", "b"}, "a\nb\n"},
+		{"no trailing newline", "a\nb", []string{"a", "b"}, "a\nb\n"},
+		{"blank lines kept", "a\n\n# comment\n", []string{"a", "", "# comment"}, "a\n\n# comment\n"},
+		{"crlf", "a\r\nb\r\n", []string{"a", "b"}, "a\nb\n"},
+		{"only newline", "\n", []string{""}, "\n"},
+		{"crlf without trailing newline", "a\r\nb\r", []string{"a", "b"}, "a\nb\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := ParseEntries([]byte(tt.data))
+			var lines []string
+			for _, entry := range entries {
+				lines = append(lines, entry.Line)
+			}
+			if !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("expected %q, got %q", tt.lines, lines)
+			}
+			if got := string(FormatEntries(entries)); got != tt.expected {
+				t.Errorf("expected formatted %q, got %q", tt.expected, got)
+			}
+
+			// Streaming must read exactly what parsing the whole file does
+			read, err := ReadEntries(strings.NewReader(tt.data))
+			if err != nil || !reflect.DeepEqual(read, entries) {
+				t.Errorf("expected ReadEntries to match ParseEntries %q, got %q %v", entries, read, err)
+			}
+			var b strings.Builder
+			if err := WriteEntries(&b, entries); err != nil || b.String() != tt.expected {
+				t.Errorf("expected written %q, got %q %v", tt.expected, b.String(), err)
+			}
+		})
+	}
+}
+
+func TestReadEntriesLongLines(t *testing.T) {
+	// Longer than bufio.Scanner allows by default
+	long := "ssh-rsa " + strings.Repeat("A", 100*1024) + " alice"
+	entries, err := ReadEntries(strings.NewReader(long + "\n"))
+	if err != nil || len(entries) != 1 || entries[0].Line != long {
+		t.Errorf("expected the long line to be read, got %d entries, %v", len(entries), err)
+	}
+
+	tooLong := strings.Repeat("A", DefaultMaxLineLength+1)
+	_, err = ReadEntries(strings.NewReader("a\n" + tooLong + "\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2 is longer than") {
+		t.Errorf("expected an error for the line over the limit, got %v", err)
+	}
+
+	_, err = ReadEntriesLimit(strings.NewReader("a\nb\n"+long+"\n"), 1024)
+	if err == nil || err.Error() != "line 3 is longer than 1024 bytes" {
+		t.Errorf("expected the line over a set limit reported, got %v", err)
+	}
+	if entries, err := ReadEntriesLimit(strings.NewReader(long+"\n"), 2*len(long)); err != nil || len(entries) != 1 {
+		t.Errorf("expected the line within a set limit read, got %d entries, %v", len(entries), err)
+	}
+}
+
+// longKeyLine returns a key line the size of a 16384-bit RSA key's, with a
+// from= list of n addresses, for a line far past bufio.Scanner's default
+// limit.
+func longKeyLine(n int, label string) string {
+	addresses := make([]string, n)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255)
+	}
+	return `from="` + strings.Join(addresses, ",") + `",no-pty ssh-rsa AAAAB3NzaC1yc2E` + strings.Repeat("A", 16*1024*4/3) + " " + label
+}
+
+func TestFileStoreLongLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	long := longKeyLine(20000, "bob")
+	original := "# managed by hand\n" + long + "\nssh-ed25519 K0 carol\n"
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := NewFileStore(path)
+	m := NewManager(WithSource(staticSource{keys: "ssh-ed25519 K1"}), WithStore(store), WithPrompter(yes(2)))
+
+	if _, err := m.Add(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != original+"ssh-ed25519 K1 alice"+today+"\n" {
+		t.Fatalf("expected the long line kept byte for byte, got %d bytes", len(data))
+	}
+	if _, err := m.Remove(context.Background(), "alice"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != original {
+		t.Errorf("expected the file back as it was, got %d bytes", len(data))
+	}
+
+	store.MaxLineLength = 64 * 1024
+	if _, err := store.Load(); err == nil || !strings.Contains(err.Error(), "line 2 is longer than 65536 bytes") {
+		t.Errorf("expected the long line over a lower limit reported, got %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(filepath.Join(dir, "authorized_keys"))
+
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a not-exist error for a missing file, got %v", err)
+	}
+
+	entries := []Entry{{"ssh-rsa K1 alice"}, {"ssh-rsa K2 bob"}}
+	if err := store.Save(entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loaded, err := store.Load()
+	if err != nil || !reflect.DeepEqual(loaded, entries) {
+		t.Errorf("expected %v, got %v (%v)", entries, loaded, err)
+	}
+
+	if runtime.GOOS != "windows" {
+		info, _ := os.Stat(store.Path())
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("expected a new file to get mode 0600, got %v", info.Mode().Perm())
+		}
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("expected no temporary files to remain, got %v", files)
+	}
+}
+
+func TestFileStoreKeepsMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("modes behave differently on Windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	os.WriteFile(path, []byte("ssh-rsa K1 alice\n"), 0640)
+	os.Chmod(path, 0640)
+
+	if err := NewFileStore(path).Save([]Entry{{"ssh-rsa K2 bob"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("expected mode 0640 to be kept, got %v", info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(path); string(data) != "ssh-rsa K2 bob\n" {
+		t.Errorf("expected the file to be rewritten, got %q", data)
+	}
+}
+
+func TestFileStoreRefusesUnsafePaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("modes and symlinks behave differently on Windows")
+	}
+
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, dir string) string
+		expected string
+	}{
+		{"symlinked file", func(t *testing.T, dir string) string {
+			os.WriteFile(filepath.Join(dir, "elsewhere"), []byte("ssh-rsa K1 alice\n"), 0600)
+			link := filepath.Join(dir, "authorized_keys")
+			if err := os.Symlink(filepath.Join(dir, "elsewhere"), link); err != nil {
+				t.Fatal(err)
+			}
+			return link
+		}, "authorized_keys is a symlink"},
+		{"symlinked directory", func(t *testing.T, dir string) string {
+			os.Mkdir(filepath.Join(dir, "elsewhere"), 0700)
+			if err := os.Symlink(filepath.Join(dir, "elsewhere"), filepath.Join(dir, ".ssh")); err != nil {
+				t.Fatal(err)
+			}
+			return filepath.Join(dir, ".ssh", "authorized_keys")
+		}, ".ssh is a symlink"},
+		{"world-writable directory", func(t *testing.T, dir string) string {
+			os.Mkdir(filepath.Join(dir, ".ssh"), 0700)
+			os.Chmod(filepath.Join(dir, ".ssh"), 0777)
+			return filepath.Join(dir, ".ssh", "authorized_keys")
+		}, "is writable by group or others (mode 0777)"},
+		{"directory as file", func(t *testing.T, dir string) string {
+			os.Mkdir(filepath.Join(dir, "authorized_keys"), 0700)
+			return filepath.Join(dir, "authorized_keys")
+		}, "is not a regular file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := NewFileStore(tt.setup(t, dir))
+			err := store.Save([]Entry{{"ssh-rsa K2 bob"}})
+			if !errors.Is(err, ErrUnsafePath) || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected an unsafe path error containing %q, got %v", tt.expected, err)
+			}
+			if data, _ := os.ReadFile(filepath.Join(dir, "elsewhere")); strings.Contains(string(data), "K2") {
+				t.Errorf("expected the symlink's target to be left alone, got %q", data)
+			}
+		})
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "elsewhere"), []byte("ssh-rsa K1 alice\n"), 0600)
+	os.Symlink(filepath.Join(dir, "elsewhere"), filepath.Join(dir, "authorized_keys"))
+	if _, err := NewFileStore(filepath.Join(dir, "authorized_keys")).Load(); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("expected Load to refuse the symlink, got %v", err)
+	}
+}
+
+func TestFileStoreSaveError(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "missing", "authorized_keys"))
+	var pathErr *fs.PathError
+	if err := store.Save([]Entry{{"ssh-rsa K1 alice"}}); !errors.As(err, &pathErr) {
+		t.Errorf("expected a path error for a missing directory, got %v", err)
+	}
+}
+
+func TestFileStoreLock(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		t.Skip("file locking is not implemented here")
+	}
+
+	store := NewFileStore(filepath.Join(t.TempDir(), "authorized_keys"))
+	unlock, err := store.Lock()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		unlockSecond, err := store.Lock()
+		if err == nil {
+			unlockSecond()
+		}
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second lock acquired while the first was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := unlock(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second lock not acquired after unlocking")
+	}
+}
+
+func TestFileStoreLockWait(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		t.Skip("file locking is not implemented here")
+	}
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	unlock, err := NewFileStore(path).Lock()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer unlock()
+
+	store := NewFileStore(path)
+	store.LockWait = 100 * time.Millisecond
+	start := time.Now()
+	if _, err := store.Lock(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < store.LockWait || elapsed > 5*time.Second {
+		t.Errorf("expected to wait about %s, waited %s", store.LockWait, elapsed)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	var store MemoryStore
+	if _, err := store.Load(); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a not-exist error before the first save, got %v", err)
+	}
+
+	entries := []Entry{{"ssh-rsa K1 alice"}}
+	store.Save(entries)
+	entries[0].Line = "changed"
+
+	loaded, err := store.Load()
+	if err != nil || len(loaded) != 1 || loaded[0].Line != "ssh-rsa K1 alice" {
+		t.Errorf("expected the saved entries to be copied, got %v (%v)", loaded, err)
+	}
+}
+
+// largeAuthorizedKeys writes an authorized_keys file of n lines, like those
+// of shared gateway accounts with a key per customer, returning its path.
+func largeAuthorizedKeys(b *testing.B, n int) string {
+	b.Helper()
+	var data []byte
+	for i := 0; i < n; i++ {
+		data = fmt.Appendf(data, "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI%043d customer-%d\n", i, i)
+	}
+	path := filepath.Join(b.TempDir(), "authorized_keys")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+func BenchmarkFileStoreLoad(b *testing.B) {
+	store := NewFileStore(largeAuthorizedKeys(b, 100000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Load(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFileStoreSave(b *testing.B) {
+	store := NewFileStore(largeAuthorizedKeys(b, 100000))
+	entries, err := store.Load()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.Save(entries); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkManagerRemoveLargeFile(b *testing.B) {
+	path := largeAuthorizedKeys(b, 100000)
+	manager := NewManager(WithStore(NewFileStore(path)), WithSource(staticSource{keys: "ssh-ed25519 " + ed25519Blob}))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Nobody is labeled alice, so the file is read and left alone
+		if _, err := manager.Remove(context.Background(), "alice"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
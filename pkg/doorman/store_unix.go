@@ -0,0 +1,84 @@
+//go:build unix
+
+package doorman
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// lockFile takes an exclusive flock on the file at path, creating it if
+// needed. It waits for the lock for up to wait, or as long as it takes if
+// wait is zero.
+func lockFile(path string, wait time.Duration) (func() error, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, errorOfKind(ErrUnsafePath, "%s is a symlink; refusing to follow it", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if wait > 0 {
+		how |= syscall.LOCK_NB
+	}
+	err = retryLock(path, wait, func() (bool, error) {
+		err := syscall.Flock(int(file.Fd()), how)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		if err != nil {
+			return false, &fs.PathError{Op: "flock", Path: path, Err: err}
+		}
+		return true, nil
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() error {
+		defer file.Close()
+		return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	}, nil
+}
+
+// copyAccess gives the file at path the owner and group of src, recorded in
+// info. Without it, a file rewritten by root would end up owned by root, and
+// sshd would refuse to use it for anyone else.
+func copyAccess(path, src string, info fs.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || (int(stat.Uid) == os.Geteuid() && int(stat.Gid) == os.Getegid()) {
+		return nil
+	}
+	return os.Chown(path, int(stat.Uid), int(stat.Gid))
+}
+
+// openNoFollow opens the file at path for reading, refusing a symlink.
+func openNoFollow(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, errorOfKind(ErrUnsafePath, "%s is a symlink; refusing to follow it", path)
+	}
+	return f, err
+}
+
+// checkDirAccess refuses a directory others than its owner can write to,
+// and, if checkOwner, one owned by anyone but root, the writer and owner.
+func checkDirAccess(dir string, info fs.FileInfo, owner string, checkOwner bool) error {
+	if info.Mode().Perm()&0022 != 0 {
+		return errorOfKind(ErrUnsafePath, "%s is writable by group or others (mode %04o); refusing to write to it", dir, info.Mode().Perm())
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !checkOwner || !ok {
+		return nil
+	}
+	uid := int(stat.Uid)
+	if uid == 0 || uid == os.Geteuid() || strconv.Itoa(uid) == owner {
+		return nil
+	}
+	return errorOfKind(ErrUnsafePath, "%s is owned by uid %d, not the user whose keys it holds; refusing to write to it", dir, uid)
+}
@@ -0,0 +1,100 @@
+package doorman
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile takes an exclusive lock on the file at path, creating it if
+// needed. It waits for the lock for up to wait, or as long as it takes if
+// wait is zero.
+func lockFile(path string, wait time.Duration) (func() error, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	handle := windows.Handle(file.Fd())
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK)
+	if wait > 0 {
+		flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+	}
+	err = retryLock(path, wait, func() (bool, error) {
+		err := windows.LockFileEx(handle, flags, 0, 1, 0, &windows.Overlapped{})
+		if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+			return false, nil
+		}
+		if err != nil {
+			return false, &fs.PathError{Op: "LockFileEx", Path: path, Err: err}
+		}
+		return true, nil
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() error {
+		defer file.Close()
+		return windows.UnlockFileEx(handle, 0, 1, 0, &windows.Overlapped{})
+	}, nil
+}
+
+// copyAccess gives the file at path the owner and DACL of src. The
+// replacement file would otherwise inherit the directory's ACL, which for
+// administrators_authorized_keys grants more access than sshd accepts.
+func copyAccess(path, src string, info fs.FileInfo) error {
+	sd, err := windows.GetNamedSecurityInfo(src, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return &fs.PathError{Op: "GetNamedSecurityInfo", Path: src, Err: err}
+	}
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	control, _, err := sd.Control()
+	if err != nil {
+		return err
+	}
+
+	secInfo := windows.SECURITY_INFORMATION(windows.DACL_SECURITY_INFORMATION)
+	if control&windows.SE_DACL_PROTECTED != 0 {
+		secInfo |= windows.PROTECTED_DACL_SECURITY_INFORMATION
+	} else {
+		secInfo |= windows.UNPROTECTED_DACL_SECURITY_INFORMATION
+	}
+
+	// Taking over the owner needs privileges not every caller has, while the
+	// DACL is what sshd checks
+	if err := windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, secInfo|windows.OWNER_SECURITY_INFORMATION, owner, nil, dacl, nil); err == nil {
+		return nil
+	}
+	if err := windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, secInfo, nil, nil, dacl, nil); err != nil {
+		return &fs.PathError{Op: "SetNamedSecurityInfo", Path: path, Err: err}
+	}
+	return nil
+}
+
+// openNoFollow opens the file at path for reading, refusing a symlink.
+func openNoFollow(path string) (*os.File, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return nil, errorOfKind(ErrUnsafePath, "%s is a symlink; refusing to follow it", path)
+	}
+	return os.Open(path)
+}
+
+// checkDirAccess leaves access to the directory's ACL on Windows, where
+// modes and uids mean nothing.
+func checkDirAccess(dir string, info fs.FileInfo, owner string, checkOwner bool) error {
+	return nil
+}
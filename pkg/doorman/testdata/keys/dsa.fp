@@ -0,0 +1 @@
+1024 SHA256:nrdLvMU7HU00kFKnHASCQtLvcwciIl0ZJwqCWSG3rJc dave (DSA)
@@ -0,0 +1 @@
+256 SHA256:4oZtYdU79gikeUGGyjqGaIoY8Y5IjQ91TzTnLBjunFk bob (ECDSA)
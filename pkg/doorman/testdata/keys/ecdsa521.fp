@@ -0,0 +1 @@
+521 SHA256:fE7FLCi9SvlAKD+Mze24cjSGnwaurV9oxCm3E17xN8s no comment (ECDSA)
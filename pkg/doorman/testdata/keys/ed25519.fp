@@ -0,0 +1 @@
+256 SHA256:69fwI+iFYofym8YxBra63SLax4KaKVmV2Rrlyfyy3Is carol work (ED25519)
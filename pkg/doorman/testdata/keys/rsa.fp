@@ -0,0 +1 @@
+3072 SHA256:JhdtUldJMnWqU5EjZZTrVmh383XlIbdrBZnsq7iogvY alice@laptop (RSA)
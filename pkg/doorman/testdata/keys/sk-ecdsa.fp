@@ -0,0 +1 @@
+256 SHA256:MOR35JXbcB//EZC42yxGaZfMiQkon0xko82eue9CWrU frank (ECDSA-SK)
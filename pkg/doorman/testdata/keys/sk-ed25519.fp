@@ -0,0 +1 @@
+256 SHA256:0EY/OPKr2EsSMLsj6UMubceodfXkyIDiqo3BehBr5WE erin (ED25519-SK)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+func (d *deps) onWindows() bool {
+	return d.goos == "windows"
+}
+
+// programDataDir returns the directory OpenSSH for Windows keeps its
+// system-wide configuration under.
+func programDataDir() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+	return `C:\ProgramData`
+}
+
+func defaultSSHDConfigPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(programDataDir(), "ssh", "sshd_config")
+	}
+	return "/etc/ssh/sshd_config"
+}
+
+// administratorsAuthorizedKeysPath is the file the stock OpenSSH for Windows
+// sshd_config uses for members of the Administrators group, ignoring the
+// per-user authorized_keys entirely.
+func administratorsAuthorizedKeysPath() string {
+	return filepath.Join(programDataDir(), "ssh", "administrators_authorized_keys")
+}
+
+// sshUsername returns the name sshd substitutes for %u. On Windows,
+// user.Current reports DOMAIN\user while sshd uses the bare user name.
+func (d *deps) sshUsername(username string) string {
+	if d.onWindows() {
+		if i := strings.LastIndex(username, `\`); i >= 0 {
+			return username[i+1:]
+		}
+	}
+	return username
+}
+
+// warnUnenforcedPermissions reminds Windows users that the 0700/0600 modes
+// doorman applies elsewhere have no effect there; access is governed by ACLs.
+func (d *deps) warnUnenforcedPermissions(path string) {
+	if !d.onWindows() {
+		return
+	}
+	fmt.Fprintf(d.stderr, "Warning: file permissions are not applied on Windows; make sure only your account, SYSTEM and Administrators can access %s\n", path)
+}
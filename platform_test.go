@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func (e *testEnv) mockPlatform(goos string, admin bool) {
+	e.goos = goos
+	e.isAdministrator = func() (bool, error) { return admin, nil }
+}
+
+func TestGetAuthorizedKeysPathWindowsAdministrator(t *testing.T) {
+	e := newTestEnv(t)
+	e.mockPlatform("windows", true)
+	t.Setenv("ProgramData", `C:\ProgramData`)
+
+	path, err := e.getAuthorizedKeysPath()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := filepath.Join(`C:\ProgramData`, "ssh", "administrators_authorized_keys"); path != expected {
+		t.Errorf("expected %q, got %q", expected, path)
+	}
+}
+
+func TestGetAuthorizedKeysPathWindowsUser(t *testing.T) {
+	e := newTestEnv(t)
+	e.mockPlatform("windows", false)
+
+	path, err := e.getAuthorizedKeysPath()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := filepath.Join(e.home, ".ssh", "authorized_keys"); path != expected {
+		t.Errorf("expected %q, got %q", expected, path)
+	}
+}
+
+func TestGetAuthorizedKeysPathWindowsAdminCheckError(t *testing.T) {
+	e := newTestEnv(t)
+	e.mockPlatform("windows", false)
+	e.isAdministrator = func() (bool, error) { return false, errors.New("token error") }
+
+	path, err := e.getAuthorizedKeysPath()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := filepath.Join(e.home, ".ssh", "authorized_keys"); path != expected {
+		t.Errorf("expected fallback %q, got %q", expected, path)
+	}
+}
+
+func TestGetAuthorizedKeysPathAdministratorIgnoredElsewhere(t *testing.T) {
+	e := newTestEnv(t)
+	e.mockPlatform("linux", true)
+
+	path, _ := e.getAuthorizedKeysPath()
+	if expected := filepath.Join(e.home, ".ssh", "authorized_keys"); path != expected {
+		t.Errorf("expected %q, got %q", expected, path)
+	}
+}
+
+func TestSSHUsername(t *testing.T) {
+	tests := []struct {
+		goos     string
+		username string
+		expected string
+	}{
+		{"windows", `CORP\alice`, "alice"},
+		{"windows", "alice", "alice"},
+		{"linux", `odd\name`, `odd\name`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.goos+"/"+tt.username, func(t *testing.T) {
+			d := &deps{goos: tt.goos}
+			if got := d.sshUsername(tt.username); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestExpandAuthorizedKeysFileProgramData(t *testing.T) {
+	d := &deps{goos: "windows"}
+	t.Setenv("ProgramData", "/programdata")
+
+	path, err := d.expandAuthorizedKeysFile("__PROGRAMDATA__/ssh/administrators_authorized_keys", "alice", "/home/alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if path != "/programdata/ssh/administrators_authorized_keys" {
+		t.Errorf("unexpected path %q", path)
+	}
+}
+
+func TestWarnUnenforcedPermissions(t *testing.T) {
+	e := newTestEnv(t)
+
+	e.mockPlatform("linux", false)
+	errOut := e.errOut
+	e.warnUnenforcedPermissions("/home/alice/.ssh/authorized_keys")
+	if errOut.Len() != 0 {
+		t.Errorf("expected no warning outside Windows, got %q", errOut.String())
+	}
+
+	e.mockPlatform("windows", false)
+	e.warnUnenforcedPermissions(`C:\Users\alice\.ssh\authorized_keys`)
+	if !strings.Contains(errOut.String(), "not applied on Windows") {
+		t.Errorf("expected permissions warning on Windows, got %q", errOut.String())
+	}
+}
+
+func TestRunAddWindowsWarnsAndWritesLF(t *testing.T) {
+	e := newTestEnv(t)
+	e.mockPlatform("windows", false)
+
+	errOut := e.errOut
+	e.mockStdin("yes\n")
+	e.mockKeys("ssh-rsa KEY1...\r\nssh-ed25519 KEY2...\r\n")
+
+	if err := run(e.deps, []string{"doorman", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(errOut.String(), "not applied on Windows") {
+		t.Error("expected permissions warning")
+	}
+
+	content := readFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"))
+	if strings.Contains(content, "\r") {
+		t.Errorf("expected LF-only file, got %q", content)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(content)
+}
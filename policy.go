@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// policyRule returns the rule deny_types and min_rsa_bits set, and false if
+// neither is set.
+func (a *app) policyRule() (keyRule, bool, error) {
+	denied, minRSABits := a.cfg.DenyTypes, a.cfg.MinRSABits
+	if minRSABits < 0 {
+		return keyRule{}, false, fmt.Errorf("invalid min_rsa_bits %d", minRSABits)
+	}
+	if len(denied) == 0 && minRSABits == 0 {
+		return keyRule{}, false, nil
+	}
+	violation := func(username string, key doorman.PublicKey) string {
+		if slices.Contains(denied, key.Type) {
+			return key.Type + " keys are denied by deny_types"
+		}
+		if key.Type == "ssh-rsa" && key.Bits() < minRSABits {
+			return fmt.Sprintf("%d-bit RSA, below min_rsa_bits (%d)", key.Bits(), minRSABits)
+		}
+		return ""
+	}
+	return keyRule{violation: violation, warnOnly: a.opts.policyWarnOnly}, true, nil
+}
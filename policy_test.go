@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newRSATestKey returns a freshly generated RSA public key of bits bits.
+func newRSATestKey(t *testing.T, bits int) string {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestRunKeyPolicy(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "min_rsa_bits = 3072\n")
+	weak := newRSATestKey(t, 2048)
+	e.source = userSource{"alice": testKey + "\n" + weak, "bob": weak}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--config", config, "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("expected the weak key to be refused, got %q", content)
+	}
+	if !strings.Contains(e.errOut.String(), "Refusing 1 of alice's 2 keys:\n  2048 SHA256:") || !strings.Contains(e.errOut.String(), "(RSA): 2048-bit RSA, below min_rsa_bits (3072)") {
+		t.Errorf("expected the refused key to be reported, got %q", e.errOut.String())
+	}
+
+	err := run(e.deps, []string{"doorman", "--yes", "--config", config, "add", "bob"})
+	if exitCodeFor(err) != exitNoKeys || !strings.Contains(err.Error(), "none of bob's keys may be installed") {
+		t.Errorf("expected bob's only key to be refused, got %v", err)
+	}
+
+	writeFile(t, config, "deny_types = [\"ssh-ed25519\"]\n")
+	e.errOut.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "--config", config, "--policy-warn-only", "sync", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n"+weak+" alice"+today+"\n" {
+		t.Errorf("expected --policy-warn-only to install every key, got %q", content)
+	}
+	if !strings.Contains(e.errOut.String(), "Warning: keeping alice's keys that break the key policy") || !strings.Contains(e.errOut.String(), "ssh-ed25519 keys are denied by deny_types") {
+		t.Errorf("expected a warning about the denied key, got %q", e.errOut.String())
+	}
+}
+
+func TestRunCheckPolicy(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	weak := newRSATestKey(t, 2048)
+	writeFile(t, path, testKey+" alice\n"+weak+" bob\n")
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "min_rsa_bits = 3072\n")
+
+	err := run(e.deps, []string{"doorman", "--config", config, "--policy-warn-only", "check"})
+	if exitCodeFor(err) != exitProblems || err.Error() != "found 1 problem in "+path {
+		t.Errorf("expected one problem, got %v", err)
+	}
+	if !strings.HasPrefix(e.out.String(), "bob: 2048 SHA256:") || !strings.Contains(e.out.String(), "below min_rsa_bits (3072)") {
+		t.Errorf("expected bob's weak key to be flagged, got %q", e.out.String())
+	}
+
+	writeFile(t, config, "min_rsa_bits = -1\n")
+	if err := run(e.deps, []string{"doorman", "--config", config, "check"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected an invalid min_rsa_bits to be a usage error, got %v", err)
+	}
+}
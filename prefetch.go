@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// defaultConcurrency is how many users' keys are fetched at once, unless
+// --concurrency says otherwise
+const defaultConcurrency = 5
+
+// prefetchSource fetches the keys of several users at once, ahead of the
+// Manager asking for them one user at a time, so a long list of users
+// isn't fetched one slow request after another. Each prefetched answer is
+// handed out once: asking again, as the Manager does after a rate limit,
+// fetches live.
+type prefetchSource struct {
+	doorman.KeySource
+	app *app
+
+	mu      sync.Mutex
+	results map[string]prefetched
+}
+
+type prefetched struct {
+	keys []doorman.PublicKey
+	err  error
+}
+
+func (s *prefetchSource) Keys(ctx context.Context, username string) ([]doorman.PublicKey, error) {
+	s.mu.Lock()
+	result, ok := s.results[username]
+	delete(s.results, username)
+	s.mu.Unlock()
+	if ok {
+		return result.keys, result.err
+	}
+	return s.KeySource.Keys(ctx, username)
+}
+
+// prefetch fetches the keys of usernames, up to concurrency at a time,
+// halving the number whenever the source reports a rate limit rather than
+// keep hammering it. It returns once every fetch has finished, or ctx is
+// done; users not fetched by then are fetched live when asked for.
+func (s *prefetchSource) prefetch(ctx context.Context, usernames []string, concurrency int) {
+	s.app.verbosef("Fetching keys for %d users, %d at a time\n", len(usernames), concurrency)
+	pool := newFetchPool(concurrency)
+	results := make(map[string]prefetched)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, username := range usernames {
+		if !pool.acquire(ctx) {
+			break
+		}
+		wg.Add(1)
+		go func(username string) {
+			defer wg.Done()
+			defer pool.release()
+			keys, err := s.KeySource.Keys(ctx, username)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.As(err, new(*doorman.RateLimitError)) {
+				if limit, shrunk := pool.shrink(); shrunk {
+					s.app.verbosef("Rate limited; fetching %d at a time\n", limit)
+				}
+			}
+			mu.Lock()
+			results[username] = prefetched{keys, err}
+			mu.Unlock()
+		}(username)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	s.results = results
+	s.mu.Unlock()
+}
+
+// fetchPool bounds how many fetches run at once, to a limit that can shrink
+// while they run.
+type fetchPool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newFetchPool(limit int) *fetchPool {
+	p := &fetchPool{limit: max(limit, 1)}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// acquire waits for a free slot, returning false if ctx is done first.
+func (p *fetchPool) acquire(ctx context.Context) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.active >= p.limit {
+		if ctx.Err() != nil {
+			return false
+		}
+		p.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	p.active++
+	return true
+}
+
+func (p *fetchPool) release() {
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// shrink halves the limit, down to one, returning the new limit and
+// whether it changed.
+func (p *fetchPool) shrink() (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.limit == 1 {
+		return 1, false
+	}
+	p.limit /= 2
+	return p.limit, true
+}
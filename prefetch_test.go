@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// slowSource serves testKey after a delay that shortens with each user, so
+// later users finish first, recording how many fetches ran at once.
+type slowSource struct {
+	mu         sync.Mutex
+	delays     map[string]time.Duration
+	active     int
+	maxActive  int
+	rateLimits int
+	calls      map[string]int
+}
+
+func (s *slowSource) Keys(ctx context.Context, user string) ([]doorman.PublicKey, error) {
+	s.mu.Lock()
+	s.active++
+	s.maxActive = max(s.maxActive, s.active)
+	s.calls[user]++
+	limited := s.rateLimits > 0
+	if limited {
+		s.rateLimits--
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	time.Sleep(s.delays[user])
+	if limited {
+		return nil, &doorman.RateLimitError{RetryAfter: -1}
+	}
+	return parseKeys(testKey), nil
+}
+
+func TestRunFetchesConcurrently(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	source := &slowSource{calls: make(map[string]int), delays: map[string]time.Duration{
+		"alice": 40 * time.Millisecond, "bob": 30 * time.Millisecond, "carol": 20 * time.Millisecond, "dave": 10 * time.Millisecond,
+	}}
+	e.source = source
+
+	err := run(e.deps, []string{"doorman", "--yes", "--force", "--concurrency", "2", "add", "alice", "bob", "carol", "dave"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if source.maxActive != 2 {
+		t.Errorf("expected 2 fetches at once, got %d", source.maxActive)
+	}
+	expected := testKey + " alice" + today + "\n" + testKey + " bob" + today + "\n" + testKey + " carol" + today + "\n" + testKey + " dave" + today + "\n"
+	if content := readFile(t, path); content != expected {
+		t.Errorf("expected the users added in the order given, got %q", content)
+	}
+	var added []string
+	for _, line := range strings.Split(e.out.String(), "\n") {
+		if strings.HasPrefix(line, "Added") {
+			added = append(added, line)
+		}
+	}
+	if len(added) != 4 || !strings.HasSuffix(added[0], "alice (1 ed25519)") || !strings.HasSuffix(added[3], "dave (1 ed25519)") {
+		t.Errorf("expected the users reported in the order given, got %q", e.out.String())
+	}
+	for user, calls := range source.calls {
+		if calls != 1 {
+			t.Errorf("expected %s's keys to be fetched once, got %d", user, calls)
+		}
+	}
+}
+
+func TestRunConcurrencyInvalid(t *testing.T) {
+	e := newTestEnv(t)
+	err := run(e.deps, []string{"doorman", "--concurrency", "0", "add", "alice", "bob"})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "--concurrency") {
+		t.Errorf("expected a usage error, got %v", err)
+	}
+}
+
+func TestPrefetchShrinksOnRateLimit(t *testing.T) {
+	e := newTestEnv(t)
+	source := &slowSource{calls: make(map[string]int), rateLimits: 1}
+	s := &prefetchSource{KeySource: source, app: &app{deps: e.deps, opts: options{verbose: true}}}
+	usernames := []string{"alice", "bob", "carol", "dave", "erin", "frank"}
+	s.prefetch(context.Background(), usernames, 4)
+
+	if !strings.Contains(e.errOut.String(), "Rate limited; fetching 2 at a time") {
+		t.Errorf("expected the pool to shrink, got %q", e.errOut.String())
+	}
+	// The rate-limited user is fetched again when the Manager retries
+	limited := 0
+	for _, username := range usernames {
+		if _, err := s.Keys(context.Background(), username); err != nil {
+			limited++
+		}
+	}
+	if _, err := s.Keys(context.Background(), "alice"); err != nil || limited != 1 {
+		t.Errorf("expected one rate limit, then live fetches, got %d and %v", limited, err)
+	}
+}
+
+func TestFetchPoolShrink(t *testing.T) {
+	pool := newFetchPool(5)
+	for _, expected := range []int{2, 1} {
+		if limit, shrunk := pool.shrink(); limit != expected || !shrunk {
+			t.Errorf("expected the limit to shrink to %d, got %d %v", expected, limit, shrunk)
+		}
+	}
+	if limit, shrunk := pool.shrink(); limit != 1 || shrunk {
+		t.Errorf("expected the limit to stay at 1, got %d %v", limit, shrunk)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// progress reports how far an action on several users has got. On a
+// terminal each user gets one line, "[3/12] fetching carol… 2 keys", which
+// is completed as the user is processed; otherwise every step is a line of
+// its own, for logs. Failures are marked where they happen and remembered
+// for the summary at the end.
+type progress struct {
+	w        io.Writer
+	terminal bool
+	verb     string
+	total    int
+
+	index int
+	user  string
+	// pending is set while a terminal line has been started but not ended
+	pending  bool
+	failures []userFailure
+}
+
+type userFailure struct {
+	user string
+	err  error
+}
+
+func newProgress(w io.Writer, terminal bool, action string, total int) *progress {
+	verb := "fetching"
+	if action == "remove" {
+		verb = "removing"
+	}
+	return &progress{w: w, terminal: terminal, verb: verb, total: total}
+}
+
+func (p *progress) prefix() string {
+	return fmt.Sprintf("[%d/%d]", p.index, p.total)
+}
+
+// start begins the next user.
+func (p *progress) start(user string) {
+	p.interrupt()
+	p.index++
+	p.user = user
+	if p.terminal {
+		fmt.Fprintf(p.w, "%s %s %s…", p.prefix(), p.verb, user)
+		p.pending = true
+		return
+	}
+	fmt.Fprintf(p.w, "%s %s %s\n", p.prefix(), p.verb, user)
+}
+
+// fetched reports how many keys the current user has.
+func (p *progress) fetched(n int) {
+	if p.pending {
+		fmt.Fprint(p.w, " "+countKeys(n))
+		return
+	}
+	fmt.Fprintf(p.w, "%s %s: %s\n", p.prefix(), p.user, countKeys(n))
+}
+
+// fail marks the current user as failed with err.
+func (p *progress) fail(err error) {
+	p.failures = append(p.failures, userFailure{p.user, err})
+	p.mark("failed")
+}
+
+// skip marks the current user as skipped, because a change was declined.
+func (p *progress) skip() {
+	p.mark("skipped")
+}
+
+func (p *progress) mark(status string) {
+	if p.pending {
+		fmt.Fprintln(p.w, " "+status)
+		p.pending = false
+		return
+	}
+	fmt.Fprintf(p.w, "%s %s %s\n", p.prefix(), p.user, status)
+}
+
+// interrupt ends a pending line, so that a preview, prompt or message can
+// be printed. A nil progress does nothing, so callers needn't check.
+func (p *progress) interrupt() {
+	if p != nil && p.pending {
+		fmt.Fprintln(p.w)
+		p.pending = false
+	}
+}
+
+// err summarizes the failures, or returns nil if there were none. The exit
+// code is the first failure's. Silent failures are left out, and only if
+// all failures are silent is the summary silent too.
+func (p *progress) err() error {
+	if len(p.failures) == 0 {
+		return nil
+	}
+	var lines []string
+	for _, failure := range p.failures {
+		if !errors.As(failure.err, new(*silentError)) {
+			lines = append(lines, fmt.Sprintf("  %s: %v", failure.user, failure.err))
+		}
+	}
+	header := fmt.Sprintf("%d of %d %s failed:", len(p.failures), p.total, plural(p.total, "user", "users"))
+	err := withExitCode(exitCodeFor(p.failures[0].err), errors.New(strings.Join(append([]string{header}, lines...), "\n")))
+	return silence(err, len(lines) == 0)
+}
+
+// progressSource reports each successful fetch to a progress.
+type progressSource struct {
+	doorman.KeySource
+	progress *progress
+}
+
+func (s progressSource) Keys(ctx context.Context, user string) ([]doorman.PublicKey, error) {
+	keys, err := s.KeySource.Keys(ctx, user)
+	if err == nil {
+		s.progress.fetched(len(keys))
+	}
+	return keys, err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// userSource serves each user's keys from a map; users missing from it
+// don't exist.
+type userSource map[string]string
+
+func (s userSource) Keys(ctx context.Context, user string) ([]doorman.PublicKey, error) {
+	keys, ok := s[user]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", doorman.ErrUserNotFound, user)
+	}
+	return parseKeys(keys), nil
+}
+
+func TestRunProgress(t *testing.T) {
+	tests := []struct {
+		name     string
+		terminal bool
+		expected []string
+	}{
+		{"terminal", true, []string{
+			"[1/3] fetching alice… 1 key",
+			"Added 1 key for alice (1 ed25519)",
+			"[2/3] fetching bob… failed",
+			"[3/3] fetching carol… 2 keys",
+			"Added 2 keys for carol (2 rsa)",
+		}},
+		{"not a terminal", false, []string{
+			"[1/3] fetching alice",
+			"[1/3] alice: 1 key",
+			"Added 1 key for alice (1 ed25519)",
+			"[2/3] fetching bob",
+			"[2/3] bob failed",
+			"[3/3] fetching carol",
+			"[3/3] carol: 2 keys",
+			"Added 2 keys for carol (2 rsa)",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.stdoutIsTerminal = func() bool { return tt.terminal }
+			writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), "")
+			e.source = userSource{"alice": "ssh-ed25519 K1", "carol": "ssh-rsa K2\nssh-rsa K3"}
+
+			err := run(e.deps, []string{"doorman", "--yes", "add", "alice", "bob", "carol"})
+			if code := exitCodeFor(err); code != exitUsage {
+				t.Errorf("expected exit code %d for the unknown user, got %d (%v)", exitUsage, code, err)
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), "1 of 3 users failed:\n  bob: ") {
+				t.Errorf("expected the failure to be summarized, got %v", err)
+			}
+
+			var got []string
+			for _, line := range strings.Split(e.out.String(), "\n") {
+				if strings.HasPrefix(line, "[") || strings.HasPrefix(line, "Added") {
+					got = append(got, line)
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+				t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(tt.expected, "\n"), e.out.String())
+			}
+		})
+	}
+}
+
+func TestRunProgressDeclined(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	e.source = userSource{"alice": "ssh-ed25519 K1", "bob": "ssh-rsa K2"}
+	e.mockStdin("no\nyes\n")
+
+	if err := run(e.deps, []string{"doorman", "add", "alice", "bob"}); err != nil {
+		t.Fatalf("declining one user shouldn't fail the others, got %v", err)
+	}
+	if !strings.Contains(e.out.String(), "[1/2] alice skipped\n") {
+		t.Errorf("expected alice to be marked skipped, got %q", e.out.String())
+	}
+	if content := readFile(t, path); content != "ssh-rsa K2 bob"+today+"\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+}
+
+func TestRunSingleUserWithoutProgress(t *testing.T) {
+	e := newTestEnv(t)
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), "")
+	e.mockKeys("ssh-ed25519 K1")
+
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(e.out.String(), "[1/1]") {
+		t.Errorf("expected no progress for a single user, got %q", e.out.String())
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// terminalPrompter confirms a Manager's changes with the person at the
+// terminal, or answers yes itself with --yes, or after showing the preview
+// with --dry-run, which writes nothing.
+type terminalPrompter struct {
+	*app
+}
+
+func (p terminalPrompter) Confirm(ctx context.Context, preview, question string) (bool, error) {
+	if p.opts.cron {
+		return true, nil
+	}
+	p.showPreview(preview)
+	if p.opts.dryRun {
+		return true, nil
+	}
+	return p.promptConfirmation(ctx, question+" (yes/no): ")
+}
+
+// ConfirmSummary shows the summary, and the full preview if the answer is
+// "show". --show-full-keys shows the full preview straight away, so it ends
+// up in logs of non-interactive runs.
+func (p terminalPrompter) ConfirmSummary(ctx context.Context, summary, full, question string) (bool, error) {
+	if p.opts.showFullKeys || p.opts.cron {
+		return p.Confirm(ctx, full, question)
+	}
+	p.showPreview(summary)
+	if p.opts.dryRun {
+		return true, nil
+	}
+	return p.askConfirmation(ctx, question+" (yes/no/show): ", func() { p.showPreview(full) })
+}
+
+func (p terminalPrompter) showPreview(preview string) {
+	p.progress.interrupt()
+	if preview == "" {
+		return
+	}
+	if p.useColor() {
+		preview = colorDiff(preview)
+	}
+	fmt.Fprintln(p.stdout, preview)
+}
+
+func (p terminalPrompter) Notify(message string) {
+	if p.opts.cron {
+		return
+	}
+	p.progress.interrupt()
+	fmt.Fprintln(p.stderr, message)
+}
+
+// useColor reports whether output may be colored: stdout is a terminal and
+// NO_COLOR (https://no-color.org) isn't set.
+func (d *deps) useColor() bool {
+	return d.stdoutIsTerminal() && d.getenv("NO_COLOR") == ""
+}
+
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// colorDiff colors the lines of a preview that are added green and those
+// that are deleted red.
+func colorDiff(preview string) string {
+	lines := strings.Split(preview, "\n")
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "+ "):
+			lines[i] = colorGreen + line + colorReset
+		case strings.HasPrefix(line, "- "):
+			lines[i] = colorRed + line + colorReset
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// maxPromptAttempts bounds how often an unrecognized answer is asked again
+const maxPromptAttempts = 3
+
+func (a *app) promptConfirmation(ctx context.Context, prompt string) (bool, error) {
+	return a.askConfirmation(ctx, prompt, nil)
+}
+
+// askConfirmation asks prompt until it is answered yes or no. When show
+// isn't nil, "show" is an answer too: show is called and prompt asked again.
+func (a *app) askConfirmation(ctx context.Context, prompt string, show func()) (bool, error) {
+	a.progress.interrupt()
+	if a.opts.yes {
+		fmt.Fprintln(a.stdout, prompt+"yes (--yes)")
+		return true, nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		fmt.Fprint(a.stdout, prompt)
+		line, err := a.readAnswer(ctx)
+		if errors.Is(err, errPromptTimeout) {
+			return false, nil
+		}
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		case "s", "show":
+			if show != nil && err == nil {
+				show()
+				attempt--
+				continue
+			}
+		}
+
+		// BEHAVIOR: EOF (Ctrl-D) declines instead of asking again, and so
+		// does running out of attempts
+		if err == io.EOF {
+			fmt.Fprintln(a.stdout)
+			return false, nil
+		}
+		if attempt == maxPromptAttempts {
+			fmt.Fprintln(a.stdout, "No valid answer given.")
+			return false, nil
+		}
+		if show != nil {
+			fmt.Fprintln(a.stdout, "Please answer yes, no or show.")
+		} else {
+			fmt.Fprintln(a.stdout, "Please answer yes or no.")
+		}
+	}
+}
+
+// errPromptTimeout is returned by readAnswer when --prompt-timeout passes
+// without an answer
+var errPromptTimeout = errors.New("no answer before the prompt timed out")
+
+// readAnswer reads the answer to the prompt just shown, giving up after
+// --prompt-timeout, if set, with errPromptTimeout once it has said so.
+func (a *app) readAnswer(ctx context.Context) (string, error) {
+	if a.opts.promptTimeout <= 0 {
+		return a.readLine(ctx)
+	}
+	promptCtx, cancel := context.WithTimeout(ctx, a.opts.promptTimeout)
+	defer cancel()
+	line, err := a.readLine(promptCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		fmt.Fprintf(a.stdout, "\nNo answer within %s; treating it as no.\n", a.opts.promptTimeout)
+		return "", errPromptTimeout
+	}
+	return line, err
+}
+
+// lineResult is the outcome of reading a line from stdin.
+type lineResult struct {
+	line string
+	err  error
+}
+
+// openTerminal opens the controlling terminal: /dev/tty, or CONIN$ on
+// Windows. It fails when there is none, as under cron or ssh without -t.
+func openTerminal() (io.ReadCloser, error) {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	return os.Open(name)
+}
+
+// readLine reads a line from stdin, or from the terminal when answers come
+// from there, giving up with ctx's error when ctx is done first. A read
+// from a terminal can't be interrupted, so one that is given up on is left
+// running; the next readLine takes over its result.
+func (a *app) readLine(ctx context.Context) (string, error) {
+	if a.pendingRead != nil {
+		// BEHAVIOR: A line typed before this prompt was shown was meant for
+		// the one that gave up waiting, so it mustn't answer this one
+		select {
+		case <-a.pendingRead:
+			a.pendingRead = nil
+		default:
+		}
+	}
+	if a.pendingRead == nil {
+		done := make(chan lineResult, 1)
+		reader := a.stdin
+		if a.answers != nil {
+			reader = a.answers
+		}
+		go func() {
+			line, err := reader.ReadString('\n')
+			done <- lineResult{line, err}
+		}()
+		a.pendingRead = done
+	}
+
+	select {
+	case r := <-a.pendingRead:
+		a.pendingRead = nil
+		return r.line, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// assumeYesVariable is the environment variable that stands in for --yes
+// where flags can't be passed, such as deep inside image builds
+const assumeYesVariable = "DOORMAN_ASSUME_YES"
+
+// assumeYes turns on --yes when DOORMAN_ASSUME_YES is true, unless
+// --interactive is given, saying so on stderr before action asks anything,
+// since an export left behind would otherwise answer for whoever runs
+// doorman next.
+func (a *app) assumeYes(action string) error {
+	if a.opts.interactive && a.opts.yes {
+		return withExitCode(exitUsage, fmt.Errorf("--interactive can't be used with --yes or --cron"))
+	}
+	value := a.getenv(assumeYesVariable)
+	if value == "" || a.opts.yes || a.opts.interactive {
+		return nil
+	}
+	assume, err := strconv.ParseBool(value)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("invalid %s '%s': use 1 or 0", assumeYesVariable, value))
+	}
+	if !assume {
+		return nil
+	}
+	a.opts.yes = true
+	if !asksNothing(action) || a.opts.removeStale {
+		fmt.Fprintf(a.stderr, "Answering yes to all confirmations because %s=%s is set; pass --interactive to be asked\n", assumeYesVariable, value)
+	}
+	return nil
+}
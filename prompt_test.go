@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// hookReader runs hook once, the first time input is read, which lets tests
+// change files while a prompt is waiting for an answer.
+type hookReader struct {
+	r    io.Reader
+	hook func()
+}
+
+func (h *hookReader) Read(p []byte) (int, error) {
+	if h.hook != nil {
+		h.hook()
+		h.hook = nil
+	}
+	return h.r.Read(p)
+}
+
+func (e *testEnv) mockStdinWithHook(input string, hook func()) {
+	e.stdin = bufio.NewReader(&hookReader{r: strings.NewReader(input), hook: hook})
+}
+
+func TestTerminalPrompterColor(t *testing.T) {
+	const preview = "Changes to authorized_keys:\n- 1  ssh-rsa K1 alice\n+ 2  ssh-ed25519 K2 alice"
+	colored := "Changes to authorized_keys:\n" + colorRed + "- 1  ssh-rsa K1 alice" + colorReset + "\n" + colorGreen + "+ 2  ssh-ed25519 K2 alice" + colorReset
+
+	tests := []struct {
+		name     string
+		terminal bool
+		noColor  string
+		expected string
+	}{
+		{"terminal", true, "", colored},
+		{"not a terminal", false, "", preview},
+		{"NO_COLOR", true, "1", preview},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.stdoutIsTerminal = func() bool { return tt.terminal }
+			e.env["NO_COLOR"] = tt.noColor
+			e.mockStdin("yes\n")
+
+			if _, err := (terminalPrompter{e.app}).Confirm(context.Background(), preview, "Continue?"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := strings.TrimSuffix(e.out.String(), "\nContinue? (yes/no): "); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTerminalPrompterSummary(t *testing.T) {
+	const summary, full = "SUMMARY", "FULL"
+
+	tests := []struct {
+		name         string
+		input        string
+		showFullKeys bool
+		confirmed    bool
+		expected     string
+	}{
+		{"yes", "yes\n", false, true, "SUMMARY\nContinue? (yes/no/show): "},
+		{"no", "no\n", false, false, "SUMMARY\nContinue? (yes/no/show): "},
+		{"show", "show\ny\n", false, true, "SUMMARY\nContinue? (yes/no/show): FULL\nContinue? (yes/no/show): "},
+		{"invalid", "maybe\nn\n", false, false, "SUMMARY\nContinue? (yes/no/show): Please answer yes, no or show.\nContinue? (yes/no/show): "},
+		{"--show-full-keys", "yes\n", true, true, "FULL\nContinue? (yes/no): "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.opts.showFullKeys = tt.showFullKeys
+			e.mockStdin(tt.input)
+
+			confirmed, err := (terminalPrompter{e.app}).ConfirmSummary(context.Background(), summary, full, "Continue?")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if confirmed != tt.confirmed {
+				t.Errorf("expected confirmed %v, got %v", tt.confirmed, confirmed)
+			}
+			if got := e.out.String(); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPromptTimeout(t *testing.T) {
+	e := newTestEnv(t)
+	e.opts.promptTimeout = 20 * time.Millisecond
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	e.stdin = bufio.NewReader(reader)
+
+	confirmed, err := e.promptConfirmation(context.Background(), "Continue? ")
+	if err != nil || confirmed {
+		t.Fatalf("expected the timeout to answer no, got %v, %v", confirmed, err)
+	}
+	if !strings.HasSuffix(e.out.String(), "\nNo answer within 20ms; treating it as no.\n") {
+		t.Errorf("expected the timeout to be reported, got %q", e.out.String())
+	}
+
+	// The answer arrives too late, and must not answer the next prompt
+	if _, err := io.WriteString(writer, "yes\n"); err != nil {
+		t.Fatal(err)
+	}
+	for len(e.pendingRead) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if confirmed, err := e.promptConfirmation(context.Background(), "Continue? "); err != nil || confirmed {
+		t.Errorf("expected the late answer to be ignored, got %v, %v", confirmed, err)
+	}
+}
+
+func TestPromptTimeoutRun(t *testing.T) {
+	e := newTestEnv(t)
+	writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), "")
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	e.stdin = bufio.NewReader(reader)
+	e.mockKeys("ssh-ed25519 K1")
+
+	err := run(e.deps, []string{"doorman", "--prompt-timeout", "20ms", "add", "contractor"})
+	if code := exitCodeFor(err); code != exitAborted {
+		t.Errorf("expected exit code %d, got %d (%v)", exitAborted, code, err)
+	}
+}
+
+func TestAddKeysConcurrentModification(t *testing.T) {
+	e := newTestEnv(t)
+
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	os.WriteFile(authorizedKeysPath, []byte("ssh-rsa EXISTING... bob"), 0600)
+
+	out := e.out
+	errOut := e.errOut
+	e.mockStdinWithHook("yes\nyes\n", func() {
+		os.WriteFile(authorizedKeysPath, []byte("ssh-rsa EXISTING... bob\nssh-rsa INTRUDER... mallory"), 0600)
+	})
+
+	summary, err := e.addKeys(t, "ssh-rsa NEW...", "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(errOut.String(), "modified by another process") {
+		t.Errorf("expected concurrent modification warning, got %q", errOut.String())
+	}
+	if !strings.Contains(out.String(), "+ ssh-rsa INTRUDER... mallory") {
+		t.Errorf("expected the external change to be shown, got %q", out.String())
+	}
+	if n := strings.Count(out.String(), "Do you want to add 1 new key?"); n != 2 {
+		t.Errorf("expected the question to be asked twice, got %d", n)
+	}
+
+	content := readFile(t, authorizedKeysPath)
+	if !strings.Contains(content, "mallory") || !strings.Contains(content, "alice") {
+		t.Errorf("unexpected content: %q", content)
+	}
+	if len(summary.Added) != 1 {
+		t.Errorf("summary should only count alice's key, got %d", len(summary.Added))
+	}
+}
+
+func TestAddKeysConcurrentModificationDeclined(t *testing.T) {
+	e := newTestEnv(t)
+
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	os.WriteFile(authorizedKeysPath, []byte("ssh-rsa EXISTING... bob"), 0600)
+
+	e.mockStdinWithHook("yes\nno\n", func() {
+		os.WriteFile(authorizedKeysPath, []byte("ssh-rsa EXISTING... bob\nssh-rsa INTRUDER... mallory"), 0600)
+	})
+
+	_, err := e.addKeys(t, "ssh-rsa NEW...", "alice")
+	if !errors.Is(err, doorman.ErrAborted) {
+		t.Fatalf("expected doorman.ErrAborted, got %v", err)
+	}
+	if content := readFile(t, authorizedKeysPath); strings.Contains(content, "alice") {
+		t.Error("keys should not be added after declining")
+	}
+}
+
+func TestRemoveKeysConcurrentModification(t *testing.T) {
+	e := newTestEnv(t)
+
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	os.WriteFile(authorizedKeysPath, []byte("ssh-rsa KEY1... alice\nssh-rsa KEY2... bob"), 0600)
+
+	out := e.out
+	e.mockStdinWithHook("yes\nyes\n", func() {
+		os.WriteFile(authorizedKeysPath, []byte("ssh-rsa KEY1... alice\nssh-rsa KEY2... bob\nssh-rsa KEY3... carol"), 0600)
+	})
+
+	_, err := e.removeKeys(t, "ssh-rsa KEY1...", "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "+ ssh-rsa KEY3... carol") {
+		t.Errorf("expected the external change to be shown, got %q", out.String())
+	}
+
+	content := readFile(t, authorizedKeysPath)
+	if strings.Contains(content, "alice") {
+		t.Error("alice should be removed")
+	}
+	if !strings.Contains(content, "carol") {
+		t.Error("concurrently added key should be preserved")
+	}
+}
+
+func TestRunAssumeYesFromEnvironment(t *testing.T) {
+	e := newTestEnv(t)
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, authorizedKeysPath, "")
+	e.stdinIsTerminal = func() bool { return false }
+	e.mockKeys(testKey)
+	e.env["DOORMAN_ASSUME_YES"] = "1"
+
+	if err := run(e.deps, []string{"doorman", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.errOut.String(), "because DOORMAN_ASSUME_YES=1 is set; pass --interactive to be asked") {
+		t.Errorf("expected a notice that the environment answers yes, got %q", e.errOut.String())
+	}
+	if !strings.Contains(readFile(t, authorizedKeysPath), "alice") {
+		t.Error("expected the keys added without asking")
+	}
+
+	e.errOut.Reset()
+	if err := run(e.deps, []string{"doorman", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.errOut.Len() != 0 {
+		t.Errorf("expected no notice when nothing is asked, got %q", e.errOut.String())
+	}
+
+	e.mockKeys(newTestKey(t))
+	err := run(e.deps, []string{"doorman", "--interactive", "add", "alice"})
+	if err == nil || !strings.Contains(err.Error(), "pass --yes") {
+		t.Errorf("expected --interactive to ask, and be refused without a terminal, got %v", err)
+	}
+	e.env["DOORMAN_ASSUME_YES"] = "0"
+	err = run(e.deps, []string{"doorman", "add", "alice"})
+	if err == nil || !strings.Contains(err.Error(), "pass --yes") {
+		t.Errorf("expected DOORMAN_ASSUME_YES=0 to ask, and be refused without a terminal, got %v", err)
+	}
+
+	e.env["DOORMAN_ASSUME_YES"] = "maybe"
+	if err := run(e.deps, []string{"doorman", "add", "alice"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected an invalid value to be refused, got %v", err)
+	}
+	if err := run(e.deps, []string{"doorman", "--yes", "--interactive", "add", "alice"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected --interactive with --yes to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// maxRateLimitWait bounds --wait-for-ratelimit; GitHub's limits reset hourly
+const maxRateLimitWait = time.Hour
+
+// clock gives a Manager the time from deps.
+type clock struct {
+	*deps
+}
+
+func (c clock) Now() time.Time {
+	return c.now()
+}
+
+func (c clock) Sleep(ctx context.Context, d time.Duration) error {
+	return c.sleep(ctx, d)
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitError explains a rate limit doorman gave up waiting for. A zero
+// reset means the source didn't say when it ends.
+type rateLimitError struct {
+	now   time.Time
+	reset time.Time
+	err   *doorman.RateLimitError
+}
+
+func newRateLimitError(err *doorman.RateLimitError, now time.Time) *rateLimitError {
+	limitErr := &rateLimitError{now: now, err: err}
+	if wait := err.Wait(now); wait >= 0 {
+		limitErr.reset = now.Add(wait)
+	}
+	return limitErr
+}
+
+func (e *rateLimitError) Error() string {
+	msg := "rate limit exceeded"
+	if !e.reset.IsZero() {
+		msg += fmt.Sprintf("; the limit resets at %s (in %s)", e.reset.Format("15:04:05 MST"), e.reset.Sub(e.now).Round(time.Second))
+	}
+	return msg + ". Retry later, pass --wait-for-ratelimit, or set GITHUB_TOKEN to a GitHub token, which has a much higher limit"
+}
+
+func (e *rateLimitError) Unwrap() error {
+	return e.err
+}
+
+func (a *app) logRateLimitHeaders(response *http.Response) {
+	remaining := response.Header.Get("X-RateLimit-Remaining")
+	if remaining == "" {
+		return
+	}
+	a.verbosef("Rate limit: %s of %s requests remaining", remaining, response.Header.Get("X-RateLimit-Limit"))
+	if reset, err := strconv.ParseInt(response.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		a.verbosef(", resets at %s", time.Unix(reset, 0).Format("15:04:05 MST"))
+	}
+	a.verbosef("\n")
+}
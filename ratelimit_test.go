@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fixedNow = time.Date(2024, 3, 18, 12, 0, 0, 0, time.UTC)
+
+// mockHttpResponses serves the given responses in order, repeating the last.
+func (e *testEnv) mockHttpResponses(responses ...*http.Response) *int {
+	calls := 0
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		r := responses[min(calls, len(responses)-1)]
+		calls++
+		return &http.Response{
+			StatusCode: r.StatusCode,
+			Header:     r.Header,
+			Body:       io.NopCloser(strings.NewReader("ssh-rsa KEY...")),
+		}, nil
+	})
+	return &calls
+}
+
+func (e *testEnv) mockClock() *[]time.Duration {
+	var slept []time.Duration
+	e.now = func() time.Time { return fixedNow }
+	e.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	return &slept
+}
+
+func rateLimited(status int, headers map[string]string) *http.Response {
+	h := http.Header{}
+	for k, v := range headers {
+		h.Set(k, v)
+	}
+	return &http.Response{StatusCode: status, Header: h}
+}
+
+// runAdd adds alice's keys from GitHub, fetched through the e.transport seam.
+func (e *testEnv) runAdd(flags ...string) error {
+	return run(e.deps, append([]string{"doorman", "add", "alice", "--yes"}, flags...))
+}
+
+func TestFetchKeysWaitsOutShortRateLimit(t *testing.T) {
+	e := newTestEnv(t)
+	slept := e.mockClock()
+	errOut := e.errOut
+
+	calls := e.mockHttpResponses(
+		rateLimited(http.StatusTooManyRequests, map[string]string{"Retry-After": "3"}),
+		rateLimited(http.StatusOK, nil),
+	)
+
+	if err := e.runAdd(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *calls != 2 || len(*slept) != 1 || (*slept)[0] != 3*time.Second {
+		t.Errorf("expected one 3s wait and a retry, got calls=%d slept=%v", *calls, *slept)
+	}
+	if !strings.Contains(errOut.String(), "waiting 3s before retrying") {
+		t.Errorf("expected wait notice, got %q", errOut.String())
+	}
+}
+
+func TestFetchKeysFailsOnLongRateLimit(t *testing.T) {
+	e := newTestEnv(t)
+	slept := e.mockClock()
+
+	e.mockHttpResponses(rateLimited(http.StatusForbidden, map[string]string{
+		"X-RateLimit-Remaining": "0",
+		"X-RateLimit-Reset":     strconv.FormatInt(fixedNow.Add(30*time.Minute).Unix(), 10),
+	}))
+
+	err := e.runAdd()
+	var limitErr *rateLimitError
+	if !errors.As(err, &limitErr) || exitCodeFor(err) != exitFetch {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "resets at 12:30:00 UTC (in 30m0s)") || !strings.Contains(err.Error(), "token") {
+		t.Errorf("unexpected message: %v", err)
+	}
+	if len(*slept) != 0 {
+		t.Errorf("should not wait without --wait-for-ratelimit, slept %v", *slept)
+	}
+}
+
+func TestFetchKeysWaitForRateLimitFlag(t *testing.T) {
+	e := newTestEnv(t)
+	slept := e.mockClock()
+
+	e.mockHttpResponses(
+		rateLimited(http.StatusTooManyRequests, map[string]string{"Retry-After": "1800"}),
+		rateLimited(http.StatusOK, nil),
+	)
+
+	if err := e.runAdd("--wait-for-ratelimit"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(*slept) != 1 || (*slept)[0] != 30*time.Minute {
+		t.Errorf("expected a 30m wait, got %v", *slept)
+	}
+}
+
+func TestFetchKeysGivesUpAfterRepeatedRateLimits(t *testing.T) {
+	e := newTestEnv(t)
+	slept := e.mockClock()
+
+	calls := e.mockHttpResponses(rateLimited(http.StatusTooManyRequests, map[string]string{"Retry-After": "1"}))
+
+	if err := e.runAdd(); exitCodeFor(err) != exitFetch {
+		t.Fatalf("expected fetch failure, got %v", err)
+	}
+	if *calls != 3 || len(*slept) != 2 {
+		t.Errorf("expected 3 attempts, got calls=%d slept=%v", *calls, *slept)
+	}
+}
+
+func TestFetchKeysVerboseRateLimitHeaders(t *testing.T) {
+	e := newTestEnv(t)
+	e.mockClock()
+	errOut := e.errOut
+
+	e.mockHttpResponses(rateLimited(http.StatusOK, map[string]string{
+		"X-RateLimit-Limit":     "60",
+		"X-RateLimit-Remaining": "57",
+		"X-RateLimit-Reset":     strconv.FormatInt(fixedNow.Add(time.Hour).Unix(), 10),
+	}))
+
+	if err := e.runAdd("--verbose"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(errOut.String(), "Rate limit: 57 of 60 requests remaining, resets at") {
+		t.Errorf("expected rate limit headers in verbose output, got %q", errOut.String())
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// remoteDialTimeout bounds connecting to and authenticating with a --host
+const remoteDialTimeout = 15 * time.Second
+
+// remoteAuthorizedKeys is the file managed on a --host without --file,
+// relative to the remote user's home directory
+const remoteAuthorizedKeys = ".ssh/authorized_keys"
+
+// remoteStore returns the store for authorized_keys on --host, and a
+// function closing the connection to it.
+func (a *app) remoteStore(ctx context.Context) (doorman.KeyStore, func() error, error) {
+	a.verbosef("Connecting to %s\n", a.opts.host)
+	client, closeRemote, err := a.openRemote(ctx, a.opts.host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to %s: %w", a.opts.host, err)
+	}
+	file := remoteAuthorizedKeys
+	if a.opts.file != "" {
+		file = a.opts.file
+	}
+	a.verbosef("Using %s on %s\n", file, a.opts.host)
+	return &sftpStore{client: client, host: a.opts.host, path: file, maxLineLength: a.cfg.MaxLineLength}, closeRemote, nil
+}
+
+// sftpStore is a KeyStore backed by an authorized_keys file on another host,
+// reached over SFTP. Like FileStore, it writes a temporary file next to the
+// original and renames it into place, so the remote sshd never reads a
+// partial file. Unlike FileStore it takes no lock, as SFTP offers none;
+// the Manager still notices changes made between the preview and the
+// write.
+type sftpStore struct {
+	client *sftp.Client
+	host   string
+	// path is the file's path on host; relative paths are relative to the
+	// remote user's home directory
+	path string
+	// maxLineLength bounds the lines Load accepts, as FileStore's does
+	maxLineLength int
+}
+
+func (s *sftpStore) Path() string {
+	return s.host + ":" + s.path
+}
+
+func (s *sftpStore) Load() ([]doorman.Entry, error) {
+	f, err := s.client.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := doorman.ReadEntriesLimit(f, s.maxLineLength)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", s.Path(), err)
+	}
+	return entries, nil
+}
+
+func (s *sftpStore) Save(entries []doorman.Entry) error {
+	// BEHAVIOR: Replace the file a symlink points to, not the symlink, as
+	// FileStore does
+	target, err := s.resolve(s.path)
+	if err != nil {
+		return err
+	}
+
+	mode := fs.FileMode(0600)
+	info, err := s.client.Stat(target)
+	switch {
+	case err == nil:
+		mode = info.Mode().Perm()
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	default:
+		if err := s.ensureDir(path.Dir(target)); err != nil {
+			return err
+		}
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmpPath := path.Join(path.Dir(target), "."+path.Base(target)+".tmp-"+hex.EncodeToString(suffix))
+	tmp, err := s.client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	// BEHAVIOR: Whatever goes wrong, no temporary file is left on the host
+	defer s.client.Remove(tmpPath)
+
+	err = doorman.WriteEntries(tmp, entries)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.client.Chmod(tmpPath, mode)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.client.PosixRename(tmpPath, target); err != nil {
+		return fmt.Errorf("error replacing %s (the server must support posix-rename@openssh.com): %w", s.Path(), err)
+	}
+	return nil
+}
+
+// maxSymlinks bounds following symlinks, which may form a loop
+const maxSymlinks = 40
+
+// resolve follows the symlinks at p on the host, returning the path of the
+// file they lead to, which need not exist.
+func (s *sftpStore) resolve(p string) (string, error) {
+	for i := 0; i < maxSymlinks; i++ {
+		info, err := s.client.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return p, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return p, nil
+		}
+		link, err := s.client.ReadLink(p)
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(link) {
+			link = path.Join(path.Dir(p), link)
+		}
+		p = link
+	}
+	return "", fmt.Errorf("too many symlinks at %s", s.Path())
+}
+
+// ensureDir creates dir on the host, readable only by its owner as sshd's
+// StrictModes requires, if it doesn't exist.
+func (s *sftpStore) ensureDir(dir string) error {
+	if _, err := s.client.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := s.client.MkdirAll(dir); err != nil {
+		return err
+	}
+	return s.client.Chmod(dir, 0700)
+}
+
+// dialRemote connects to host, given as [user@]host[:port], authenticating
+// with the keys in the local SSH agent and checking the host's key against
+// ~/.ssh/known_hosts.
+func dialRemote(ctx context.Context, host string) (*sftp.Client, func() error, error) {
+	username, address := "", host
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		username, address = host[:i], host[i+1:]
+	}
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, nil, err
+		}
+		username = current.Username
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil, errors.New("no SSH agent to authenticate with; start ssh-agent and add your key with ssh-add")
+	}
+	agentConn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to the SSH agent: %w", err)
+	}
+	defer agentConn.Close()
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	knownHostsPath := filepath.Join(home, ".ssh", "known_hosts")
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("host keys are checked against %s, which can't be read (connect with ssh once to add the host): %w", knownHostsPath, err)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         remoteDialTimeout,
+	}
+	return connectSFTP(ctx, address, config, knownHostsPath)
+}
+
+// connectSFTP connects to address with config and starts SFTP, explaining
+// host key failures in terms of knownHostsPath.
+func connectSFTP(ctx context.Context, address string, config *ssh.ClientConfig, knownHostsPath string) (*sftp.Client, func() error, error) {
+	dialer := net.Dialer{Timeout: remoteDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(remoteDialTimeout))
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		var keyErr *knownhosts.KeyError
+		switch {
+		case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+			return nil, nil, fmt.Errorf("%s is not in %s; connect with ssh once to check and add its host key", address, knownHostsPath)
+		case errors.As(err, &keyErr):
+			return nil, nil, fmt.Errorf("the host key of %s doesn't match the one in %s; it may have been reinstalled, or someone may be intercepting the connection", address, knownHostsPath)
+		}
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("error starting SFTP: %w", err)
+	}
+	return sftpClient, func() error {
+		sftpClient.Close()
+		return client.Close()
+	}, nil
+}
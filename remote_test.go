@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// mockRemote serves SFTP from a fresh directory, standing in for the home
+// directory of the user on --host, and returns it.
+func (e *testEnv) mockRemote(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	e.openRemote = func(ctx context.Context, host string) (*sftp.Client, func() error, error) {
+		return pipeSFTP(dir)
+	}
+	return dir
+}
+
+// pipeSFTP connects a client to an SFTP server working in dir through
+// pipes.
+func pipeSFTP(dir string) (*sftp.Client, func() error, error) {
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverRead, serverWrite}, sftp.WithServerWorkingDirectory(dir))
+	if err != nil {
+		return nil, nil, err
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientRead, clientWrite)
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	return client, func() error {
+		// The client waits for its reader, which ends when the server
+		// closes its end of the pipe
+		server.Close()
+		return client.Close()
+	}, nil
+}
+
+func TestRunRemote(t *testing.T) {
+	e := newTestEnv(t)
+	remoteHome := e.mockRemote(t)
+	e.mockKeys(testKey)
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--host", "admin@web1", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(remoteHome, ".ssh", "authorized_keys")
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("unexpected remote content %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(e.home, ".ssh", "authorized_keys")); err == nil {
+		t.Error("expected the local authorized_keys to be left alone")
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected only authorized_keys in the remote .ssh, got %v %v", entries, err)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--host", "admin@web1", "list"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.out.String(), "alice") {
+		t.Errorf("expected alice's key to be listed, got %q", e.out.String())
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--host", "admin@web1", "remove", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != "" {
+		t.Errorf("expected alice's key to be removed, got %q", content)
+	}
+}
+
+func TestRunRemoteUnsupportedAction(t *testing.T) {
+	e := newTestEnv(t)
+	err := run(e.deps, []string{"doorman", "--host", "web1", "audit-log"})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected a usage error, got %v", err)
+	}
+}
+
+func TestSFTPStoreFollowsSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "keys", "admin"), "")
+	if err := os.Mkdir(filepath.Join(dir, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, ".ssh", "authorized_keys")
+	if err := os.Symlink("../keys/admin", link); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	client, closeRemote, err := pipeSFTP(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeRemote()
+
+	store := &sftpStore{client: client, host: "web1", path: remoteAuthorizedKeys}
+	if err := store.Save(doorman.ParseEntries([]byte(testKey + " alice\n"))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected the symlink to be kept, got %v %v", info, err)
+	}
+	if content := readFile(t, filepath.Join(dir, "keys", "admin")); content != testKey+" alice\n" {
+		t.Errorf("expected the symlink's target to be written, got %q", content)
+	}
+}
+
+func TestSFTPStoreFailedRenameLeavesNoTemporaryFile(t *testing.T) {
+	dir := t.TempDir()
+	// A directory in the way makes the rename fail
+	writeFile(t, filepath.Join(dir, ".ssh", "authorized_keys", "in-the-way"), "")
+	client, closeRemote, err := pipeSFTP(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeRemote()
+
+	store := &sftpStore{client: client, host: "web1", path: remoteAuthorizedKeys}
+	err = store.Save(doorman.ParseEntries([]byte(testKey + " alice\n")))
+	if err == nil || !strings.Contains(err.Error(), "error replacing web1:.ssh/authorized_keys") {
+		t.Errorf("expected the rename to fail, got %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, ".ssh"))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected no temporary file to be left, got %v %v", entries, err)
+	}
+}
+
+// sshServer accepts SSH connections on a local port with a fresh host key,
+// returning its address.
+func sshServer(t *testing.T) string {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ssh.NewServerConn(conn, config)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestConnectSFTPChecksHostKeys(t *testing.T) {
+	address := sshServer(t)
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, err := ssh.NewPublicKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		knownHosts string
+		expected   string
+	}{
+		{"unknown host", "", "is not in"},
+		{"changed host key", knownhosts.Line([]string{address}, otherPublic) + "\n", "doesn't match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			knownHostsPath := filepath.Join(t.TempDir(), "known_hosts")
+			writeFile(t, knownHostsPath, tt.knownHosts)
+			callback, err := knownhosts.New(knownHostsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &ssh.ClientConfig{User: "admin", HostKeyCallback: callback, Timeout: time.Second}
+			_, _, err = connectSFTP(context.Background(), address, config, knownHostsPath)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected an error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestConnectSFTPRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	config := &ssh.ClientConfig{User: "admin", HostKeyCallback: ssh.InsecureIgnoreHostKey(), Timeout: time.Second}
+	if _, _, err := connectSFTP(context.Background(), address, config, "known_hosts"); err == nil {
+		t.Error("expected a refused connection to fail")
+	}
+}
+
+func TestRunRemoteConnectionFailure(t *testing.T) {
+	e := newTestEnv(t)
+	e.openRemote = func(ctx context.Context, host string) (*sftp.Client, func() error, error) {
+		return nil, nil, &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}
+	}
+	e.mockKeys(testKey)
+	err := run(e.deps, []string{"doorman", "--yes", "--host", "web1", "add", "alice"})
+	if exitCodeFor(err) != exitRemote || !strings.Contains(err.Error(), "error connecting to web1") {
+		t.Errorf("expected a remote failure, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// installsKeys reports whether action may add keys to authorized_keys.
+func installsKeys(action string) bool {
+	switch action {
+	case "add", "sync", "apply", "add-ca", "serve", "systemd-install":
+		return true
+	}
+	return false
+}
+
+// checkRootTarget refuses to install keys in root's authorized_keys, the
+// file at path, without --allow-root (or --really-root): third-party keys
+// on root are almost always a mistake.
+func (a *app) checkRootTarget(action, path string) error {
+	if !installsKeys(action) || a.opts.allowRoot || a.opts.reallyRoot {
+		return nil
+	}
+	root, err := a.isRootKeysFile(path)
+	if err != nil || !root {
+		return err
+	}
+	a.logger.Warn("root_refused", "path", path, "action", action)
+	return withExitCode(exitUsage, fmt.Errorf("refusing to install keys in root's authorized_keys %s: anyone holding them could log in as root; use --file to manage another user's keys, or pass --allow-root if this is really meant", path))
+}
+
+// isRootKeysFile reports whether path, the authorized_keys file chosen for
+// the current action, lets its keys log in as root.
+func (a *app) isRootKeysFile(path string) (bool, error) {
+	// BEHAVIOR: A home under --home-dir belongs to the image or chroot
+	// being prepared, whoever it's named after
+	if a.opts.homeDir != "" || a.onWindows() {
+		return false, nil
+	}
+	if a.opts.host != "" {
+		return isRemoteRootKeysFile(a.opts.host, path), nil
+	}
+	if a.opts.file == "" {
+		keysUser, err := a.keysUser()
+		if err != nil {
+			return false, err
+		}
+		if keysUser.Uid == "0" {
+			return true, nil
+		}
+	}
+	root, err := a.lookupUser("root")
+	if err != nil {
+		a.verbosef("Could not look up root's home directory: %v\n", err)
+		return false, nil
+	}
+	return withinDir(path, root.HomeDir), nil
+}
+
+// isRemoteRootKeysFile reports whether path, a file on host, is root's:
+// either relative to the home of a root login, or under /root.
+func isRemoteRootKeysFile(host, path string) bool {
+	login, _, found := strings.Cut(host, "@")
+	if found && login == "root" && !strings.HasPrefix(path, "/") {
+		return true
+	}
+	return strings.HasPrefix(path, "/root/")
+}
+
+// withinDir reports whether path, once absolute and with symlinks
+// resolved as far as they exist, lies under dir.
+func withinDir(path, dir string) bool {
+	path, dir = resolvePath(path), resolvePath(dir)
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath makes path absolute and resolves symlinks in the longest
+// part of it that exists, so a file not yet created still compares equal
+// to its directory's real location.
+func resolvePath(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path
+	}
+	return filepath.Join(resolvePath(parent), filepath.Base(path))
+}
+
+// storePath returns the local or remote path of the file store manages,
+// without the host prefix Path adds for --host.
+func storePath(store doorman.KeyStore) string {
+	if dry, ok := store.(*dryRunStore); ok {
+		return storePath(dry.KeyStore)
+	}
+	if sorted, ok := store.(*sortedStore); ok {
+		return storePath(sorted.KeyStore)
+	}
+	if remote, ok := store.(*sftpStore); ok {
+		return remote.path
+	}
+	return store.Path()
+}
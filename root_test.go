@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runAsRoot makes the current user root, with e.home as root's home.
+func (e *testEnv) runAsRoot() {
+	root := &user.User{Username: "root", Uid: "0", Gid: "0", HomeDir: e.home}
+	e.currentUser = func() (*user.User, error) { return root, nil }
+	e.lookupUser = func(username string) (*user.User, error) {
+		if username == "root" {
+			return root, nil
+		}
+		return nil, user.UnknownUserError(username)
+	}
+}
+
+func TestRunRefusesRoot(t *testing.T) {
+	e := newTestEnv(t)
+	e.runAsRoot()
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, testKey+" alice\n")
+	e.source = userSource{"alice": testKey, "bob": newTestKey(t)}
+
+	for _, action := range []string{"add", "sync", "serve"} {
+		err := run(e.deps, []string{"doorman", "--yes", action, "bob"})
+		if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "refusing to install keys in root's authorized_keys "+path) {
+			t.Errorf("expected %s to be refused, got %v", action, err)
+		}
+	}
+	if err := run(e.deps, []string{"doorman", "--yes", "remove", "alice"}); err != nil {
+		t.Fatalf("expected remove to be allowed, got %v", err)
+	}
+	if err := run(e.deps, []string{"doorman", "--yes", "--allow-root", "add", "bob"}); err != nil {
+		t.Fatalf("unexpected error with --allow-root: %v", err)
+	}
+	if content := readFile(t, path); !strings.HasSuffix(content, " bob"+today+"\n") {
+		t.Errorf("expected bob's key with --allow-root, got %q", content)
+	}
+}
+
+func TestRunRefusesRootFile(t *testing.T) {
+	e := newTestEnv(t)
+	rootHome := t.TempDir()
+	e.lookupUser = func(username string) (*user.User, error) {
+		return &user.User{Username: "root", Uid: "0", HomeDir: rootHome}, nil
+	}
+	e.source = userSource{"alice": testKey}
+
+	path := filepath.Join(rootHome, ".ssh", "authorized_keys")
+	err := run(e.deps, []string{"doorman", "--yes", "--file", path, "add", "alice"})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "refusing to install keys in root's authorized_keys") {
+		t.Errorf("expected --file under root's home to be refused, got %v", err)
+	}
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Errorf("expected the tester's own file to be allowed, got %v", err)
+	}
+}
+
+func TestIsRemoteRootKeysFile(t *testing.T) {
+	tests := []struct {
+		host     string
+		path     string
+		expected bool
+	}{
+		{"root@web1", ".ssh/authorized_keys", true},
+		{"root@web1:2222", ".ssh/authorized_keys", true},
+		{"admin@web1", ".ssh/authorized_keys", false},
+		{"web1", ".ssh/authorized_keys", false},
+		{"admin@web1", "/root/.ssh/authorized_keys", true},
+		{"root@web1", "/home/deploy/.ssh/authorized_keys", false},
+	}
+	for _, tt := range tests {
+		if actual := isRemoteRootKeysFile(tt.host, tt.path); actual != tt.expected {
+			t.Errorf("isRemoteRootKeysFile(%q, %q) = %v, expected %v", tt.host, tt.path, actual, tt.expected)
+		}
+	}
+}
+
+func TestWithinDir(t *testing.T) {
+	tests := []struct {
+		path     string
+		dir      string
+		expected bool
+	}{
+		{"/root/.ssh/authorized_keys", "/root", true},
+		{"/root/../home/alice/.ssh/authorized_keys", "/root", false},
+		{"/rootless/.ssh/authorized_keys", "/root", false},
+		{"/root", "/root", true},
+	}
+	for _, tt := range tests {
+		if actual := withinDir(tt.path, tt.dir); actual != tt.expected {
+			t.Errorf("withinDir(%q, %q) = %v, expected %v", tt.path, tt.dir, actual, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// keyRule is a rule keys must follow to be installed, such as pins or the
+// key policy.
+type keyRule struct {
+	// violation explains why key may not be installed for username, or is
+	// "" if it may
+	violation func(username string, key doorman.PublicKey) string
+	// warnOnly reports violations without refusing the keys
+	warnOnly bool
+}
+
+// keyRules returns the rules the configuration sets, if any.
+func (a *app) keyRules() ([]keyRule, error) {
+	var rules []keyRule
+	denied, err := a.loadDenyList()
+	if err != nil {
+		return nil, err
+	}
+	if denied != nil {
+		rules = append(rules, keyRule{violation: denied.violation})
+	}
+	p, err := a.loadPins()
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		rules = append(rules, keyRule{violation: p.violation})
+	}
+	policy, ok, err := a.policyRule()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		rules = append(rules, policy)
+	}
+	return rules, nil
+}
+
+// withRules restricts source to the keys the configured rules allow.
+func (a *app) withRules(source doorman.KeySource) (*ruleSource, error) {
+	rules, err := a.keyRules()
+	if err != nil {
+		return nil, err
+	}
+	return &ruleSource{KeySource: source, app: a, rules: rules}, nil
+}
+
+// ruleSource drops the fetched keys that break a rule, saying which and
+// why, and fails if none are left.
+type ruleSource struct {
+	doorman.KeySource
+	app   *app
+	rules []keyRule
+}
+
+// reload rereads the files the rules come from, so serve picks up a changed
+// deny or pin file without a restart. If they can't be read, the rules
+// already loaded stay in force.
+func (s *ruleSource) reload() {
+	rules, err := s.app.keyRules()
+	if err != nil {
+		s.app.logger.Error("rules_reload_failed", "error", err)
+		return
+	}
+	s.rules = rules
+}
+
+func (s *ruleSource) Keys(ctx context.Context, username string) ([]doorman.PublicKey, error) {
+	keys, err := s.KeySource.Keys(ctx, username)
+	if err != nil || len(s.rules) == 0 {
+		return keys, err
+	}
+	var allowed []doorman.PublicKey
+	var refused, warned []string
+	for _, key := range keys {
+		ok := true
+		for _, rule := range s.rules {
+			reason := rule.violation(username, key)
+			switch {
+			case reason == "":
+			case rule.warnOnly:
+				warned = append(warned, describeViolation(key, reason))
+			default:
+				refused = append(refused, describeViolation(key, reason))
+				ok = false
+			}
+		}
+		if ok {
+			allowed = append(allowed, key)
+		}
+	}
+
+	if len(refused) > 0 || len(warned) > 0 {
+		s.app.progress.interrupt()
+	}
+	if len(warned) > 0 {
+		fmt.Fprintf(s.app.stderr, "Warning: keeping %s's keys that break the key policy, as --policy-warn-only is set:\n", username)
+		for _, line := range warned {
+			fmt.Fprintln(s.app.stderr, "  "+line)
+		}
+	}
+	if len(refused) == 0 {
+		return allowed, nil
+	}
+	fmt.Fprintf(s.app.stderr, "Refusing %d of %s's %s:\n", len(keys)-len(allowed), username, countKeys(len(keys)))
+	for _, line := range refused {
+		fmt.Fprintln(s.app.stderr, "  "+line)
+	}
+	s.app.logger.Warn("keys_refused", "user", username, "refused", len(keys)-len(allowed))
+	if len(allowed) == 0 {
+		return nil, withExitCode(exitNoKeys, &refusedKeysError{username})
+	}
+	return allowed, nil
+}
+
+func describeViolation(key doorman.PublicKey, reason string) string {
+	return doorman.Key{PublicKey: key}.Describe() + ": " + reason
+}
+
+// refusedKeysError reports that every one of a user's keys broke a rule.
+type refusedKeysError struct {
+	user string
+}
+
+func (e *refusedKeysError) Error() string {
+	return fmt.Sprintf("none of %s's keys may be installed", e.user)
+}
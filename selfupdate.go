@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// version is the release doorman was built as, set with
+// -ldflags "-X main.version=v1.2.3"
+var version = "dev"
+
+const (
+	releasesURL = "https://api.github.com/repos/sultano/doorman/releases/latest"
+	// checksumsAsset lists the SHA256 of every other asset of a release, in
+	// sha256sum's format
+	checksumsAsset = "checksums.txt"
+	// maxBinarySize keeps a bad download from filling the disk
+	maxBinarySize = 100 << 20
+)
+
+// release is the part of GitHub's releases API response self-update uses.
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r release) assetURL(name string) (string, bool) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL, true
+		}
+	}
+	return "", false
+}
+
+// binaryAsset names the release asset built for the running platform.
+func (a *app) binaryAsset() string {
+	name := "doorman_" + a.goos + "_" + runtime.GOARCH
+	if a.onWindows() {
+		name += ".exe"
+	}
+	return name
+}
+
+// selfUpdate replaces the running binary with the latest release, or with
+// --check only reports whether there is one.
+func (a *app) selfUpdate(ctx context.Context) error {
+	latest, err := a.latestRelease(ctx)
+	if err != nil {
+		return withExitCode(exitFetch, fmt.Errorf("error checking for updates: %w", err))
+	}
+
+	newer, known := versionNewer(latest.TagName, version)
+	switch {
+	case a.opts.check && !known:
+		fmt.Fprintf(a.stdout, "The latest release is %s; this doorman is a development build\n", latest.TagName)
+		return nil
+	case a.opts.check && newer:
+		fmt.Fprintf(a.stdout, "Update available: %s (running %s)\n", latest.TagName, version)
+		return nil
+	case a.opts.check, known && !newer && !a.opts.force:
+		fmt.Fprintf(a.stdout, "doorman %s is up to date\n", version)
+		return nil
+	case !known && !a.opts.force:
+		return withExitCode(exitUsage, fmt.Errorf("this doorman is a development build; pass --force to replace it with %s", latest.TagName))
+	}
+
+	asset := a.binaryAsset()
+	binaryURL, ok := latest.assetURL(asset)
+	if !ok {
+		return withExitCode(exitFetch, fmt.Errorf("release %s has no build for %s/%s (%s)", latest.TagName, a.goos, runtime.GOARCH, asset))
+	}
+	checksumsURL, ok := latest.assetURL(checksumsAsset)
+	if !ok {
+		return withExitCode(exitFetch, fmt.Errorf("release %s has no %s to verify the download with", latest.TagName, checksumsAsset))
+	}
+	checksums, err := a.download(ctx, checksumsURL)
+	if err != nil {
+		return withExitCode(exitFetch, fmt.Errorf("error downloading %s: %w", checksumsAsset, err))
+	}
+	expected, ok := findChecksum(checksums, asset)
+	if !ok {
+		return withExitCode(exitFetch, fmt.Errorf("%s of release %s doesn't list %s", checksumsAsset, latest.TagName, asset))
+	}
+	binary, err := a.download(ctx, binaryURL)
+	if err != nil {
+		return withExitCode(exitFetch, fmt.Errorf("error downloading %s: %w", asset, err))
+	}
+	sum := sha256.Sum256(binary)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return withExitCode(exitFetch, fmt.Errorf("checksum mismatch for %s: expected %s, got %s; nothing was replaced", asset, expected, actual))
+	}
+
+	path, err := a.executable()
+	if err == nil {
+		path, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		return fmt.Errorf("error locating the doorman executable: %w", err)
+	}
+	if err := a.replaceBinary(path, binary); err != nil {
+		return withExitCode(exitFile, err)
+	}
+	fmt.Fprintf(a.stdout, "Updated %s from %s to %s\n", path, version, latest.TagName)
+	return nil
+}
+
+func (a *app) latestRelease(ctx context.Context) (release, error) {
+	var latest release
+	data, err := a.download(ctx, releasesURL)
+	if err != nil {
+		return latest, err
+	}
+	if err := json.Unmarshal(data, &latest); err != nil {
+		return latest, fmt.Errorf("unexpected response from %s: %w", releasesURL, err)
+	}
+	if latest.TagName == "" {
+		return latest, fmt.Errorf("unexpected response from %s: no tag_name", releasesURL)
+	}
+	return latest, nil
+}
+
+// download returns the body of url, failing on anything but 200 OK.
+func (a *app) download(ctx context.Context, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := a.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %d", url, response.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxBinarySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBinarySize {
+		return nil, fmt.Errorf("%s is larger than %d MB", url, maxBinarySize>>20)
+	}
+	return data, nil
+}
+
+// findChecksum returns the hex SHA256 listed for name in checksums.
+func findChecksum(checksums []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// sha256sum marks files read in binary mode with '*'
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+// replaceBinary writes binary next to path and renames it into place, so
+// the binary is never half-written.
+func (a *app) replaceBinary(path string, binary []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".doorman-update-*")
+	if errors.Is(err, fs.ErrPermission) {
+		// BEHAVIOR: The usual cause is a binary installed by root and
+		// updated as someone else
+		name := "this user"
+		if currentUser, err := a.currentUser(); err == nil {
+			name = currentUser.Username
+		}
+		return fmt.Errorf("can't replace %s: %s isn't writable by %s; run self-update as the binary's owner, e.g. with sudo", path, dir, name)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing the new binary: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(binary)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0755)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing the new binary: %w", err)
+	}
+
+	if !a.onWindows() {
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return fmt.Errorf("error replacing %s: %w", path, err)
+		}
+		return nil
+	}
+	// Windows won't replace a running executable, but lets it be renamed
+	// out of the way
+	old := path + ".old"
+	os.Remove(old)
+	if err := os.Rename(path, old); err != nil {
+		return fmt.Errorf("error moving %s aside: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		// BEHAVIOR: Put the running binary back rather than leave no doorman
+		// at path
+		if restoreErr := os.Rename(old, path); restoreErr != nil {
+			return fmt.Errorf("error replacing %s: %w; the previous binary is at %s", path, err, old)
+		}
+		return fmt.Errorf("error replacing %s: %w", path, err)
+	}
+	return nil
+}
+
+// versionNewer reports whether release is a later version than current.
+// known is false when either isn't of the vMAJOR.MINOR.PATCH form, as with
+// development builds.
+func versionNewer(release, current string) (newer, known bool) {
+	r, ok := parseVersion(release)
+	if !ok {
+		return false, false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return false, false
+	}
+	for i := range r {
+		if r[i] != c[i] {
+			return r[i] > c[i], true
+		}
+	}
+	return false, true
+}
+
+func parseVersion(v string) ([3]int, bool) {
+	var parsed [3]int
+	parts := strings.Split(strings.TrimPrefix(v, "v"), ".")
+	if len(parts) != len(parsed) {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
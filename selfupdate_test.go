@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mockRelease serves a release tagged tag whose binary for the running
+// platform is binary, listed in its checksums file with checksum.
+func (e *testEnv) mockRelease(tag, binary, checksum string) {
+	asset := e.binaryAsset()
+	responses := map[string]string{
+		releasesURL: `{"tag_name":"` + tag + `","assets":[` +
+			`{"name":"` + asset + `","browser_download_url":"https://example.com/` + asset + `"},` +
+			`{"name":"checksums.txt","browser_download_url":"https://example.com/checksums.txt"}]}`,
+		"https://example.com/" + asset:      binary,
+		"https://example.com/checksums.txt": checksum + "  " + asset + "\n",
+	}
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		body, ok := responses[request.URL.String()]
+		if !ok {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+	})
+}
+
+func setVersion(t *testing.T, v string) {
+	old := version
+	version = v
+	t.Cleanup(func() { version = old })
+}
+
+func TestSelfUpdate(t *testing.T) {
+	e := newTestEnv(t)
+	setVersion(t, "v1.2.0")
+	binary := filepath.Join(e.home, "doorman")
+	writeFile(t, binary, "old")
+	e.executable = func() (string, error) { return binary, nil }
+	e.mockRelease("v1.10.0", "new", sha256Hex("new"))
+
+	if err := run(e.deps, []string{"doorman", "self-update", "--check"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.String() != "Update available: v1.10.0 (running v1.2.0)\n" || readFile(t, binary) != "old" {
+		t.Errorf("expected --check only to report the update, got %q", e.out.String())
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "self-update"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, binary); content != "new" {
+		t.Errorf("expected the binary to be replaced, got %q", content)
+	}
+	if info, err := os.Stat(binary); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("expected the new binary to be executable, got %v %v", info, err)
+	}
+	if e.out.String() != "Updated "+binary+" from v1.2.0 to v1.10.0\n" {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+}
+
+func TestSelfUpdateChecksumMismatch(t *testing.T) {
+	e := newTestEnv(t)
+	setVersion(t, "v1.2.0")
+	binary := filepath.Join(e.home, "doorman")
+	writeFile(t, binary, "old")
+	e.executable = func() (string, error) { return binary, nil }
+	e.mockRelease("v1.3.0", "tampered", sha256Hex("new"))
+
+	err := run(e.deps, []string{"doorman", "self-update"})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") || exitCodeFor(err) != exitFetch {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+	if content := readFile(t, binary); content != "old" {
+		t.Errorf("expected the binary to be left alone, got %q", content)
+	}
+}
+
+func TestSelfUpdateUpToDate(t *testing.T) {
+	e := newTestEnv(t)
+	setVersion(t, "v1.3.0")
+	e.mockRelease("v1.3.0", "new", sha256Hex("new"))
+
+	if err := run(e.deps, []string{"doorman", "self-update"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.String() != "doorman v1.3.0 is up to date\n" {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+
+	setVersion(t, "dev")
+	err := run(e.deps, []string{"doorman", "self-update"})
+	if err == nil || !strings.Contains(err.Error(), "development build") {
+		t.Errorf("expected a development build not to be replaced, got %v", err)
+	}
+}
+
+func TestVersionNewer(t *testing.T) {
+	tests := []struct {
+		release, current string
+		newer, known     bool
+	}{
+		{"v1.10.0", "v1.9.3", true, true},
+		{"v1.2.0", "v1.2.0", false, true},
+		{"v1.2.0", "v2.0.0", false, true},
+		{"v1.2.0", "dev", false, false},
+		{"nightly", "v1.2.0", false, false},
+	}
+	for _, tt := range tests {
+		newer, known := versionNewer(tt.release, tt.current)
+		if newer != tt.newer || known != tt.known {
+			t.Errorf("versionNewer(%q, %q) = %v, %v; expected %v, %v", tt.release, tt.current, newer, known, tt.newer, tt.known)
+		}
+	}
+}
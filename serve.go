@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxWebhookBody bounds the payloads serve reads; GitHub's are far smaller
+const maxWebhookBody = 1 << 20
+
+// signatureHeader carries the payload's HMAC-SHA256, as GitHub sends it
+const signatureHeader = "X-Hub-Signature-256"
+
+// syncQueue coalesces requests for a sync: however many arrive while a sync
+// is running, at most one more follows it.
+type syncQueue chan struct{}
+
+func newSyncQueue() syncQueue {
+	return make(syncQueue, 1)
+}
+
+// request asks for a sync without waiting for it.
+func (q syncQueue) request() {
+	select {
+	case q <- struct{}{}:
+	default:
+	}
+}
+
+// run calls sync for each request until ctx is done.
+func (q syncQueue) run(ctx context.Context, sync func(context.Context)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q:
+			sync(ctx)
+		}
+	}
+}
+
+// readWebhookSecret reads the shared secret webhooks are signed with.
+func readWebhookSecret(path string) ([]byte, error) {
+	if path == "" {
+		return nil, withExitCode(exitUsage, fmt.Errorf("serve needs --secret-file, a file holding the webhook secret"))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading webhook secret: %w", err)
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, withExitCode(exitUsage, fmt.Errorf("webhook secret file %s is empty", path))
+	}
+	return secret, nil
+}
+
+// validSignature reports whether signature, "sha256=" and the hex HMAC, is
+// body's HMAC-SHA256 under secret.
+func validSignature(secret, body []byte, signature string) bool {
+	digest, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// webhookHandler requests a sync for every POST signed with secret. It
+// answers before the sync runs.
+func (a *app) webhookHandler(secret []byte, queue syncQueue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+		if err != nil {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if !validSignature(secret, body, r.Header.Get(signatureHeader)) {
+			a.logger.Warn("webhook_rejected", "remote", r.RemoteAddr, "reason", "invalid signature")
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		a.logger.Info("webhook_accepted", "remote", r.RemoteAddr, "event", r.Header.Get("X-GitHub-Event"))
+		queue.request()
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// serve listens on --webhook until ctx is done, calling sync on starting,
+// after each signed POST and every --interval, one sync at a time.
+func (a *app) serve(ctx context.Context, sync func(context.Context)) error {
+	if a.opts.webhook == "" {
+		return withExitCode(exitUsage, fmt.Errorf("serve needs --webhook, the address to listen on, e.g. --webhook :9876"))
+	}
+	secret, err := readWebhookSecret(a.opts.secretFile)
+	if err != nil {
+		return err
+	}
+	interval, err := a.syncInterval()
+	if err != nil {
+		return err
+	}
+	// BEHAVIOR: By default a single missed sync doesn't make serve unhealthy
+	maxAge := 2 * interval
+	if a.opts.healthMaxAge != "" {
+		if maxAge, err = parseAge(a.opts.healthMaxAge); err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("invalid --health-max-age '%s': %w", a.opts.healthMaxAge, err))
+		}
+	}
+	a.health = newHealth(maxAge)
+	listener, err := net.Listen("tcp", a.opts.webhook)
+	if err != nil {
+		return fmt.Errorf("error listening for webhooks: %w", err)
+	}
+
+	if a.metrics != nil {
+		metricsListener, err := net.Listen("tcp", a.metricsAddress())
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("error listening for metrics: %w", err)
+		}
+		fmt.Fprintf(a.stdout, "Serving metrics on http://%s/metrics\n", metricsListener.Addr())
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			if err := a.serveMetrics(ctx, metricsListener); err != nil {
+				a.logger.Error("metrics_failed", "error", err)
+			}
+		}()
+	}
+	return a.serveWebhooks(ctx, listener, secret, interval, sync)
+}
+
+// serveWebhooks serves webhooks, and /healthz if a.health is set, on
+// listener. A sync runs straight away and, unless interval is 0, every
+// interval after.
+func (a *app) serveWebhooks(ctx context.Context, listener net.Listener, secret []byte, interval time.Duration, sync func(context.Context)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := newSyncQueue()
+	mux := http.NewServeMux()
+	mux.Handle("/", a.webhookHandler(secret, queue))
+	if a.health != nil {
+		mux.Handle("/healthz", a.healthHandler())
+	}
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Fprintf(a.stdout, "Listening for webhooks on %s\n", listener.Addr())
+
+	var progress syncProgress
+	queue.request()
+	synced := make(chan struct{})
+	go func() {
+		defer close(synced)
+		queue.run(ctx, progress.track(a.now, sync))
+	}()
+	if interval > 0 {
+		go tick(ctx, interval, queue.request)
+	}
+	if err := a.notifySystemd("READY=1"); err != nil {
+		a.logger.Warn("systemd_notify_failed", "error", err)
+	}
+	if watchdog := a.watchdogInterval(); watchdog > 0 {
+		go tick(ctx, watchdog, func() {
+			// BEHAVIOR: Stop pinging once a sync has run for longer than
+			// WatchdogSec, so systemd restarts a serve that is stuck
+			if limit := 2 * watchdog; progress.stuck(a.now(), limit) {
+				a.logger.Warn("sync_stuck", "limit", limit)
+				return
+			}
+			if err := a.notifySystemd("WATCHDOG=1"); err != nil {
+				a.logger.Warn("systemd_notify_failed", "error", err)
+			}
+		})
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	err := server.Serve(listener)
+	cancel()
+	<-synced
+	_ = a.notifySystemd("STOPPING=1")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// tick calls fn every interval until ctx is done.
+func tick(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
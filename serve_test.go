@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const webhookSecret = "s3cret"
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookHandler(t *testing.T) {
+	body := `{"action":"member_removed"}`
+	tests := []struct {
+		name       string
+		method     string
+		signature  string
+		wantStatus int
+		wantSync   bool
+	}{
+		{"signed", http.MethodPost, sign(webhookSecret, body), http.StatusAccepted, true},
+		{"wrong secret", http.MethodPost, sign("guess", body), http.StatusUnauthorized, false},
+		{"unsigned", http.MethodPost, "", http.StatusUnauthorized, false},
+		{"malformed", http.MethodPost, "sha256=zz", http.StatusUnauthorized, false},
+		{"sha1", http.MethodPost, "sha1=" + strings.TrimPrefix(sign(webhookSecret, body), "sha256="), http.StatusUnauthorized, false},
+		{"get", http.MethodGet, sign(webhookSecret, body), http.StatusMethodNotAllowed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			queue := newSyncQueue()
+			request := httptest.NewRequest(tt.method, "/", strings.NewReader(body))
+			if tt.signature != "" {
+				request.Header.Set(signatureHeader, tt.signature)
+			}
+			recorder := httptest.NewRecorder()
+
+			e.webhookHandler([]byte(webhookSecret), queue).ServeHTTP(recorder, request)
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, recorder.Code)
+			}
+			if synced := len(queue) == 1; synced != tt.wantSync {
+				t.Errorf("expected sync requested %v, got %v", tt.wantSync, synced)
+			}
+			if rejected := strings.Contains(e.errOut.String(), "webhook_rejected"); rejected != (tt.wantStatus == http.StatusUnauthorized) {
+				t.Errorf("unexpected log %q", e.errOut.String())
+			}
+		})
+	}
+}
+
+func TestSyncQueueCoalesces(t *testing.T) {
+	queue := newSyncQueue()
+	for i := 0; i < 5; i++ {
+		queue.request()
+	}
+	if len(queue) != 1 {
+		t.Errorf("expected one pending sync, got %d", len(queue))
+	}
+}
+
+func TestServeWebhooks(t *testing.T) {
+	e := newTestEnv(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	synced := make(chan struct{}, 10)
+	served := make(chan error)
+	go func() {
+		served <- e.serveWebhooks(ctx, listener, []byte(webhookSecret), 0, func(context.Context) {
+			synced <- struct{}{}
+		})
+	}()
+	expectSync := func(why string) {
+		t.Helper()
+		select {
+		case <-synced:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a sync " + why)
+		}
+	}
+	expectSync("on starting")
+
+	request, err := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+"/", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(signatureHeader, sign(webhookSecret, "{}"))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		t.Errorf("expected status %d, got %d", http.StatusAccepted, response.StatusCode)
+	}
+	expectSync("after the webhook")
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected serve to stop")
+	}
+}
+
+func TestRunServeInvalidArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		args    []string
+		wantErr string
+	}{
+		{"no webhook", webhookSecret, []string{"serve", "alice"}, "serve needs --webhook"},
+		{"no secret file", webhookSecret, []string{"serve", "--webhook", "127.0.0.1:0", "alice"}, "serve needs --secret-file"},
+		{"empty secret", "\n", []string{"serve", "--webhook", "127.0.0.1:0", "--secret-file", "SECRET", "alice"}, "is empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.mockKeys(testKey)
+			secretPath := filepath.Join(e.home, "secret")
+			writeFile(t, secretPath, tt.secret)
+			args := []string{"doorman"}
+			for _, arg := range tt.args {
+				args = append(args, strings.ReplaceAll(arg, "SECRET", secretPath))
+			}
+			if code := runMain(e.deps, args); code != exitUsage || !strings.Contains(e.errOut.String(), tt.wantErr) {
+				t.Errorf("expected exit code %d and %q, got %d and %q", exitUsage, tt.wantErr, code, e.errOut.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// listSSHAgentKeys returns the keys loaded in the agent at SSH_AUTH_SOCK.
+func listSSHAgentKeys() ([]doorman.PublicKey, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := make([]doorman.PublicKey, len(keys))
+	for i, key := range keys {
+		loaded[i] = doorman.PublicKey{Type: key.Format, Blob: base64.StdEncoding.EncodeToString(key.Blob), Comment: key.Comment}
+	}
+	return loaded, nil
+}
+
+// confirmSessionKeyRemoval guards against removing the key the current SSH
+// session logged in with. When connected over SSH it compares the keys being
+// removed with those in the agent, or warns generically when the agent can't
+// be asked, and then requires the username to be typed to proceed.
+func (a *app) confirmSessionKeyRemoval(ctx context.Context, removing []doorman.Key, username string) error {
+	if a.opts.force || len(removing) == 0 || a.getenv("SSH_CONNECTION") == "" {
+		return nil
+	}
+
+	agentKeys, err := a.listAgentKeys()
+	if err != nil {
+		a.verbosef("Could not list SSH agent keys: %v\n", err)
+		fmt.Fprintln(a.stderr, "Warning: you appear to be connected via SSH and are removing keys that may include your own.")
+	} else {
+		loaded := make(map[doorman.KeyID]bool)
+		for _, key := range agentKeys {
+			loaded[key.ID()] = true
+		}
+		var matches []doorman.Key
+		for _, key := range removing {
+			if loaded[key.ID()] {
+				matches = append(matches, key)
+			}
+		}
+		if len(matches) == 0 {
+			a.verbosef("None of the keys being removed are loaded in your SSH agent\n")
+			return nil
+		}
+		fmt.Fprintf(a.stderr, "Warning: you are connected via SSH and %d of the keys being removed %s loaded in your SSH agent; removing them may lock you out:\n", len(matches), pluralVerb(len(matches)))
+		for _, key := range matches {
+			fmt.Fprintln(a.stderr, "  "+key.Describe())
+		}
+	}
+
+	// BEHAVIOR: --yes answers ordinary questions, but losing access is
+	// only bypassed by the explicit --force
+	if a.opts.yes {
+		return withExitCode(exitUsage, fmt.Errorf("refusing to remove keys that may belong to this SSH session without --force"))
+	}
+
+	return a.confirmByTyping(ctx, username)
+}
+
+// confirmByTyping asks for username to be typed, for changes too risky
+// for a yes, and fails with doorman.ErrAborted unless it is.
+func (a *app) confirmByTyping(ctx context.Context, username string) error {
+	return a.confirmTyped(ctx, fmt.Sprintf("Type the username '%s' to confirm: ", username), username)
+}
+
+// confirmTyped asks prompt, failing with doorman.ErrAborted unless answer
+// is typed.
+func (a *app) confirmTyped(ctx context.Context, prompt, answer string) error {
+	fmt.Fprint(a.stdout, prompt)
+	line, err := a.readAnswer(ctx)
+	if errors.Is(err, errPromptTimeout) {
+		return doorman.ErrAborted
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil && len(line) == 0 {
+		fmt.Fprintln(a.stdout)
+		return doorman.ErrAborted
+	}
+	if strings.TrimSpace(line) != answer {
+		return doorman.ErrAborted
+	}
+	return nil
+}
+
+func pluralVerb(n int) string {
+	if n == 1 {
+		return "is"
+	}
+	return "are"
+}
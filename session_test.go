@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+func (e *testEnv) mockSSHSession(agentBlobs []string, agentErr error) {
+	e.getenv = func(key string) string {
+		if key == "SSH_CONNECTION" {
+			return "203.0.113.5 50022 198.51.100.7 22"
+		}
+		return ""
+	}
+	e.listAgentKeys = func() ([]doorman.PublicKey, error) {
+		keys := make([]doorman.PublicKey, len(agentBlobs))
+		for i, blob := range agentBlobs {
+			keys[i] = doorman.PublicKey{Type: "ssh-ed25519", Blob: blob}
+		}
+		return keys, agentErr
+	}
+}
+
+func TestConfirmSessionKeyRemoval(t *testing.T) {
+	removing := []doorman.Key{{Line: "ssh-ed25519 MINE alice", PublicKey: doorman.PublicKey{Type: "ssh-ed25519", Blob: "MINE", Comment: "alice"}}}
+
+	tests := []struct {
+		name        string
+		session     bool
+		agentBlobs  []string
+		agentErr    error
+		force       bool
+		yes         bool
+		input       string
+		expectError error
+		warning     string
+	}{
+		{name: "not over ssh", session: false},
+		{name: "agent has other keys", session: true, agentBlobs: []string{"OTHER"}},
+		{name: "agent key typed username", session: true, agentBlobs: []string{"MINE"}, input: "alice\n", warning: "1 of the keys being removed is loaded"},
+		{name: "agent key wrong username", session: true, agentBlobs: []string{"MINE"}, input: "yes\n", expectError: doorman.ErrAborted, warning: "may lock you out:\n  ssh-ed25519 MINE alice\n"},
+		{name: "agent key EOF", session: true, agentBlobs: []string{"MINE"}, input: "", expectError: doorman.ErrAborted},
+		{name: "no agent typed username", session: true, agentErr: errors.New("no agent"), input: "alice\n", warning: "may include your own"},
+		{name: "force", session: true, agentBlobs: []string{"MINE"}, force: true},
+		{name: "yes without force", session: true, agentBlobs: []string{"MINE"}, yes: true, expectError: errors.New("without --force")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+
+			if tt.session {
+				e.mockSSHSession(tt.agentBlobs, tt.agentErr)
+			}
+			e.opts.force = tt.force
+			e.opts.yes = tt.yes
+			errOut := e.errOut
+			e.mockStdin(tt.input)
+
+			err := e.confirmSessionKeyRemoval(context.Background(), removing, "alice")
+			switch {
+			case tt.expectError == nil && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.expectError == doorman.ErrAborted && !errors.Is(err, doorman.ErrAborted):
+				t.Errorf("expected doorman.ErrAborted, got %v", err)
+			case tt.expectError != nil && tt.expectError != doorman.ErrAborted && (err == nil || !strings.Contains(err.Error(), tt.expectError.Error())):
+				t.Errorf("expected error containing %q, got %v", tt.expectError, err)
+			}
+			if !strings.Contains(errOut.String(), tt.warning) {
+				t.Errorf("expected warning containing %q, got %q", tt.warning, errOut.String())
+			}
+		})
+	}
+}
+
+func TestRunRemoveOwnSessionKey(t *testing.T) {
+	e := newTestEnv(t)
+
+	authorizedKeysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	original := "ssh-ed25519 MINE alice\nssh-rsa OTHER bob"
+	os.WriteFile(authorizedKeysPath, []byte(original), 0600)
+
+	e.mockSSHSession([]string{"MINE"}, nil)
+	e.mockKeys("ssh-ed25519 MINE")
+	e.mockStdin("yes\nnope\n")
+
+	err := run(e.deps, []string{"doorman", "remove", "alice"})
+	if exitCodeFor(err) != exitAborted {
+		t.Fatalf("expected abort, got %v", err)
+	}
+	if content, _ := os.ReadFile(authorizedKeysPath); string(content) != original {
+		t.Error("file should not be modified")
+	}
+
+	err = run(e.deps, []string{"doorman", "remove", "alice", "--yes", "--force"})
+	if err != nil {
+		t.Fatalf("unexpected error with --force: %v", err)
+	}
+	if content, _ := os.ReadFile(authorizedKeysPath); strings.Contains(string(content), "alice") {
+		t.Error("alice's key should be removed with --force")
+	}
+}
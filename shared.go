@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// confirmSharedKeys warns about keys about to be added for username that
+// are already installed for someone else, since a key shared by several
+// people can't tell them apart, and asks for the username to be typed to go
+// on. --yes alone refuses; --force goes on with the warning.
+func (a *app) confirmSharedKeys(ctx context.Context, adding, installed []doorman.Key, username string) error {
+	if strings.HasPrefix(username, caLabelPrefix) {
+		return nil
+	}
+	owners := a.keyOwners(installed)
+	var shared []string
+	for _, key := range adding {
+		var others []string
+		for _, owner := range owners[key.ID()] {
+			if owner != username {
+				others = append(others, owner)
+			}
+		}
+		if len(others) > 0 {
+			shared = append(shared, key.Describe()+" is installed for "+joinNames(others))
+		}
+	}
+	if len(shared) == 0 {
+		return nil
+	}
+
+	a.progress.interrupt()
+	fmt.Fprintf(a.stderr, "Warning: %d of the keys being added for %s %s already installed for other users:\n", len(shared), username, pluralVerb(len(shared)))
+	for _, line := range shared {
+		fmt.Fprintln(a.stderr, "  "+line)
+	}
+	if a.opts.force {
+		return nil
+	}
+	if a.opts.yes {
+		return withExitCode(exitUsage, fmt.Errorf("refusing to install keys already installed for other users without --force"))
+	}
+	return a.confirmByTyping(ctx, username)
+}
+
+// keyOwners maps each key's ID to the users it is installed for, in
+// order and without repeats. Unlabeled keys and CAs have no owner.
+func (a *app) keyOwners(keys []doorman.Key) map[doorman.KeyID][]string {
+	owners := make(map[doorman.KeyID][]string)
+	for _, key := range keys {
+		label := a.keyUser(key)
+		if label == "" || strings.HasPrefix(label, caLabelPrefix) || slices.Contains(owners[key.ID()], label) {
+			continue
+		}
+		owners[key.ID()] = append(owners[key.ID()], label)
+	}
+	return owners
+}
+
+// sharedKeyProblems reports each key installed under more than one label,
+// once, against the first.
+func (a *app) sharedKeyProblems(keys []doorman.Key) []problem {
+	owners := a.keyOwners(keys)
+	var problems []problem
+	reported := make(map[doorman.KeyID]bool)
+	for _, key := range keys {
+		labels := owners[key.ID()]
+		if len(labels) < 2 || reported[key.ID()] {
+			continue
+		}
+		reported[key.ID()] = true
+		others := append([]string(nil), labels[1:]...)
+		sort.Strings(others)
+		problems = append(problems, problem{labels[0], key, "the same key is installed for " + joinNames(others)})
+	}
+	return problems
+}
+
+// joinNames lists names as "alice", "alice and bob" or "alice, bob and
+// carol".
+func joinNames(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
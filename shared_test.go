@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+func TestConfirmSharedKeys(t *testing.T) {
+	installed := doorman.ParseKeys([]byte("ssh-ed25519 SHARED bob\nssh-ed25519 SHARED carol\nssh-ed25519 MINE alice\nssh-ed25519 CA doorman-ca:corp\n"))
+	shared := []doorman.Key{{Line: "ssh-ed25519 SHARED", PublicKey: doorman.PublicKey{Type: "ssh-ed25519", Blob: "SHARED"}}}
+
+	tests := []struct {
+		name        string
+		adding      []doorman.Key
+		username    string
+		force       bool
+		yes         bool
+		input       string
+		expectError error
+		warning     string
+	}{
+		{name: "own key", adding: doorman.ParseKeys([]byte("ssh-ed25519 MINE")), username: "alice"},
+		{name: "ca key", adding: doorman.ParseKeys([]byte("ssh-ed25519 CA")), username: "alice"},
+		{name: "typed username", adding: shared, username: "alice", input: "alice\n", warning: "1 of the keys being added for alice is already installed for other users:\n  ssh-ed25519 SHARED is installed for bob and carol\n"},
+		{name: "wrong username", adding: shared, username: "alice", input: "yes\n", expectError: doorman.ErrAborted, warning: "already installed"},
+		{name: "force", adding: shared, username: "alice", force: true, warning: "is installed for bob and carol"},
+		{name: "yes without force", adding: shared, username: "alice", yes: true, expectError: errors.New("without --force"), warning: "already installed"},
+		{name: "shared with itself", adding: shared, username: "bob", input: "bob\n", warning: "is installed for carol\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.opts.force = tt.force
+			e.opts.yes = tt.yes
+			errOut := e.errOut
+			e.mockStdin(tt.input)
+
+			err := e.confirmSharedKeys(context.Background(), tt.adding, installed, tt.username)
+			switch {
+			case tt.expectError == nil && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.expectError == doorman.ErrAborted && !errors.Is(err, doorman.ErrAborted):
+				t.Errorf("expected doorman.ErrAborted, got %v", err)
+			case tt.expectError != nil && tt.expectError != doorman.ErrAborted && (err == nil || !strings.Contains(err.Error(), tt.expectError.Error())):
+				t.Errorf("expected error containing %q, got %v", tt.expectError, err)
+			}
+			if tt.warning == "" && errOut.Len() > 0 {
+				t.Errorf("expected no warning, got %q", errOut.String())
+			}
+			if !strings.Contains(errOut.String(), tt.warning) {
+				t.Errorf("expected warning containing %q, got %q", tt.warning, errOut.String())
+			}
+		})
+	}
+}
+
+func TestRunAddSharedKey(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, testKey+" bob\n")
+	e.source = userSource{"alice": testKey}
+
+	err := run(e.deps, []string{"doorman", "--yes", "add", "alice"})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "without --force") {
+		t.Fatalf("expected the shared key to be refused, got %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" bob\n" {
+		t.Errorf("file should not be modified, got %q", content)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--force", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error with --force: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" bob\n"+testKey+" alice"+today+"\n" {
+		t.Errorf("expected alice's key with --force, got %q", content)
+	}
+}
+
+func TestRunCheckSharedKeys(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, testKey+" alice\n"+newTestKey(t)+" bob\n"+testKey+" carol\n"+testKey+" alice\n")
+
+	err := run(e.deps, []string{"doorman", "check"})
+	if exitCodeFor(err) != exitProblems || err.Error() != "found 1 problem in "+path {
+		t.Errorf("expected one problem, got %v", err)
+	}
+	if expected := "alice: 256 " + testKeyFingerprint + " alice (ED25519): the same key is installed for carol\n"; !strings.Contains(e.out.String(), expected) {
+		t.Errorf("expected %q, got %q", expected, e.out.String())
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+	"golang.org/x/crypto/ssh"
+)
+
+// signatureNamespace is the namespace key lists must be signed in, as in
+//
+//	ssh-keygen -Y sign -f signing_key -n doorman alice.keys
+const signatureNamespace = "doorman"
+
+// allowedSigner is an entry of allowed_signers: a key trusted to sign key
+// lists, and the principals it was listed for.
+type allowedSigner struct {
+	principals string
+	key        ssh.PublicKey
+}
+
+// readAllowedSigners reads a file in ssh-keygen's allowed signers format:
+// lines of comma-separated principals, optional namespaces="..." and the
+// key. Keys limited to other namespaces are skipped. Blank lines and #
+// comments are skipped too.
+func readAllowedSigners(path string) ([]allowedSigner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading allowed_signers: %w", err)
+	}
+	var signers []allowedSigner
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		principals, rest, _ := strings.Cut(line, " ")
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(rest))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: expected principals followed by a public key: %w", path, n, err)
+		}
+		allowed := true
+		for _, option := range options {
+			name, value, _ := strings.Cut(option, "=")
+			if !strings.EqualFold(name, "namespaces") {
+				return nil, fmt.Errorf("%s:%d: the %s option isn't supported", path, n, name)
+			}
+			allowed = slices.Contains(strings.Split(strings.Trim(value, `"`), ","), signatureNamespace)
+		}
+		if allowed {
+			signers = append(signers, allowedSigner{principals, key})
+		}
+	}
+	return signers, scanner.Err()
+}
+
+// signatureError reports that a user's key list didn't carry a valid
+// signature from a key in allowed_signers.
+type signatureError struct {
+	reason string
+}
+
+func (e *signatureError) Error() string {
+	return "signature check failed: " + e.reason
+}
+
+// sshSignature is the blob inside an armored ssh-keygen -Y sign signature.
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// verifySignature checks that armored is a signature over message, in
+// signatureNamespace, by one of signers, returning that signer.
+func verifySignature(armored, message []byte, signers []allowedSigner) (*allowedSigner, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, errors.New("not an SSH signature")
+	}
+	blob, ok := bytes.CutPrefix(block.Bytes, []byte("SSHSIG"))
+	if !ok {
+		return nil, errors.New("not an SSH signature")
+	}
+	var sig sshSignature
+	if err := ssh.Unmarshal(blob, &sig); err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	if sig.Version != 1 {
+		return nil, fmt.Errorf("unsupported signature version %d", sig.Version)
+	}
+	if sig.Namespace != signatureNamespace {
+		return nil, fmt.Errorf("signed in namespace '%s', not '%s'", sig.Namespace, signatureNamespace)
+	}
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm '%s'", sig.HashAlgorithm)
+	}
+
+	var signer *allowedSigner
+	for i := range signers {
+		if bytes.Equal(signers[i].key.Marshal(), sig.PublicKey) {
+			signer = &signers[i]
+			break
+		}
+	}
+	if signer == nil {
+		key, err := ssh.ParsePublicKey(sig.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("malformed signature: %w", err)
+		}
+		return nil, fmt.Errorf("signed by %s, which isn't in allowed_signers", ssh.FingerprintSHA256(key))
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &signature); err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	h.Write(message)
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})...)
+	if err := signer.key.Verify(signed, &signature); err != nil {
+		return nil, errors.New("the signature doesn't match the keys fetched")
+	}
+	return signer, nil
+}
+
+// payloadKey is the context key under which signedSource asks httpClient to
+// keep the key list it downloads.
+type payloadKey struct{}
+
+// recordPayload keeps the body of response in the payload ctx asks for, if
+// any, leaving response readable as before.
+func recordPayload(ctx context.Context, response *http.Response) error {
+	payload, ok := ctx.Value(payloadKey{}).(*[]byte)
+	if !ok || response.StatusCode != http.StatusOK {
+		return nil
+	}
+	data, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return err
+	}
+	*payload = data
+	response.Body = io.NopCloser(bytes.NewReader(data))
+	return nil
+}
+
+// withSignatures requires the key lists source fetches to be signed by a
+// key in allowed_signers, if it is set.
+func (a *app) withSignatures(source doorman.KeySource, provider, location string) (doorman.KeySource, error) {
+	if a.cfg.AllowedSigners == "" {
+		return source, nil
+	}
+	signers, err := readAllowedSigners(a.cfg.AllowedSigners)
+	if err != nil {
+		return nil, err
+	}
+	signatures := a.cfg.SignatureURL
+	if signatures == "" {
+		if provider == "github" {
+			return nil, errors.New("allowed_signers needs signature_url with the github provider, which doesn't serve signatures")
+		}
+		signatures = location + ".sig"
+	}
+	if strings.HasPrefix(signatures, "http://") {
+		return nil, fmt.Errorf("invalid signature_url '%s': only https:// URLs are supported", signatures)
+	}
+	s := signedSource{KeySource: source, app: a, signers: signers, signatures: signatures}
+	if provider == "file" {
+		s.file = location
+	}
+	return s, nil
+}
+
+// signedSource refuses a user's keys unless the exact key list they were
+// parsed from is signed by a key in allowed_signers.
+type signedSource struct {
+	doorman.KeySource
+	app     *app
+	signers []allowedSigner
+	// signatures is the URL or path of each user's signature, with {user}
+	// replaced by the username
+	signatures string
+	// file is the keys file template when keys are read from files, whose
+	// contents are then verified instead of a download
+	file string
+}
+
+func (s signedSource) Keys(ctx context.Context, username string) ([]doorman.PublicKey, error) {
+	var payload []byte
+	keys, err := s.KeySource.Keys(context.WithValue(ctx, payloadKey{}, &payload), username)
+	if err != nil {
+		return nil, err
+	}
+	if s.file != "" {
+		if payload, err = os.ReadFile(strings.ReplaceAll(s.file, "{user}", username)); err != nil {
+			return nil, err
+		}
+		keys = doorman.ParsePublicKeys(payload)
+	}
+
+	location := strings.ReplaceAll(s.signatures, "{user}", url.PathEscape(username))
+	var signature []byte
+	if strings.HasPrefix(location, "https://") {
+		signature, err = doorman.FetchKeys(ctx, httpClient{s.app}, location)
+	} else {
+		signature, err = os.ReadFile(location)
+	}
+	if err != nil {
+		return nil, withExitCode(exitSignature, &signatureError{fmt.Sprintf("error fetching %s: %v", location, err)})
+	}
+	signer, err := verifySignature(signature, payload, s.signers)
+	if err != nil {
+		return nil, withExitCode(exitSignature, &signatureError{err.Error()})
+	}
+	s.app.verbosef("Verified %s's keys: signed by %s (%s)\n", username, signer.principals, ssh.FingerprintSHA256(signer.key))
+	return keys, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newSigner returns a freshly generated key to sign key lists with.
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// sshSign signs message in namespace as ssh-keygen -Y sign does.
+func sshSign(t *testing.T, signer ssh.Signer, namespace string, message []byte) []byte {
+	t.Helper()
+	hash := sha512.Sum512(message)
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{namespace, "", "sha512", hash[:]})...)
+	signature, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte("SSHSIG"), ssh.Marshal(sshSignature{1, signer.PublicKey().Marshal(), namespace, "", "sha512", ssh.Marshal(signature)})...)
+	return pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob})
+}
+
+func allowedSignerLine(principals string, signer ssh.Signer) string {
+	return principals + " " + string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+func TestVerifySignature(t *testing.T) {
+	signer, other := newSigner(t), newSigner(t)
+	signers := []allowedSigner{{"sec@example.com", signer.PublicKey()}}
+	message := []byte(testKey + "\n")
+
+	tests := []struct {
+		name      string
+		signature []byte
+		expected  string
+	}{
+		{"valid", sshSign(t, signer, "doorman", message), ""},
+		{"other message", sshSign(t, signer, "doorman", []byte(testKey+" evil\n")), "doesn't match the keys fetched"},
+		{"other namespace", sshSign(t, signer, "file", message), "signed in namespace 'file'"},
+		{"untrusted signer", sshSign(t, other, "doorman", message), "which isn't in allowed_signers"},
+		{"not a signature", []byte(testKey), "not an SSH signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifySignature(tt.signature, message, signers)
+			if tt.expected == "" {
+				if err != nil || got.principals != "sec@example.com" {
+					t.Errorf("expected a valid signature by sec@example.com, got %v, %v", got, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected an error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestReadAllowedSigners(t *testing.T) {
+	signer, other := newSigner(t), newSigner(t)
+	path := filepath.Join(t.TempDir(), "allowed_signers")
+	writeFile(t, path, "# signers\n"+allowedSignerLine("a@example.com,b@example.com", signer)+
+		`c@example.com namespaces="git,file" `+string(ssh.MarshalAuthorizedKey(other.PublicKey())))
+	signers, err := readAllowedSigners(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(signers) != 1 || signers[0].principals != "a@example.com,b@example.com" {
+		t.Errorf("expected only the signer allowed in the doorman namespace, got %v", signers)
+	}
+
+	writeFile(t, path, "a@example.com cert-authority "+string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	if _, err := readAllowedSigners(path); err == nil || !strings.Contains(err.Error(), "the cert-authority option isn't supported") {
+		t.Errorf("expected cert-authority to be rejected, got %v", err)
+	}
+}
+
+func TestRunSignedKeys(t *testing.T) {
+	e := newTestEnv(t)
+	e.source = nil
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	signer := newSigner(t)
+	allowed := filepath.Join(e.home, "allowed_signers")
+	writeFile(t, allowed, allowedSignerLine("sec@example.com", signer))
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "allowed_signers = '"+allowed+"'\n")
+
+	keys := filepath.Join(e.home, "alice.keys")
+	writeFile(t, keys, testKey+"\n")
+	writeFile(t, keys+".sig", string(sshSign(t, signer, "doorman", []byte(testKey+"\n"))))
+	if err := run(e.deps, []string{"doorman", "--yes", "-v", "--config", config, "--keys-file", filepath.Join(e.home, "{user}.keys"), "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("expected alice's signed key to be added, got %q", content)
+	}
+	if !strings.Contains(e.errOut.String(), "Verified alice's keys: signed by sec@example.com (SHA256:") {
+		t.Errorf("expected the signer to be shown, got %q", e.errOut.String())
+	}
+
+	writeFile(t, keys, testKey+"\n"+newTestKey(t)+"\n")
+	err := run(e.deps, []string{"doorman", "--yes", "--config", config, "--keys-file", filepath.Join(e.home, "{user}.keys"), "sync", "alice"})
+	if exitCodeFor(err) != exitSignature || !strings.Contains(err.Error(), "signature check failed: the signature doesn't match the keys fetched") {
+		t.Errorf("expected the tampered list to fail the signature check, got %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("expected nothing to change, got %q", content)
+	}
+}
+
+func TestRunSignedKeysURL(t *testing.T) {
+	e := newTestEnv(t)
+	e.source = nil
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	signer := newSigner(t)
+	allowed := filepath.Join(e.home, "allowed_signers")
+	writeFile(t, allowed, allowedSignerLine("sec@example.com", signer))
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "allowed_signers = '"+allowed+"'\nsignature_url = 'https://sigs.example.com/{user}'\n")
+
+	signature := sshSign(t, signer, "doorman", []byte(testKey+"\n"))
+	e.transport = roundTripFunc(func(request *http.Request) (*http.Response, error) {
+		body := testKey + "\n"
+		if request.URL.Host == "sigs.example.com" {
+			body = string(signature)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+	})
+	if err := run(e.deps, []string{"doorman", "--yes", "--config", config, "--url", "https://keys.example.com/{user}", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n" {
+		t.Errorf("expected alice's signed key to be added, got %q", content)
+	}
+
+	writeFile(t, config, "allowed_signers = '"+allowed+"'\n")
+	err := run(e.deps, []string{"doorman", "--yes", "--config", config, "add", "alice"})
+	if err == nil || !strings.Contains(err.Error(), "allowed_signers needs signature_url with the github provider") {
+		t.Errorf("expected GitHub without signature_url to be refused, got %v", err)
+	}
+}
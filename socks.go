@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// socksDialer returns the DialContext that connects through the SOCKS5
+// proxy --socks5 names, as host:port or user:password@host:port, such as
+// an ssh -D dynamic forward, dialing the proxy itself with forward. It
+// returns nil when --socks5 isn't set.
+func (a *app) socksDialer(forward *net.Dialer) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	if a.opts.socks5 == "" {
+		return nil, nil
+	}
+	address, auth := a.opts.socks5, (*proxy.Auth)(nil)
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		user, password, _ := strings.Cut(address[:i], ":")
+		address, auth = address[i+1:], &proxy.Auth{User: user, Password: password}
+	}
+	// The address alone names the proxy from here on, so the password
+	// never shows up in errors
+	if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+		return nil, fmt.Errorf("invalid --socks5 '%s': use host:port or user:password@host:port", address)
+	}
+	dialer, err := proxy.SOCKS5("tcp", address, auth, forward)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --socks5 '%s': %w", address, err)
+	}
+	contextDialer := dialer.(proxy.ContextDialer)
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		a.verbosef("Connecting to %s through SOCKS5 proxy %s\n", addr, address)
+		conn, err := contextDialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to %s through SOCKS5 proxy %s: %w", addr, address, err)
+		}
+		return conn, nil
+	}, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// socksServer is a SOCKS5 proxy (RFC 1928) just big enough for tests: it
+// takes CONNECT requests, with username and password authentication when
+// user is set, and records where each went.
+type socksServer struct {
+	listener net.Listener
+	user     string
+	password string
+
+	mu        sync.Mutex
+	connected []string
+}
+
+func newSOCKSServer(t *testing.T, user, password string) *socksServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{listener: listener, user: user, password: password}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if s.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		if !s.authenticate(conn) {
+			return
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	s.mu.Lock()
+	s.connected = append(s.connected, address)
+	s.mu.Unlock()
+
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// authenticate runs the username and password subnegotiation (RFC 1929).
+func (s *socksServer) authenticate(conn net.Conn) bool {
+	read := func() string {
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		value := make([]byte, length[0])
+		io.ReadFull(conn, value)
+		return string(value)
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return false
+	}
+	ok := read() == s.user && read() == s.password
+	if !ok {
+		conn.Write([]byte{1, 1})
+		return false
+	}
+	conn.Write([]byte{1, 0})
+	return true
+}
+
+func (s *socksServer) addresses() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.connected...)
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	e := newTestEnv(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testKey+"\n")
+	}))
+	defer server.Close()
+	proxy := newSOCKSServer(t, "bastion", "p@ss:word")
+	e.transport = nil
+	e.trustServer(t, server)
+	e.opts.socks5 = "bastion:p@ss:word@" + proxy.listener.Addr().String()
+	e.opts.verbose = true
+
+	client, err := e.newHTTPClient()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.Transport.(*http.Transport).Proxy != nil {
+		t.Error("expected --socks5 to take the place of HTTPS_PROXY")
+	}
+	source := doorman.URLSource{Template: server.URL + "/{user}.keys", Client: client}
+	keys, err := source.Keys(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("expected 1 key, got %v", keys)
+	}
+	target := strings.TrimPrefix(server.URL, "https://")
+	if got := proxy.addresses(); len(got) != 1 || got[0] != target {
+		t.Errorf("expected one connection to %s through the proxy, got %v", target, got)
+	}
+	expected := "Connecting to " + target + " through SOCKS5 proxy " + proxy.listener.Addr().String()
+	if !strings.Contains(e.errOut.String(), expected) {
+		t.Errorf("expected %q, got %q", expected, e.errOut.String())
+	}
+}
+
+func TestSOCKS5ProxyErrors(t *testing.T) {
+	proxy := newSOCKSServer(t, "bastion", "secret")
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name     string
+		socks5   string
+		expected string
+	}{
+		{"unreachable", down, "error connecting to example.com:443 through SOCKS5 proxy " + down + ": "},
+		{"wrong password", "bastion:wrong@" + proxy.listener.Addr().String(), "error connecting to example.com:443 through SOCKS5 proxy " + proxy.listener.Addr().String() + ": "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.transport = nil
+			e.opts.socks5 = tt.socks5
+			client, err := e.newHTTPClient()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			source := doorman.URLSource{Template: "https://example.com/{user}.keys", Client: client}
+			_, err = source.Keys(context.Background(), "alice")
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("expected %q, got %v", tt.expected, err)
+			}
+			if err != nil && strings.Contains(err.Error(), "wrong") {
+				t.Errorf("expected the password to be left out, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Invalid(t *testing.T) {
+	e := newTestEnv(t)
+	e.transport = nil
+	for _, socks5 := range []string{"localhost", "bastion:secret@localhost"} {
+		e.opts.socks5 = socks5
+		_, err := e.newHTTPClient()
+		if err == nil || !strings.HasPrefix(err.Error(), "invalid --socks5 'localhost': use host:port") {
+			t.Errorf("%s: expected an invalid --socks5 error without the password, got %v", socks5, err)
+		}
+	}
+}
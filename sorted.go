@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// sortedStore stands in for a store with --sort: it orders entries for
+// doorman.Orderer, so every rewrite leaves the file in the same order,
+// whichever host it is on and whatever order its keys were added in.
+type sortedStore struct {
+	doorman.KeyStore
+	app *app
+}
+
+// sortedStore returns store as --sort leaves it: unchanged without it, or
+// wrapped so entries are sorted before they are saved.
+func (a *app) sortedStore(store doorman.KeyStore) doorman.KeyStore {
+	if !a.opts.sort && !a.cfg.SortEntries {
+		return store
+	}
+	return &sortedStore{KeyStore: store, app: a}
+}
+
+func (s *sortedStore) Order(entries []doorman.Entry) ([]doorman.Entry, error) {
+	state, _, err := s.app.loadState()
+	if err != nil {
+		return nil, err
+	}
+	return s.app.sortEntries(entries, recordedFingerprints(state, s.Path())), nil
+}
+
+// Lock locks the store underneath, if it can be locked, so sorting doesn't
+// give up the lock held from Load until Save.
+func (s *sortedStore) Lock() (func() error, error) {
+	if locker, ok := s.KeyStore.(doorman.Locker); ok {
+		return locker.Lock()
+	}
+	return func() error { return nil }, nil
+}
+
+// sortEntries returns entries with the keys doorman manages, by the rule
+// of managedKey given the fingerprints recorded for the file, after
+// everything else, ordered by username, then key type, then fingerprint.
+// Comments, blank lines and keys added by hand keep their order, at the
+// top. The sort is stable, so sorting again changes nothing, and copies of
+// a key keep their order.
+func (a *app) sortEntries(entries []doorman.Entry, recorded map[string]bool) []doorman.Entry {
+	type sortedKey struct {
+		entry                      doorman.Entry
+		user, keyType, fingerprint string
+	}
+	sorted := make([]doorman.Entry, 0, len(entries))
+	var managed []sortedKey
+	for _, entry := range entries {
+		key, ok := entry.Key()
+		if !ok || !managedKey(key, recorded) {
+			sorted = append(sorted, entry)
+			continue
+		}
+		user := a.keyUser(key)
+		if user == "" {
+			user = key.Label()
+		}
+		managed = append(managed, sortedKey{entry, user, key.Type, key.Fingerprint()})
+	}
+	sort.SliceStable(managed, func(i, j int) bool {
+		if managed[i].user != managed[j].user {
+			return managed[i].user < managed[j].user
+		}
+		if managed[i].keyType != managed[j].keyType {
+			return managed[i].keyType < managed[j].keyType
+		}
+		return managed[i].fingerprint < managed[j].fingerprint
+	})
+	for _, key := range managed {
+		sorted = append(sorted, key.entry)
+	}
+	return sorted
+}
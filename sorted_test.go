@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+const (
+	sortECDSA256 = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBOn3TBov3B0UZp0HGKn7os0dWuSgmtHs6RGUP2iSHrkxtscIipIrEnAKicU86H4JXwp0TRy/417kiPJvydzbtPk="
+	sortECDSA521 = "ecdsa-sha2-nistp521 AAAAE2VjZHNhLXNoYTItbmlzdHA1MjEAAAAIbmlzdHA1MjEAAACFBAH3q0oxkqZv/Fs8WjQpv6cMyoePGNQis0jq0gHqUPXNzCNQJyRDsf/ZWvSIBi82csDRAqOllXhzWRo+E5Upd0caEQDkni6GyI5Bb90Al/dFUrKFgYWpOTlfqnHJSTelCeG0TLoYSEEYM0SCmrPgTziOHCv8wVv7izcUkuNOTxWu2tNB4A=="
+	// sortEd25519's fingerprint, SHA256:69fw..., sorts after testKey's,
+	// SHA256:0aql...
+	sortEd25519 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJYgr1474Dqzl3QKBUlyKA2YY2GfiqgAK/4hNGjeSMv/"
+)
+
+func TestSortEntries(t *testing.T) {
+	e := newTestEnv(t)
+	lines := []string{
+		"# managed by doorman",
+		sortEd25519 + " bob doorman-added=2025-01-01",
+		"",
+		testKey + " alice doorman-added=2025-01-01",
+		"ssh-rsa KEY2... laptop",
+		sortECDSA256 + " bob doorman-added=2025-01-01",
+		sortEd25519 + " alice",
+		"# carol's keys",
+		testKey + " bob doorman-added=2025-01-01",
+		`no-pty ` + testKey + " alice doorman-added=2025-02-02",
+	}
+	entries := make([]doorman.Entry, len(lines))
+	for i, line := range lines {
+		entries[i] = doorman.Entry{Line: line}
+	}
+	recorded := map[string]bool{"SHA256:69fwI+iFYofym8YxBra63SLax4KaKVmV2Rrlyfyy3Is": true}
+
+	sorted := e.sortEntries(entries, recorded)
+	expected := []string{
+		"# managed by doorman",
+		"",
+		"ssh-rsa KEY2... laptop",
+		"# carol's keys",
+		testKey + " alice doorman-added=2025-01-01",
+		`no-pty ` + testKey + " alice doorman-added=2025-02-02",
+		sortEd25519 + " alice",
+		sortECDSA256 + " bob doorman-added=2025-01-01",
+		testKey + " bob doorman-added=2025-01-01",
+		sortEd25519 + " bob doorman-added=2025-01-01",
+	}
+	got := make([]string, len(sorted))
+	for i, entry := range sorted {
+		got[i] = entry.Line
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	again := e.sortEntries(sorted, recorded)
+	if string(doorman.FormatEntries(again)) != string(doorman.FormatEntries(sorted)) {
+		t.Errorf("expected sorting again to change nothing, got\n%s", doorman.FormatEntries(again))
+	}
+}
+
+func TestRunSort(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "# managed by doorman\n"+
+		sortEd25519+" bob doorman-added=2025-01-01\n"+
+		"ssh-rsa KEY2... laptop\n"+
+		testKey+" alice doorman-added=2025-01-01\n"+
+		sortECDSA256+" bob doorman-added=2025-01-01\n")
+	e.source = userSource{"alice": testKey + "\n" + sortECDSA521, "bob": sortEd25519 + "\n" + sortECDSA256}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--sort", "sync", "alice", "bob"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "# managed by doorman\n" +
+		"ssh-rsa KEY2... laptop\n" +
+		sortECDSA521 + " alice" + today + "\n" +
+		testKey + " alice doorman-added=2025-01-01\n" +
+		sortECDSA256 + " bob doorman-added=2025-01-01\n" +
+		sortEd25519 + " bob doorman-added=2025-01-01\n"
+	first := readFile(t, path)
+	if first != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, first)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--sort", "sync", "alice", "bob"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second := readFile(t, path); second != first {
+		t.Errorf("expected a second sync to leave the file byte for byte, got\n%s", second)
+	}
+
+	// sort_entries does the same, on every rewrite
+	config := filepath.Join(e.home, "config.toml")
+	writeFile(t, config, "sort_entries = true\n")
+	e.source = userSource{"alice": testKey + "\n" + sortECDSA521, "bob": sortEd25519 + "\n" + sortECDSA256, "aaron": sortEd25519}
+	if err := run(e.deps, []string{"doorman", "--yes", "--force", "--config", config, "add", "aaron"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = "# managed by doorman\n" +
+		"ssh-rsa KEY2... laptop\n" +
+		sortEd25519 + " aaron" + today + "\n" +
+		strings.TrimPrefix(first, "# managed by doorman\nssh-rsa KEY2... laptop\n")
+	if content := readFile(t, path); content != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, content)
+	}
+}
+
+func TestRunSortAudit(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, sortEd25519+" bob doorman-added=2025-01-01\n"+
+		testKey+" alice doorman-added=2025-01-01\n")
+	e.source = userSource{"alice": testKey, "bob": sortEd25519 + "\n" + sortECDSA256, "aaron": sortECDSA521}
+
+	// Each change is recorded as sorted, just as it is written
+	for _, args := range [][]string{{"add", "aaron"}, {"sync", "alice", "bob"}} {
+		if err := run(e.deps, append([]string{"doorman", "--yes", "--sort"}, args...)); err != nil {
+			t.Fatalf("%v: unexpected error: %v", args, err)
+		}
+		log := readFile(t, filepath.Join(e.home, ".ssh", ".doorman_audit.jsonl"))
+		lines := strings.Split(strings.TrimSuffix(log, "\n"), "\n")
+		var record auditRecord
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", lines[len(lines)-1], err)
+		}
+		if content := readFile(t, path); record.After != sha256Hex(content) {
+			t.Errorf("%v: expected after_sha256 to be the hash of\n%s", args, content)
+		}
+	}
+}
+
+func TestRunSortErrors(t *testing.T) {
+	e := newTestEnv(t)
+	for _, args := range [][]string{{"list", "--sort"}, {"check", "--sort"}, {"list", "--stale", "90d", "--sort"}} {
+		if err := run(e.deps, append([]string{"doorman"}, args...)); exitCodeFor(err) != exitUsage {
+			t.Errorf("%v: expected exit code %d, got %v", args, exitUsage, err)
+		}
+	}
+}
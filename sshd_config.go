@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth mirrors sshd's guard against Include loops.
+const maxIncludeDepth = 16
+
+// sshdConfigScanner walks an sshd_config file and its Include directives in
+// the order sshd itself reads them, looking for keyword.
+type sshdConfigScanner struct {
+	baseDir string
+	keyword string
+	inMatch bool
+}
+
+// authorizedKeysFileFromSSHDConfig returns the first file named by the
+// AuthorizedKeysFile directive in the sshd configuration at path, or "" when
+// the directive is not set outside of a Match block.
+func authorizedKeysFileFromSSHDConfig(path string) (string, error) {
+	args, err := sshdConfigValue(path, "AuthorizedKeysFile")
+	if err != nil || len(args) == 0 {
+		return "", err
+	}
+	return args[0], nil
+}
+
+// sshdConfigValue returns the arguments of the keyword directive in the
+// sshd configuration at path, or nil when it is not set outside of a Match
+// block. BEHAVIOR: sshd uses the first value it sees for a keyword, so
+// later directives are ignored.
+func sshdConfigValue(path, keyword string) ([]string, error) {
+	s := &sshdConfigScanner{baseDir: filepath.Dir(path), keyword: strings.ToLower(keyword)}
+	return s.scan(path, 0)
+}
+
+func (s *sshdConfigScanner) scan(path string, depth int) ([]string, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%s: too many nested Include directives", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		keyword, args := splitSSHDConfigLine(scanner.Text())
+		switch keyword {
+		case "":
+			continue
+		case "match":
+			// BEHAVIOR: Settings inside Match blocks only apply to some
+			// connections, so only the global section is considered. Like
+			// sshd, a Match block runs until the end of the configuration,
+			// including lines that follow an Include containing it.
+			s.inMatch = true
+		case "include":
+			if s.inMatch {
+				continue
+			}
+			for _, pattern := range args {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(s.baseDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("%s: bad Include pattern %q: %w", path, pattern, err)
+				}
+				for _, match := range matches {
+					value, err := s.scan(match, depth+1)
+					if err != nil && !os.IsNotExist(err) {
+						return nil, err
+					}
+					if value != nil {
+						return value, nil
+					}
+				}
+			}
+		case s.keyword:
+			// BEHAVIOR: For AuthorizedKeysFile, sshd tries the listed
+			// files in order, so the first file of the first directive is
+			// where keys belong
+			if !s.inMatch && len(args) > 0 {
+				return args, nil
+			}
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// splitSSHDConfigLine returns the lowercased keyword and the arguments of a
+// configuration line, honoring "Keyword=value" syntax and double quotes.
+func splitSSHDConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	var current strings.Builder
+	inQuotes, inArg := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case r == '#' && !inQuotes && !inArg:
+			return keyword, args
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return keyword, args
+}
+
+// expandAuthorizedKeysFile expands the %%, %h and %u tokens sshd supports in
+// AuthorizedKeysFile (plus __PROGRAMDATA__ on Windows) and resolves relative
+// paths against the home directory.
+func (d *deps) expandAuthorizedKeysFile(value, username, homeDir string) (string, error) {
+	if d.onWindows() {
+		value = strings.ReplaceAll(value, "__PROGRAMDATA__", programDataDir())
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '%' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+1 == len(value) {
+			return "", fmt.Errorf("invalid token at end of %q", value)
+		}
+		i++
+		switch value[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'h':
+			b.WriteString(homeDir)
+		case 'u':
+			b.WriteString(username)
+		default:
+			return "", fmt.Errorf("unsupported token %%%c in %q", value[i], value)
+		}
+	}
+
+	path := b.String()
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(homeDir, path)
+	}
+	return path, nil
+}
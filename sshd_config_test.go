@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestSplitSSHDConfigLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		keyword string
+		args    []string
+	}{
+		{"empty", "", "", nil},
+		{"comment", "# AuthorizedKeysFile foo", "", nil},
+		{"simple", "AuthorizedKeysFile .ssh/authorized_keys", "authorizedkeysfile", []string{".ssh/authorized_keys"}},
+		{"multiple", "AuthorizedKeysFile .ssh/a  .ssh/b", "authorizedkeysfile", []string{".ssh/a", ".ssh/b"}},
+		{"equals", "AuthorizedKeysFile=.ssh/a", "authorizedkeysfile", []string{".ssh/a"}},
+		{"quoted", `AuthorizedKeysFile "/etc/ssh/my keys/%u"`, "authorizedkeysfile", []string{"/etc/ssh/my keys/%u"}},
+		{"indented", "\t  Include /etc/ssh/sshd_config.d/*.conf", "include", []string{"/etc/ssh/sshd_config.d/*.conf"}},
+		{"trailing comment", "PermitRootLogin no # really", "permitrootlogin", []string{"no"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyword, args := splitSSHDConfigLine(tt.line)
+			if keyword != tt.keyword || !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("expected (%q, %q), got (%q, %q)", tt.keyword, tt.args, keyword, args)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysFileFromSSHDConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{
+			"not set",
+			map[string]string{"sshd_config": "PermitRootLogin no\n"},
+			"",
+		},
+		{
+			"first file wins",
+			map[string]string{"sshd_config": "AuthorizedKeysFile .ssh/authorized_keys2 .ssh/authorized_keys\nAuthorizedKeysFile /other\n"},
+			".ssh/authorized_keys2",
+		},
+		{
+			"case insensitive keyword",
+			map[string]string{"sshd_config": "authorizedkeysfile /etc/ssh/keys/%u\n"},
+			"/etc/ssh/keys/%u",
+		},
+		{
+			"include before main setting",
+			map[string]string{
+				"sshd_config":                "Include sshd_config.d/*.conf\nAuthorizedKeysFile .ssh/main\n",
+				"sshd_config.d/10-keys.conf": "AuthorizedKeysFile /etc/ssh/keys/%u\n",
+			},
+			"/etc/ssh/keys/%u",
+		},
+		{
+			"includes in lexical order",
+			map[string]string{
+				"sshd_config":           "Include sshd_config.d/*.conf\n",
+				"sshd_config.d/20.conf": "AuthorizedKeysFile .ssh/second\n",
+				"sshd_config.d/10.conf": "AuthorizedKeysFile .ssh/first\n",
+			},
+			".ssh/first",
+		},
+		{
+			"ignores match blocks",
+			map[string]string{"sshd_config": "Match User git\n  AuthorizedKeysFile /srv/git/keys\n"},
+			"",
+		},
+		{
+			"match in include covers rest of main file",
+			map[string]string{
+				"sshd_config":           "Include sshd_config.d/*.conf\nAuthorizedKeysFile .ssh/main\n",
+				"sshd_config.d/50.conf": "Match Group admins\n  PasswordAuthentication no\n",
+			},
+			"",
+		},
+		{
+			"missing include",
+			map[string]string{"sshd_config": "Include /nonexistent/*.conf\nAuthorizedKeysFile .ssh/main\n"},
+			".ssh/main",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				writeFile(t, filepath.Join(dir, name), content)
+			}
+
+			value, err := authorizedKeysFileFromSSHDConfig(filepath.Join(dir, "sshd_config"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if value != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, value)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysFileFromSSHDConfigMissing(t *testing.T) {
+	_, err := authorizedKeysFileFromSSHDConfig(filepath.Join(t.TempDir(), "sshd_config"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error, got %v", err)
+	}
+}
+
+func TestAuthorizedKeysFileFromSSHDConfigIncludeLoop(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "sshd_config"), "Include sshd_config\n")
+
+	_, err := authorizedKeysFileFromSSHDConfig(filepath.Join(dir, "sshd_config"))
+	if err == nil {
+		t.Error("expected error for recursive Include")
+	}
+}
+
+func TestExpandAuthorizedKeysFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		expected    string
+		expectError bool
+	}{
+		{"relative", ".ssh/authorized_keys2", "/home/alice/.ssh/authorized_keys2", false},
+		{"absolute user", "/etc/ssh/keys/%u", "/etc/ssh/keys/alice", false},
+		{"home token", "%h/.ssh/keys", "/home/alice/.ssh/keys", false},
+		{"percent", "/etc/ssh/100%%/%u", "/etc/ssh/100%/alice", false},
+		{"unknown token", "/etc/ssh/%i", "", true},
+		{"dangling percent", "/etc/ssh/%", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := (&deps{goos: runtime.GOOS}).expandAuthorizedKeysFile(tt.value, "alice", "/home/alice")
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if path != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, path)
+			}
+		})
+	}
+}
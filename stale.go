@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// staleKeys splits keys into those created or added longer than maxAge
+// before now and those that don't record either, each grouped by user.
+func (a *app) staleKeys(keys []doorman.Key, maxAge time.Duration, now time.Time) (stale, unknown map[string][]doorman.Key) {
+	stale, unknown = make(map[string][]doorman.Key), make(map[string][]doorman.Key)
+	for _, key := range keys {
+		user := a.keyUser(key)
+		born, ok := keyBorn(key)
+		switch {
+		case !ok:
+			unknown[user] = append(unknown[user], key)
+		case now.Sub(born) > maxAge:
+			stale[user] = append(stale[user], key)
+		}
+	}
+	return stale, unknown
+}
+
+// listStale prints the keys added longer ago than --stale, grouped by user,
+// and apart from them those of unknown age, failing with exitProblems if
+// any are stale so review jobs notice. With --remove-stale, the stale keys
+// are removed instead, a user at a time, once confirmed.
+func (a *app) listStale(ctx context.Context, store doorman.KeyStore) error {
+	maxAge, err := parseAge(a.opts.stale)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	manager := a.newManager(doorman.WithStore(store))
+	keys, err := manager.List(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading authorized_keys: %w", err)
+	}
+	now := a.now()
+	stale, unknown := a.staleKeys(keys, maxAge, now)
+	if a.opts.removeStale {
+		return a.removeStale(ctx, manager, store, stale)
+	}
+
+	count := countGroups(stale)
+	if a.opts.output == "json" {
+		var rows []listRow
+		for _, group := range []map[string][]doorman.Key{stale, unknown} {
+			for _, user := range sortedUsers(group) {
+				for _, key := range group[user] {
+					rows = append(rows, newListRow(key, user, now))
+				}
+			}
+		}
+		encoder := json.NewEncoder(a.stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(rows); err != nil {
+			return err
+		}
+	} else {
+		a.printKeyGroups(stale, func(key doorman.Key) string {
+			born, _ := keyBorn(key)
+			return keyDates(key) + ", " + daysAgo(born, now)
+		})
+		if len(unknown) > 0 {
+			fmt.Fprintln(a.stdout, "Of unknown age:")
+			a.printKeyGroups(unknown, func(doorman.Key) string { return "age unknown" })
+		}
+		fmt.Fprintf(a.stdout, "%s added more than %s ago, %d of unknown age\n", countKeys(count), formatAge(maxAge), countGroups(unknown))
+	}
+	if count > 0 {
+		return withExitCode(exitProblems, fmt.Errorf("found %s added more than %s ago in %s", countKeys(count), formatAge(maxAge), store.Path()))
+	}
+	return nil
+}
+
+// printKeyGroups prints each user's keys under their name, followed by
+// what note says about each.
+func (a *app) printKeyGroups(groups map[string][]doorman.Key, note func(doorman.Key) string) {
+	for _, user := range sortedUsers(groups) {
+		name := user
+		if name == "" {
+			name = "(unlabeled)"
+		}
+		fmt.Fprintln(a.stdout, name+":")
+		for _, key := range groups[user] {
+			fmt.Fprintf(a.stdout, "  %s  %s\n", key.Describe(), note(key))
+		}
+	}
+}
+
+// removeStale removes each user's stale keys, once confirmed, recording
+// every change like remove does. Unlabeled keys can't be told apart by
+// user, so they are left for removing by hand.
+func (a *app) removeStale(ctx context.Context, manager *doorman.Manager, store doorman.KeyStore, stale map[string][]doorman.Key) error {
+	closeAudit, err := a.openAudit()
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	if len(stale) == 0 {
+		fmt.Fprintln(a.stdout, "No stale keys to remove")
+		return nil
+	}
+	for _, user := range sortedUsers(stale) {
+		if user == "" {
+			fmt.Fprintf(a.stderr, "Warning: leaving %s without a label; remove them by hand\n", countKeys(len(stale[user])))
+			continue
+		}
+		change, err := manager.RemoveKeys(ctx, user, stale[user])
+		if err != nil {
+			return actionError("remove", err, a.now())
+		}
+		if err := a.recordChange(ctx, store, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedUsers returns the users groups has keys for, in order.
+func sortedUsers(groups map[string][]doorman.Key) []string {
+	users := make([]string, 0, len(groups))
+	for user := range groups {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// countGroups returns how many keys groups holds.
+func countGroups(groups map[string][]doorman.Key) int {
+	n := 0
+	for _, keys := range groups {
+		n += len(keys)
+	}
+	return n
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunListStale(t *testing.T) {
+	e := newTestEnv(t)
+	e.now = func() time.Time { return time.Date(2026, 5, 4, 12, 0, 0, 0, time.UTC) }
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	recent := newTestKey(t)
+	writeFile(t, path, ""+
+		testKey+" alice doorman-added=2025-03-18\n"+
+		recent+" alice doorman-added=2026-05-01\n"+
+		"ssh-rsa KEY2... work laptop bob\n")
+
+	err := run(e.deps, []string{"doorman", "list", "--stale", "180d"})
+	if exitCodeFor(err) != exitProblems {
+		t.Errorf("expected exit code %d for a stale key, got %v", exitProblems, err)
+	}
+	expected := "" +
+		"alice:\n" +
+		"  256 " + testKeyFingerprint + " alice doorman-added=2025-03-18 (ED25519)  added 2025-03-18, 412 days ago\n" +
+		"Of unknown age:\n" +
+		"bob:\n" +
+		"  ssh-rsa KEY2... work laptop bob  age unknown\n" +
+		"1 key added more than 180 days ago, 1 of unknown age\n"
+	if e.out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, e.out.String())
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "list", "--stale", "500d"}); err != nil {
+		t.Errorf("expected no failure without stale keys, got %v", err)
+	}
+	if !strings.HasSuffix(e.out.String(), "0 keys added more than 500 days ago, 1 of unknown age\n") {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+}
+
+func TestRunListRemoveStale(t *testing.T) {
+	e := newTestEnv(t)
+	e.now = func() time.Time { return time.Date(2026, 5, 4, 12, 0, 0, 0, time.UTC) }
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	recent := newTestKey(t)
+	writeFile(t, path, ""+
+		testKey+" alice doorman-added=2025-03-18\n"+
+		recent+" alice doorman-added=2026-05-01\n"+
+		"ssh-rsa KEY2... work laptop bob\n")
+	if err := run(e.deps, []string{"doorman", "state", "import", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "list", "--stale", "180d", "--remove-stale"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := recent + " alice doorman-added=2026-05-01\nssh-rsa KEY2... work laptop bob\n"
+	if content := readFile(t, path); content != expected {
+		t.Errorf("expected only the stale key removed, got %q", content)
+	}
+	state, _, err := e.loadState()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if user, ok := state.Files[path]["alice"]; !ok || len(user.Fingerprints) != 1 {
+		t.Errorf("expected alice to stay managed with her recent key, got %+v", state.Files[path])
+	}
+}
+
+func TestRunListStaleErrors(t *testing.T) {
+	e := newTestEnv(t)
+	tests := [][]string{
+		{"doorman", "stats", "--stale", "180d"},
+		{"doorman", "list", "--remove-stale"},
+		{"doorman", "list", "--stale", "soon"},
+	}
+	for _, args := range tests {
+		if err := run(e.deps, args); exitCodeFor(err) != exitUsage {
+			t.Errorf("%v: expected a usage error, got %v", args, err)
+		}
+	}
+	e.stdinIsTerminal = func() bool { return false }
+	err := run(e.deps, []string{"doorman", "list", "--stale", "180d", "--remove-stale"})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "pass --yes") {
+		t.Errorf("expected --remove-stale to need --yes without a terminal, got %v", err)
+	}
+}
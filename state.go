@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// stateVersion is the version of the state file format written
+const stateVersion = 1
+
+// managedState is the state file: which users doorman manages in which
+// authorized_keys files, and how. It records intent, so doorman needn't
+// guess it from the comments in the files.
+type managedState struct {
+	Version int `json:"version"`
+	// Files maps each authorized_keys path to the users managed in it
+	Files map[string]map[string]managedUser `json:"files"`
+	// CommentFormats maps each authorized_keys path to the comment formats
+	// keys have been labeled with in it, so keys labeled before a change
+	// of format are still recognized
+	CommentFormats map[string][]string `json:"comment_formats,omitempty"`
+}
+
+// managedUser is what doorman knows about a user it manages.
+type managedUser struct {
+	// Provider and Source say where the user's keys come from, as
+	// --provider and its URL template or path
+	Provider string `json:"provider"`
+	Source   string `json:"source,omitempty"`
+	// Fingerprints are those of the keys doorman last installed
+	Fingerprints []string  `json:"fingerprints"`
+	Updated      time.Time `json:"updated"`
+}
+
+func (d *deps) statePath() (string, error) {
+	dir, err := d.stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "state.json"), nil
+}
+
+// loadState reads the state file, which is empty if it doesn't exist yet.
+func (a *app) loadState() (managedState, string, error) {
+	state := managedState{Version: stateVersion, Files: make(map[string]map[string]managedUser)}
+	path, err := a.statePath()
+	if err != nil {
+		return state, "", err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, path, nil
+	}
+	if err != nil {
+		return state, path, fmt.Errorf("error reading state file: %w", err)
+	}
+
+	// BEHAVIOR: A damaged state file is reported rather than overwritten,
+	// since it is the record of which users doorman manages
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, path, fmt.Errorf("state file %s is corrupt (%v); move it aside and run 'doorman state import' to rebuild it", path, err)
+	}
+	if state.Version > stateVersion {
+		return state, path, fmt.Errorf("state file %s was written by a newer doorman (version %d)", path, state.Version)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]map[string]managedUser)
+	}
+	return state, path, nil
+}
+
+func saveState(path string, state managedState) error {
+	state.Version = stateVersion
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// installedFingerprints returns the fingerprints of username's keys in
+// store, labeled as labels says.
+func installedFingerprints(store doorman.KeyStore, username string, labels doorman.Labels) ([]string, error) {
+	entries, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	fingerprints := []string{}
+	for _, key := range labels.UserKeys(doorman.FormatEntries(entries), username) {
+		fingerprints = append(fingerprints, key.Fingerprint())
+	}
+	return fingerprints, nil
+}
+
+// recordState updates the state file after change: a removed user is no
+// longer managed, and an added or synced one is, with the keys now in
+// store. With --all, each user's recorded source is kept.
+func (a *app) recordState(store doorman.KeyStore, change *doorman.Change) error {
+	// BEHAVIOR: A CA isn't a user to sync, and keys removed for no user,
+	// by remove --unmanaged, were never recorded
+	if change.Username == "" || strings.HasPrefix(change.Username, caLabelPrefix) || a.unsynced {
+		return nil
+	}
+	state, path, err := a.loadState()
+	if err != nil {
+		return err
+	}
+	users := state.Files[store.Path()]
+	if users == nil {
+		users = make(map[string]managedUser)
+		state.Files[store.Path()] = users
+	}
+
+	if change.Action == doorman.ActionRemove || change.Action == doorman.ActionReconcile {
+		// BEHAVIOR: A user left with keys, such as after list --remove-stale
+		// took only their old ones or reconcile those they revoked, is
+		// still managed
+		remaining, err := installedFingerprints(store, change.Username, a.labels)
+		if err != nil {
+			return err
+		}
+		if user, recorded := users[change.Username]; recorded && len(remaining) > 0 {
+			user.Fingerprints, user.Updated = remaining, a.now().UTC()
+			users[change.Username] = user
+			return saveState(path, state)
+		}
+		delete(users, change.Username)
+		if len(users) == 0 {
+			delete(state.Files, store.Path())
+		}
+		return saveState(path, state)
+	}
+
+	user, recorded := users[change.Username]
+	if !recorded || !a.opts.all {
+		if user.Provider, user.Source, err = a.providerChoice(); err != nil {
+			return err
+		}
+	}
+	if user.Fingerprints, err = installedFingerprints(store, change.Username, a.labels); err != nil {
+		return err
+	}
+	user.Updated = a.now().UTC()
+	users[change.Username] = user
+	if format := a.labels.Format; format != "" && !slices.Contains(state.CommentFormats[store.Path()], format) {
+		if state.CommentFormats == nil {
+			state.CommentFormats = make(map[string][]string)
+		}
+		state.CommentFormats[store.Path()] = append(state.CommentFormats[store.Path()], format)
+	}
+	return saveState(path, state)
+}
+
+// managedUsers returns the users the state file records for store, sorted,
+// and a source getting each one's keys from where it was recorded.
+func (a *app) managedUsers(store doorman.KeyStore) ([]string, doorman.KeySource, error) {
+	state, _, err := a.loadState()
+	if err != nil {
+		return nil, nil, err
+	}
+	users := state.Files[store.Path()]
+	if len(users) == 0 {
+		return nil, nil, fmt.Errorf("no users are recorded as managed in %s; add some, or run 'doorman state import'", store.Path())
+	}
+	usernames := make([]string, 0, len(users))
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	slices.Sort(usernames)
+
+	if a.source != nil {
+		return usernames, a.source, nil
+	}
+	return usernames, stateSource{a, users}, nil
+}
+
+// syncManaged syncs usernames, the users the state file records, with a
+// single preview and write, reporting each user as changed or up to date.
+// A user the provider no longer knows keeps their keys unless --prune is
+// given, and fails the run so the state file gets looked at.
+func (a *app) syncManaged(ctx context.Context, manager *doorman.Manager, store doorman.KeyStore, usernames []string) error {
+	changes, err := manager.SyncUsers(ctx, usernames, a.opts.prune)
+	silent := a.opts.cron && a.recordFetches(usernames, err)
+	var usersErr *doorman.UsersError
+	if errors.As(err, &usersErr) {
+		return silence(a.userListError("sync", usersErr, len(usernames), nil), silent)
+	}
+	if err != nil {
+		return actionError("sync", err, a.now())
+	}
+
+	var gone []string
+	for _, change := range changes {
+		if change.Gone && change.Action == doorman.ActionSync {
+			gone = append(gone, change.Username)
+			fmt.Fprintf(a.stderr, "%s no longer exists at their provider; their keys were left in place\n", change.Username)
+			continue
+		}
+		if change.Gone {
+			fmt.Fprintf(a.stderr, "%s no longer exists at their provider; pruning their keys\n", change.Username)
+		}
+		if err := a.recordChange(ctx, store, change); err != nil {
+			return err
+		}
+	}
+	if len(gone) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("%d managed %s no longer %s: %s; pass --prune to remove their keys", len(gone), plural(len(gone), "user", "users"), plural(len(gone), "exists", "exist"), joinNames(gone)))
+	}
+	return nil
+}
+
+// recordFetches counts each user's fetch for --cron, failed if err, a
+// *doorman.UsersError, lists them, reporting whether every failure is still
+// too recent to be worth reporting.
+func (a *app) recordFetches(usernames []string, err error) (silent bool) {
+	failures := make(map[string]error)
+	var usersErr *doorman.UsersError
+	if errors.As(err, &usersErr) {
+		for _, failure := range usersErr.Failures {
+			failures[failure.User] = failure.Err
+		}
+	}
+	unlock := a.lockLocalFiles()
+	defer unlock()
+	silent = true
+	for _, username := range usernames {
+		if !a.recordFetch(username, failures[username]) && failures[username] != nil {
+			silent = false
+		}
+	}
+	return silent
+}
+
+// stateSource gets each user's keys from the provider recorded for them.
+type stateSource struct {
+	app   *app
+	users map[string]managedUser
+}
+
+func (s stateSource) Keys(ctx context.Context, username string) ([]doorman.PublicKey, error) {
+	user := s.users[username]
+	source, err := s.app.newSource(user.Provider, user.Source)
+	if err != nil {
+		return nil, err
+	}
+	return source.Keys(ctx, username)
+}
+
+// importState records the users with keys labeled in store as managed,
+// with the keys they have now and the provider chosen by the flags or the
+// configuration file. Only usernames are imported, if given; otherwise
+// every label but those of the user@host form ssh-keygen gives keys, which
+// doorman didn't add.
+func (a *app) importState(store doorman.KeyStore, usernames []string) error {
+	provider, source, err := a.providerChoice()
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	entries, err := store.Load()
+	if errors.Is(err, fs.ErrNotExist) {
+		return withExitCode(exitFile, fmt.Errorf("%s does not exist", store.Path()))
+	}
+	if err != nil {
+		return withExitCode(exitFile, fmt.Errorf("error reading authorized_keys: %w", err))
+	}
+	state, path, err := a.loadState()
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]managedUser)
+	for _, key := range doorman.ParseKeys(doorman.FormatEntries(entries)) {
+		username := a.keyUser(key)
+		switch {
+		case username == "", strings.HasPrefix(username, caLabelPrefix):
+			continue
+		case len(usernames) > 0 && !slices.Contains(usernames, username):
+			continue
+		case len(usernames) == 0 && strings.Contains(username, "@"):
+			continue
+		}
+		user := users[username]
+		user.Provider, user.Source = provider, source
+		user.Fingerprints = append(user.Fingerprints, key.Fingerprint())
+		user.Updated = a.now().UTC()
+		users[username] = user
+	}
+	if len(users) == 0 {
+		fmt.Fprintf(a.stdout, "No keys added by doorman in %s\n", store.Path())
+		return nil
+	}
+	state.Files[store.Path()] = users
+	if err := saveState(path, state); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	fmt.Fprintf(a.stdout, "Recorded %d managed %s from %s in %s\n", len(users), plural(len(users), "user", "users"), store.Path(), path)
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunRecordsState(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	e.mockKeys(testKey)
+
+	for _, username := range []string{"alice", "bob"} {
+		if err := run(e.deps, []string{"doorman", "--yes", "--force", "--url", "https://keys.example.com/{user}.keys", "add", username}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	state, _, err := e.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := state.Files[path]["alice"]
+	if alice.Provider != "url" || alice.Source != "https://keys.example.com/{user}.keys" {
+		t.Errorf("expected alice's source to be recorded, got %+v", alice)
+	}
+	if expected := []string{"SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I"}; !reflect.DeepEqual(alice.Fingerprints, expected) {
+		t.Errorf("expected fingerprints %v, got %v", expected, alice.Fingerprints)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "remove", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	state, _, err = e.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Files[path]["alice"]; ok {
+		t.Error("expected alice to no longer be managed")
+	}
+	if _, ok := state.Files[path]["bob"]; !ok {
+		t.Error("expected bob to still be managed")
+	}
+}
+
+func TestRunSyncAll(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	// carol added her own key by hand, so doorman doesn't manage her
+	writeFile(t, path, testKey+" alice\n"+testKey+" carol\n")
+	if err := run(e.deps, []string{"doorman", "state", "import", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	e.mockKeys("")
+	e.out.Reset()
+	err := run(e.deps, []string{"doorman", "--yes", "sync", "--all"})
+	if err == nil || !strings.Contains(err.Error(), "alice") {
+		t.Errorf("expected only alice to be synced, got %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice\n"+testKey+" carol\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "sync", "--all", "alice"}); err == nil {
+		t.Error("expected --all with a username to be refused")
+	}
+}
+
+func TestRunSyncAllGoneUsers(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	bobsNew := newTestKey(t)
+	carols := newTestKey(t)
+	writeFile(t, path, testKey+" alice\n"+testKey+" bob\n"+carols+" carol\n")
+	if err := run(e.deps, []string{"doorman", "state", "import"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// carol has left, and her account with her
+	e.source = userSource{"alice": testKey, "bob": bobsNew}
+	e.mockStdin("yes\n")
+
+	e.out.Reset()
+	err := run(e.deps, []string{"doorman", "--force", "sync", "--all"})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "1 managed user no longer exists: carol; pass --prune") {
+		t.Errorf("expected carol to be reported, got %v", err)
+	}
+	expected := "Keys for alice are up to date (1 key)\nSynced keys for bob: added 1 (1 ed25519), removed 1 (1 ed25519)\n"
+	if !strings.HasSuffix(e.out.String(), expected) {
+		t.Errorf("expected a line for each user, got %q", e.out.String())
+	}
+	if strings.Count(e.out.String(), "Do you want to update these keys?") != 1 {
+		t.Errorf("expected a single confirmation, got %q", e.out.String())
+	}
+	if content := readFile(t, path); content != testKey+" alice\n"+carols+" carol\n"+bobsNew+" bob"+today+"\n" {
+		t.Errorf("expected carol's key to be left in place, got %q", content)
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "sync", "--all", "--prune"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice\n"+bobsNew+" bob"+today+"\n" {
+		t.Errorf("expected carol's key to be pruned, got %q", content)
+	}
+	state, _, err := e.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Files[path]["carol"]; ok || len(state.Files[path]) != 2 {
+		t.Errorf("expected carol to no longer be managed, got %+v", state.Files[path])
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "sync", "--prune", "alice"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected --prune without --all to be refused, got %v", err)
+	}
+}
+
+func TestStateImport(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, testKey+" alice\n"+testKey+" me@laptop\n"+testKey+"\n")
+
+	if err := run(e.deps, []string{"doorman", "state", "import"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	state, statePath, err := e.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Files[path]) != 1 || state.Files[path]["alice"].Provider != "github" {
+		t.Errorf("expected only alice to be imported, got %+v", state.Files[path])
+	}
+	if !strings.Contains(e.out.String(), "Recorded 1 managed user") {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+	if statePath != filepath.Join(e.home, ".local", "state", "doorman", "state.json") {
+		t.Errorf("unexpected state file %s", statePath)
+	}
+}
+
+func TestCorruptState(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+	statePath, err := e.statePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, statePath, "{not json")
+
+	err = run(e.deps, []string{"doorman", "--yes", "sync", "--all"})
+	if err == nil || !strings.Contains(err.Error(), "is corrupt") {
+		t.Errorf("expected a corrupt state file error, got %v", err)
+	}
+
+	// Changes are still made, with a warning
+	e.mockKeys(testKey)
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(e.errOut.String(), "could not update the state file") {
+		t.Errorf("expected a warning, got %q", e.errOut.String())
+	}
+	if content := readFile(t, statePath); content != "{not json" {
+		t.Errorf("expected the state file to be left alone, got %q", content)
+	}
+}
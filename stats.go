@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// defaultMaxKeyAge is how old a key may be before stats flags it, unless
+// --max-age or max_key_age says otherwise
+const defaultMaxKeyAge = 365 * 24 * time.Hour
+
+// parseAge parses an age such as "180d", or any duration time.ParseDuration
+// accepts.
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age '%s': use a number of days such as 180d, or a duration such as 36h", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age '%s': use a number of days such as 180d, or a duration such as 36h", value)
+	}
+	return age, nil
+}
+
+// keyBorn returns the day key's age counts from: the day GitHub says it was
+// created, if its comment records it, or else the day doorman added it.
+func keyBorn(key doorman.Key) (time.Time, bool) {
+	if created, ok := key.GitHubCreated(); ok {
+		return created, true
+	}
+	return key.Added()
+}
+
+// keyDates describes when key was created and added, e.g. "created
+// 2023-11-02, installed 2024-06-01", "created 2023-11-02" or "added
+// 2024-06-01", or is "" when neither is known.
+func keyDates(key doorman.Key) string {
+	created, hasCreated := key.GitHubCreated()
+	added, hasAdded := key.Added()
+	switch {
+	case hasCreated && hasAdded:
+		return "created " + created.Format(time.DateOnly) + ", installed " + added.Format(time.DateOnly)
+	case hasCreated:
+		return "created " + created.Format(time.DateOnly)
+	case hasAdded:
+		return "added " + added.Format(time.DateOnly)
+	}
+	return ""
+}
+
+// maxKeyAge returns the age chosen by --max-age or max_key_age.
+func (a *app) maxKeyAge() (time.Duration, error) {
+	value := a.cfg.MaxKeyAge
+	if a.opts.maxAge != "" {
+		value = a.opts.maxAge
+	}
+	if value == "" {
+		return defaultMaxKeyAge, nil
+	}
+	return parseAge(value)
+}
+
+// printStats prints each user's keys with their types and ages, then the
+// totals, flagging keys added longer ago than the maximum age. A key's age
+// is only known when it records the date doorman added it; others are
+// reported as of unknown age rather than guessed.
+func (a *app) printStats(ctx context.Context, manager *doorman.Manager) error {
+	maxAge, err := a.maxKeyAge()
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	keys, err := manager.List(ctx)
+	if err != nil {
+		return fmt.Errorf("error reading authorized_keys: %w", err)
+	}
+
+	byUser := make(map[string][]doorman.Key)
+	for _, key := range keys {
+		byUser[a.keyUser(key)] = append(byUser[a.keyUser(key)], key)
+	}
+	users := make([]string, 0, len(byUser))
+	for user := range byUser {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	now := a.now()
+	old, unknown := 0, 0
+	for _, user := range users {
+		userKeys := byUser[user]
+		name := user
+		if name == "" {
+			name = "(unlabeled)"
+		}
+		fmt.Fprintf(a.stdout, "%s: %s (%s)\n", name, countKeys(len(userKeys)), doorman.CountTypes(userKeys))
+		for _, key := range userKeys {
+			born, ok := keyBorn(key)
+			if !ok {
+				unknown++
+				fmt.Fprintf(a.stdout, "  %s  age unknown\n", key.Describe())
+				continue
+			}
+			age := now.Sub(born)
+			note := fmt.Sprintf("%s (%d days ago", keyDates(key), int(age.Hours()/24))
+			if age > maxAge {
+				old++
+				note += ", older than " + formatAge(maxAge)
+			}
+			fmt.Fprintf(a.stdout, "  %s  %s)\n", key.Describe(), note)
+		}
+	}
+
+	total := fmt.Sprintf("Total: %s for %d %s", countKeys(len(keys)), len(users), plural(len(users), "user", "users"))
+	if len(keys) > 0 {
+		total += " (" + doorman.CountTypes(keys) + ")"
+	}
+	fmt.Fprintf(a.stdout, "%s; %d older than %s, %d of unknown age\n", total, old, formatAge(maxAge), unknown)
+	return nil
+}
+
+// formatAge renders whole days as "365 days" and anything else as a
+// duration.
+func formatAge(age time.Duration) string {
+	if age%(24*time.Hour) == 0 {
+		days := int(age / (24 * time.Hour))
+		return fmt.Sprintf("%d %s", days, plural(days, "day", "days"))
+	}
+	return age.String()
+}
+
+func countKeys(n int) string {
+	return fmt.Sprintf("%d %s", n, plural(n, "key", "keys"))
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
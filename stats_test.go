@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"180d", 180 * 24 * time.Hour, true},
+		{"0d", 0, true},
+		{"36h", 36 * time.Hour, true},
+		{"d", 0, false},
+		{"-3d", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			age, err := parseAge(tt.value)
+			if (err == nil) != tt.ok || age != tt.expected {
+				t.Errorf("expected %v (ok %v), got %v (%v)", tt.expected, tt.ok, age, err)
+			}
+		})
+	}
+}
+
+func TestRunStats(t *testing.T) {
+	const ed25519 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBMpUdogPMMHu+nQNMCIXHV5Emg2Caeeb8/Qmy8gs/Kc"
+	const keys = "# managed by doorman\n" +
+		ed25519 + " alice doorman-added=2025-03-18\n" +
+		"ssh-rsa KEY2... alice\n" +
+		"ssh-rsa KEY3... bob doorman-added=2023-01-02\n"
+
+	tests := []struct {
+		name     string
+		flags    []string
+		maxAge   string
+		expected string
+	}{
+		{"default age", nil, "", "" +
+			"alice: 2 keys (1 ed25519, 1 rsa)\n" +
+			"  256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice doorman-added=2025-03-18 (ED25519)  added 2025-03-18 (212 days ago)\n" +
+			"  ssh-rsa KEY2... alice  age unknown\n" +
+			"bob: 1 key (1 rsa)\n" +
+			"  ssh-rsa KEY3... bob doorman-added=2023-01-02  added 2023-01-02 (1018 days ago, older than 365 days)\n" +
+			"Total: 3 keys for 2 users (2 rsa, 1 ed25519); 1 older than 365 days, 1 of unknown age\n"},
+		{"flag", []string{"--max-age", "180d"}, "", "" +
+			"alice: 2 keys (1 ed25519, 1 rsa)\n" +
+			"  256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice doorman-added=2025-03-18 (ED25519)  added 2025-03-18 (212 days ago, older than 180 days)\n" +
+			"  ssh-rsa KEY2... alice  age unknown\n" +
+			"bob: 1 key (1 rsa)\n" +
+			"  ssh-rsa KEY3... bob doorman-added=2023-01-02  added 2023-01-02 (1018 days ago, older than 180 days)\n" +
+			"Total: 3 keys for 2 users (2 rsa, 1 ed25519); 2 older than 180 days, 1 of unknown age\n"},
+		{"setting", nil, "2000d", "" +
+			"alice: 2 keys (1 ed25519, 1 rsa)\n" +
+			"  256 SHA256:0aql0uXGjvyeQUcE1SAh4ZXlWgCgYVf/o+Xi2eYY15I alice doorman-added=2025-03-18 (ED25519)  added 2025-03-18 (212 days ago)\n" +
+			"  ssh-rsa KEY2... alice  age unknown\n" +
+			"bob: 1 key (1 rsa)\n" +
+			"  ssh-rsa KEY3... bob doorman-added=2023-01-02  added 2023-01-02 (1018 days ago)\n" +
+			"Total: 3 keys for 2 users (2 rsa, 1 ed25519); 0 older than 2000 days, 1 of unknown age\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.now = func() time.Time { return time.Date(2025, 10, 16, 12, 0, 0, 0, time.UTC) }
+			writeFile(t, filepath.Join(e.home, ".ssh", "authorized_keys"), keys)
+			if tt.maxAge != "" {
+				writeFile(t, filepath.Join(e.home, ".config", "doorman", "config.toml"), `max_key_age = "`+tt.maxAge+`"`+"\n")
+			}
+
+			if err := run(e.deps, append([]string{"doorman", "stats"}, tt.flags...)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if e.out.String() != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, e.out.String())
+			}
+		})
+	}
+}
+
+func TestRunStatsInvalidAge(t *testing.T) {
+	e := newTestEnv(t)
+	if err := run(e.deps, []string{"doorman", "stats", "--max-age", "forever"}); exitCodeFor(err) != exitUsage {
+		t.Errorf("expected usage error, got %v", err)
+	}
+}
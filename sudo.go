@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// sudoUser returns the user who ran doorman as root with sudo, whose
+// authorized_keys `sudo doorman add alice` almost always means rather than
+// root's, or nil when doorman wasn't run that way, was told which file to
+// manage, or was given --really-root.
+func (a *app) sudoUser(action string) (*user.User, error) {
+	if !worksRemotely(action) && action != "fix-perms" || a.opts.reallyRoot || a.opts.file != "" || a.opts.homeDir != "" || a.opts.host != "" || a.opts.inventory != "" {
+		return nil, nil
+	}
+	name := a.getenv("SUDO_USER")
+	if name == "" || name == "root" {
+		return nil, nil
+	}
+	currentUser, err := a.currentUser()
+	if err != nil || currentUser.Uid != "0" {
+		return nil, nil
+	}
+	invoker, err := a.lookupUser(name)
+	if err != nil {
+		return nil, withExitCode(exitUsage, fmt.Errorf("error looking up %s, who ran doorman with sudo: %w; pass --really-root to manage root's keys", name, err))
+	}
+	return invoker, nil
+}
+
+// withKeysOwner returns deps that manage owner's authorized_keys, handing
+// whatever they create in owner's ~/.ssh back to owner.
+func (d *deps) withKeysOwner(owner *user.User) *deps {
+	owned := *d
+	owned.keysOwner = owner
+	return &owned
+}
+
+// keysUser returns the user whose authorized_keys is managed: the current
+// user, or the one who ran doorman with sudo.
+func (d *deps) keysUser() (*user.User, error) {
+	if d.keysOwner != nil {
+		return d.keysOwner, nil
+	}
+	return d.currentUser()
+}
+
+// chownToKeysOwner gives path to the user who ran doorman with sudo, if
+// any, so sshd accepts what root created in their ~/.ssh.
+func (d *deps) chownToKeysOwner(path string) error {
+	if d.keysOwner == nil {
+		return nil
+	}
+	uid, err := strconv.Atoi(d.keysOwner.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid for %s: %w", d.keysOwner.Username, err)
+	}
+	gid, err := strconv.Atoi(d.keysOwner.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid for %s: %w", d.keysOwner.Username, err)
+	}
+	return os.Chown(path, uid, gid)
+}
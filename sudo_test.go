@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// mockSudo makes doorman run as root under sudo by bob, whose home is
+// returned.
+func (e *testEnv) mockSudo(t *testing.T) string {
+	t.Helper()
+	e.env["SUDO_USER"] = "bob"
+	e.currentUser = func() (*user.User, error) {
+		return &user.User{Username: "root", Uid: "0", Gid: "0", HomeDir: e.home}, nil
+	}
+	bobHome := t.TempDir()
+	// bob is whoever runs the tests, so chowning to bob succeeds, unless
+	// that's root, who may chown to anyone
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = 1000, 1000
+	}
+	e.lookupUser = func(username string) (*user.User, error) {
+		switch username {
+		case "bob":
+			return &user.User{Username: "bob", Uid: strconv.Itoa(uid), Gid: strconv.Itoa(gid), HomeDir: bobHome}, nil
+		case "root":
+			return &user.User{Username: "root", Uid: "0", Gid: "0", HomeDir: e.home}, nil
+		}
+		return nil, user.UnknownUserError(username)
+	}
+	return bobHome
+}
+
+func TestRunUnderSudo(t *testing.T) {
+	e := newTestEnv(t)
+	bobHome := e.mockSudo(t)
+	e.source = userSource{"alice": testKey}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "add", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, filepath.Join(bobHome, ".ssh", "authorized_keys")); content != testKey+" alice"+today+"\n" {
+		t.Errorf("expected alice's key in bob's authorized_keys, got %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(e.home, ".ssh", "authorized_keys")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected root's authorized_keys to be left alone, got %v", err)
+	}
+	if expected := "Run with sudo by bob: managing bob's authorized_keys in " + bobHome; !strings.Contains(e.errOut.String(), expected) {
+		t.Errorf("expected %q, got %q", expected, e.errOut.String())
+	}
+
+	err := run(e.deps, []string{"doorman", "--yes", "--really-root", "add", "alice"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, filepath.Join(e.home, ".ssh", "authorized_keys")); content != testKey+" alice"+today+"\n" {
+		t.Errorf("expected --really-root to use root's authorized_keys, got %q", content)
+	}
+
+	e.env["SUDO_USER"] = "mallory"
+	err = run(e.deps, []string{"doorman", "--yes", "add", "alice"})
+	if exitCodeFor(err) != exitUsage || !strings.Contains(err.Error(), "error looking up mallory") {
+		t.Errorf("expected an unknown sudo user to be an error, got %v", err)
+	}
+}
+
+func TestSudoUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		sudoUser string
+		uid      string
+		expected bool
+	}{
+		{name: "sudo", sudoUser: "bob", uid: "0", expected: true},
+		{name: "not sudo", sudoUser: "", uid: "0"},
+		{name: "sudo -u", sudoUser: "bob", uid: "1001"},
+		{name: "root sudo", sudoUser: "root", uid: "0"},
+		{name: "file", args: []string{"--file", "/tmp/keys"}, sudoUser: "bob", uid: "0"},
+		{name: "home dir", args: []string{"--home-dir", "/srv/image"}, sudoUser: "bob", uid: "0"},
+		{name: "really root", args: []string{"--really-root"}, sudoUser: "bob", uid: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.mockSudo(t)
+			e.env["SUDO_USER"] = tt.sudoUser
+			uid := tt.uid
+			e.currentUser = func() (*user.User, error) {
+				return &user.User{Username: "root", Uid: uid, HomeDir: e.home}, nil
+			}
+			opts, _, err := e.parseArgs(append(tt.args, "add", "alice"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.opts = opts
+			owner, err := e.sudoUser("add")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (owner != nil) != tt.expected {
+				t.Errorf("expected redirection %v, got %v", tt.expected, owner)
+			}
+		})
+	}
+}
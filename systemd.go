@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Unit files written by systemd-install. The marker on their first line is
+// how systemd-uninstall knows it may remove them.
+const (
+	systemdService = "doorman-sync.service"
+	systemdTimer   = "doorman-sync.timer"
+	systemdMarker  = "# Generated by doorman systemd-install; remove with doorman systemd-uninstall"
+)
+
+// minSyncInterval keeps timers from hammering the key source
+const minSyncInterval = time.Minute
+
+// systemdUnitDir returns where units are installed: the system unit
+// directory with --system, and otherwise the user's.
+func (a *app) systemdUnitDir() (string, error) {
+	if a.opts.system {
+		return a.systemdSystemDir, nil
+	}
+	if dir := a.getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "systemd", "user"), nil
+	}
+	currentUser, err := a.currentUser()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(currentUser.HomeDir, ".config", "systemd", "user"), nil
+}
+
+// systemctl returns the systemctl command line for args, with --user unless
+// --system was given.
+func (a *app) systemctl(args ...string) []string {
+	if a.opts.system {
+		return append([]string{"systemctl"}, args...)
+	}
+	return append([]string{"systemctl", "--user"}, args...)
+}
+
+// runOrPrint runs commands with --enable, and otherwise prints them for the
+// user to run.
+func (a *app) runOrPrint(ctx context.Context, heading string, commands ...[]string) error {
+	if !a.opts.enable {
+		fmt.Fprintln(a.stdout, heading)
+		for _, command := range commands {
+			fmt.Fprintln(a.stdout, "  "+strings.Join(command, " "))
+		}
+		return nil
+	}
+	for _, command := range commands {
+		if err := a.runCommand(ctx, command[0], command[1:]...); err != nil {
+			return fmt.Errorf("error running %s: %w", strings.Join(command, " "), err)
+		}
+	}
+	return nil
+}
+
+// syncInterval returns --interval, which must be at least minSyncInterval.
+func (a *app) syncInterval() (time.Duration, error) {
+	interval, err := parseAge(a.opts.interval)
+	if err != nil || interval < minSyncInterval {
+		return 0, withExitCode(exitUsage, fmt.Errorf("invalid interval '%s': use a duration of at least %s, e.g. 30m", a.opts.interval, minSyncInterval))
+	}
+	return interval, nil
+}
+
+// installSystemd writes a service syncing the --users every --interval and
+// a timer triggering it, then enables the timer or says how to.
+func (a *app) installSystemd(ctx context.Context) error {
+	if a.goos != "linux" {
+		return withExitCode(exitUsage, fmt.Errorf("systemd-install is only supported on Linux"))
+	}
+	users := strings.FieldsFunc(a.opts.users, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(users) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf("systemd-install needs --users, e.g. --users alice,bob"))
+	}
+	interval, err := a.syncInterval()
+	if err != nil {
+		return err
+	}
+
+	dir, err := a.systemdUnitDir()
+	if err != nil {
+		return err
+	}
+	executable, err := a.executable()
+	if err != nil {
+		return fmt.Errorf("error locating the doorman executable: %w", err)
+	}
+	keysPath, err := a.getAuthorizedKeysPath()
+	if err != nil {
+		return fmt.Errorf("error locating authorized_keys: %w", err)
+	}
+	if err := a.checkRootTarget("systemd-install", keysPath); err != nil {
+		return err
+	}
+	sshDir, err := a.getSSHDir()
+	if err != nil {
+		return err
+	}
+
+	command := []string{executable, "--yes", "--file", keysPath}
+	if a.opts.configPath != "" {
+		command = append(command, "--config", a.opts.configPath)
+	}
+	if a.opts.allowRoot || a.opts.reallyRoot {
+		command = append(command, "--allow-root")
+	}
+	command = append(append(command, "sync"), users...)
+	units := []struct {
+		name    string
+		content string
+	}{
+		{systemdService, serviceUnit(command, filepath.Dir(keysPath), sshDir)},
+		{systemdTimer, timerUnit(interval)},
+	}
+
+	// BEHAVIOR: Check both units before writing either, so a refusal
+	// leaves nothing half-installed
+	for _, unit := range units {
+		path := filepath.Join(dir, unit.name)
+		if _, err := os.Lstat(path); err == nil && !a.opts.force {
+			return withExitCode(exitFile, fmt.Errorf("%s already exists; pass --force to replace it", path))
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, unit := range units {
+		path := filepath.Join(dir, unit.name)
+		if err := os.WriteFile(path, []byte(unit.content), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintln(a.stdout, "Wrote "+path)
+	}
+
+	return a.runOrPrint(ctx, "To start syncing, run:",
+		a.systemctl("daemon-reload"),
+		a.systemctl("enable", "--now", systemdTimer))
+}
+
+// uninstallSystemd disables the timer, or says how to, and removes the
+// units systemd-install wrote. Files without its marker are left alone
+// unless --force is given.
+func (a *app) uninstallSystemd(ctx context.Context) error {
+	dir, err := a.systemdUnitDir()
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, name := range []string{systemdService, systemdTimer} {
+		path := filepath.Join(dir, name)
+		content, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(content, []byte(systemdMarker)) && !a.opts.force {
+			return withExitCode(exitFile, fmt.Errorf("%s wasn't written by doorman systemd-install; pass --force to remove it anyway", path))
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		fmt.Fprintf(a.stdout, "No doorman units installed in %s\n", dir)
+		return nil
+	}
+
+	disable := a.systemctl("disable", "--now", systemdTimer)
+	if a.opts.enable {
+		// The timer may never have been enabled, which is fine
+		_ = a.runCommand(ctx, disable[0], disable[1:]...)
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		fmt.Fprintln(a.stdout, "Removed "+path)
+	}
+	if a.opts.enable {
+		return a.runOrPrint(ctx, "", a.systemctl("daemon-reload"))
+	}
+	return a.runOrPrint(ctx, "To finish, run:", disable, a.systemctl("daemon-reload"))
+}
+
+func serviceUnit(command []string, writable ...string) string {
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = systemdQuote(arg)
+	}
+	var paths []string
+	for _, path := range writable {
+		quotedPath := systemdQuote(path)
+		if !slices.Contains(paths, quotedPath) {
+			paths = append(paths, quotedPath)
+		}
+	}
+
+	return systemdMarker + `
+[Unit]
+Description=Sync SSH keys with doorman
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=` + strings.Join(quoted, " ") + `
+NoNewPrivileges=yes
+ProtectSystem=strict
+ReadWritePaths=` + strings.Join(paths, " ") + `
+PrivateTmp=yes
+PrivateDevices=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectControlGroups=yes
+RestrictSUIDSGID=yes
+LockPersonality=yes
+`
+}
+
+func timerUnit(interval time.Duration) string {
+	return systemdMarker + `
+[Unit]
+Description=Sync SSH keys with doorman every ` + systemdSpan(interval) + `
+
+[Timer]
+OnBootSec=1min
+OnUnitActiveSec=` + systemdSpan(interval) + `
+RandomizedDelaySec=30s
+
+[Install]
+WantedBy=timers.target
+`
+}
+
+// systemdSpan renders d as a systemd time span, e.g. "30min" or "2d".
+func systemdSpan(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dmin", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
+
+// systemdQuote quotes arg for ExecStart= when it contains anything but
+// plain characters.
+func systemdQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\$%;") {
+		return arg
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`, `%`, `%%`)
+	return `"` + replacer.Replace(arg) + `"`
+}
+
+// runSystemCommand runs name with args, passing its output through.
+func runSystemCommand(ctx context.Context, name string, args ...string) error {
+	command := exec.CommandContext(ctx, name, args...)
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+	return command.Run()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockSystemd makes e a Linux host with doorman at /usr/local/bin/doorman,
+// recording the commands run instead of running them.
+func mockSystemd(e *testEnv) *[][]string {
+	var commands [][]string
+	e.goos = "linux"
+	e.executable = func() (string, error) { return "/usr/local/bin/doorman", nil }
+	e.runCommand = func(ctx context.Context, name string, args ...string) error {
+		commands = append(commands, append([]string{name}, args...))
+		return nil
+	}
+	e.systemdSystemDir = filepath.Join(e.home, "etc", "systemd", "system")
+	return &commands
+}
+
+func TestSystemdInstall(t *testing.T) {
+	e := newTestEnv(t)
+	commands := mockSystemd(e)
+
+	if err := run(e.deps, []string{"doorman", "systemd-install", "--users", "alice,bob", "--interval", "30m"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dir := filepath.Join(e.home, ".config", "systemd", "user")
+	service := readFile(t, filepath.Join(dir, "doorman-sync.service"))
+	keysPath := filepath.Join(e.home, ".ssh", "authorized_keys")
+	for _, expected := range []string{
+		systemdMarker + "\n",
+		"\nExecStart=/usr/local/bin/doorman --yes --file " + keysPath + " sync alice bob\n",
+		"\nNoNewPrivileges=yes\n",
+		"\nProtectSystem=strict\n",
+		"\nReadWritePaths=" + filepath.Join(e.home, ".ssh") + "\n",
+	} {
+		if !strings.Contains(service, expected) {
+			t.Errorf("expected %q in the service, got:\n%s", expected, service)
+		}
+	}
+	timer := readFile(t, filepath.Join(dir, "doorman-sync.timer"))
+	if !strings.Contains(timer, "\nOnUnitActiveSec=30min\n") || !strings.Contains(timer, "\nWantedBy=timers.target\n") {
+		t.Errorf("unexpected timer:\n%s", timer)
+	}
+
+	if len(*commands) != 0 {
+		t.Errorf("expected nothing to be run without --enable, got %q", *commands)
+	}
+	if !strings.HasSuffix(e.out.String(), "To start syncing, run:\n  systemctl --user daemon-reload\n  systemctl --user enable --now doorman-sync.timer\n") {
+		t.Errorf("expected the commands to be printed, got %q", e.out.String())
+	}
+
+	// Installing again would lose the first install's settings
+	err := run(e.deps, []string{"doorman", "systemd-install", "--users", "carol"})
+	if code := exitCodeFor(err); code != exitFile {
+		t.Errorf("expected exit code %d, got %d (%v)", exitFile, code, err)
+	}
+	if err := run(e.deps, []string{"doorman", "systemd-install", "--users", "carol", "--force"}); err != nil {
+		t.Fatalf("unexpected error with --force: %v", err)
+	}
+	if service := readFile(t, filepath.Join(dir, "doorman-sync.service")); !strings.Contains(service, " sync carol\n") {
+		t.Errorf("expected --force to replace the service, got:\n%s", service)
+	}
+}
+
+func TestSystemdInstallSystemEnable(t *testing.T) {
+	e := newTestEnv(t)
+	commands := mockSystemd(e)
+
+	if err := run(e.deps, []string{"doorman", "systemd-install", "--system", "--enable", "--users", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(e.systemdSystemDir, "doorman-sync.timer")); err != nil {
+		t.Errorf("expected the timer in the system unit directory: %v", err)
+	}
+	expected := [][]string{{"systemctl", "daemon-reload"}, {"systemctl", "enable", "--now", "doorman-sync.timer"}}
+	if !reflect.DeepEqual(*commands, expected) {
+		t.Errorf("expected %q to be run, got %q", expected, *commands)
+	}
+}
+
+func TestSystemdInstallInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		goos string
+		args []string
+	}{
+		{"no users", "linux", []string{"--interval", "30m"}},
+		{"interval too short", "linux", []string{"--users", "alice", "--interval", "10s"}},
+		{"invalid interval", "linux", []string{"--users", "alice", "--interval", "often"}},
+		{"not linux", "darwin", []string{"--users", "alice"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			mockSystemd(e)
+			e.goos = tt.goos
+
+			err := run(e.deps, append([]string{"doorman", "systemd-install"}, tt.args...))
+			if code := exitCodeFor(err); code != exitUsage {
+				t.Errorf("expected exit code %d, got %d (%v)", exitUsage, code, err)
+			}
+		})
+	}
+}
+
+func TestSystemdUninstall(t *testing.T) {
+	e := newTestEnv(t)
+	commands := mockSystemd(e)
+	if err := run(e.deps, []string{"doorman", "systemd-install", "--users", "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	e.out.Reset()
+
+	if err := run(e.deps, []string{"doorman", "systemd-uninstall", "--enable"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	dir := filepath.Join(e.home, ".config", "systemd", "user")
+	for _, name := range []string{"doorman-sync.service", "doorman-sync.timer"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+	expected := [][]string{{"systemctl", "--user", "disable", "--now", "doorman-sync.timer"}, {"systemctl", "--user", "daemon-reload"}}
+	if !reflect.DeepEqual(*commands, expected) {
+		t.Errorf("expected %q to be run, got %q", expected, *commands)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "systemd-uninstall"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(e.out.String(), "No doorman units installed in ") {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+}
+
+func TestSystemdUninstallForeignUnit(t *testing.T) {
+	e := newTestEnv(t)
+	mockSystemd(e)
+	path := filepath.Join(e.home, ".config", "systemd", "user", "doorman-sync.service")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, "[Service]\nExecStart=/bin/true\n")
+
+	err := run(e.deps, []string{"doorman", "systemd-uninstall"})
+	if code := exitCodeFor(err); code != exitFile {
+		t.Errorf("expected exit code %d, got %d (%v)", exitFile, code, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the unit to be kept: %v", err)
+	}
+}
+
+func TestSystemdSpan(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		expected string
+	}{
+		{90 * time.Second, "90s"},
+		{30 * time.Minute, "30min"},
+		{2 * time.Hour, "2h"},
+		{48 * time.Hour, "2d"},
+	}
+
+	for _, tt := range tests {
+		if got := systemdSpan(tt.interval); got != tt.expected {
+			t.Errorf("systemdSpan(%s): expected %q, got %q", tt.interval, tt.expected, got)
+		}
+	}
+}
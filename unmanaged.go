@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// unmanagedKey is a key doorman didn't install, and its line in the file.
+type unmanagedKey struct {
+	line int
+	key  doorman.Key
+}
+
+// unmanagedKeys returns the keys in store doorman didn't install, except
+// those with the fingerprints in except. A key is doorman's when its
+// comment records the date doorman added it, when it is a CA doorman
+// added, or when the state file records its fingerprint, which covers keys
+// added before doorman dated them.
+func (a *app) unmanagedKeys(store doorman.KeyStore, except map[string]bool) ([]unmanagedKey, error) {
+	state, _, err := a.loadState()
+	if err != nil {
+		return nil, err
+	}
+	recorded := recordedFingerprints(state, store.Path())
+
+	entries, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	var unmanaged []unmanagedKey
+	for i, entry := range entries {
+		key, ok := entry.Key()
+		if !ok || except[key.Fingerprint()] || managedKey(key, recorded) {
+			continue
+		}
+		unmanaged = append(unmanaged, unmanagedKey{line: i + 1, key: key})
+	}
+	return unmanaged, nil
+}
+
+// recordedFingerprints returns the fingerprints state records doorman
+// installing in the file at path.
+func recordedFingerprints(state managedState, path string) map[string]bool {
+	recorded := make(map[string]bool)
+	for _, user := range state.Files[path] {
+		for _, fingerprint := range user.Fingerprints {
+			recorded[fingerprint] = true
+		}
+	}
+	return recorded
+}
+
+// managedKey reports whether doorman installed key, by the rule
+// unmanagedKeys describes, given the fingerprints recorded for its file.
+func managedKey(key doorman.Key, recorded map[string]bool) bool {
+	_, dated := key.Added()
+	return dated || recorded[key.Fingerprint()] || strings.HasPrefix(key.Label(), caLabelPrefix)
+}
+
+// removeUnmanaged removes every key doorman didn't install, but those
+// --except-fingerprint keeps, after listing them and having their number
+// typed, so a file maintained by hand can be handed over to doorman.
+func (a *app) removeUnmanaged(ctx context.Context, store doorman.KeyStore) error {
+	except := make(map[string]bool)
+	for _, fingerprint := range a.opts.exceptFingerprints {
+		except[fingerprint] = true
+	}
+	unmanaged, err := a.unmanagedKeys(store, except)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintln(a.stderr, "The authorized_keys file does not exist.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading authorized_keys: %w", err)
+	}
+	if len(unmanaged) == 0 {
+		fmt.Fprintf(a.stdout, "Every key in %s was installed by doorman\n", store.Path())
+		return nil
+	}
+
+	fmt.Fprintf(a.stdout, "Found %s in %s not installed by doorman:\n", countKeys(len(unmanaged)), store.Path())
+	keys := make([]doorman.Key, len(unmanaged))
+	for i, u := range unmanaged {
+		fmt.Fprintf(a.stdout, "  line %d: %s\n", u.line, u.key.Describe())
+		keys[i] = u.key
+	}
+
+	closeAudit, err := a.openAudit()
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	manager := a.newManager(doorman.WithStore(store), doorman.WithRemovalCheck(a.confirmUnmanagedRemoval))
+	change, err := manager.RemoveLines(ctx, keys)
+	if err != nil {
+		return actionError("remove", err, a.now())
+	}
+	return a.recordChange(ctx, store, change)
+}
+
+// confirmUnmanagedRemoval has the number of keys being removed typed, since
+// whoever uses them loses access and doorman can't put them back. With
+// --yes nothing is asked, but the keys of this SSH session are still only
+// removed with --force.
+func (a *app) confirmUnmanagedRemoval(ctx context.Context, removing []doorman.Key, username string) error {
+	if a.opts.yes {
+		return a.confirmSessionKeyRemoval(ctx, removing, username)
+	}
+	count := strconv.Itoa(len(removing))
+	return a.confirmTyped(ctx, fmt.Sprintf("Type the number of keys being removed (%s) to confirm: ", count), count)
+}
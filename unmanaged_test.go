@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+func TestRunRemoveUnmanaged(t *testing.T) {
+	e := newTestEnv(t)
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	bobs, jumphost, laptop := newTestKey(t), newTestKey(t), newTestKey(t)
+	// bob's key was added before doorman dated keys, so only the state
+	// file says it is doorman's
+	writeFile(t, path, bobs+" bob\n")
+	if err := run(e.deps, []string{"doorman", "state", "import", "bob"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content := "" +
+		"# maintained by hand until now\n" +
+		testKey + " alice doorman-added=2025-03-18\n" +
+		bobs + " bob\n" +
+		jumphost + " ops@jumphost\n" +
+		laptop + " old laptop\n"
+	writeFile(t, path, content)
+	laptopKey, _ := doorman.ParseKey(laptop)
+	jumphostKey, _ := doorman.ParseKey(jumphost)
+
+	e.out.Reset()
+	e.mockStdin("yes\n2\n")
+	err := run(e.deps, []string{"doorman", "remove", "--unmanaged", "--except-fingerprint", laptopKey.Fingerprint()})
+	if exitCodeFor(err) != exitAborted {
+		t.Errorf("expected a wrong count to abort, got %v", err)
+	}
+	expected := "Found 1 key in " + path + " not installed by doorman:\n" +
+		"  line 4: 256 " + jumphostKey.Fingerprint() + " ops@jumphost (ED25519)\n"
+	if !strings.HasPrefix(e.out.String(), expected) {
+		t.Errorf("expected the key to be listed with its line, got %q", e.out.String())
+	}
+	if !strings.Contains(e.out.String(), "Type the number of keys being removed (1) to confirm: ") {
+		t.Errorf("expected the number of keys to be asked for, got %q", e.out.String())
+	}
+	if got := readFile(t, path); got != content {
+		t.Errorf("expected nothing removed, got %q", got)
+	}
+
+	e.mockStdin("yes\n1\n")
+	if err := run(e.deps, []string{"doorman", "remove", "--unmanaged", "--except-fingerprint", laptopKey.Fingerprint()}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = strings.Replace(content, jumphost+" ops@jumphost\n", "", 1)
+	if got := readFile(t, path); got != expected {
+		t.Errorf("expected only the jumphost key removed, got %q", got)
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "remove", "--unmanaged"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := readFile(t, path); got != "# maintained by hand until now\n"+testKey+" alice doorman-added=2025-03-18\n"+bobs+" bob\n" {
+		t.Errorf("expected only doorman's keys left, got %q", got)
+	}
+	if !strings.Contains(e.out.String(), "Removed 1 of 3 keys (1 ed25519)") {
+		t.Errorf("expected the removal to be summarized, got %q", e.out.String())
+	}
+
+	e.out.Reset()
+	if err := run(e.deps, []string{"doorman", "--yes", "remove", "--unmanaged"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.out.String() != "Every key in "+path+" was installed by doorman\n" {
+		t.Errorf("unexpected output %q", e.out.String())
+	}
+}
+
+func TestRunRemoveUnmanagedErrors(t *testing.T) {
+	e := newTestEnv(t)
+	tests := [][]string{
+		{"doorman", "remove", "--unmanaged", "alice"},
+		{"doorman", "sync", "--unmanaged"},
+		{"doorman", "remove", "--except-fingerprint", "SHA256:abc", "alice"},
+	}
+	for _, args := range tests {
+		if err := run(e.deps, args); exitCodeFor(err) != exitUsage {
+			t.Errorf("%q: expected exit code %d, got %v", args, exitUsage, err)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// commandHelp describes one way of running doorman. Usage and the man page
+// are both generated from commands and flagGroups, so keep them in step
+// with parseArgs and run.
+type commandHelp struct {
+	// usage follows "doorman" on the command line
+	usage   string
+	summary string
+}
+
+// flagHelp describes a flag, named as it is typed, e.g. "--file <path>".
+type flagHelp struct {
+	name        string
+	description string
+}
+
+// flagGroup is a set of flags, such as those of a single action.
+type flagGroup struct {
+	title string
+	flags []flagHelp
+}
+
+// example is a command line worth showing, and what it does.
+type example struct {
+	command     string
+	description string
+}
+
+var commands = []commandHelp{
+	{"[flags] add <username>...", "fetch the users' keys and add them to authorized_keys"},
+	{"[flags] add --from-list <path> [<username>...]", "add the keys of every user listed in path in one change"},
+	{"[flags] remove <username>...", "remove every key labeled with the users' names"},
+	{"[flags] remove --unmanaged [--except-fingerprint <fingerprint>]...", "remove every key doorman didn't install, after the number of them is typed"},
+	{"[flags] sync <username>...", "make the users' keys match what they publish"},
+	{"[flags] sync --all [--prune]", "sync every user the state file records as managed"},
+	{"[flags] reconcile <username>... [--allow-empty]", "remove the users' keys they no longer publish, adding none"},
+	{"[flags] diff <username>... [--brief|--quiet]", "compare the users' installed keys with those they publish, exiting like diff(1)"},
+	{"[flags] add-ca <url-or-file> --principals <names> [--label <name>]", "trust the SSH certificates a CA key signs for the principals"},
+	{"[flags] remove-ca <label>", "remove the CA add-ca installed under label"},
+	{"[flags] list", "list the keys in authorized_keys"},
+	{"[flags] list --stale <age> [--remove-stale]", "list, or remove, the keys added longer ago than age"},
+	{"[flags] stats", "summarize the keys by type and age"},
+	{"[flags] export [--format cloud-init] [<username>...]", "print the keys doorman manages, or the users' keys, as a cloud-init users entry"},
+	{"[flags] apply --label <name> [--format cloud-init|json] <path>", "make the keys labeled name match those listed in cloud-init user-data or Terraform's JSON output"},
+	{"[flags] check [--strict]", "report installed keys that break the configured rules: the deny list, pins, the key policy and forced options, or that are installed for several users, and warn of keys on more than one line"},
+	{"[flags] fix-perms", "give ~/.ssh and authorized_keys the modes and owner sshd requires"},
+	{"[flags] audit-log", "print the audit log and verify its chain"},
+	{"[flags] keys <username>", "print the user's keys, for sshd's AuthorizedKeysCommand"},
+	{"[flags] state import [<username>...]", "record the users already in authorized_keys as managed"},
+	{"[flags] serve --webhook <address> --secret-file <path> <username>...", "sync the users whenever a signed webhook arrives"},
+	{"[flags] systemd-install --users <names> [--interval <duration>]", "install a systemd timer that syncs the users"},
+	{"[flags] systemd-uninstall", "remove the units systemd-install wrote"},
+	{"[flags] self-update [--check]", "replace doorman with its latest release"},
+	{"[flags] man [--format roff|markdown]", "print this manual"},
+	{"help [exit-codes|providers|diff]", "print usage, the exit codes, the key providers or how diff reports"},
+}
+
+// flagGroups lists the flags; the first group applies to every action.
+func flagGroups() []flagGroup {
+	return []flagGroup{
+		{"Flags", []flagHelp{
+			{"--config <path>", "read settings from path instead of ~/.config/doorman/config.toml"},
+			{"--file <path>", "manage this authorized_keys file instead of the one sshd uses"},
+			{"--host [<user>@]<host>[:<port>]", "manage authorized_keys on host over SSH, authenticating with the SSH agent and checking ~/.ssh/known_hosts; --file is then a path on host. Remote writes are atomic but not locked"},
+			{"--inventory <path>", "run add, remove, sync or reconcile on every host listed in path, one [<user>@]<host>[:<port>] per line, several at once, after one confirmation; each host's output is prefixed with its name"},
+			{"--continue-on-error", "with --inventory, keep starting hosts after one fails"},
+			{"--from-list <path>", "add or remove the users listed in path, one per line, as well as any named, with one preview and one write; nothing changes if any fails"},
+			{"--comment-format <format>", "label keys with format, e.g. doorman:{user}:{date}, instead of the bare username; {user}, {provider}, {date} and {host} are filled in"},
+			{"--home-dir <path>", "act as if path were the home directory, for building images and chroots: manage path/.ssh/authorized_keys without looking up the current user or reading sshd_config"},
+			{"--really-root", "under sudo, manage root's authorized_keys rather than that of the user who ran sudo"},
+			{"--allow-root", "let add, sync, add-ca and serve install keys in root's authorized_keys, which they otherwise refuse"},
+			{"-v, --verbose", "explain what doorman is doing"},
+			{"-y, --yes", "answer yes to all confirmations (for scripts and cron); DOORMAN_ASSUME_YES=1 does the same"},
+			{"--interactive", "ask for confirmations even though DOORMAN_ASSUME_YES is set"},
+			{"--force", "remove keys that may belong to the current SSH session, and install keys already installed for other users"},
+			{"--cron", "for cron: like --yes, but silent unless authorized_keys changed or fetching keys failed repeatedly"},
+			{"--post-hook <command>", "run command with the shell after authorized_keys changes"},
+			{"--prompt-timeout <duration>", "answer no to a prompt left unanswered this long, e.g. 60s"},
+			{"--provider <name>", "where to get keys from: " + strings.Join(doorman.ListProviders(), ", ") + " (default github; with GITHUB_TOKEN set, keys come from GitHub's API with their IDs)"},
+			{"--url <template>", "fetch keys from this URL instead of GitHub; {user} is replaced by the username"},
+			{"--header 'Name: value'", "send this header with requests for keys, e.g. an internal service's token; may be given more than once. Never sent to GitHub unless --send-headers-anywhere"},
+			{"--send-headers-anywhere", "send --header and headers to GitHub too"},
+			{"--client-cert <path>", "present this PEM certificate to key servers that require client certificates"},
+			{"--client-key <path>", "the PEM private key of --client-cert"},
+			{"--socks5 <host:port>", "fetch keys through this SOCKS5 proxy, e.g. an ssh -D forward, instead of HTTPS_PROXY"},
+			{"--keys-file <path>", "read keys from this local file instead of GitHub; {user} is replaced by the username"},
+			{"--policy-warn-only", "install keys that break deny_types or min_rsa_bits, with a warning, instead of refusing them"},
+			{"--offline", "with add, remove, sync or reconcile, use the keys cached by the last fetch from the same source instead of the network, showing how old they are"},
+			{"--no-cache", "fetch key lists in full rather than revalidating the cached copies with their ETag or Last-Modified"},
+			{"--concurrency <n>", "fetch the keys of up to n users at once, fewer after a rate limit; changes are still made in the order given (default 5)"},
+			{"--wait-for-ratelimit", "wait up to an hour for a rate limit to reset instead of failing"},
+			{"--show-full-keys", "preview every line of large changes instead of a summary"},
+			{"--no-header", "list without the header row"},
+			{"--max-age <age>", "flag keys in stats added longer ago than age, e.g. 180d (default 365d)"},
+			{"--output table|json", "how list and check print what they find (default table); with json, add, remove, sync and reconcile also print each change as a line of JSON, saying whether the file changed, and everything else on stderr"},
+			{"--dry-run", "with add, remove, sync or reconcile, show the change without writing it; with fix-perms, print what would be changed"},
+			{"--patch <path>", "with --dry-run, also write the change to path as a unified diff, for patch -p0"},
+			{"--changed-exit-code <n>", "with add, remove, sync and reconcile, exit with n rather than 0 when authorized_keys was modified, for configuration management"},
+			{"--log-format text|json", "format of log events (default text)"},
+			{"--log-level debug|info|warn|error", "least severe log events to write (default warn, or debug with --verbose)"},
+			{"--log-file <path>", "append log events to path instead of writing them to stderr"},
+			{"--events ndjson", "write events to stdout as JSON lines, for programs, and everything else to stderr"},
+			{"--include-legacy-file", "with remove, list and check, act on authorized_keys2 next to authorized_keys as well, if it exists; keys are still only added to authorized_keys"},
+			{"--sort", "whenever authorized_keys is written, put the keys doorman manages after every other line, ordered by username, key type and fingerprint"},
+			{"--set-env-option", "install keys with environment=\"DOORMAN_USER=<username>\", so sessions say who logged in; sshd needs PermitUserEnvironment DOORMAN_USER, which check looks for"},
+		}},
+		{"list flags", []flagHelp{
+			{"--stale <age>", "list only the keys added longer ago than age, e.g. 180d, grouped by user, and those of unknown age apart; exits with code 8 if any are stale"},
+			{"--remove-stale", "with --stale, remove the stale keys, a user at a time, after confirmation"},
+		}},
+		{"check flags", []flagHelp{
+			{"--strict", "count keys on more than one line, and an sshd_config that ignores --set-env-option, as problems, exiting with code 8, rather than warning of them"},
+		}},
+		{"add flags", []flagHelp{
+			{"--if-missing", "skip users who already have keys installed, without fetching anything, so add can be run again safely"},
+		}},
+		{"remove flags", []flagHelp{
+			{"--unmanaged", "remove every key doorman didn't install: those not dated by doorman nor recorded in the state file. They are listed with their line numbers first, and the number of them must be typed to confirm"},
+			{"--except-fingerprint <fingerprint>", "with --unmanaged, keep the key with this SHA256 fingerprint; may be given more than once"},
+		}},
+		{"reconcile flags", []flagHelp{
+			{"--allow-empty", "remove all of a user's keys when they publish none, which is otherwise refused in case the empty list is a bad response"},
+		}},
+		{"diff flags", []flagHelp{
+			{"--brief", "print only whether each user's keys differ, not the keys"},
+			{"--quiet", "print nothing; only the exit code says whether the keys differ"},
+		}},
+		{"sync flags", []flagHelp{
+			{"--all", "sync every user the state file records as managed, each from the provider they were added with, with one preview and one write"},
+			{"--prune", "with --all, remove the keys of managed users their provider no longer knows, rather than leaving them and failing"},
+			{"--no-expire", "with sync or serve, keep keys whose doorman-expires= stamp has passed instead of dropping them, for debugging"},
+		}},
+		{"add-ca flags", []flagHelp{
+			{"--principals <names>", "comma-separated principals the CA's certificates are accepted for; required"},
+			{"--label <name>", "name the CA is installed and removed under (default the file name, without extension)"},
+		}},
+		{"keys flags", []flagHelp{
+			{"--max-cache-age <age>", "refuse cached keys older than age when fetching fails, e.g. 12h (default 7d)"},
+		}},
+		{"serve flags", []flagHelp{
+			{"--webhook <address>", "listen for webhooks on address, e.g. :9876, and sync the users after each one"},
+			{"--secret-file <path>", "file holding the secret webhooks are signed with"},
+			{"--interval <duration>", "also sync this often, in case a webhook is missed (default 1h)"},
+			{"--health-max-age <age>", "/healthz fails once a user hasn't synced for this long (default twice --interval)"},
+			{"--metrics-address <address>", "serve Prometheus metrics at /metrics on address, e.g. 127.0.0.1:9100 (off by default)"},
+		}},
+		{"systemd-install and systemd-uninstall flags", []flagHelp{
+			{"--users <names>", "comma-separated users the timer syncs"},
+			{"--interval <duration>", "how often to sync, e.g. 30m (default 1h)"},
+			{"--system", "install system units instead of user units"},
+			{"--enable", "run systemctl instead of printing the commands to run"},
+			{"--force", "replace, or remove, unit files that already exist"},
+		}},
+		{"self-update flags", []flagHelp{
+			{"--check", "only report whether a newer release exists"},
+			{"--force", "replace a development build, or reinstall the same release"},
+		}},
+		{"apply flags", []flagHelp{
+			{"--label <name>", "the user the document's keys are installed for; required"},
+			{"--format cloud-init|json", "read path as cloud-init user-data, or as JSON such as terraform output -json prints (default cloud-init)"},
+		}},
+		{"export flags", []flagHelp{
+			{"--format cloud-init", "print the keys as cloud-init user-data (the default and only format)"},
+		}},
+		{"man flags", []flagHelp{
+			{"--format roff|markdown", "print the manual for man(1), or as Markdown (default roff)"},
+		}},
+	}
+}
+
+var examples = []example{
+	{"doorman add alice", "Add alice's GitHub keys to authorized_keys, after previewing them"},
+	{"doorman remove alice bob", "Remove every key labeled alice or bob"},
+	{"doorman --yes sync alice", "Make alice's keys match GitHub's without asking, e.g. from a script"},
+	{"doorman --cron sync alice bob", "Sync from cron, printing nothing unless keys changed"},
+}
+
+// usageWidth is the width usage is wrapped to, and usageIndent where flag
+// descriptions start
+const (
+	usageWidth  = 80
+	usageIndent = 19
+)
+
+// summaryIndent is where the summaries of actions and examples start, on
+// the line after them
+const summaryIndent = 6
+
+// printUsage writes what doorman does, its actions, some examples and its
+// flags, all from commands, examples and flagGroups.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, manName)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Usage: doorman [flags] <action> [<arguments>]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Actions:")
+	for _, c := range commands {
+		printSummarized(w, commandName(c), c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Examples:")
+	for _, e := range examples {
+		printSummarized(w, e.command, e.description)
+	}
+	for _, group := range flagGroups() {
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, group.title+":")
+		for _, f := range group.flags {
+			lines := wrapText(f.description, usageWidth-usageIndent)
+			// Names too long to leave two spaces before the description
+			// get a line of their own
+			name := "  " + f.name
+			if len(name) > usageIndent-2 {
+				fmt.Fprintln(w, name)
+			} else {
+				fmt.Fprintf(w, "%-*s%s\n", usageIndent, name, lines[0])
+				lines = lines[1:]
+			}
+			for _, line := range lines {
+				fmt.Fprintln(w, strings.Repeat(" ", usageIndent)+line)
+			}
+		}
+	}
+}
+
+// printSummarized writes name indented, and summary wrapped below it.
+func printSummarized(w io.Writer, name, summary string) {
+	fmt.Fprintln(w, "  "+name)
+	for _, line := range wrapText(summary, usageWidth-summaryIndent) {
+		fmt.Fprintln(w, strings.Repeat(" ", summaryIndent)+line)
+	}
+}
+
+// wrapText splits text into lines of at most width characters, breaking
+// between words. A word longer than width gets a line of its own.
+func wrapText(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= width:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	return append(lines, line)
+}
+
+// actionNames returns the actions commands documents, in its order: the
+// first word of each usage after "[flags]".
+func actionNames() []string {
+	var names []string
+	for _, c := range commands {
+		name := strings.Fields(strings.TrimPrefix(c.usage, "[flags] "))[0]
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// maxSuggestionDistance is how many edits away from an action a mistyped
+// one may be for the action to be suggested
+const maxSuggestionDistance = 2
+
+// invalidActionError reports that action isn't one, suggesting the closest
+// action when it is probably a typo and listing them all otherwise.
+func invalidActionError(action string) error {
+	names := actionNames()
+	best, bestDistance := "", maxSuggestionDistance+1
+	for _, name := range names {
+		if d := editDistance(action, name); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	// BEHAVIOR: A word as short as the edits it needs, like "ls" for "list",
+	// isn't a typo of anything
+	if best != "" && bestDistance < len(action) {
+		return fmt.Errorf("invalid action '%s'; did you mean '%s'?", action, best)
+	}
+	return fmt.Errorf("invalid action '%s'; available actions: %s", action, strings.Join(names, ", "))
+}
+
+// editDistance is the Levenshtein distance between a and b: how many
+// characters must be inserted, deleted or replaced to turn one into the
+// other.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// readUserList returns usernames followed by those listed in path, one per
+// line, with each name only once. Blank lines and # comments are skipped.
+// listed maps the names read from path to the line they were first on.
+func readUserList(path string, usernames []string) (all []string, listed map[string]int, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading user list: %w", err)
+	}
+	seen := make(map[string]bool)
+	for _, username := range usernames {
+		if !seen[username] {
+			seen[username] = true
+			all = append(all, username)
+		}
+	}
+	listed = make(map[string]int)
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		username := strings.TrimSpace(line)
+		if username == "" || seen[username] {
+			continue
+		}
+		seen[username] = true
+		listed[username] = i + 1
+		all = append(all, username)
+	}
+	if len(all) == 0 {
+		return nil, nil, fmt.Errorf("%s lists no users", path)
+	}
+	return all, listed, nil
+}
+
+// applyUsers carries out action, add or remove, for all of usernames at
+// once: one preview, one confirmation and one write. listed gives the line
+// of --from-list each name was read from, for reporting failures.
+func (a *app) applyUsers(ctx context.Context, manager *doorman.Manager, store doorman.KeyStore, action string, usernames []string, listed map[string]int) error {
+	var changes []*doorman.Change
+	var err error
+	switch action {
+	case "add":
+		changes, err = manager.AddUsers(ctx, usernames)
+	case "remove":
+		changes, err = manager.RemoveUsers(ctx, usernames)
+	}
+	var usersErr *doorman.UsersError
+	switch {
+	case errors.As(err, &usersErr):
+		return a.userListError(action, usersErr, len(usernames), listed)
+	case errors.Is(err, doorman.ErrFileMissing) && action == "remove":
+		fmt.Fprintln(a.stderr, "The authorized_keys file does not exist.")
+		return nil
+	case err != nil:
+		return actionError(action, err, a.now())
+	}
+	for _, change := range changes {
+		if err := a.recordChange(ctx, store, change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userListError lists the users that failed, each with the line of
+// --from-list it was read from, if any. The exit code is the first
+// failure's.
+func (a *app) userListError(action string, err *doorman.UsersError, total int, listed map[string]int) error {
+	lines := []string{fmt.Sprintf("%d of %d %s failed; nothing was changed:", len(err.Failures), total, plural(total, "user", "users"))}
+	for _, failure := range err.Failures {
+		message := actionError(action, failure.Err, a.now()).Error()
+		if line, ok := listed[failure.User]; ok {
+			message = fmt.Sprintf("%s:%d: %s", a.opts.fromList, line, message)
+		}
+		lines = append(lines, "  "+message)
+	}
+	return withExitCode(exitCodeFor(err.Failures[0].Err), errors.New(strings.Join(lines, "\n")))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sultano/doorman/pkg/doorman"
+)
+
+// knownUsersSource serves testKey for the users in known, and
+// ErrUserNotFound for anyone else.
+type knownUsersSource map[string]bool
+
+func (s knownUsersSource) Keys(ctx context.Context, user string) ([]doorman.PublicKey, error) {
+	if !s[user] {
+		return nil, doorman.ErrUserNotFound
+	}
+	return parseKeys(testKey), nil
+}
+
+func TestReadUserList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "new-hires.txt")
+	writeFile(t, path, "# spring cohort\nbob\n\ncarol  # team lead\nalice\nbob\n")
+
+	usernames, listed, err := readUserList(path, []string{"alice"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(usernames, ",") != "alice,bob,carol" {
+		t.Errorf("unexpected usernames %v", usernames)
+	}
+	if listed["bob"] != 2 || listed["carol"] != 4 || listed["alice"] != 0 {
+		t.Errorf("unexpected lines %v", listed)
+	}
+}
+
+func TestRunFromList(t *testing.T) {
+	e := newTestEnv(t)
+	e.source = knownUsersSource{"alice": true, "bob": true}
+	list := filepath.Join(e.home, "new-hires.txt")
+	writeFile(t, list, "alice\nbob\nalice\n")
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--force", "--from-list", list, "add"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != testKey+" alice"+today+"\n"+testKey+" bob"+today+"\n" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if strings.Count(e.out.String(), "Do you want to add 2 new keys?") != 1 {
+		t.Errorf("expected a single confirmation, got %q", e.out.String())
+	}
+
+	if err := run(e.deps, []string{"doorman", "--yes", "--from-list", list, "remove"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if content := readFile(t, path); content != "" {
+		t.Errorf("expected every key to be removed, got %q", content)
+	}
+}
+
+func TestRunFromListReportsLines(t *testing.T) {
+	e := newTestEnv(t)
+	e.source = knownUsersSource{"alice": true}
+	list := filepath.Join(e.home, "new-hires.txt")
+	writeFile(t, list, "alice\n# typo below\nbobb\n")
+	path := filepath.Join(e.home, ".ssh", "authorized_keys")
+	writeFile(t, path, "")
+
+	err := run(e.deps, []string{"doorman", "--yes", "--from-list", list, "add", "carol"})
+	if exitCodeFor(err) != exitUsage {
+		t.Errorf("expected a usage error, got %v", err)
+	}
+	expected := "2 of 3 users failed; nothing was changed:\n  user not found\n  " + list + ":3: user not found"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	if content := readFile(t, path); content != "" {
+		t.Errorf("expected nothing to be written, got %q", content)
+	}
+}